@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configAliases are readable config keys for the single-letter flags.
+var configAliases = map[string]string{
+	"output":      "o",
+	"force":       "f",
+	"output-name": "O",
+	"input":       "i",
+	"jobs":        "j",
+	"header":      "H",
+	"verbose":     "v",
+}
+
+// defaultConfigPath returns where the config file is looked for when
+// -config isn't given, or "" if there is no user config directory.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "umbrel-downloader", "config.toml")
+}
+
+// parseConfig reads a config file of flag defaults. It accepts the subset of
+// TOML needed for that, one setting per line:
+//
+//	# comment
+//	output = "downloads"
+//	retries = 3
+//	insecure = false
+//	header = ["Accept: */*", "X-Token: abc"]
+//
+// Keys are flag names (underscores may stand in for dashes), or the aliases
+// in configAliases. An array sets a repeatable flag once per element.
+// Tables aren't supported.
+func parseConfig(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var settings [][2]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: tables are not supported", path, n)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		values, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, key, err)
+		}
+		for _, v := range values {
+			settings = append(settings, [2]string{key, v})
+		}
+	}
+	return settings, scanner.Err()
+}
+
+// parseConfigValue parses a string, number, boolean or one-line array.
+func parseConfigValue(s string) ([]string, error) {
+	inner, ok := strings.CutPrefix(s, "[")
+	if !ok {
+		v, err := parseConfigScalar(s)
+		return []string{v}, err
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok {
+		return nil, errors.New("arrays must be on one line")
+	}
+	var values []string
+	for _, item := range splitConfigArray(inner) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue // trailing comma
+		}
+		v, err := parseConfigScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func parseConfigScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s == "":
+		return "", errors.New("missing value")
+	}
+	return s, nil // number, boolean or bare word, passed to the flag as is
+}
+
+// splitConfigArray splits array items on commas outside quotes.
+func splitConfigArray(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// stripComment removes a # comment that isn't inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// applyConfig sets flags from the config file at path, skipping flags given
+// on the command line so those take precedence. With required unset a
+// missing file is not an error.
+func applyConfig(fs *flag.FlagSet, path string, required bool) error {
+	settings, err := parseConfig(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, kv := range settings {
+		name := strings.ReplaceAll(kv[0], "_", "-")
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+		switch {
+		case fs.Lookup(name) == nil:
+			return fmt.Errorf("%s: unknown setting %q", path, kv[0])
+		case name == "config":
+			return fmt.Errorf("%s: config files can't include other config files", path)
+		case explicit[name]:
+			continue
+		}
+		if err := fs.Set(name, kv[1]); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, kv[0], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfig(t *testing.T) {
+	path := writeConfig(t, `# defaults
+output = "downloads"   # where files go
+retries = 3
+insecure = false
+user_agent = 'agent # not a comment'
+header = ["Accept: */*", "X-Note: a, b",]
+
+jobs = 4
+`)
+	settings, err := parseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{
+		{"output", "downloads"},
+		{"retries", "3"},
+		{"insecure", "false"},
+		{"user_agent", "agent # not a comment"},
+		{"header", "Accept: */*"},
+		{"header", "X-Note: a, b"},
+		{"jobs", "4"},
+	}
+	if !slices.Equal(settings, want) {
+		t.Errorf("settings = %q\nwant %q", settings, want)
+	}
+
+	for _, content := range []string{
+		"[downloads]\noutput = \"x\"\n",
+		"output\n",
+		"= 3\n",
+		"output = \"unterminated\n",
+		"output = 'unterminated\n",
+		"header = [\"a\",\n\"b\"]\n",
+		"retries =\n",
+	} {
+		if _, err := parseConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("%q: no error", content)
+		}
+	}
+}
+
+// testFlags returns a flag set with a few of the CLI's flags.
+func testFlags() (fs *flag.FlagSet, output *string, retries *int, headers *[]string) {
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	output = fs.String("o", ".", "")
+	retries = fs.Int("retries", 0, "")
+	headers = new([]string)
+	fs.Func("H", "", func(s string) error {
+		*headers = append(*headers, s)
+		return nil
+	})
+	fs.String("config", "", "")
+	return fs, output, retries, headers
+}
+
+func TestApplyConfig(t *testing.T) {
+	path := writeConfig(t, "output = \"from-config\"\nretries = 3\nheader = [\"A: 1\", \"B: 2\"]\n")
+
+	// Nothing on the command line: the file sets everything
+	fs, output, retries, headers := testFlags()
+	fs.Parse(nil)
+	if err := applyConfig(fs, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if *output != "from-config" || *retries != 3 || !slices.Equal(*headers, []string{"A: 1", "B: 2"}) {
+		t.Errorf("from file: -o %q, -retries %d, -H %q", *output, *retries, *headers)
+	}
+
+	// Command-line flags win over the file
+	fs, output, retries, headers = testFlags()
+	fs.Parse([]string{"-retries", "0", "-H", "C: 3"})
+	if err := applyConfig(fs, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if *output != "from-config" || *retries != 0 || !slices.Equal(*headers, []string{"C: 3"}) {
+		t.Errorf("with flags: -o %q, -retries %d, -H %q", *output, *retries, *headers)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.toml")
+	fs, _, _, _ := testFlags()
+	if err := applyConfig(fs, missing, false); err != nil {
+		t.Errorf("missing default config: %v", err)
+	}
+	if err := applyConfig(fs, missing, true); err == nil {
+		t.Error("missing -config file: no error")
+	}
+
+	for content, want := range map[string]string{
+		"colour = \"red\"\n":        `unknown setting "colour"`,
+		"config = \"other.toml\"\n": "can't include",
+		"retries = \"three\"\n":     "retries",
+	} {
+		fs, _, _, _ := testFlags()
+		err := applyConfig(fs, writeConfig(t, content), true)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: error %v, want one containing %q", content, err, want)
+		}
+	}
+}
+
+func TestConfigFlag(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	config := writeConfig(t, "output = \"from-config\"\nprogress = \"none\"\n")
+
+	if _, stderr, code := runCLI(t, dir, "", "-config", config, srv.URL+"/a.bin"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "from-config", "a.bin")); err != nil {
+		t.Errorf("config's output ignored: %v", err)
+	}
+
+	if _, stderr, code := runCLI(t, dir, "", "-config", config, "-o", "from-flag", srv.URL+"/b.bin"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "from-flag", "b.bin")); err != nil {
+		t.Errorf("-o didn't override the config: %v", err)
+	}
+
+	_, stderr, code := runCLI(t, dir, "", "-config", filepath.Join(dir, "missing.toml"), srv.URL+"/c.bin")
+	if code == 0 || !strings.Contains(stderr, "missing.toml") {
+		t.Errorf("missing -config file: exit %d: %s", code, stderr)
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the config directory is only set by XDG_CONFIG_HOME on Linux")
+	}
+	srv := fileServer(t)
+	dir := t.TempDir()
+	configHome := t.TempDir()
+	os.MkdirAll(filepath.Join(configHome, "umbrel-downloader"), 0755)
+	os.WriteFile(filepath.Join(configHome, "umbrel-downloader", "config.toml"), []byte("output = \"from-default\"\n"), 0644)
+
+	cmd := cliCommand(t, dir, "-progress", "none", srv.URL+"/a.bin")
+	// Later entries win, overriding cliCommand's empty config directory
+	cmd.Env = append(cmd.Env, "XDG_CONFIG_HOME="+configHome)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "from-default", "a.bin")); err != nil {
+		t.Errorf("default config ignored: %v", err)
+	}
+}
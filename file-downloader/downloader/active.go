@@ -0,0 +1,21 @@
+package downloader
+
+import (
+	"time"
+)
+
+// The web server snapshots its active and queued downloads to a file in the
+// output directory, so that after a crash or restart they can be picked up
+// again. Interrupted transfers are resumed from their .part files.
+
+const (
+	ActiveFileName         = ".active_downloads.json"
+	ActiveSnapshotInterval = 5 * time.Second
+)
+
+// ActiveEntry is one download in the snapshot.
+type ActiveEntry struct {
+	URLs       []string `json:"urls"`                  // primary URL first, then mirrors
+	OutputPath string   `json:"output_path,omitempty"` // empty until the download has started
+	Bytes      int64    `json:"bytes"`
+}
@@ -0,0 +1,57 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkedResponse(t *testing.T) {
+	body := strings.Repeat("chunk ", 2000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before the end sends the body chunked, without a length
+		for i := 0; i < len(body); i += 1000 {
+			io.WriteString(w, body[i:min(i+1000, len(body))])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	// The size isn't known up front, so neither the free space check nor
+	// preallocation get in the way
+	opts := &DownloadOptions{Client: srv.Client(), MinFree: 1 << 60, Preallocate: true, MaxSize: 1 << 20}
+	var total int64
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/stream.bin"}, t.TempDir(), "", func(_ string, _, n int64) io.Writer {
+		total = n
+		return io.Discard
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != -1 {
+		t.Errorf("progress total = %d, want -1 for an unknown size", total)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != body {
+		t.Errorf("file has %d bytes, want %d", len(data), len(body))
+	}
+	if record := opts.HistoryRecord(srv.URL+"/stream.bin", result, time.Time{}); record.Size != int64(len(body)) {
+		t.Errorf("recorded size %d, want %d", record.Size, len(body))
+	}
+
+	// -max-size is still enforced while the body arrives
+	dir := t.TempDir()
+	opts = &DownloadOptions{Client: srv.Client(), MaxSize: 5000}
+	discard := func(string, int64, int64) io.Writer { return io.Discard }
+	if _, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/stream.bin"}, dir, "", discard); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("err = %v, want ErrTooLarge", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("oversized download left %v", entries)
+	}
+}
@@ -0,0 +1,171 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// orphan is a file in the output directory that -clean would remove.
+type orphan struct {
+	Path   string
+	Size   int64
+	Reason string
+}
+
+// findOrphans walks outputDir and returns abandoned .part files and files
+// that no history record points to. A record's kept versions, files under
+// extracted archive directories, the web server's active download snapshot
+// and the .part files it will resume, and the paths in keep (history and
+// lock files) are left alone. Symlinks are never followed or reported.
+func findOrphans(outputDir string, store Store, keep []string) ([]orphan, error) {
+	root, err := filepath.Abs(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	var extracted []string
+	for _, r := range store.All() {
+		if p, err := filepath.Abs(r.Filename); err == nil {
+			known[p] = true
+			known[p+checksumSuffix] = true
+		}
+		// Older copies kept by -keep-versions belong to the record too
+		for _, v := range r.Versions {
+			if p, err := filepath.Abs(v); err == nil {
+				known[p] = true
+				known[p+checksumSuffix] = true
+			}
+		}
+		if r.ExtractedTo != "" {
+			if p, err := filepath.Abs(r.ExtractedTo); err == nil {
+				extracted = append(extracted, p)
+			}
+		}
+	}
+	activePath := filepath.Join(outputDir, ActiveFileName)
+	keep = append(keep, activePath, activePath+".tmp")
+	for _, p := range keep {
+		if p, err := filepath.Abs(p); err == nil {
+			known[p] = true
+		}
+	}
+	for _, p := range resumableParts(activePath) {
+		if p, err := filepath.Abs(p); err == nil {
+			known[p] = true
+		}
+	}
+
+	var orphans []orphan
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			for _, dir := range extracted {
+				if path == dir {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || known[path] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		reason := "not in history"
+		if strings.HasSuffix(path, PartSuffix) {
+			reason = "abandoned partial download"
+		}
+		orphans = append(orphans, orphan{Path: path, Size: info.Size(), Reason: reason})
+		return nil
+	})
+	return orphans, err
+}
+
+// HistoryPaths returns the history file for historyFile or a json: store
+// spec, with its lock, temporary and log files, and the database of a
+// sqlite: store spec with SQLite's journal files, for findOrphans to keep.
+func HistoryPaths(historyFile, storeSpec string) []string {
+	jsonFiles := []string{historyFile}
+	var paths []string
+	if p, ok := strings.CutPrefix(storeSpec, "sqlite:"); ok {
+		paths = append(paths, p, p+"-wal", p+"-shm", p+"-journal")
+	} else {
+		jsonFiles = append(jsonFiles, strings.TrimPrefix(storeSpec, "json:"))
+	}
+	for _, p := range jsonFiles {
+		if p != "" {
+			paths = append(paths, p, p+".lock", p+".tmp", historyLogPath(p))
+		}
+	}
+	return paths
+}
+
+// resumableParts returns the .part files listed in the web server's active
+// download snapshot.
+func resumableParts(activePath string) []string {
+	data, err := os.ReadFile(activePath)
+	if err != nil {
+		return nil
+	}
+	var entries []ActiveEntry
+	if json.Unmarshal(data, &entries) != nil {
+		return nil
+	}
+	var parts []string
+	for _, e := range entries {
+		if e.OutputPath != "" {
+			parts = append(parts, PartPath(e.OutputPath))
+		}
+	}
+	return parts
+}
+
+// RunClean lists orphaned files in outputDir, removing them when remove is
+// set. It returns an error if any file couldn't be removed.
+func RunClean(outputDir string, store Store, keep []string, remove bool) error {
+	orphans, err := findOrphans(outputDir, store, keep)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned files")
+		return nil
+	}
+
+	var total, removed int64
+	failed := 0
+	for _, o := range orphans {
+		total += o.Size
+		if !remove {
+			fmt.Printf("  %s (%s, %s)\n", o.Path, o.Reason, FormatBytes(o.Size))
+			continue
+		}
+		if err := os.Remove(o.Path); err != nil {
+			fmt.Fprintf(os.Stderr, "  could not remove %s: %v\n", o.Path, err)
+			failed++
+			continue
+		}
+		removed += o.Size
+		fmt.Printf("  removed %s (%s, %s)\n", o.Path, o.Reason, FormatBytes(o.Size))
+	}
+
+	if !remove {
+		fmt.Printf("%d orphaned files, %s. Run with -clean -f to remove them.\n", len(orphans), FormatBytes(total))
+		return nil
+	}
+	fmt.Printf("Removed %d files, %s\n", len(orphans)-failed, FormatBytes(removed))
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be removed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFindOrphans(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "downloads")
+	os.MkdirAll(filepath.Join(dir, "bundle", "docs"), 0755)
+	outside := writeTestFile(t, base, "outside.txt", []byte("not ours"))
+
+	historyPath := filepath.Join(dir, "history.json")
+	store, err := OpenStore("", historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := testRecord("app.iso")
+	record.Filename = writeTestFile(t, dir, "app.iso", []byte("app"))
+	writeTestFile(t, dir, "app.iso"+checksumSuffix, []byte("sum"))
+	record.Versions = []string{writeTestFile(t, dir, "app.1.iso", []byte("old"))}
+	record.ExtractedTo = filepath.Join(dir, "bundle")
+	writeTestFile(t, record.ExtractedTo, "docs/guide.txt", []byte("guide"))
+	if err := store.Put("app.iso", record); err != nil {
+		t.Fatal(err)
+	}
+
+	// A web download to be resumed, listed in the active snapshot
+	resumable := filepath.Join(dir, "big.iso")
+	writeTestFile(t, dir, "big.iso"+PartSuffix, []byte("half"))
+	writeTestFile(t, dir, ActiveFileName, []byte(`[{"urls":["https://example.com/big.iso"],"output_path":"`+resumable+`","bytes":4}]`))
+
+	partial := writeTestFile(t, dir, "crashed.zip"+PartSuffix, []byte("partial"))
+	stray := writeTestFile(t, dir, "stray.bin", []byte("stray"))
+	if err := os.Symlink(outside, filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := findOrphans(dir, store, HistoryPaths(historyPath, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, o := range orphans {
+		reasons[o.Path] = o.Reason
+	}
+	want := map[string]string{
+		partial: "abandoned partial download",
+		stray:   "not in history",
+	}
+	if len(reasons) != len(want) || reasons[partial] != want[partial] || reasons[stray] != want[stray] {
+		t.Errorf("orphans = %v, want %v", reasons, want)
+	}
+
+	// The default is a dry run
+	if err := RunClean(dir, store, HistoryPaths(historyPath, ""), false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{partial, stray} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("dry run removed %s", p)
+		}
+	}
+
+	if err := RunClean(dir, store, HistoryPaths(historyPath, ""), true); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(base, path)
+			left = append(left, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	wantLeft := []string{
+		"downloads/" + ActiveFileName,
+		"downloads/app.1.iso",
+		"downloads/app.iso",
+		"downloads/app.iso" + checksumSuffix,
+		"downloads/big.iso" + PartSuffix,
+		"downloads/bundle/docs/guide.txt",
+		"downloads/history.json",
+		"downloads/history.json.lock",
+		"downloads/history.jsonl",
+		"downloads/link.txt",
+		"outside.txt",
+	}
+	slices.Sort(left)
+	slices.Sort(wantLeft)
+	if !slices.Equal(left, wantLeft) {
+		t.Errorf("after -clean -f:\n got %q\nwant %q", left, wantLeft)
+	}
+}
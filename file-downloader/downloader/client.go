@@ -0,0 +1,296 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ClientConfig holds the settings used to build the HTTP client shared by
+// the CLI and web download paths.
+type ClientConfig struct {
+	Proxy                 string        // http://, https:// or socks5:// URL; empty means use the environment
+	ConnectTimeout        time.Duration // dial and TLS handshake timeout; 0 means none
+	ResponseHeaderTimeout time.Duration // time to wait for response headers; 0 means none
+	MaxRedirects          int           // redirects to follow before giving up
+	RedirectSameHost      bool          // refuse redirects that leave the original host
+
+	// InsecureSkipVerify disables TLS certificate verification. This is
+	// unsafe: anyone on the network path can impersonate the server.
+	InsecureSkipVerify bool
+	CACertFile         string // PEM bundle trusted in addition to the system roots
+
+	CookieFile string // Netscape cookies.txt loaded into the cookie jar
+
+	Network   string // "tcp4" or "tcp6" to use only that IP version; empty means either
+	DNSServer string // host[:port] of a DNS server to resolve with instead of the system's
+
+	// Connection reuse. The client is shared by every download, so idle
+	// connections are pooled across a batch.
+	HTTP1               bool // never use HTTP/2
+	MaxIdleConns        int  // idle connections kept in total; 0 keeps the default
+	MaxIdleConnsPerHost int  // idle connections kept per host; 0 keeps the default
+}
+
+// NewHTTPClient builds an *http.Client from cfg. When no proxy is configured
+// the standard HTTP_PROXY/HTTPS_PROXY/NO_PROXY variables are honored.
+func NewHTTPClient(cfg ClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.DNSServer != "" {
+		dialer.Resolver = newResolver(cfg.DNSServer, cfg.ConnectTimeout)
+	}
+	transport.DialContext = dialer.DialContext
+	if cfg.Network != "" {
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, cfg.Network, addr)
+		}
+	}
+	transport.TLSHandshakeTimeout = cfg.ConnectTimeout
+	transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	if cfg.HTTP1 {
+		// Some proxies mishandle HTTP/2; only offer HTTP/1.1
+		transport.ForceAttemptHTTP2 = false
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	}
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+
+	if cfg.InsecureSkipVerify || cfg.CACertFile != "" {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if cfg.Proxy != "" {
+		proxyURL, err := parseProxyURL(cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+		if strings.HasPrefix(proxyURL.Scheme, "socks5") {
+			// Dialing through the proxy rather than leaving it to the
+			// transport reaches the proxy with -ipv4/-dns-server applied
+			// and sends FTP through it too
+			socks, err := proxy.FromURL(proxyURL, dialFunc(transport.DialContext))
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy URL: %w", err)
+			}
+			transport.DialContext = socks.(proxy.ContextDialer).DialContext
+			transport.Proxy = nil
+		}
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+
+	// FTP and S3 go through the same client; HTTP proxies don't apply to FTP
+	transport.RegisterProtocol("ftp", &ftpTransport{dial: transport.DialContext, tlsConfig: transport.TLSClientConfig})
+	transport.RegisterProtocol("ftps", &ftpTransport{dial: transport.DialContext, tlsConfig: transport.TLSClientConfig})
+	transport.RegisterProtocol("s3", &s3Transport{next: transport})
+
+	// The jar keeps cookies set along a redirect chain, so login redirects
+	// work, and holds any cookies loaded from -cookie-file.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CookieFile != "" {
+		if err := loadCookieFile(jar, cfg.CookieFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &http.Client{
+		Transport:     &loggingTransport{next: transport},
+		CheckRedirect: checkRedirect(cfg),
+		Jar:           jar,
+	}, nil
+}
+
+// newResolver returns a resolver that sends every DNS query to server
+// (port 53 unless given) instead of the servers in the system configuration.
+func newResolver(server string, timeout time.Duration) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// loadCookieFile adds the cookies from a Netscape-format cookies.txt file, as
+// exported by browsers and curl, to jar. Expired cookies are skipped.
+func loadCookieFile(jar http.CookieJar, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading cookie file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line, httpOnly = rest, true
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expiry, name, value
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("%s:%d: expected 7 tab-separated fields, got %d", path, n, len(fields))
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid expiry %q", path, n, fields[4])
+		}
+
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+			if cookie.Expires.Before(time.Now()) {
+				continue
+			}
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: "/"}, []*http.Cookie{cookie})
+	}
+	return scanner.Err()
+}
+
+// CookieFlags collects repeatable -cookie "name=value" flags. They're sent
+// with every download request regardless of host.
+type CookieFlags []*http.Cookie
+
+func (c *CookieFlags) String() string {
+	var parts []string
+	for _, cookie := range *c {
+		parts = append(parts, cookie.Name+"=...")
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (c *CookieFlags) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("cookie must be in the form name=value, got %q", value)
+	}
+	*c = append(*c, &http.Cookie{Name: name, Value: strings.TrimSpace(val)})
+	return nil
+}
+
+// newTLSConfig builds the client TLS settings for -insecure and -cacert.
+func newTLSConfig(cfg ClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", cfg.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// checkRedirect enforces the redirect limit and, optionally, that every hop
+// stays on the host of the original request.
+func checkRedirect(cfg ClientConfig) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > cfg.MaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", cfg.MaxRedirects)
+		}
+		slog.Debug("following redirect", "from", via[len(via)-1].URL.Redacted(), "to", req.URL.Redacted())
+		if cfg.RedirectSameHost {
+			origin := via[0].URL.Hostname()
+			if !strings.EqualFold(req.URL.Hostname(), origin) {
+				return fmt.Errorf("redirect from %s to %s blocked: leaves original host", origin, req.URL.Hostname())
+			}
+		}
+		return nil
+	}
+}
+
+// dialFunc adapts a DialContext function to the dialer golang.org/x/net/proxy
+// forwards through.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// parseProxyURL validates a -proxy value. socks5:// URLs are dialed with
+// golang.org/x/net/proxy; the rest go to http.Transport as forward proxies.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: missing host in %q", raw)
+	}
+	return u, nil
+}
@@ -0,0 +1,65 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCollisionReplace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		existing string
+		wantKept bool
+	}{
+		{"identical", "new", true},
+		{"differing", "old", false},
+		{"same size, differing", "odd", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			existing := filepath.Join(dir, "file.zip")
+			if err := os.WriteFile(existing, []byte(tt.existing), 0644); err != nil {
+				t.Fatal(err)
+			}
+			past := time.Now().Add(-time.Hour).Truncate(time.Second)
+			os.Chtimes(existing, past, past)
+
+			opts := &DownloadOptions{Client: srv.Client(), Collision: CollisionReplace}
+			discard := func(string, int64, int64) io.Writer { return io.Discard }
+			result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.zip"}, dir, "", discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Path != existing {
+				t.Errorf("saved to %s, want file.zip", filepath.Base(result.Path))
+			}
+			if data, _ := os.ReadFile(existing); string(data) != "new" {
+				t.Errorf("file.zip = %q, want %q", data, "new")
+			}
+			// Nothing but file.zip: no .part and no hash-suffixed copy
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("%d files in the directory, want 1", len(entries))
+			}
+			// The identical file is left alone, its modification time included
+			info, err := os.Stat(existing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := info.ModTime().Equal(past); kept != tt.wantKept {
+				t.Errorf("modification time %v, kept %t, want %t", info.ModTime(), kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || dragonfly || windows)
+
+package downloader
+
+import "errors"
+
+// diskFree isn't implemented on this platform; callers skip the check.
+func diskFree(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package downloader
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// diskFree returns the bytes available to unprivileged users on the
+// filesystem containing dir.
+func diskFree(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
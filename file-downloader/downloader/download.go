@@ -0,0 +1,1266 @@
+package downloader
+
+import (
+	"bufio"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DownloadOptions holds the settings shared by the CLI and web download paths.
+type DownloadOptions struct {
+	Client       *http.Client
+	Fetcher      Fetcher       // opens URLs; nil means HTTPFetcher with these options
+	StallTimeout time.Duration // cancel when no data arrives for this long; 0 disables
+	MinSpeed     int64         // cancel when slower than this many bytes per second, see speedWatchdog; 0 disables
+	AssumeHTTPS  bool          // treat scheme-less URLs as https://
+	UserAgent    string
+	Referer      string
+	Header       http.Header // explicit -H headers; these win over UserAgent/Referer
+	OutTemplate  string      // relative output path template, see expandOutTemplate
+	Preflight    bool        // send a HEAD request first to learn size and range support
+	Notifier     *Notifier   // called after each download completes or fails
+	MinFree      int64       // bytes to leave free on the output filesystem
+	MaxSize      int64       // abort downloads larger than this; 0 means no limit
+	Retries      int         // extra attempts per URL before trying the next mirror
+	Mirrors      []string    // base URLs serving the same paths as the primary host
+
+	MirrorSelector *MirrorSelector // picks the first mirror to try; nil means the primary
+	NoDecompress   bool            // store gzip/deflate encoded bodies as received
+	Cookies        []*http.Cookie  // -cookie values, sent to every host
+	ExpectType     string          // expected Content-Type media type; HTML instead is an error
+	DenyTypes      []string        // Content-Type prefixes that are refused, e.g. text/html
+	SkipExisting   bool            // treat a matching file already on disk as downloaded
+
+	ContentDisposition bool // name files after the Content-Disposition header when it has a filename
+	InferExt           bool // add an extension from Content-Type to file names without one
+
+	Flat string // with -flat, replaces path separators in file names and -out-template paths; "" keeps them
+
+	// Bandwidth limits in bytes per second; the tighter one wins
+	Limit        int64        // per download; 0 means unlimited
+	TotalLimiter *RateLimiter // shared by all running downloads; nil means unlimited
+
+	// Per-download settings, set on a copy of the shared options
+	IfNoneMatch     string // send If-None-Match; a 304 returns ErrNotModified
+	IfModifiedSince string // send If-Modified-Since; a 304 returns ErrNotModified
+	Overwrite       bool   // replace an existing file regardless of Collision
+	ExistingSHA256  string // with SkipExisting, a file on disk must have this hash
+	ExpectSHA256    string // the download must have this hash; see checkSHA256
+	KeepVersions    int    // keep this many older versions of a replaced file; see keepVersion
+
+	Collision   string   // what to do when the output file exists; see CollisionPath
+	RedactQuery []string // query parameters masked in history records; see redactURL
+	Normalize   bool     // key history on canonicalizeURL
+
+	// Confirm, when set, is asked before overwriting a file or before a
+	// download larger than ConfirmOver; false skips it with ErrDeclined.
+	// size is -1 when unknown. Only the CLI sets it (-interactive).
+	Confirm     func(outputPath string, size int64, overwrite bool) bool
+	ConfirmOver int64
+
+	Segments int         // download in this many concurrent ranges when the server allows it
+	FileMode os.FileMode // permissions for downloaded files, applied regardless of the umask; 0 means 0644
+
+	// Post-download processing
+	Extract       bool // extract archives after downloading
+	ExtractRemove bool // delete the archive after extracting it
+	WriteChecksum bool // write a PATH.sha256 file next to each download
+
+	// Signature verification (-verify-key); see verifySignature
+	VerifyKey *MinisignKey
+	VerifySig string
+
+	BufferSize int // copy buffer size in bytes; 0 uses io.Copy's default
+
+	Preallocate bool // reserve disk space for the whole file before downloading
+
+	PreserveMtime bool // set downloaded files' modification time from Last-Modified
+
+	Tee string // directory that gets a second copy of each download; see teeFile
+}
+
+// Bounds for -buffer-size.
+const (
+	MinBufferSize = 4 * 1024
+	MaxBufferSize = 64 * 1024 * 1024
+)
+
+// copyBody copies a response body to w through a BufferSize buffer.
+func (o *DownloadOptions) copyBody(w io.Writer, r io.Reader) (int64, error) {
+	if o.BufferSize <= 0 {
+		return io.Copy(w, r)
+	}
+	// Hide *os.File's ReadFrom, which would bypass the buffer
+	return io.CopyBuffer(struct{ io.Writer }{w}, r, make([]byte, o.BufferSize))
+}
+
+// HeaderFlags collects repeatable -H "Name: value" flags.
+type HeaderFlags http.Header
+
+func (h *HeaderFlags) String() string {
+	return fmt.Sprint(map[string][]string(*h))
+}
+
+func (h *HeaderFlags) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("header must be in the form \"Name: value\", got %q", value)
+	}
+	if *h == nil {
+		*h = make(HeaderFlags)
+	}
+	http.Header(*h).Add(name, strings.TrimSpace(val))
+	return nil
+}
+
+// setHeaders applies the configured headers to req. Explicit -H headers are
+// applied last so they take precedence over the convenience flags.
+func (o *DownloadOptions) setHeaders(req *http.Request) {
+	if o.UserAgent != "" {
+		req.Header.Set("User-Agent", o.UserAgent)
+	}
+	if o.Referer != "" {
+		req.Header.Set("Referer", o.Referer)
+	}
+	for _, c := range o.Cookies {
+		req.AddCookie(c)
+	}
+	for name, values := range o.Header {
+		req.Header.Del(name)
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+}
+
+// DownloadResult describes a completed download.
+type DownloadResult struct {
+	Path     string
+	Size     int64
+	URL      string // mirror that was used; set by FetchMirrors
+	FinalURL string // URL the bytes were served from after redirects
+	SHA256   string // hex digest of the file
+	Existing bool   // the file was already on disk (-skip-existing); nothing was written
+
+	AcceptRanges bool   // server advertised "Accept-Ranges: bytes"
+	ExtractedTo  string // directory the archive was extracted into
+	ETag         string
+	LastModified string
+
+	SignedBy string // ID of the key that verified the file's signature
+}
+
+// errIncomplete is reported when a download ends before its Content-Length.
+var errIncomplete = errors.New("incomplete")
+
+// ErrStalled is reported when the stall watchdog cancels a download.
+var ErrStalled = errors.New("download stalled")
+
+// ErrTooSlow is reported when the speed watchdog cancels a download.
+var ErrTooSlow = errors.New("download too slow")
+
+// ErrNotModified is reported when a conditional request gets 304 Not
+// Modified, meaning the copy from the last download is current.
+var ErrNotModified = errors.New("not modified")
+
+// errUnexpectedType is reported when -expect-type is set and the server
+// returned an HTML page instead of the file, or when the Content-Type is
+// one of the -deny-type ones.
+var errUnexpectedType = errors.New("unexpected content type")
+
+// ErrInsufficientSpace is reported when a download of known size wouldn't
+// fit on the output filesystem.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// ErrTooLarge is reported when a download exceeds MaxSize.
+var ErrTooLarge = errors.New("download exceeds maximum size")
+
+// ErrOutputUnwritable is reported when a download can't be written to the
+// output directory, e.g. because its permissions changed, the filesystem is
+// read-only or full, or the drive was unmounted.
+var ErrOutputUnwritable = errors.New("output directory is not writable")
+
+// OutputError wraps err in ErrOutputUnwritable if it is a filesystem error
+// that retrying or another mirror won't fix. Other errors, including network
+// errors, are returned as is.
+func OutputError(err error) error {
+	var path string
+	var pe *fs.PathError
+	var le *os.LinkError
+	switch {
+	case errors.As(err, &pe):
+		path = pe.Path
+	case errors.As(err, &le):
+		path = le.New
+	default:
+		return err
+	}
+	dir := filepath.Dir(path)
+	switch {
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, syscall.EROFS),
+		errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EIO):
+	case errors.Is(err, fs.ErrNotExist):
+		// A missing file is expected; a missing directory means it went away
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return err
+		}
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %s: %w", ErrOutputUnwritable, dir, err)
+}
+
+// CheckSize rejects a download whose size is known to exceed MaxSize.
+func (o *DownloadOptions) CheckSize(size int64) error {
+	if o.MaxSize > 0 && size > o.MaxSize {
+		return fmt.Errorf("%w: %s is over the %s limit", ErrTooLarge, FormatBytes(size), FormatBytes(o.MaxSize))
+	}
+	return nil
+}
+
+// sizeLimiter fails the copy once more than limit bytes have been written.
+// Like stallWatchdog, it sits next to the progress writer.
+type sizeLimiter struct {
+	limit   int64
+	written int64
+}
+
+func (l *sizeLimiter) Write(p []byte) (int, error) {
+	l.written += int64(len(p))
+	if l.written > l.limit {
+		return 0, fmt.Errorf("%w: received more than %s", ErrTooLarge, FormatBytes(l.limit))
+	}
+	return len(p), nil
+}
+
+// diskFreeFunc is the free-space lookup CheckDiskSpace uses; tests replace
+// it to simulate a full disk.
+var diskFreeFunc = diskFree
+
+// CheckDiskSpace returns ErrInsufficientSpace if writing size bytes into dir
+// would leave less than minFree bytes available. Platforms where free space
+// can't be determined always pass.
+func CheckDiskSpace(dir string, size, minFree int64) error {
+	free, err := diskFreeFunc(dir)
+	if err != nil {
+		return nil
+	}
+	if size+minFree > free {
+		return fmt.Errorf("%w: need %s plus %s margin, %s available in %s",
+			ErrInsufficientSpace, FormatBytes(size), FormatBytes(minFree), FormatBytes(free), dir)
+	}
+	return nil
+}
+
+// stallWatchdog cancels a download's context when Write isn't called within
+// the timeout. It sits next to the progress writer in the copy pipeline.
+type stallWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	stalled bool
+}
+
+func newStallWatchdog(timeout time.Duration, cancel context.CancelFunc) *stallWatchdog {
+	w := &stallWatchdog{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.mu.Lock()
+		w.stalled = true
+		w.mu.Unlock()
+		cancel()
+	})
+	return w
+}
+
+func (w *stallWatchdog) Write(p []byte) (int, error) {
+	w.timer.Reset(w.timeout)
+	return len(p), nil
+}
+
+func (w *stallWatchdog) Stop() {
+	w.timer.Stop()
+}
+
+func (w *stallWatchdog) Stalled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stalled
+}
+
+// With -min-speed a download is cancelled when it averages less than the
+// minimum over a whole minSpeedWindow, once minSpeedGrace has passed. That
+// catches connections that keep dribbling a few bytes, which the stall
+// watchdog never sees. They are variables so tests can shorten them.
+var (
+	minSpeedGrace  = 15 * time.Second
+	minSpeedWindow = 30 * time.Second
+)
+
+// speedWatchdog cancels a download's context when it is slower than a
+// minimum speed. It sits next to the progress writer in the copy pipeline.
+type speedWatchdog struct {
+	bytes atomic.Int64 // since the current window started
+	slow  atomic.Bool
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newSpeedWatchdog(minSpeed int64, cancel context.CancelFunc) *speedWatchdog {
+	w := &speedWatchdog{done: make(chan struct{})}
+	grace, window := minSpeedGrace, minSpeedWindow
+	minBytes := minSpeed * int64(window) / int64(time.Second)
+	go func() {
+		select {
+		case <-time.After(grace):
+		case <-w.done:
+			return
+		}
+		w.bytes.Store(0)
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if w.bytes.Swap(0) < minBytes {
+					w.slow.Store(true)
+					cancel()
+					return
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *speedWatchdog) Write(p []byte) (int, error) {
+	w.bytes.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (w *speedWatchdog) Stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (w *speedWatchdog) Slow() bool {
+	return w.slow.Load()
+}
+
+// slowError is the error for a download the speed watchdog cancelled.
+func (o *DownloadOptions) slowError() error {
+	return fmt.Errorf("%w: under %s/s for %s", ErrTooSlow, FormatBytes(o.MinSpeed), minSpeedWindow)
+}
+
+// Head sends a HEAD request for rawURL and reports the advertised size
+// (-1 if unknown) and range support. ok is false when HEAD fails or isn't
+// allowed, in which case the caller just proceeds with the GET.
+func (o *DownloadOptions) Head(ctx context.Context, rawURL string) (size int64, acceptRanges bool, ok bool) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", rawURL, nil)
+	if err != nil {
+		return -1, false, false
+	}
+	o.setHeaders(req)
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return -1, false, false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return -1, false, false
+	}
+	return resp.ContentLength, resp.Header.Get("Accept-Ranges") == "bytes", true
+}
+
+// ProgressFunc is called when a download's output file is ready. offset is
+// the number of bytes already on disk (non-zero when resuming) and total the
+// full size, or -1 if unknown. It returns the writer that receives a copy of
+// every chunk for progress reporting.
+type ProgressFunc func(outputPath string, offset, total int64) io.Writer
+
+// PartSuffix is appended to the output path while a download is in progress.
+// The file is renamed into place once the transfer completes, so a leftover
+// .part file always means an interrupted download.
+const PartSuffix = ".part"
+
+func PartPath(outputPath string) string {
+	return outputPath + PartSuffix
+}
+
+// fetch downloads rawURL into outputDir, saving it as name (or a name derived
+// from the URL when empty).
+func (o *DownloadOptions) fetch(ctx context.Context, rawURL, outputDir, name string, newProgress ProgressFunc) (*DownloadResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	knownSize := int64(-1)
+	acceptRanges := false
+	if o.Preflight {
+		if size, ranges, ok := o.Head(ctx, rawURL); ok {
+			knownSize, acceptRanges = size, ranges
+			sizeText := "unknown"
+			if size >= 0 {
+				sizeText = FormatBytes(size)
+			}
+			slog.Info("preflight", "url", rawURL, "size", sizeText, "resumable", ranges)
+		}
+	}
+
+	resp, wire, err := o.get(ctx, rawURL, cancel)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	decoded := wire != nil
+
+	outputPath := o.OutputPath(rawURL, outputDir, o.Filename(rawURL, name, resp))
+	if o.OutTemplate != "" {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.SkipExisting {
+		if result := o.ExistingFile(outputPath, resp, decoded); result != nil {
+			return result, nil
+		}
+	}
+
+	total := resp.ContentLength
+	if total < 0 {
+		total = knownSize
+	}
+	if err := o.checkSpace(filepath.Dir(outputPath), total); err != nil {
+		return nil, err
+	}
+	if !o.Overwrite {
+		if outputPath, err = o.CollisionPath(rawURL, outputPath); err != nil {
+			return nil, err
+		}
+	}
+	slog.Debug("chose output path", "url", rawURL, "path", outputPath)
+	if o.Confirm != nil {
+		_, statErr := os.Stat(outputPath)
+		overwrite := statErr == nil
+		if (overwrite || o.ConfirmOver > 0 && total > o.ConfirmOver) && !o.Confirm(outputPath, total, overwrite) {
+			return nil, fmt.Errorf("%w: %s", ErrDeclined, outputPath)
+		}
+	}
+
+	out, err := o.createPart(PartPath(outputPath))
+	if err != nil {
+		return nil, err
+	}
+	allocSize := total
+	if decoded {
+		allocSize = -1 // Content-Length is the encoded size
+	}
+	if err := o.allocate(out, allocSize); err != nil {
+		out.Close()
+		os.Remove(PartPath(outputPath))
+		return nil, err
+	}
+
+	if resp.Header.Get("Accept-Ranges") == "bytes" {
+		acceptRanges = true
+	}
+	if n := o.segmentCount(resp, total, decoded); n > 1 {
+		return o.saveSegments(ctx, resp, out, outputPath, total, n, newProgress, cancel)
+	}
+	return o.save(ctx, resp, out, outputPath, 0, total, acceptRanges, wire, newProgress, cancel)
+}
+
+// get makes the GET request for rawURL and checks the response: its status,
+// its encoding, which it decodes (see decodeBody), and -deny-type. cancel
+// cancels ctx; it stops a request that stalls while the body is sniffed. On
+// success the caller closes resp.Body.
+func (o *DownloadOptions) get(ctx context.Context, rawURL string, cancel context.CancelFunc) (*http.Response, *wireReader, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	o.setHeaders(req)
+	if o.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", o.IfNoneMatch)
+	}
+	if o.IfModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", o.IfModifiedSince)
+	}
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	body := resp.Body
+	fail := func(err error) (*http.Response, *wireReader, error) {
+		body.Close()
+		return nil, nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && (o.IfNoneMatch != "" || o.IfModifiedSince != "") {
+		return fail(ErrNotModified)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fail(&statusError{Code: resp.StatusCode, Status: resp.Status, URL: resp.Request.URL.String(), RetryAfter: retryAfter(resp, time.Now())})
+	}
+	// decodeBody and checkContentType may read the start of the body
+	// before save starts its stall watchdog, so they get one of their own
+	var sniffing *stallWatchdog
+	if o.StallTimeout > 0 {
+		sniffing = newStallWatchdog(o.StallTimeout, cancel)
+	}
+	wire, err := o.decodeBody(resp)
+	if err == nil {
+		err = o.checkContentType(rawURL, resp)
+	}
+	if sniffing != nil {
+		sniffing.Stop()
+		if sniffing.Stalled() {
+			return fail(fmt.Errorf("%w: no data received for %s", ErrStalled, o.StallTimeout))
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	// Decoding and sniffing may have replaced resp.Body with a reader that
+	// doesn't close the connection
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{resp.Body, body}
+	return resp, wire, nil
+}
+
+// Filename picks the file name for a response: name if set, then the
+// Content-Disposition filename when ContentDisposition is enabled, then the
+// last element of the URL path. The result is sanitized, and with InferExt a
+// derived name without an extension gets one from the Content-Type.
+func (o *DownloadOptions) Filename(rawURL, name string, resp *http.Response) string {
+	filename, source := name, "requested"
+	if filename == "" && o.ContentDisposition {
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+			filename, source = params["filename"], "Content-Disposition"
+		}
+	}
+	if filename == "" {
+		filename, source = FilenameFromURL(rawURL), "URL"
+	}
+	if o.Flat != "" {
+		filename = flatten(filename, o.Flat)
+	}
+	if filename = SanitizeFilename(filename); filename == "" {
+		filename, source = urlHash(rawURL), "URL hash"
+	}
+	if o.InferExt && source != "requested" {
+		filename = inferExtension(filename, resp.Header.Get("Content-Type"))
+	}
+	slog.Debug("chose filename", "url", rawURL, "filename", filename, "from", source)
+	return filename
+}
+
+// OutputPath returns where filename is saved: in outputDir, or under the
+// path given by OutTemplate.
+func (o *DownloadOptions) OutputPath(rawURL, outputDir, filename string) string {
+	if o.OutTemplate != "" {
+		if rel := expandOutTemplate(o.OutTemplate, rawURL, filename, time.Now()); rel != "" {
+			if o.Flat != "" {
+				rel = flatten(rel, o.Flat)
+			}
+			return filepath.Join(outputDir, rel)
+		}
+	}
+	return filepath.Join(outputDir, filename)
+}
+
+// preferredExtensions picks the usual extension for types that mime knows
+// several for, and covers common download types missing from minimal
+// systems without a mime.types file.
+var preferredExtensions = map[string]string{
+	"application/gzip":             ".gz",
+	"application/x-gzip":           ".gz",
+	"application/x-7z-compressed":  ".7z",
+	"application/x-bzip2":          ".bz2",
+	"application/x-iso9660-image":  ".iso",
+	"application/x-rar-compressed": ".rar",
+	"application/vnd.rar":          ".rar",
+	"application/x-tar":            ".tar",
+	"application/x-xz":             ".xz",
+	"application/zip":              ".zip",
+	"application/zstd":             ".zst",
+	"audio/flac":                   ".flac",
+	"audio/mpeg":                   ".mp3",
+	"image/jpeg":                   ".jpg",
+	"image/tiff":                   ".tif",
+	"text/html":                    ".html",
+	"text/plain":                   ".txt",
+	"video/mp4":                    ".mp4",
+	"video/mpeg":                   ".mpg",
+	"video/quicktime":              ".mov",
+	"video/x-matroska":             ".mkv",
+	"video/x-msvideo":              ".avi",
+}
+
+// inferExtension adds the extension for contentType to filename when it has
+// none, for -infer-ext. Generic binary types say nothing about the file and
+// are ignored.
+func inferExtension(filename, contentType string) string {
+	if filepath.Ext(filename) != "" {
+		return filename
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream" {
+		return filename
+	}
+	ext := preferredExtensions[mediaType]
+	if ext == "" {
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return filename + ext
+}
+
+// flatten replaces the path separators in name with sep, for -flat.
+func flatten(name, sep string) string {
+	return strings.NewReplacer("/", sep, "\\", sep).Replace(name)
+}
+
+// Strategies for -collision, used when the output file already exists.
+const (
+	CollisionHash      = "hash"      // add a hash of the URL: file_a1b2c3d4.zip
+	CollisionNumber    = "number"    // add the first free number: file (1).zip
+	CollisionOverwrite = "overwrite" // replace the existing file
+	CollisionSkip      = "skip"      // don't download; ErrFileExists
+	CollisionReplace   = "replace"   // replace the existing file unless the content is the same; see finish
+)
+
+// ErrDeclined is reported when Confirm turns a download down.
+var ErrDeclined = errors.New("declined")
+
+// ErrFileExists is reported with -collision skip when the output file is
+// already on disk.
+var ErrFileExists = errors.New("file already exists")
+
+// ValidCollision reports whether s is a -collision strategy.
+func ValidCollision(s string) bool {
+	switch s {
+	case CollisionHash, CollisionNumber, CollisionOverwrite, CollisionSkip, CollisionReplace:
+		return true
+	}
+	return false
+}
+
+// CollisionPath returns outputPath if nothing exists there yet, and
+// otherwise the path picked by the Collision strategy (hash by default).
+func (o *DownloadOptions) CollisionPath(rawURL, outputPath string) (string, error) {
+	if _, err := os.Stat(outputPath); err != nil {
+		return outputPath, nil
+	}
+	dir, file := filepath.Split(outputPath)
+	ext := filepath.Ext(file)
+	base := strings.TrimSuffix(file, ext)
+	switch o.Collision {
+	case CollisionOverwrite, CollisionReplace:
+		return outputPath, nil
+	case CollisionSkip:
+		return "", fmt.Errorf("%w: %s", ErrFileExists, outputPath)
+	case CollisionNumber:
+		for i := 1; ; i++ {
+			p := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+			if _, err := os.Stat(p); err != nil {
+				return p, nil
+			}
+		}
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s_%s%s", base, urlHash(rawURL), ext)), nil
+}
+
+// Probe fetches the response headers for rawURL without the body, following
+// redirects. It sends HEAD and falls back to a GET whose body is closed
+// right away for servers that don't support HEAD.
+func (o *DownloadOptions) Probe(ctx context.Context, rawURL string) (*http.Response, error) {
+	var resp *http.Response
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		o.setHeaders(req)
+		resp, err = o.Client.Do(req)
+		if err != nil {
+			if method == "GET" {
+				return nil, err
+			}
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+	}
+	return nil, &statusError{Code: resp.StatusCode, Status: resp.Status, URL: resp.Request.URL.String()}
+}
+
+// decodeBody replaces resp.Body with a decompressing reader when the server
+// sent a gzip or deflate Content-Encoding that the transport didn't already
+// undo. That happens when Accept-Encoding was set explicitly, e.g. with -H.
+// When it was wrapped, the returned wireReader sees the encoded bytes.
+func (o *DownloadOptions) decodeBody(resp *http.Response) (*wireReader, error) {
+	if o.NoDecompress || resp.Uncompressed {
+		return nil, nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "gzip" && encoding != "x-gzip" && encoding != "deflate" {
+		return nil, nil
+	}
+	wire := &wireReader{r: resp.Body}
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip response: %w", err)
+		}
+		resp.Body = io.NopCloser(zr) // the original body is closed by the caller
+		return wire, nil
+	case "deflate":
+		// "deflate" should be zlib-wrapped, but some servers send raw
+		// deflate data. Check for a zlib header to tell them apart.
+		br := bufio.NewReader(wire)
+		if head, err := br.Peek(2); err == nil && head[0]&0x0F == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, fmt.Errorf("reading deflate response: %w", err)
+			}
+			resp.Body = io.NopCloser(zr)
+		} else {
+			resp.Body = io.NopCloser(flate.NewReader(br))
+		}
+		return wire, nil
+	}
+	return nil, nil
+}
+
+// wireReader reads an encoded body under the decompressor, counting the
+// bytes as they come off the connection and copying them to to once set.
+// Progress follows these so it matches the encoded Content-Length.
+type wireReader struct {
+	r  io.Reader
+	n  int64
+	to io.Writer
+}
+
+func (w *wireReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	w.n += int64(n)
+	if n > 0 && w.to != nil {
+		w.to.Write(p[:n])
+	}
+	return n, err
+}
+
+// checkContentType catches HTML error pages served with a 200 status. The
+// declared Content-Type is compared with ExpectType; on a mismatch the start
+// of the body is sniffed and an HTML page is rejected. Without ExpectType an
+// HTML page only logs a warning, and the body is only sniffed when no type
+// was declared. After sniffing, resp.Body is replaced with a reader that
+// still returns the sniffed bytes.
+//
+// A declared type matching DenyTypes is rejected before anything is read.
+func (o *DownloadOptions) checkContentType(rawURL string, resp *http.Response) error {
+	declared, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if denied := o.deniedType(declared); denied != "" {
+		return fmt.Errorf("%w: %s is refused by -deny-type %s", errUnexpectedType, declared, denied)
+	}
+	if o.ExpectType == "" {
+		if declared == "text/html" || declared == "" && sniffType(resp) == "text/html" {
+			slog.Warn("response looks like an HTML page, not a file", "url", rawURL, "content_type", declared)
+		}
+		return nil
+	}
+	if strings.EqualFold(declared, o.ExpectType) {
+		return nil
+	}
+
+	if sniffType(resp) == "text/html" {
+		return fmt.Errorf("%w: expected %s but got %s, which looks like an HTML page (maybe an error or login page)",
+			errUnexpectedType, o.ExpectType, cmp.Or(declared, "no Content-Type"))
+	}
+	slog.Warn("content type differs from -expect-type", "url", rawURL, "expected", o.ExpectType, "content_type", declared)
+	return nil
+}
+
+// sniffType detects the media type of resp's body from its first 512
+// bytes, replacing resp.Body with a reader that still returns them.
+func sniffType(resp *http.Response) string {
+	br := bufio.NewReaderSize(resp.Body, 512)
+	head, err := br.Peek(512)
+	var body io.Reader = br
+	if err != nil && err != io.EOF {
+		// Peek reports a read error only once; fail the copy with it after
+		// the peeked bytes rather than ending the body early
+		body = io.MultiReader(br, errReader{err})
+	}
+	resp.Body = io.NopCloser(body) // the original body is closed by the caller
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return sniffed
+}
+
+// errReader is a reader that always fails with err.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// deniedType returns the DenyTypes entry the media type mediaType starts
+// with, ignoring case, or "" if none does.
+func (o *DownloadOptions) deniedType(mediaType string) string {
+	if mediaType == "" {
+		return ""
+	}
+	for _, t := range o.DenyTypes {
+		if len(mediaType) >= len(t) && strings.EqualFold(mediaType[:len(t)], t) {
+			return t
+		}
+	}
+	return ""
+}
+
+// ExistingFile returns a result for a file already at outputPath when it is
+// complete: it has ExistingSHA256 if that is set, otherwise its size matches
+// the response's Content-Length. It returns nil when the file should be
+// downloaded.
+func (o *DownloadOptions) ExistingFile(outputPath string, resp *http.Response, decoded bool) *DownloadResult {
+	info, err := os.Stat(outputPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	var sum string
+	switch want := cmp.Or(o.ExpectSHA256, o.ExistingSHA256); {
+	case want != "":
+		if sum, err = fileSHA256(outputPath); err != nil || !strings.EqualFold(sum, want) {
+			return nil
+		}
+	case !decoded && resp.ContentLength == info.Size():
+		sum, _ = fileSHA256(outputPath)
+	default:
+		return nil
+	}
+	return &DownloadResult{
+		Path:     outputPath,
+		Size:     info.Size(),
+		FinalURL: resp.Request.URL.String(),
+		SHA256:   sum,
+		Existing: true,
+
+		AcceptRanges: resp.Header.Get("Accept-Ranges") == "bytes",
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+}
+
+// ValidSHA256 reports whether s is a hex SHA-256 digest.
+func ValidSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// errChecksum is reported when a download doesn't have the -sha256 hash.
+var errChecksum = errors.New("checksum mismatch")
+
+// checkSHA256 compares a finished download with ExpectSHA256 and deletes it
+// if it differs. FetchMirrors then tries the next mirror, since the same
+// server is likely to send the same bytes again.
+func (o *DownloadOptions) checkSHA256(result *DownloadResult) error {
+	if o.ExpectSHA256 == "" || strings.EqualFold(result.SHA256, o.ExpectSHA256) {
+		return nil
+	}
+	if !result.Existing {
+		os.Remove(result.Path)
+	}
+	return fmt.Errorf("%w: got %s from %s, expected %s", errChecksum, result.SHA256, result.URL, strings.ToLower(o.ExpectSHA256))
+}
+
+// checksumSuffix is appended to a download's path for its -write-checksum file.
+const checksumSuffix = ".sha256"
+
+// writeChecksum writes the checksum file for a finished download, in the
+// "<hex>  <name>" format read by sha256sum -c. Failures only produce a
+// warning; the download itself still succeeds.
+func (o *DownloadOptions) writeChecksum(result *DownloadResult) {
+	if result.ExtractedTo != "" && o.ExtractRemove {
+		return // the archive is gone
+	}
+	sum := result.SHA256
+	if sum == "" {
+		var err error
+		if sum, err = fileSHA256(result.Path); err != nil {
+			slog.Warn("could not write checksum file", "file", result.Path, "error", err)
+			return
+		}
+	}
+	mode := o.FileMode
+	if mode == 0 {
+		mode = 0644
+	}
+	path := result.Path + checksumSuffix
+	line := sum + "  " + filepath.Base(result.Path) + "\n"
+	err := os.WriteFile(path, []byte(line), mode)
+	if err == nil {
+		// WriteFile's mode is masked by the umask; set it exactly
+		err = os.Chmod(path, mode)
+	}
+	if err != nil {
+		slog.Warn("could not write checksum file", "file", path, "error", err)
+	}
+}
+
+// fileSHA256 returns the hex SHA-256 digest of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// createPart creates (or truncates) a .part file with FileMode. The mode is
+// set with Chmod as well, since OpenFile's is reduced by the umask.
+func (o *DownloadOptions) createPart(path string) (*os.File, error) {
+	mode := o.FileMode
+	if mode == 0 {
+		mode = 0644
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// allocate preallocates size bytes for the .part file out with
+// -preallocate. Running out of space is reported as ErrInsufficientSpace so
+// the download stops before any data is fetched; filesystems that can't
+// preallocate are left to grow the file as usual.
+func (o *DownloadOptions) allocate(out *os.File, size int64) error {
+	if !o.Preallocate || size <= 0 {
+		return nil
+	}
+	err := preallocate(out, size)
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return fmt.Errorf("%w: could not preallocate %s for %s", ErrInsufficientSpace, FormatBytes(size), out.Name())
+	case err != nil:
+		slog.Debug("preallocation not supported", "file", out.Name(), "error", err)
+	}
+	return nil
+}
+
+// Resume continues an interrupted download of rawURL from the end of
+// outputPath's .part file with a Range request. If the server ignores the
+// range the download starts over.
+func (o *DownloadOptions) Resume(ctx context.Context, rawURL, outputPath string, newProgress ProgressFunc) (*DownloadResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	part := PartPath(outputPath)
+	info, err := os.Stat(part)
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.setHeaders(req)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out *os.File
+	total := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+		out, err = os.OpenFile(part, os.O_WRONLY|os.O_APPEND, 0644)
+	case http.StatusOK:
+		offset, total = 0, resp.ContentLength
+		if out, err = o.createPart(part); err == nil {
+			if err = o.allocate(out, total); err != nil {
+				out.Close()
+				os.Remove(part)
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The .part file already holds the whole body
+		if err := o.finish(part, outputPath, "", nil); err != nil {
+			return nil, err
+		}
+		sum, _ := fileSHA256(outputPath)
+		return &DownloadResult{Path: outputPath, Size: offset, FinalURL: resp.Request.URL.String(), SHA256: sum, AcceptRanges: true}, nil
+	default:
+		return nil, &statusError{Code: resp.StatusCode, Status: resp.Status, URL: resp.Request.URL.String(), RetryAfter: retryAfter(resp, time.Now())}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if total >= 0 {
+		if err := o.checkSpace(filepath.Dir(outputPath), total-offset); err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	slog.Info("resuming download", "url", rawURL, "file", outputPath, "offset", offset)
+	return o.save(ctx, resp, out, outputPath, offset, total, resp.StatusCode == http.StatusPartialContent, nil, newProgress, cancel)
+}
+
+// finish moves a completed .part file to outputPath. With KeepVersions the
+// file it replaces is kept as a version, and with PreserveMtime the file gets
+// lastModified, the response's Last-Modified header, as its modification
+// time. With Tee, tee is the copy streamed alongside the .part file, or nil
+// to copy the finished file instead.
+//
+// With -collision replace an existing file with the same SHA-256 is kept
+// as it is, modification time included, and the .part file is dropped.
+func (o *DownloadOptions) finish(part, outputPath, lastModified string, tee *teeFile) error {
+	if o.Collision == CollisionReplace && sameContent(part, outputPath) {
+		slog.Info("existing file has the same content, kept it", "file", outputPath)
+		if err := os.Remove(part); err != nil {
+			tee.abort()
+			return err
+		}
+		lastModified = ""
+	} else {
+		if o.KeepVersions > 0 {
+			if err := o.keepVersion(outputPath); err != nil {
+				tee.abort()
+				return err
+			}
+		}
+		// The rename replaces an existing file atomically
+		if err := os.Rename(part, outputPath); err != nil {
+			tee.abort()
+			return err
+		}
+	}
+	paths := []string{outputPath}
+	if o.Tee != "" {
+		if tee == nil {
+			tee = o.copyTee(outputPath)
+		}
+		if tee.commit() {
+			paths = append(paths, tee.path)
+		}
+	}
+	if o.PreserveMtime && lastModified != "" {
+		mod, err := http.ParseTime(lastModified)
+		if err != nil {
+			slog.Debug("ignoring unparseable Last-Modified", "file", outputPath, "last_modified", lastModified)
+			return nil
+		}
+		for _, path := range paths {
+			// The zero access time is left unchanged
+			if err := os.Chtimes(path, time.Time{}, mod); err != nil {
+				slog.Warn("could not set modification time", "file", path, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sameContent reports whether the files at a and b have the same SHA-256.
+// A missing file is never the same.
+func sameContent(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil || infoA.Size() != infoB.Size() {
+		return false
+	}
+	sumA, errA := fileSHA256(a)
+	sumB, errB := fileSHA256(b)
+	return errA == nil && errB == nil && sumA == sumB
+}
+
+// checkSpace applies the MaxSize and MinFree checks to a download of size
+// bytes. An unknown size (-1) passes.
+func (o *DownloadOptions) checkSpace(dir string, size int64) error {
+	if size < 0 {
+		return nil
+	}
+	if err := o.CheckSize(size); err != nil {
+		return err
+	}
+	return CheckDiskSpace(dir, size, o.MinFree)
+}
+
+// PartialError is returned by save when a download of a server that
+// accepts ranges failed midway. Its .part file is kept, so FetchMirrors can
+// continue from there with resume instead of starting over.
+type PartialError struct {
+	path string // output path; the data so far is in its .part file
+	err  error
+}
+
+func (e *PartialError) Error() string {
+	return e.err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.err
+}
+
+// keepPart leaves the .part file holding size bytes for resume, which
+// continues from its size. A preallocated file is cut back to what was
+// written.
+func (o *DownloadOptions) keepPart(part string, size int64) {
+	if o.Preallocate {
+		os.Truncate(part, size)
+	}
+}
+
+// save copies resp's body into out, the .part file for outputPath that
+// already holds offset bytes, then renames it into place. wire is set when
+// decodeBody decompresses the body; total is then the encoded size. cancel
+// stops ctx and is used by the stall watchdog.
+//
+// On failure the .part file is removed, except when the caller cancelled ctx
+// or, with acceptRanges, when the error is a PartialError: then it's kept so
+// the download can be resumed.
+func (o *DownloadOptions) save(ctx context.Context, resp *http.Response, out *os.File, outputPath string, offset, total int64, acceptRanges bool, wire *wireReader, newProgress ProgressFunc, cancel context.CancelFunc) (*DownloadResult, error) {
+	start := offset
+	if wire != nil {
+		start = wire.n // already read for the decompressor's header and sniffing
+	}
+	progress := newProgress(outputPath, start, total)
+
+	var watchdog *stallWatchdog
+	if o.StallTimeout > 0 {
+		watchdog = newStallWatchdog(o.StallTimeout, cancel)
+		defer watchdog.Stop()
+		progress = io.MultiWriter(progress, watchdog)
+	}
+	var speed *speedWatchdog
+	if o.MinSpeed > 0 {
+		speed = newSpeedWatchdog(o.MinSpeed, cancel)
+		defer speed.Stop()
+		progress = io.MultiWriter(progress, speed)
+	}
+	// The limit and the hash apply to the bytes written. So does progress,
+	// except for a decoded body: then it follows the bytes on the wire
+	hash := sha256.New()
+	written := io.Writer(hash)
+	if o.MaxSize > 0 {
+		written = io.MultiWriter(&sizeLimiter{limit: o.MaxSize, written: offset}, hash)
+	}
+	if wire != nil {
+		wire.to = progress
+	} else {
+		written = io.MultiWriter(progress, written)
+	}
+
+	// A resumed download has no start for the copy; finish makes it from the
+	// whole file instead
+	dst := io.Writer(out)
+	var tee *teeFile
+	if offset == 0 {
+		if tee = o.openTee(outputPath); tee != nil {
+			dst = io.MultiWriter(out, tee)
+		}
+	}
+
+	size, err := o.copyBody(dst, io.TeeReader(throttle(ctx, resp.Body, o.limiters()), written))
+	got := offset + size
+	if wire != nil {
+		got = wire.n
+	}
+	if (err == nil || errors.Is(err, io.ErrUnexpectedEOF)) && total >= 0 && got != total {
+		// The connection ended early, possibly without an error
+		err = fmt.Errorf("%w: got %d of %d bytes", errIncomplete, got, total)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	part := PartPath(outputPath)
+	if err != nil {
+		tee.abort()
+		switch {
+		case watchdog != nil && watchdog.Stalled():
+			err = fmt.Errorf("%w: no data received for %s", ErrStalled, o.StallTimeout)
+		case speed != nil && speed.Slow():
+			err = o.slowError()
+		case ctx.Err() != nil:
+			o.keepPart(part, offset+size)
+			return nil, err
+		}
+		// A body the server can send the rest of is worth keeping for the
+		// next attempt. Offsets into a decoded body don't match the server's.
+		if acceptRanges && wire == nil && !resp.Uncompressed && offset+size > 0 && !errors.Is(err, ErrTooLarge) {
+			o.keepPart(part, offset+size)
+			return nil, &PartialError{path: outputPath, err: err}
+		}
+		os.Remove(part)
+		return nil, err
+	}
+	if err := o.finish(part, outputPath, resp.Header.Get("Last-Modified"), tee); err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if offset > 0 {
+		// The hash only saw the resumed bytes
+		sum, _ = fileSHA256(outputPath)
+	}
+	return &DownloadResult{
+		Path:     outputPath,
+		Size:     offset + size,
+		FinalURL: resp.Request.URL.String(),
+		SHA256:   sum,
+
+		AcceptRanges: acceptRanges,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
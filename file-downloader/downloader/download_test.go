@@ -0,0 +1,1143 @@
+package downloader
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// noProgress is a ProgressFunc that discards progress.
+func noProgress(string, int64, int64) io.Writer { return io.Discard }
+
+// stallingServer serves body, but the first response stops halfway and
+// hangs until the test ends. It records the Range header of every request.
+func stallingServer(t *testing.T, body string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var ranges []string
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+
+		w.Header().Set("Accept-Ranges", "bytes")
+		if first {
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			io.WriteString(w, body[:len(body)/2])
+			w.(http.Flusher).Flush()
+			select {
+			case <-done:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	t.Cleanup(func() {
+		close(done)
+		srv.Close()
+	})
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+func TestFetchStalled(t *testing.T) {
+	srv, _ := stallingServer(t, strings.Repeat("x", 1000))
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), StallTimeout: 100 * time.Millisecond}
+
+	_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, dir, "", noProgress)
+	if !errors.Is(err, ErrStalled) {
+		t.Fatalf("err = %v, want ErrStalled", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file.bin"+PartSuffix)); !os.IsNotExist(err) {
+		t.Errorf(".part file left behind with no retry to resume it (stat err = %v)", err)
+	}
+}
+
+func TestFetchStalledResumes(t *testing.T) {
+	body := strings.Repeat("0123456789", 100)
+	srv, ranges := stallingServer(t, body)
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), StallTimeout: 100 * time.Millisecond, Retries: 1}
+
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, dir, "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(result.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Errorf("file has %d bytes, want the %d byte body", len(data), len(body))
+	}
+	want := []string{"", fmt.Sprintf("bytes=%d-", len(body)/2)}
+	if got := ranges(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Range headers = %q, want %q", got, want)
+	}
+}
+
+// shortSpeedWindow shortens the -min-speed grace period and window for a
+// test.
+func shortSpeedWindow(t *testing.T) {
+	grace, window := minSpeedGrace, minSpeedWindow
+	t.Cleanup(func() { minSpeedGrace, minSpeedWindow = grace, window })
+	minSpeedGrace, minSpeedWindow = 50*time.Millisecond, 100*time.Millisecond
+}
+
+// dribblingServer sends a few bytes of its body every 10ms, well under
+// 10K/s, to the first n requests and the whole body at once afterwards.
+func dribblingServer(t *testing.T, body string, n int32) *httptest.Server {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > n {
+			io.WriteString(w, body)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		for i := 0; i < len(body); i += 2 {
+			io.WriteString(w, body[i:i+2])
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMinSpeed(t *testing.T) {
+	shortSpeedWindow(t)
+	body := strings.Repeat("slow", 1000)
+
+	// Too slow for the whole window: the download is aborted
+	srv := dribblingServer(t, body, 1)
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), MinSpeed: 10 << 10}
+	_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, dir, "", noProgress)
+	if !errors.Is(err, ErrTooSlow) {
+		t.Fatalf("err = %v, want ErrTooSlow", err)
+	}
+
+	// With a retry the second, fast response completes it
+	opts.Retries = 1
+	result, err := opts.FetchMirrors(context.Background(), []string{dribblingServer(t, body, 1).URL + "/file.bin"}, t.TempDir(), "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != body {
+		t.Errorf("retried file has %d bytes, want %d", len(data), len(body))
+	}
+
+	// A download that is fast enough isn't touched
+	opts.Retries = 0
+	fast := dribblingServer(t, body, 0)
+	if _, err := opts.FetchMirrors(context.Background(), []string{fast.URL + "/file.bin"}, t.TempDir(), "", noProgress); err != nil {
+		t.Errorf("fast download: %v", err)
+	}
+}
+
+func TestMinSpeedFailover(t *testing.T) {
+	shortSpeedWindow(t)
+	body := strings.Repeat("slow", 1000)
+	slow := dribblingServer(t, body, 100)
+	mirror := dribblingServer(t, body, 0)
+
+	opts := &DownloadOptions{Client: http.DefaultClient, MinSpeed: 10 << 10}
+	result, err := opts.FetchMirrors(context.Background(), []string{slow.URL + "/file.bin", mirror.URL + "/file.bin"}, t.TempDir(), "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.URL != mirror.URL+"/file.bin" {
+		t.Errorf("URL = %q, want the mirror", result.URL)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != body {
+		t.Errorf("file has %d bytes, want %d", len(data), len(body))
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	var gotUA, gotReferer string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA, gotReferer = r.UserAgent(), r.Referer()
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		opts        DownloadOptions
+		wantUA      string
+		wantReferer string
+	}{
+		{
+			name:        "user agent and referer",
+			opts:        DownloadOptions{UserAgent: "umbrel-downloader/1.0", Referer: "https://example.com/page"},
+			wantUA:      "umbrel-downloader/1.0",
+			wantReferer: "https://example.com/page",
+		},
+		{
+			name:   "-H wins",
+			opts:   DownloadOptions{UserAgent: "umbrel-downloader/1.0", Header: http.Header{"User-Agent": {"curl/8.0"}}},
+			wantUA: "curl/8.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Client = srv.Client()
+			if _, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, t.TempDir(), "", noProgress); err != nil {
+				t.Fatal(err)
+			}
+			if gotUA != tt.wantUA {
+				t.Errorf("User-Agent = %q, want %q", gotUA, tt.wantUA)
+			}
+			if gotReferer != tt.wantReferer {
+				t.Errorf("Referer = %q, want %q", gotReferer, tt.wantReferer)
+			}
+		})
+	}
+}
+
+func TestHead(t *testing.T) {
+	// Only HEAD is answered; a GET would fail
+	headOnly := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			http.Error(w, "no", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Length", "1000")
+		w.Header().Set("Accept-Ranges", "bytes")
+	}))
+	defer headOnly.Close()
+	noHead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		io.WriteString(w, "data")
+	}))
+	defer noHead.Close()
+
+	opts := &DownloadOptions{Client: http.DefaultClient}
+	size, ranges, ok := opts.Head(context.Background(), headOnly.URL+"/file.bin")
+	if !ok || size != 1000 || !ranges {
+		t.Errorf("Head = %d, %v, %v, want 1000, true, true", size, ranges, ok)
+	}
+	if _, _, ok := opts.Head(context.Background(), noHead.URL+"/file.bin"); ok {
+		t.Error("Head ok = true for a 405")
+	}
+
+	// A failed preflight falls through to the GET
+	opts.Preflight = true
+	if _, err := opts.FetchMirrors(context.Background(), []string{noHead.URL + "/file.bin"}, t.TempDir(), "", noProgress); err != nil {
+		t.Errorf("download after a 405 preflight: %v", err)
+	}
+}
+
+func TestPreflightTotal(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			return
+		}
+		// Flushing before the body makes the GET chunked, without a length
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	for _, preflight := range []bool{false, true} {
+		var total int64
+		opts := &DownloadOptions{Client: srv.Client(), Preflight: preflight}
+		_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, t.TempDir(), "", func(_ string, _, n int64) io.Writer {
+			total = n
+			return io.Discard
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := int64(-1)
+		if preflight {
+			want = int64(len(body))
+		}
+		if total != want {
+			t.Errorf("Preflight %v: progress total = %d, want %d", preflight, total, want)
+		}
+	}
+}
+
+// fakeDiskFree makes CheckDiskSpace see free bytes available until the test
+// ends.
+func fakeDiskFree(t *testing.T, free int64, err error) {
+	t.Helper()
+	orig := diskFreeFunc
+	diskFreeFunc = func(string) (int64, error) { return free, err }
+	t.Cleanup(func() { diskFreeFunc = orig })
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	tests := []struct {
+		name          string
+		free          int64
+		statErr       error
+		size, minFree int64
+		wantErr       bool
+	}{
+		{name: "fits", free: 1000, size: 900},
+		{name: "exactly fits", free: 1000, size: 900, minFree: 100},
+		{name: "margin too small", free: 1000, size: 901, minFree: 100, wantErr: true},
+		{name: "too large", free: 1000, size: 2000, wantErr: true},
+		{name: "free space unknown", statErr: errors.New("not supported"), size: 1 << 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDiskFree(t, tt.free, tt.statErr)
+			err := CheckDiskSpace(t.TempDir(), tt.size, tt.minFree)
+			if tt.wantErr != errors.Is(err, ErrInsufficientSpace) {
+				t.Errorf("err = %v, want ErrInsufficientSpace %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetchInsufficientSpace(t *testing.T) {
+	fakeDiskFree(t, 100, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), Retries: 2}
+
+	_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/big.bin"}, dir, "", noProgress)
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("err = %v, want ErrInsufficientSpace", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("output directory has %d entries, want none", len(entries))
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	const limit = 10 << 10
+	var bodyRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/declared.bin" {
+			w.Header().Set("Content-Length", fmt.Sprint(limit+1))
+		} else {
+			w.(http.Flusher).Flush() // chunked: the size isn't known up front
+		}
+		if r.Method == http.MethodGet {
+			bodyRequests++
+		}
+		// Stream well past the cap, a KiB at a time
+		chunk := strings.Repeat("x", 1<<10)
+		for range 64 {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/streamed.bin", "/declared.bin"} {
+		t.Run(path, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &DownloadOptions{Client: srv.Client(), MaxSize: limit, Retries: 1}
+			_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + path}, dir, "", noProgress)
+			if !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("err = %v, want ErrTooLarge", err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				t.Errorf("output directory has %s, want nothing", entries[0].Name())
+			}
+		})
+	}
+	if bodyRequests != 2 {
+		t.Errorf("server got %d GETs, want 2: an oversized download isn't retried", bodyRequests)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	body := strings.Repeat("compressible text ", 500)
+	var gz, zl, raw bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	io.WriteString(gw, body)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	io.WriteString(zw, body)
+	zw.Close()
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	io.WriteString(fw, body)
+	fw.Close()
+
+	tests := []struct {
+		name         string
+		encoding     string
+		data         []byte
+		noDecompress bool
+		want         string
+	}{
+		{"gzip", "gzip", gz.Bytes(), false, body},
+		{"x-gzip", "x-gzip", gz.Bytes(), false, body},
+		{"zlib deflate", "deflate", zl.Bytes(), false, body},
+		{"raw deflate", "deflate", raw.Bytes(), false, body},
+		{"no-decompress", "gzip", gz.Bytes(), true, gz.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.Header().Set("Content-Length", fmt.Sprint(len(tt.data)))
+				w.Write(tt.data)
+			}))
+			defer srv.Close()
+
+			// An explicit Accept-Encoding stops the transport decompressing
+			opts := &DownloadOptions{
+				Client:       srv.Client(),
+				Header:       http.Header{"Accept-Encoding": {"gzip, deflate"}},
+				NoDecompress: tt.noDecompress,
+			}
+			var offset, total int64
+			var progress countingWriter
+			result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/page.txt"}, t.TempDir(), "", func(_ string, off, n int64) io.Writer {
+				offset, total = off, n
+				return &progress
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(result.Path); string(data) != tt.want {
+				t.Errorf("file has %d bytes, want %d", len(data), len(tt.want))
+			}
+			// Progress follows the encoded bytes so it matches Content-Length.
+			// The decompressor may have read some before progress started.
+			if got := offset + progress.n; total != int64(len(tt.data)) || got != total {
+				t.Errorf("progress %d of %d, want %d of %d", got, total, len(tt.data), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestDecompressProgressMidway(t *testing.T) {
+	// Decompressed, the body is far bigger than its Content-Length
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	io.WriteString(gw, strings.Repeat("a", 1<<20))
+	gw.Close()
+	half := gz.Len() / 2
+
+	resume := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", fmt.Sprint(gz.Len()))
+		w.Write(gz.Bytes()[:half])
+		w.(http.Flusher).Flush()
+		<-resume
+		w.Write(gz.Bytes()[half:])
+	}))
+	defer srv.Close()
+
+	opts := &DownloadOptions{Client: srv.Client(), Header: http.Header{"Accept-Encoding": {"gzip"}}}
+	progress := &percentWriter{reached: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/big.txt"}, t.TempDir(), "", func(_ string, off, total int64) io.Writer {
+			progress.start(off, total)
+			return progress
+		})
+		done <- err
+	}()
+
+	// Wait until everything sent so far is counted
+	<-progress.reached
+	var last float64
+	for {
+		time.Sleep(20 * time.Millisecond)
+		if p := progress.percent(); p == last {
+			break
+		} else {
+			last = p
+		}
+	}
+	if wire := 100 * float64(half) / float64(gz.Len()); last > wire || last < wire/2 {
+		t.Errorf("progress at half the wire bytes is %.1f%%, want about %.1f%%", last, wire)
+	}
+	close(resume)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if p := progress.percent(); p != 100 {
+		t.Errorf("final progress %.1f%%, want 100%%", p)
+	}
+}
+
+// percentWriter is a progress writer that reports the percentage done. It
+// closes reached once progress starts.
+type percentWriter struct {
+	mu          sync.Mutex
+	done, total int64
+	reached     chan struct{}
+	once        sync.Once
+}
+
+func (w *percentWriter) start(offset, total int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done, w.total = offset, total
+	w.once.Do(func() { close(w.reached) })
+}
+
+func (w *percentWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.done += int64(len(p))
+	w.mu.Unlock()
+	return len(p), nil
+}
+
+func (w *percentWriter) percent() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return 100 * float64(w.done) / float64(w.total)
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestCheckContentType(t *testing.T) {
+	html := "<!DOCTYPE html><html><body>404 - page not found</body></html>"
+	binary := "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00binary"
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expectType  string
+		wantErr     bool
+		wantWarning string
+	}{
+		{"HTML with -expect-type", "text/html; charset=utf-8", html, "application/octet-stream", true, ""},
+		{"mislabelled HTML with -expect-type", "application/x-unknown", html, "application/octet-stream", true, ""},
+		{"binary with -expect-type", "application/octet-stream", binary, "application/octet-stream", false, ""},
+		{"other binary type with -expect-type", "application/x-executable", binary, "application/octet-stream", false, "differs from -expect-type"},
+		{"HTML without -expect-type", "text/html", html, "", false, "looks like an HTML page"},
+		{"undeclared HTML without -expect-type", "", html, "", false, "looks like an HTML page"},
+		{"binary without -expect-type", "application/octet-stream", binary, "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// An empty value stops net/http sniffing a type itself
+				w.Header()["Content-Type"] = []string{tt.contentType}
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+			dir := t.TempDir()
+			opts := &DownloadOptions{Client: srv.Client(), ExpectType: tt.expectType}
+			result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, dir, "", noProgress)
+			if tt.wantErr {
+				if !errors.Is(err, errUnexpectedType) {
+					t.Fatalf("err = %v, want errUnexpectedType", err)
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("rejected download left %s", entries[0].Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(result.Path); string(data) != tt.body {
+				t.Errorf("file = %q, want the whole body", data)
+			}
+			if tt.wantWarning == "" && strings.Contains(logs.String(), "WARN") {
+				t.Errorf("unexpected warning: %s", logs.String())
+			}
+			if !strings.Contains(logs.String(), tt.wantWarning) {
+				t.Errorf("logs %q, want a warning containing %q", logs.String(), tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestSkipExisting(t *testing.T) {
+	body := "server content"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256([]byte(body))
+	bodySum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name         string
+		onDisk       string
+		sha256       string
+		wantExisting bool
+	}{
+		// The same size is taken as the same file, so its bytes are kept
+		{"same size", "local content!", "", true},
+		{"different size", "short", "", false},
+		{"matching stored hash", body, bodySum, true},
+		{"same size but another stored hash", "local content!", bodySum, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeTestFile(t, dir, "file.bin", []byte(tt.onDisk))
+			opts := &DownloadOptions{Client: srv.Client(), SkipExisting: true, ExistingSHA256: tt.sha256, Overwrite: true}
+			result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, dir, "", noProgress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Existing != tt.wantExisting {
+				t.Errorf("Existing = %t, want %t", result.Existing, tt.wantExisting)
+			}
+			want := body
+			if tt.wantExisting {
+				want = tt.onDisk
+				if s := sha256.Sum256([]byte(tt.onDisk)); result.SHA256 != hex.EncodeToString(s[:]) {
+					t.Errorf("SHA256 = %q, want the file's hash for the history", result.SHA256)
+				}
+			}
+			if data, _ := os.ReadFile(path); string(data) != want {
+				t.Errorf("file = %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestCollision(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	}))
+	defer srv.Close()
+	rawURL := srv.URL + "/file.zip"
+
+	tests := []struct {
+		mode     string
+		wantFile string // where the download goes; "" when it's skipped
+	}{
+		{"", "file_" + urlHash(rawURL) + ".zip"},
+		{CollisionHash, "file_" + urlHash(rawURL) + ".zip"},
+		{CollisionNumber, "file (2).zip"},
+		{CollisionOverwrite, "file.zip"},
+		{CollisionSkip, ""},
+	}
+	for _, tt := range tests {
+		t.Run(cmp.Or(tt.mode, "default"), func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, dir, "file.zip", []byte("old"))
+			writeTestFile(t, dir, "file (1).zip", []byte("older"))
+
+			opts := &DownloadOptions{Client: srv.Client(), Collision: tt.mode}
+			result, err := opts.FetchMirrors(context.Background(), []string{rawURL}, dir, "", noProgress)
+			if tt.wantFile == "" {
+				if !errors.Is(err, ErrFileExists) {
+					t.Errorf("err = %v, want ErrFileExists", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if result.Path != filepath.Join(dir, tt.wantFile) {
+				t.Errorf("saved to %s, want %s", filepath.Base(result.Path), tt.wantFile)
+			}
+
+			want := map[string]string{"file.zip": "old", "file (1).zip": "older"}
+			if tt.wantFile != "" {
+				want[tt.wantFile] = "new"
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != len(want) {
+				t.Errorf("%d files in the directory, want %d", len(entries), len(want))
+			}
+			for name, content := range want {
+				if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != content {
+					t.Errorf("%s = %q, want %q", name, data, content)
+				}
+			}
+		})
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", len(r.URL.Path)*10))
+	}))
+	defer srv.Close()
+
+	type ask struct {
+		file      string
+		size      int64
+		overwrite bool
+	}
+	tests := []struct {
+		name    string
+		path    string // served as 10 bytes per character
+		exists  bool
+		answer  bool
+		wantAsk *ask
+	}{
+		{"small new file", "/a", false, false, nil},
+		{"over -confirm-over, declined", "/big.iso", false, false, &ask{"big.iso", 80, false}},
+		{"over -confirm-over, accepted", "/big.iso", false, true, &ask{"big.iso", 80, false}},
+		{"overwrite, declined", "/a", true, false, &ask{"a", 20, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.exists {
+				writeTestFile(t, dir, filepath.Base(tt.path), []byte("old"))
+			}
+			var asked *ask
+			opts := &DownloadOptions{
+				Client:      srv.Client(),
+				Collision:   CollisionOverwrite,
+				ConfirmOver: 50,
+				Confirm: func(outputPath string, size int64, overwrite bool) bool {
+					asked = &ask{filepath.Base(outputPath), size, overwrite}
+					return tt.answer
+				},
+			}
+			_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + tt.path}, dir, "", noProgress)
+			if (asked == nil) != (tt.wantAsk == nil) || asked != nil && *asked != *tt.wantAsk {
+				t.Errorf("asked %+v, want %+v", asked, tt.wantAsk)
+			}
+			declined := tt.wantAsk != nil && !tt.answer
+			if declined != errors.Is(err, ErrDeclined) || !declined && err != nil {
+				t.Errorf("err = %v, declined %t", err, declined)
+			}
+			if declined {
+				// Only the existing file, if any, and no .part
+				want := 0
+				if tt.exists {
+					want = 1
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) != want {
+					t.Errorf("%d files after declining, want %d", len(entries), want)
+				}
+			}
+		})
+	}
+}
+
+func TestOutputError(t *testing.T) {
+	dir := t.TempDir()
+	gone := filepath.Join(dir, "unmounted")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"permission", &fs.PathError{Op: "open", Path: filepath.Join(dir, "a.part"), Err: syscall.EACCES}, true},
+		{"read-only filesystem", &fs.PathError{Op: "open", Path: filepath.Join(dir, "a.part"), Err: syscall.EROFS}, true},
+		{"disk full", &fs.PathError{Op: "write", Path: filepath.Join(dir, "a.part"), Err: syscall.ENOSPC}, true},
+		{"rename", &os.LinkError{Op: "rename", Old: "a.part", New: filepath.Join(dir, "a"), Err: syscall.EACCES}, true},
+		{"directory gone", &fs.PathError{Op: "open", Path: filepath.Join(gone, "a.part"), Err: syscall.ENOENT}, true},
+		{"file gone", &fs.PathError{Op: "open", Path: filepath.Join(dir, "a.part"), Err: syscall.ENOENT}, false},
+		{"network", errors.New("connection reset by peer"), false},
+	}
+	for _, tt := range tests {
+		err := OutputError(tt.err)
+		if got := errors.Is(err, ErrOutputUnwritable); got != tt.want {
+			t.Errorf("%s: unwritable = %t, want %t (%v)", tt.name, got, tt.want, err)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: original error lost: %v", tt.name, err)
+		}
+	}
+}
+
+func TestFetchUnwritable(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	// The output directory went away, as with an unmounted drive
+	dir := filepath.Join(t.TempDir(), "downloads")
+	opts := &DownloadOptions{Client: srv.Client(), Retries: 2}
+	_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/a.iso", srv.URL + "/mirror/a.iso"}, dir, "", noProgress)
+	if !errors.Is(err, ErrOutputUnwritable) {
+		t.Fatalf("err = %v, want ErrOutputUnwritable", err)
+	}
+	// Neither a retry nor another mirror can fix it
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+}
+
+func TestWriteChecksum(t *testing.T) {
+	body := []byte("checksum me")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), WriteChecksum: true}
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/app image.iso"}, dir, "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.PostProcess(context.Background(), result); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(result.Path + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+	// sha256sum's format: the hex digest, two spaces and the file name
+	want := hex.EncodeToString(sum[:]) + "  app image.iso\n"
+	if string(data) != want {
+		t.Errorf("sidecar = %q, want %q", data, want)
+	}
+
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Log("sha256sum not installed; not checking the sidecar with it")
+		return
+	}
+	cmd := exec.Command("sha256sum", "-c", filepath.Base(result.Path)+".sha256")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("sha256sum -c: %v: %s", err, out)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 100_000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	for _, size := range []int{0, MinBufferSize, 1 << 20} {
+		opts := &DownloadOptions{Client: srv.Client(), BufferSize: size}
+		result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/big.bin"}, t.TempDir(), "", noProgress)
+		if err != nil {
+			t.Fatalf("buffer %d: %v", size, err)
+		}
+		if data, _ := os.ReadFile(result.Path); !bytes.Equal(data, body) {
+			t.Errorf("buffer %d: file differs from the body (%d of %d bytes)", size, len(data), len(body))
+		}
+	}
+}
+
+// BenchmarkFetchBufferSize compares io.Copy's default buffer with larger
+// -buffer-size values on a 64 MiB download from a local server.
+func BenchmarkFetchBufferSize(b *testing.B) {
+	body := make([]byte, 64<<20)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	for _, size := range []int{0, 256 << 10, 4 << 20} {
+		name := "default"
+		if size > 0 {
+			name = fmt.Sprintf("%dK", size>>10)
+		}
+		b.Run(name, func(b *testing.B) {
+			opts := &DownloadOptions{Client: srv.Client(), BufferSize: size, Overwrite: true}
+			dir := b.TempDir()
+			b.SetBytes(int64(len(body)))
+			for b.Loop() {
+				if _, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/big.bin"}, dir, "", noProgress); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPreallocateResumes(t *testing.T) {
+	// A stall keeps the preallocated .part for the retry, which must resume
+	// from the bytes received rather than the reserved size
+	body := strings.Repeat("0123456789", 100)
+	srv, ranges := stallingServer(t, body)
+	opts := &DownloadOptions{Client: srv.Client(), Preallocate: true, StallTimeout: 100 * time.Millisecond, Retries: 1}
+
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, t.TempDir(), "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != body {
+		t.Errorf("file has %d bytes, want the %d byte body", len(data), len(body))
+	}
+	want := []string{"", fmt.Sprintf("bytes=%d-", len(body)/2)}
+	if got := ranges(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Range headers = %q, want %q", got, want)
+	}
+}
+
+func TestDenyTypes(t *testing.T) {
+	tests := []struct {
+		contentType string
+		deny        []string
+		wantDenied  bool
+	}{
+		{"text/html; charset=utf-8", []string{"text/html"}, true},
+		{"TEXT/HTML", []string{"text/html"}, true},
+		{"application/json", []string{"text/html", "application/json"}, true},
+		{"text/plain", []string{"text/"}, true},
+		{"application/octet-stream", []string{"text/html", "application/json"}, false},
+		{"application/zip", []string{"application/json"}, false},
+		{"", []string{"text/html"}, false},
+		{"text/html", nil, false},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["Content-Type"] = []string{tt.contentType}
+			io.WriteString(w, "\x00\x01 file data")
+		}))
+		dir := t.TempDir()
+		opts := &DownloadOptions{Client: srv.Client(), DenyTypes: tt.deny}
+		_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, dir, "", noProgress)
+		srv.Close()
+
+		entries, _ := os.ReadDir(dir)
+		if tt.wantDenied {
+			if !errors.Is(err, errUnexpectedType) || !strings.Contains(err.Error(), "-deny-type") {
+				t.Errorf("%q with -deny-type %q: err = %v, want it refused", tt.contentType, tt.deny, err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("%q with -deny-type %q: refused download left %s", tt.contentType, tt.deny, entries[0].Name())
+			}
+		} else if err != nil || len(entries) != 1 {
+			t.Errorf("%q with -deny-type %q: err = %v, %d files; want it downloaded", tt.contentType, tt.deny, err, len(entries))
+		}
+	}
+}
+
+func TestFlat(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="dir/sub/file.bin"`)
+		io.WriteString(w, "nested")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		opts     DownloadOptions
+		wantPath string
+	}{
+		{"default sanitizing", DownloadOptions{}, "dir_sub_file.bin"},
+		{"flat", DownloadOptions{Flat: "-"}, "dir-sub-file.bin"},
+		// -flat also joins the directories -out-template adds
+		{"flat template", DownloadOptions{Flat: "-", OutTemplate: "{host}/{name}"}, "127.0.0.1-dir-sub-file.bin"},
+		{"template", DownloadOptions{OutTemplate: "{host}/{name}"}, filepath.Join("127.0.0.1", "dir_sub_file.bin")},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		opts := tt.opts
+		opts.Client, opts.ContentDisposition = srv.Client(), true
+		result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/download?id=1"}, dir, "", noProgress)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if want := filepath.Join(dir, tt.wantPath); result.Path != want {
+			t.Errorf("%s: saved to %s, want %s", tt.name, result.Path, want)
+		}
+		if data, _ := os.ReadFile(result.Path); string(data) != "nested" {
+			t.Errorf("%s: file = %q", tt.name, data)
+		}
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	// The server promises 1000 bytes, sends 10 and closes the connection
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 1000\r\nConnection: close\r\n\r\n0123456789")
+		buf.Flush()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client()}
+	_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/short.bin"}, dir, "", noProgress)
+	if !errors.Is(err, errIncomplete) || !strings.Contains(err.Error(), "got 10 of 1000 bytes") {
+		t.Errorf("err = %v, want incomplete: got 10 of 1000 bytes", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "short.bin")); !os.IsNotExist(err) {
+		t.Error("truncated download was saved")
+	}
+}
+
+func TestInferExtension(t *testing.T) {
+	tests := []struct {
+		filename, contentType, want string
+	}{
+		{"123", "application/zip", "123.zip"},
+		{"123", "application/gzip", "123.gz"},
+		{"123", "application/x-iso9660-image", "123.iso"},
+		{"123", "image/jpeg", "123.jpg"},
+		{"123", "image/png", "123.png"},
+		{"123", "text/plain; charset=utf-8", "123.txt"},
+		{"123", "video/mp4", "123.mp4"},
+		{"123", "application/octet-stream", "123"},
+		{"123", "", "123"},
+		{"123", "not a type", "123"},
+		{"123", "application/x-unknown-to-mime", "123"},
+		{"archive.tar", "application/gzip", "archive.tar"},
+	}
+	for _, tt := range tests {
+		if got := inferExtension(tt.filename, tt.contentType); got != tt.want {
+			t.Errorf("inferExtension(%q, %q) = %q, want %q", tt.filename, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestInferExtFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		if r.URL.Path == "/attachment" {
+			w.Header().Set("Content-Disposition", `attachment; filename="release"`)
+		}
+		io.WriteString(w, "PK")
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), InferExt: true, ContentDisposition: true}
+
+	tests := []struct {
+		path, name, want string
+	}{
+		{"/download/123", "", "123.zip"},
+		{"/attachment", "", "release.zip"},
+		// A name chosen by the user is kept as given
+		{"/download/456", "mine", "mine"},
+		// The inferred name goes through collision handling
+		{"/other/123", "", "123_" + urlHash(srv.URL+"/other/123") + ".zip"},
+	}
+	for _, tt := range tests {
+		result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + tt.path}, dir, tt.name, noProgress)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if filepath.Base(result.Path) != tt.want {
+			t.Errorf("%s saved as %s, want %s", tt.path, filepath.Base(result.Path), tt.want)
+		}
+		if record := opts.HistoryRecord(srv.URL+tt.path, result, time.Time{}); filepath.Base(record.Filename) != tt.want {
+			t.Errorf("%s recorded as %s, want %s", tt.path, record.Filename, tt.want)
+		}
+	}
+}
+
+func TestFetchLongName(t *testing.T) {
+	long := strings.Repeat("ж", 150) + ".tar.gz"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": long}))
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	opts := &DownloadOptions{Client: srv.Client(), ContentDisposition: true, WriteChecksum: true}
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/download"}, t.TempDir(), "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(result.Path)
+	if len(name) > MaxNameLength || !strings.HasSuffix(name, ".gz") || !strings.HasPrefix(name, "жжж") {
+		t.Errorf("saved as %q (%d bytes)", name, len(name))
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != "data" {
+		t.Errorf("file = %q", data)
+	}
+}
+
+func TestPreserveMtime(t *testing.T) {
+	lastModified := time.Date(2020, 5, 17, 8, 30, 0, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/garbled.bin" {
+			w.Header().Set("Last-Modified", "last Tuesday")
+		} else {
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		}
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path     string
+		preserve bool
+		want     time.Time // zero for about now
+	}{
+		{"/a.bin", true, lastModified},
+		{"/b.bin", false, time.Time{}},
+		{"/garbled.bin", true, time.Time{}},
+	}
+	for _, tt := range tests {
+		opts := &DownloadOptions{Client: srv.Client(), PreserveMtime: tt.preserve}
+		before := time.Now().Add(-time.Second)
+		result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + tt.path}, t.TempDir(), "", noProgress)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		info, err := os.Stat(result.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mtime := info.ModTime(); !tt.want.IsZero() && !mtime.Equal(tt.want) || tt.want.IsZero() && mtime.Before(before) {
+			t.Errorf("%s with PreserveMtime %t: mtime %v, want %v", tt.path, tt.preserve, mtime, cmp.Or(tt.want, time.Now()))
+		}
+
+		// History keeps both the download time and the server's time
+		record := opts.HistoryRecord(srv.URL+tt.path, result, time.Time{})
+		if tt.path == "/a.bin" && (record.LastModified != lastModified.Format(http.TimeFormat) || record.Downloaded.Before(before)) {
+			t.Errorf("record has Last-Modified %q, downloaded %v", record.LastModified, record.Downloaded)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Package downloader downloads files over HTTP(S), FTP(S) and S3 and keeps a
+// history of what was downloaded. It is the core of the umbrel-downloader
+// CLI and web server (package web).
+//
+// Downloader is the entry point for other programs:
+//
+//	d, err := downloader.New(downloader.WithOutputDir("/downloads"))
+//	if err != nil {
+//		return err
+//	}
+//	result, err := d.Download(ctx, "https://example.com/file.zip")
+//
+// DownloadOptions holds every setting the CLI has a flag for; WithOptions
+// reaches the ones without an Option of their own.
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Downloader downloads URLs into a directory the way the CLI does: URLs and
+// file names already in the history are skipped, "URL|MIRROR" lists and
+// Mirrors fail over, and finished downloads are post-processed and recorded.
+// It is safe for concurrent use.
+type Downloader struct {
+	outputDir string
+	store     Store
+	opts      DownloadOptions
+
+	// Per download
+	name     string
+	progress ProgressFunc
+}
+
+// Option configures a Downloader when passed to New, or a single download
+// when passed to Download.
+type Option func(*Downloader)
+
+// WithOutputDir sets the directory downloads are saved in, "." by default.
+func WithOutputDir(dir string) Option {
+	return func(d *Downloader) { d.outputDir = dir }
+}
+
+// WithStore records downloads in store and skips URLs and file names it
+// already has. Without a store nothing is skipped or recorded.
+func WithStore(store Store) Option {
+	return func(d *Downloader) { d.store = store }
+}
+
+// WithClient sets the HTTP client. The default comes from NewHTTPClient
+// with a zero ClientConfig.
+func WithClient(client *http.Client) Option {
+	return func(d *Downloader) { d.opts.Client = client }
+}
+
+// WithFetcher opens URLs through f instead of the HTTP client.
+func WithFetcher(f Fetcher) Option {
+	return func(d *Downloader) { d.opts.Fetcher = f }
+}
+
+// WithRetries sets how many more times each URL is tried before moving on
+// to the next mirror.
+func WithRetries(n int) Option {
+	return func(d *Downloader) { d.opts.Retries = n }
+}
+
+// WithFilename saves the download under name instead of a name derived
+// from the URL.
+func WithFilename(name string) Option {
+	return func(d *Downloader) { d.name = name }
+}
+
+// WithSHA256 requires the download to have the hex SHA-256 digest sum.
+func WithSHA256(sum string) Option {
+	return func(d *Downloader) { d.opts.ExpectSHA256 = sum }
+}
+
+// WithProgress has f called when a download's file is ready; it returns the
+// writer that receives a copy of every chunk.
+func WithProgress(f ProgressFunc) Option {
+	return func(d *Downloader) { d.progress = f }
+}
+
+// WithOptions applies fn to the download options, for settings that have
+// no Option of their own.
+func WithOptions(fn func(*DownloadOptions)) Option {
+	return func(d *Downloader) { fn(&d.opts) }
+}
+
+// New returns a Downloader configured by opts. The output directory is
+// created if it doesn't exist.
+func New(opts ...Option) (*Downloader, error) {
+	d := &Downloader{outputDir: "."}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.opts.Client == nil {
+		client, err := NewHTTPClient(ClientConfig{})
+		if err != nil {
+			return nil, err
+		}
+		d.opts.Client = client
+	}
+	if err := os.MkdirAll(d.outputDir, 0755); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Result is the outcome of Downloader.Download.
+type Result struct {
+	DownloadRecord      // what was recorded in history; Filename is the file's path
+	Skipped        bool // already downloaded; the record is the earlier one
+}
+
+// Download downloads rawURL, which may list mirrors as "URL|MIRROR|...".
+// opts apply to this download only. A URL or file name the store already
+// has is skipped, with Skipped set and the earlier record returned.
+func (d *Downloader) Download(ctx context.Context, rawURL string, opts ...Option) (Result, error) {
+	dl := *d
+	for _, opt := range opts {
+		opt(&dl)
+	}
+	o := &dl.opts
+
+	urls := SplitMirrors(rawURL)
+	if len(urls) == 0 {
+		return Result{}, errors.New("missing URL")
+	}
+	for i, u := range urls {
+		valid, err := ValidateURL(u, o.AssumeHTTPS)
+		if err != nil {
+			return Result{}, err
+		}
+		urls[i] = valid
+	}
+	rawURL = urls[0]
+
+	filename := FilenameFromURL(rawURL)
+	if dl.name != "" {
+		if filename = SanitizeFilename(dl.name); filename == "" {
+			return Result{}, fmt.Errorf("invalid output filename %q", dl.name)
+		}
+	}
+	if dl.store != nil {
+		if record, ok := dl.store.Get(o.HistoryKey(rawURL)); ok {
+			return Result{DownloadRecord: record, Skipped: true}, nil
+		}
+		if u, ok := dl.store.Files()[filename]; ok {
+			record, _ := dl.store.Get(u)
+			return Result{DownloadRecord: record, Skipped: true}, nil
+		}
+	}
+	// With ContentDisposition or InferExt the response may change the name
+	fixedName := filename
+	if dl.name == "" && (o.ContentDisposition || o.InferExt) {
+		fixedName = ""
+	}
+	progress := dl.progress
+	if progress == nil {
+		progress = func(string, int64, int64) io.Writer { return io.Discard }
+	}
+
+	started := time.Now()
+	result, err := o.FetchMirrors(ctx, urls, dl.outputDir, fixedName, progress)
+	if err == nil {
+		err = o.PostProcess(ctx, result)
+	}
+	o.Notify(rawURL, filename, result, err)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if result.Existing {
+		started = time.Time{}
+	}
+	record := o.HistoryRecord(rawURL, result, started)
+	if o.KeepVersions > 0 {
+		record.Versions = ListVersions(result.Path)
+	}
+	if dl.store != nil {
+		if err := dl.store.Put(filename, record); err != nil {
+			return Result{DownloadRecord: record}, err
+		}
+	}
+	return Result{DownloadRecord: record, Skipped: result.Existing}, nil
+}
+
+// PostProcess runs the steps o asks for after a new download: signature
+// verification, extraction and the checksum file. A file that was already
+// on disk is left alone.
+func (o *DownloadOptions) PostProcess(ctx context.Context, result *DownloadResult) error {
+	if result.Existing {
+		return nil
+	}
+	if o.VerifyKey != nil {
+		if err := o.verifySignature(ctx, result); err != nil {
+			return err
+		}
+	}
+	if o.Extract {
+		o.extract(result)
+	}
+	if o.WriteChecksum {
+		o.writeChecksum(result)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package downloader_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"umbrel-downloader/downloader"
+)
+
+// newServer serves body at every path and counts the requests.
+func newServer(t *testing.T, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func newDownloader(t *testing.T, opts ...downloader.Option) (*downloader.Downloader, string) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := downloader.OpenStore("", filepath.Join(dir, "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	out := filepath.Join(dir, "out")
+	d, err := downloader.New(append([]downloader.Option{downloader.WithOutputDir(out), downloader.WithStore(store)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, out
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDownload(t *testing.T) {
+	srv, _ := newServer(t, "hello")
+	d, out := newDownloader(t)
+
+	result, err := d.Download(context.Background(), srv.URL+"/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Skipped {
+		t.Error("Skipped = true for a new download")
+	}
+	if want := filepath.Join(out, "hello.txt"); result.Filename != want {
+		t.Errorf("Filename = %q, want %q", result.Filename, want)
+	}
+	if result.Size != 5 {
+		t.Errorf("Size = %d, want 5", result.Size)
+	}
+	if got := readFile(t, filepath.Join(out, "hello.txt")); got != "hello" {
+		t.Errorf("file = %q, want %q", got, "hello")
+	}
+}
+
+func TestDownloadSkipsRepeat(t *testing.T) {
+	srv, hits := newServer(t, "hello")
+	d, _ := newDownloader(t)
+
+	first, err := d.Download(context.Background(), srv.URL+"/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.Download(context.Background(), srv.URL+"/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Skipped {
+		t.Error("Skipped = false for a URL in history")
+	}
+	if second.Filename != first.Filename {
+		t.Errorf("Filename = %q, want the earlier %q", second.Filename, first.Filename)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+}
+
+func TestDownloadMirrorFailover(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	mirror, _ := newServer(t, "from mirror")
+	d, out := newDownloader(t)
+
+	result, err := d.Download(context.Background(), broken.URL+"/a.bin|"+mirror.URL+"/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result.Mirror, mirror.URL) {
+		t.Errorf("Mirror = %q, want the mirror's URL", result.Mirror)
+	}
+	if got := readFile(t, filepath.Join(out, "a.bin")); got != "from mirror" {
+		t.Errorf("file = %q, want %q", got, "from mirror")
+	}
+}
+
+func TestDownloadWithFilename(t *testing.T) {
+	srv, _ := newServer(t, "data")
+	d, out := newDownloader(t)
+
+	if _, err := d.Download(context.Background(), srv.URL+"/download?id=7", downloader.WithFilename("report.csv")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(out, "report.csv")); got != "data" {
+		t.Errorf("file = %q, want %q", got, "data")
+	}
+}
+
+func TestDownloadSHA256(t *testing.T) {
+	srv, _ := newServer(t, "checked")
+	sum := sha256.Sum256([]byte("checked"))
+
+	t.Run("match", func(t *testing.T) {
+		d, _ := newDownloader(t)
+		result, err := d.Download(context.Background(), srv.URL+"/c.bin", downloader.WithSHA256(hex.EncodeToString(sum[:])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("SHA256 = %q, want %x", result.SHA256, sum)
+		}
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		d, out := newDownloader(t)
+		_, err := d.Download(context.Background(), srv.URL+"/c.bin", downloader.WithSHA256(strings.Repeat("0", 64)))
+		if err == nil {
+			t.Fatal("err = nil for a wrong checksum")
+		}
+		if _, err := os.Stat(filepath.Join(out, "c.bin")); !os.IsNotExist(err) {
+			t.Errorf("file kept after a checksum mismatch (stat err = %v)", err)
+		}
+	})
+}
+
+// fetcher serves one body for every URL.
+type fetcher string
+
+func (f fetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, int64, string, error) {
+	return io.NopCloser(strings.NewReader(string(f))), int64(len(f)), "", nil
+}
+
+func TestDownloadWithFetcher(t *testing.T) {
+	d, out := newDownloader(t, downloader.WithFetcher(fetcher("fetched")))
+
+	if _, err := d.Download(context.Background(), "https://example.com/f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(out, "f.txt")); got != "fetched" {
+		t.Errorf("file = %q, want %q", got, "fetched")
+	}
+}
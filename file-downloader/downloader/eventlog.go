@@ -0,0 +1,143 @@
+package downloader
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Download lifecycle events written to the -event-log audit file.
+const (
+	EventQueued    = "queued"
+	EventStarted   = "started"
+	EventProgress  = "progress" // at every 25% of a download with a known size
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	EventCancelled = "cancelled"
+)
+
+// Event is one line of the event log.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	ID    string    `json:"id,omitempty"` // web download ID
+	URL   string    `json:"url,omitempty"`
+	File  string    `json:"file,omitempty"`
+	Bytes int64     `json:"bytes,omitempty"` // received so far, or the final size
+	Total int64     `json:"total,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// EventLog appends events as JSON lines to a file, which is rotated to
+// PATH.1 once it grows past maxSize.
+type EventLog struct {
+	path    string
+	maxSize int64 // 0 disables rotation
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func OpenEventLog(path string, maxSize int64) (*EventLog, error) {
+	l := &EventLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *EventLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// write appends e, rotating first if the line would overflow the file.
+func (l *EventLog) write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		l.f.Close()
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// DefaultEventLog is the -event-log file shared by the CLI and web paths; nil
+// when the flag isn't set.
+var DefaultEventLog *EventLog
+
+// LogEvent records e in the event log, if there is one. Failures are logged
+// and otherwise ignored.
+func LogEvent(e Event) {
+	if DefaultEventLog == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := DefaultEventLog.write(e); err != nil {
+		slog.Warn("could not write event log", "error", err)
+	}
+}
+
+// milestoneWriter counts a download's bytes and logs an EventProgress each
+// time another quarter of total has arrived.
+type milestoneWriter struct {
+	event   Event
+	written int64
+	next    int64 // next milestone, in quarters
+}
+
+// NewMilestoneWriter returns a progress writer for the event log, starting
+// at offset bytes. It discards everything when there is no event log or the
+// size is unknown.
+func NewMilestoneWriter(id, rawURL, outputPath string, offset, total int64) io.Writer {
+	if DefaultEventLog == nil || total <= 0 {
+		return io.Discard
+	}
+	return &milestoneWriter{
+		event:   Event{Event: EventProgress, ID: id, URL: rawURL, File: outputPath, Total: total},
+		written: offset,
+		next:    offset*4/total + 1,
+	}
+}
+
+func (m *milestoneWriter) Write(p []byte) (int, error) {
+	m.written += int64(len(p))
+	for m.next < 4 && m.written*4 >= m.next*m.event.Total {
+		e := m.event
+		e.Bytes = m.written
+		LogEvent(e)
+		m.next++
+	}
+	return len(p), nil
+}
@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// readEvents returns the events in the log file at path.
+func readEvents(t *testing.T, path string) []Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("bad event line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// useEventLog makes an event log at path the DefaultEventLog for the test.
+func useEventLog(t *testing.T, path string, maxSize int64) {
+	t.Helper()
+	l, err := OpenEventLog(path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DefaultEventLog = l
+	t.Cleanup(func() {
+		DefaultEventLog = nil
+		l.f.Close()
+	})
+}
+
+func TestEventLogMilestones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	useEventLog(t, path, 0)
+
+	LogEvent(Event{Event: EventStarted, URL: "https://example.com/a.iso"})
+	w := NewMilestoneWriter("", "https://example.com/a.iso", "/downloads/a.iso", 0, 1000)
+	for range 10 {
+		w.Write(make([]byte, 100))
+	}
+	LogEvent(Event{Event: EventCompleted, URL: "https://example.com/a.iso", Bytes: 1000})
+
+	var kinds []string
+	var milestones []int64
+	for _, e := range readEvents(t, path) {
+		if e.Time.IsZero() {
+			t.Errorf("%s event without a time", e.Event)
+		}
+		kinds = append(kinds, e.Event)
+		if e.Event == EventProgress {
+			milestones = append(milestones, e.Bytes)
+		}
+	}
+	if want := []string{EventStarted, EventProgress, EventProgress, EventProgress, EventCompleted}; !slices.Equal(kinds, want) {
+		t.Errorf("events %q, want %q", kinds, want)
+	}
+	if want := []int64{300, 500, 800}; !slices.Equal(milestones, want) {
+		t.Errorf("milestones at %d bytes, want %d", milestones, want)
+	}
+
+	// A resumed download only logs the milestones still ahead
+	w = NewMilestoneWriter("", "https://example.com/a.iso", "/downloads/a.iso", 600, 1000)
+	w.Write(make([]byte, 400))
+	events := readEvents(t, path)
+	if last := events[len(events)-1]; len(events) != 6 || last.Event != EventProgress || last.Bytes != 1000 {
+		t.Errorf("resumed at 60%%: %d events ending with %+v, want one more at 75%%", len(events), last)
+	}
+}
+
+func TestEventLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	useEventLog(t, path, 300)
+	for range 10 {
+		LogEvent(Event{Event: EventCompleted, URL: "https://example.com/a.iso", Bytes: 12345})
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 300 {
+		t.Errorf("log is %d bytes, over the 300 byte limit", info.Size())
+	}
+	current, rotated := readEvents(t, path), readEvents(t, path+".1")
+	if len(current) == 0 || len(rotated) == 0 {
+		t.Errorf("%d events in the log and %d in .1, want some in both", len(current), len(rotated))
+	}
+
+	// Reopening appends rather than truncating
+	useEventLog(t, path, 0)
+	LogEvent(Event{Event: EventFailed})
+	if n := len(readEvents(t, path)); n != len(current)+1 {
+		t.Errorf("%d events after reopening, want %d", n, len(current)+1)
+	}
+}
@@ -0,0 +1,85 @@
+package downloader
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxExpandedURLs caps how many URLs one pattern may expand into, so a typo
+// like [1-1000000] fails instead of queueing a million downloads.
+const maxExpandedURLs = 10000
+
+var (
+	// rangePattern matches a numeric range such as [01-20]
+	rangePattern = regexp.MustCompile(`\[(\d+)-(\d+)\]`)
+	// bracePattern matches an alternation such as {a,b,c}
+	bracePattern = regexp.MustCompile(`\{([^{}]*,[^{}]*)\}`)
+)
+
+// ExpandURLs expands the range and brace patterns in each line (see
+// expandPattern). Lines without patterns are kept as they are.
+func ExpandURLs(lines []string) ([]string, error) {
+	var urls []string
+	for _, line := range lines {
+		expanded, err := expandPattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", line, err)
+		}
+		urls = append(urls, expanded...)
+	}
+	return urls, nil
+}
+
+// expandPattern expands numbered ranges like "file-[01-20].bin" and
+// alternations like "{x86,arm64}" into every combination, in order. A range
+// whose start has a leading zero is zero-padded to the start's width.
+func expandPattern(s string) ([]string, error) {
+	r := rangePattern.FindStringSubmatchIndex(s)
+	b := bracePattern.FindStringSubmatchIndex(s)
+	if r == nil && b == nil {
+		return []string{s}, nil
+	}
+
+	// Expand the leftmost pattern, then the rest of each result
+	var variants []string
+	var start, end int
+	if r != nil && (b == nil || r[0] < b[0]) {
+		start, end = r[0], r[1]
+		lo, hi := s[r[2]:r[3]], s[r[4]:r[5]]
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || from > to {
+			return nil, fmt.Errorf("invalid range [%s-%s]", lo, hi)
+		}
+		if to-from >= maxExpandedURLs {
+			return nil, fmt.Errorf("range [%s-%s] expands to more than %d URLs", lo, hi, maxExpandedURLs)
+		}
+		width := 0
+		if len(lo) > 1 && lo[0] == '0' {
+			width = len(lo)
+		}
+		for n := from; n <= to; n++ {
+			variants = append(variants, fmt.Sprintf("%0*d", width, n))
+		}
+	} else {
+		start, end = b[0], b[1]
+		variants = strings.Split(s[b[2]:b[3]], ",")
+	}
+
+	var urls []string
+	for _, v := range variants {
+		rest, err := expandPattern(s[end:])
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rest {
+			urls = append(urls, s[:start]+v+r)
+		}
+		if len(urls) > maxExpandedURLs {
+			return nil, fmt.Errorf("pattern expands to more than %d URLs", maxExpandedURLs)
+		}
+	}
+	return urls, nil
+}
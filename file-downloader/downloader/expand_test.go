@@ -0,0 +1,67 @@
+package downloader
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandPattern(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"https://h/file.bin", []string{"https://h/file.bin"}},
+		{"https://h/file-[1-3].bin", []string{"https://h/file-1.bin", "https://h/file-2.bin", "https://h/file-3.bin"}},
+		{"https://h/file-[08-11].bin", []string{"https://h/file-08.bin", "https://h/file-09.bin", "https://h/file-10.bin", "https://h/file-11.bin"}},
+		{"https://h/file-[001-002].bin", []string{"https://h/file-001.bin", "https://h/file-002.bin"}},
+		{"https://h/file-[9-10].bin", []string{"https://h/file-9.bin", "https://h/file-10.bin"}},
+		{"https://h/app-{x86,arm64}.tar", []string{"https://h/app-x86.tar", "https://h/app-arm64.tar"}},
+		{"https://h/{a,}b", []string{"https://h/ab", "https://h/b"}},
+		{"https://h/{v1,v2}/part-[1-2].bin", []string{
+			"https://h/v1/part-1.bin", "https://h/v1/part-2.bin",
+			"https://h/v2/part-1.bin", "https://h/v2/part-2.bin",
+		}},
+		{"https://h/[1-2]-{a,b}", []string{"https://h/1-a", "https://h/1-b", "https://h/2-a", "https://h/2-b"}},
+		// Not patterns: no comma in the braces, no range in the brackets
+		{"https://h/{single}/[x]", []string{"https://h/{single}/[x]"}},
+	}
+	for _, tt := range tests {
+		got, err := expandPattern(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExpandPatternErrors(t *testing.T) {
+	for _, in := range []string{
+		"https://h/file-[5-1].bin",
+		"https://h/file-[1-1000000].bin",
+		"https://h/[1-200]/[1-200]",
+	} {
+		if urls, err := expandPattern(in); err == nil {
+			t.Errorf("%s: %d URLs, want an error", in, len(urls))
+		}
+	}
+}
+
+func TestExpandURLs(t *testing.T) {
+	got, err := ExpandURLs([]string{"https://h/a.iso", "https://h/b-[1-2].iso"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://h/a.iso", "https://h/b-1.iso", "https://h/b-2.iso"}
+	if !slices.Equal(got, want) {
+		t.Errorf("%q, want %q", got, want)
+	}
+
+	_, err = ExpandURLs([]string{"https://h/a.iso", "https://h/b-[2-1].iso"})
+	if err == nil || !strings.Contains(err.Error(), "https://h/b-[2-1].iso") {
+		t.Errorf("error %v doesn't name the bad line", err)
+	}
+}
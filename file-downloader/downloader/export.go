@@ -0,0 +1,53 @@
+package downloader
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// csvHeader lists the columns written by WriteHistoryCSV.
+var csvHeader = []string{"url", "filename", "size", "downloaded", "sha256", "duration"}
+
+// WriteHistoryCSV writes records as CSV, one row per download in the order
+// given. sha256 and duration are left empty for records that don't have
+// them; duration is in seconds.
+func WriteHistoryCSV(w io.Writer, records []DownloadRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, r := range records {
+		var duration string
+		if r.Duration > 0 {
+			duration = strconv.FormatFloat(r.Duration.Seconds(), 'f', 3, 64)
+		}
+		cw.Write([]string{
+			r.URL,
+			r.Filename,
+			strconv.FormatInt(r.Size, 10),
+			r.Downloaded.Format(time.RFC3339),
+			r.SHA256,
+			duration,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportCSV writes the history to path for -export-csv, or to stdout when
+// path is "-".
+func ExportCSV(store Store, path string) error {
+	if path == "-" {
+		return WriteHistoryCSV(os.Stdout, store.All())
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteHistoryCSV(f, store.All()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
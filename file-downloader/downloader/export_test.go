@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWriteHistoryCSV(t *testing.T) {
+	when := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	records := []DownloadRecord{
+		{
+			URL:        "https://example.com/a.iso?x=1,2",
+			Filename:   `/downloads/report, "final".pdf`,
+			Downloaded: when,
+			Size:       1024,
+			SHA256:     "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			Duration:   1500 * time.Millisecond,
+		},
+		// An old record without a hash or timing
+		{URL: "https://example.com/b.iso", Filename: "/downloads/b\nc.iso", Downloaded: when.Add(-time.Hour), Size: 0},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteHistoryCSV(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV doesn't parse: %v\n%s", err, buf.String())
+	}
+	want := [][]string{
+		{"url", "filename", "size", "downloaded", "sha256", "duration"},
+		{"https://example.com/a.iso?x=1,2", `/downloads/report, "final".pdf`, "1024", "2024-03-01T10:30:00Z", records[0].SHA256, "1.500"},
+		{"https://example.com/b.iso", "/downloads/b\nc.iso", "0", "2024-03-01T09:30:00Z", "", ""},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("%d rows, want %d", len(rows), len(want))
+	}
+	for i := range want {
+		if !slices.Equal(rows[i], want[i]) {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore("", filepath.Join(dir, "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, day := range map[string]int{"old.iso": 1, "new.iso": 3, "mid.iso": 2} {
+		r := testRecord(name)
+		r.Downloaded = time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC)
+		store.Put(name, r)
+	}
+
+	path := filepath.Join(dir, "history.csv")
+	if err := ExportCSV(store, path); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, row := range rows[1:] {
+		names = append(names, filepath.Base(row[1]))
+	}
+	// Newest first, like the history list
+	if want := []string{"new.iso", "mid.iso", "old.iso"}; !slices.Equal(names, want) {
+		t.Errorf("rows for %q, want %q", names, want)
+	}
+}
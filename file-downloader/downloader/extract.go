@@ -0,0 +1,235 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errUnsupportedArchive is returned by extractArchive for files it can't
+// recognise as zip, tar or tar.gz.
+var errUnsupportedArchive = errors.New("unsupported archive type")
+
+type archiveKind int
+
+const (
+	archiveNone archiveKind = iota
+	archiveZip
+	archiveTar
+	archiveTarGz
+)
+
+// archiveExtensions maps supported suffixes to archive types, longest first
+// so ".tar.gz" wins over ".gz".
+var archiveExtensions = []struct {
+	ext  string
+	kind archiveKind
+}{
+	{".tar.gz", archiveTarGz},
+	{".tgz", archiveTarGz},
+	{".tar", archiveTar},
+	{".zip", archiveZip},
+}
+
+// detectArchive identifies an archive by extension and checks it against the
+// file's magic bytes. It returns the archive type and the file name with the
+// archive extension removed.
+func detectArchive(path string) (archiveKind, string, error) {
+	name := filepath.Base(path)
+	kind, base, ext := archiveNone, name, ""
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(strings.ToLower(name), e.ext) {
+			kind, base, ext = e.kind, name[:len(name)-len(e.ext)], e.ext
+			break
+		}
+	}
+	if kind == archiveNone {
+		return archiveNone, "", errUnsupportedArchive
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return archiveNone, "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 262)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+
+	var ok bool
+	switch kind {
+	case archiveZip:
+		ok = bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06"))
+	case archiveTarGz:
+		ok = bytes.HasPrefix(header, []byte{0x1f, 0x8b})
+	case archiveTar:
+		ok = len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar"))
+	}
+	if !ok {
+		return archiveNone, "", fmt.Errorf("%s does not look like a %s archive", name, ext)
+	}
+	return kind, base, nil
+}
+
+// extractArchive extracts the archive at path into a sibling directory named
+// after it and returns that directory. Entries that would land outside the
+// directory (zip-slip) and links are rejected.
+func extractArchive(path string) (string, error) {
+	kind, base, err := detectArchive(path)
+	if err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(filepath.Dir(path), base)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return "", err
+	}
+
+	switch kind {
+	case archiveZip:
+		err = extractZip(path, dest)
+	case archiveTar, archiveTarGz:
+		err = extractTar(path, dest, kind == archiveTarGz)
+	}
+	if err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// extract runs -extract on a finished download. Unsupported or broken
+// archives only produce a warning; the download itself still succeeds.
+func (o *DownloadOptions) extract(result *DownloadResult) {
+	dest, err := extractArchive(result.Path)
+	if err != nil {
+		slog.Warn("not extracting", "file", filepath.Base(result.Path), "error", err)
+		return
+	}
+	result.ExtractedTo = dest
+	slog.Info("extracted", "file", filepath.Base(result.Path), "dir", dest)
+
+	if o.ExtractRemove {
+		if err := os.Remove(result.Path); err != nil {
+			slog.Warn("could not remove archive", "file", result.Path, "error", err)
+		}
+	}
+}
+
+// safeJoin joins an archive entry name onto dest, refusing names that escape it.
+func safeJoin(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if target != dest && !strings.HasPrefix(target, dest+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+	return target, nil
+}
+
+func extractZip(path, dest string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		target, err := safeJoin(dest, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			slog.Warn("skipping non-regular file in archive", "name", f.Name)
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeExtracted(target, rc, f.Mode().Perm())
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(path, dest string, gzipped bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := safeJoin(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeExtracted(target, tr, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		default:
+			slog.Warn("skipping non-regular file in archive", "name", hdr.Name)
+		}
+	}
+}
+
+func writeExtracted(target string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if perm == 0 {
+		perm = 0644
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,158 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testArchiveFiles is the content of the archives built by zipArchive and
+// tarGzArchive.
+var testArchiveFiles = map[string]string{
+	"readme.txt":     "hello",
+	"docs/guide.txt": "nested",
+}
+
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarGzArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+// writeTestFile writes data to name in dir and returns its path.
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    func(*testing.T, map[string]string) []byte
+		wantDir string
+	}{
+		{"zip", "bundle.zip", zipArchive, "bundle"},
+		{"tar.gz", "bundle-1.0.tar.gz", tarGzArchive, "bundle-1.0"},
+		{"tgz", "bundle.TGZ", tarGzArchive, "bundle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeTestFile(t, dir, tt.file, tt.data(t, testArchiveFiles))
+
+			dest, err := extractArchive(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, tt.wantDir); dest != want {
+				t.Errorf("extracted to %q, want %q", dest, want)
+			}
+			for name, want := range testArchiveFiles {
+				got, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Error(err)
+				} else if string(got) != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArchiveRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data func(*testing.T) []byte
+	}{
+		{"zip slip", "evil.zip", func(t *testing.T) []byte {
+			return zipArchive(t, map[string]string{"../escaped.txt": "x"})
+		}},
+		{"tar slip", "evil.tar.gz", func(t *testing.T) []byte {
+			return tarGzArchive(t, map[string]string{"../../escaped.txt": "x"})
+		}},
+		{"wrong magic bytes", "fake.zip", func(t *testing.T) []byte {
+			return []byte("<html>not a zip</html>")
+		}},
+		{"unsupported type", "disk.iso", func(t *testing.T) []byte {
+			return []byte("data")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeTestFile(t, dir, tt.file, tt.data(t))
+			if _, err := extractArchive(path); err == nil {
+				t.Fatal("err = nil")
+			}
+			for _, escaped := range []string{filepath.Join(dir, "escaped.txt"), filepath.Join(filepath.Dir(dir), "escaped.txt")} {
+				if _, err := os.Stat(escaped); err == nil {
+					t.Errorf("entry written outside the extraction directory: %s", escaped)
+				}
+			}
+		})
+	}
+
+	path := writeTestFile(t, t.TempDir(), "disk.iso", []byte("data"))
+	if _, err := extractArchive(path); !errors.Is(err, errUnsupportedArchive) {
+		t.Errorf("err = %v, want errUnsupportedArchive", err)
+	}
+}
+
+func TestExtractRemove(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "bundle.zip", zipArchive(t, testArchiveFiles))
+	opts := &DownloadOptions{Extract: true, ExtractRemove: true}
+	result := &DownloadResult{Path: path}
+
+	if err := opts.PostProcess(context.Background(), result); err != nil {
+		t.Fatal(err)
+	}
+	if result.ExtractedTo != filepath.Join(dir, "bundle") {
+		t.Errorf("ExtractedTo = %q, want %q", result.ExtractedTo, filepath.Join(dir, "bundle"))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("archive not removed (stat err = %v)", err)
+	}
+}
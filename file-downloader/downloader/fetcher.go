@@ -0,0 +1,157 @@
+package downloader
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Fetcher opens a URL for downloading. It returns the body, its size or -1
+// when unknown, and the file name the source suggests, or "" to name the
+// file after the URL.
+//
+// Every attempt goes through DownloadOptions.Fetcher, HTTPFetcher when it
+// is unset. The body takes the same path as an HTTP response body:
+// progress, hashing, -max-size, the watchdogs, the .part file, -tee and
+// collisions. Ranges, resuming, segments and conditional requests need HTTP
+// and are only used through HTTPFetcher.
+type Fetcher interface {
+	Fetch(ctx context.Context, rawURL string) (body io.ReadCloser, size int64, filename string, err error)
+}
+
+// fileFetcher is a Fetcher that saves the file itself rather than handing
+// fetchWith a body, as HTTPFetcher does to use ranges and segments.
+type fileFetcher interface {
+	Fetcher
+	download(ctx context.Context, rawURL, outputDir, name string, newProgress ProgressFunc) (*DownloadResult, error)
+}
+
+// HTTPFetcher is the Fetcher for HTTP and the schemes Options.Client's
+// transport adds, using the client, headers, decompression and Content-Type
+// checks of Options. Fetch suggests the Content-Disposition file name when
+// Options.ContentDisposition is set.
+type HTTPFetcher struct {
+	Options *DownloadOptions
+}
+
+func (f HTTPFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, int64, string, error) {
+	o := f.Options
+	ctx, cancel := context.WithCancel(ctx)
+	resp, wire, err := o.get(ctx, rawURL, cancel)
+	if err != nil {
+		cancel()
+		return nil, 0, "", err
+	}
+	size := resp.ContentLength
+	if wire != nil {
+		size = -1 // Content-Length is the encoded size
+	}
+	var filename string
+	if o.ContentDisposition {
+		filename = o.Filename(rawURL, "", resp)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{resp.Body, closerFunc(func() error {
+		defer cancel()
+		return resp.Body.Close()
+	})}, size, filename, nil
+}
+
+// download is the full HTTP download: it resumes, splits into segments and
+// skips existing files as Options asks.
+func (f HTTPFetcher) download(ctx context.Context, rawURL, outputDir, name string, newProgress ProgressFunc) (*DownloadResult, error) {
+	return f.Options.fetch(ctx, rawURL, outputDir, name, newProgress)
+}
+
+// closerFunc is an io.Closer calling itself.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// fetcher returns the Fetcher attempts go through.
+func (o *DownloadOptions) fetcher() Fetcher {
+	if o.Fetcher != nil {
+		return o.Fetcher
+	}
+	return HTTPFetcher{Options: o}
+}
+
+// fetchWith downloads rawURL through f into outputDir, saving it as name,
+// else the name f suggests, else one derived from the URL. A fileFetcher
+// saves the file itself.
+func (o *DownloadOptions) fetchWith(ctx context.Context, f Fetcher, rawURL, outputDir, name string, newProgress ProgressFunc) (*DownloadResult, error) {
+	if ff, ok := f.(fileFetcher); ok {
+		return ff.download(ctx, rawURL, outputDir, name, newProgress)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	body, total, suggested, err := f.Fetch(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	filename := cmp.Or(name, suggested, FilenameFromURL(rawURL))
+	if o.Flat != "" {
+		filename = flatten(filename, o.Flat)
+	}
+	if filename = SanitizeFilename(filename); filename == "" {
+		filename = urlHash(rawURL)
+	}
+	outputPath := o.OutputPath(rawURL, outputDir, filename)
+	if o.OutTemplate != "" {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.checkSpace(filepath.Dir(outputPath), total); err != nil {
+		return nil, err
+	}
+	if !o.Overwrite {
+		if outputPath, err = o.CollisionPath(rawURL, outputPath); err != nil {
+			return nil, err
+		}
+	}
+	if o.Confirm != nil {
+		_, statErr := os.Stat(outputPath)
+		overwrite := statErr == nil
+		if (overwrite || o.ConfirmOver > 0 && total > o.ConfirmOver) && !o.Confirm(outputPath, total, overwrite) {
+			return nil, fmt.Errorf("%w: %s", ErrDeclined, outputPath)
+		}
+	}
+
+	out, err := o.createPart(PartPath(outputPath))
+	if err != nil {
+		return nil, err
+	}
+	if err := o.allocate(out, total); err != nil {
+		out.Close()
+		os.Remove(PartPath(outputPath))
+		return nil, err
+	}
+
+	// save reads the body like an HTTP response's; a Fetcher has no
+	// headers to offer
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		out.Close()
+		os.Remove(PartPath(outputPath))
+		return nil, err
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          body,
+		ContentLength: total,
+		Request:       &http.Request{URL: u},
+	}
+	return o.save(ctx, resp, out, outputPath, 0, total, false, nil, newProgress, cancel)
+}
@@ -0,0 +1,172 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeFetcher serves bodies from memory and records the URLs it was asked
+// for. A URL without a body fails.
+type fakeFetcher struct {
+	bodies map[string]string
+	names  map[string]string
+	calls  []string
+}
+
+func (f *fakeFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, int64, string, error) {
+	f.calls = append(f.calls, rawURL)
+	body, ok := f.bodies[rawURL]
+	if !ok {
+		return nil, 0, "", &statusError{Code: http.StatusInternalServerError, Status: "500 Internal Server Error", URL: rawURL}
+	}
+	return io.NopCloser(strings.NewReader(body)), int64(len(body)), f.names[rawURL], nil
+}
+
+func TestFetchMirrorsFetcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		urls     []string
+		bodies   map[string]string
+		names    map[string]string
+		wantFile string
+		wantBody string
+		wantURL  string
+		wantErr  bool
+	}{
+		{
+			name:     "primary",
+			urls:     []string{"https://example.com/a.bin"},
+			bodies:   map[string]string{"https://example.com/a.bin": "primary"},
+			wantFile: "a.bin",
+			wantBody: "primary",
+			wantURL:  "https://example.com/a.bin",
+		},
+		{
+			name:     "mirror after failure",
+			urls:     []string{"https://example.com/a.bin", "https://mirror.example.com/a.bin"},
+			bodies:   map[string]string{"https://mirror.example.com/a.bin": "mirror"},
+			wantFile: "a.bin",
+			wantBody: "mirror",
+			wantURL:  "https://mirror.example.com/a.bin",
+		},
+		{
+			name:     "suggested name",
+			urls:     []string{"https://example.com/download?id=1"},
+			bodies:   map[string]string{"https://example.com/download?id=1": "named"},
+			names:    map[string]string{"https://example.com/download?id=1": "report.pdf"},
+			wantFile: "report.pdf",
+			wantBody: "named",
+			wantURL:  "https://example.com/download?id=1",
+		},
+		{
+			name:    "all fail",
+			urls:    []string{"https://example.com/a.bin"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fetcher := &fakeFetcher{bodies: tt.bodies, names: tt.names}
+			opts := &DownloadOptions{Fetcher: fetcher}
+			discard := func(string, int64, int64) io.Writer { return io.Discard }
+
+			result, err := opts.FetchMirrors(context.Background(), tt.urls, dir, "", discard)
+			if tt.wantErr {
+				var se *statusError
+				if !errors.As(err, &se) {
+					t.Fatalf("err = %v, want a statusError", err)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "a.bin.part")); err == nil {
+					t.Error("the .part file was left behind")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, tt.wantFile); result.Path != want {
+				t.Errorf("Path = %q, want %q", result.Path, want)
+			}
+			if result.URL != tt.wantURL {
+				t.Errorf("URL = %q, want %q", result.URL, tt.wantURL)
+			}
+			if result.Size != int64(len(tt.wantBody)) {
+				t.Errorf("Size = %d, want %d", result.Size, len(tt.wantBody))
+			}
+			data, err := os.ReadFile(result.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantBody {
+				t.Errorf("file holds %q, want %q", data, tt.wantBody)
+			}
+			if len(fetcher.calls) != len(tt.urls) {
+				t.Errorf("fetched %v, want one call per URL", fetcher.calls)
+			}
+		})
+	}
+}
+
+func TestHTTPFetcher(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "test-agent" {
+			http.Error(w, "bad agent", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="data.bin"`)
+		io.WriteString(w, "payload")
+	}))
+	defer srv.Close()
+
+	opts := &DownloadOptions{Client: srv.Client(), UserAgent: "test-agent", ContentDisposition: true}
+	body, size, name, err := HTTPFetcher{Options: opts}.Fetch(context.Background(), srv.URL+"/get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "payload" || size != int64(len(data)) || name != "data.bin" {
+		t.Errorf("got %q, size %d, name %q", data, size, name)
+	}
+
+	opts.UserAgent = "other"
+	if _, _, _, err := (HTTPFetcher{Options: opts}).Fetch(context.Background(), srv.URL+"/get"); err == nil {
+		t.Error("a 403 didn't fail")
+	}
+}
+
+func TestDefaultFetcher(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "payload")
+	}))
+	defer srv.Close()
+
+	opts := &DownloadOptions{Client: srv.Client(), SkipExisting: true}
+	if _, ok := opts.fetcher().(HTTPFetcher); !ok {
+		t.Fatalf("default fetcher is %T, want HTTPFetcher", opts.fetcher())
+	}
+	// Through the Fetcher the full HTTP download still runs, so
+	// -skip-existing finds the first download's file
+	dir := t.TempDir()
+	for _, wantExisting := range []bool{false, true} {
+		result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/a.bin"}, dir, "", noProgress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Existing != wantExisting || result.Size != 7 {
+			t.Errorf("result %+v, want existing %t", result, wantExisting)
+		}
+	}
+}
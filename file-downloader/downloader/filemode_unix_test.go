@@ -0,0 +1,78 @@
+//go:build unix
+
+package downloader
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	// A umask that would strip the group bits the modes below ask for
+	old := syscall.Umask(0o077)
+	defer syscall.Umask(old)
+	defer func(mode fs.FileMode) { HistoryFileMode = mode }(HistoryFileMode)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		mode fs.FileMode
+		want fs.FileMode
+	}{
+		{"default", 0, 0644},
+		{"group writable", 0660, 0660},
+		{"private", 0600, 0600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &DownloadOptions{Client: srv.Client(), FileMode: tt.mode, WriteChecksum: true}
+			result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, dir, "", noProgress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := opts.PostProcess(context.Background(), result); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range []string{result.Path, result.Path + checksumSuffix} {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := info.Mode().Perm(); got != tt.want {
+					t.Errorf("%s has mode %#o, want %#o", filepath.Base(path), got, tt.want)
+				}
+			}
+		})
+	}
+
+	HistoryFileMode = 0640
+	path := filepath.Join(t.TempDir(), "history.json")
+	store, err := OpenStore("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("a.iso", testRecord("a.iso")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, historyLogPath(path)} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != 0640 {
+			t.Errorf("%s has mode %#o, want 0640", filepath.Base(p), got)
+		}
+	}
+}
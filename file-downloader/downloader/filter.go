@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// History orderings for -sort and the sort query parameter.
+const (
+	SortDate = "date" // newest first (the default)
+	SortName = "name" // by file name
+	SortSize = "size" // largest first
+)
+
+// HistoryFilter selects and orders history records. It backs both -list and
+// the web history endpoints.
+type HistoryFilter struct {
+	Query string    // substring of the file name or URL, ignoring case
+	Since time.Time // only records downloaded at or after this; zero means all
+	Sort  string
+}
+
+// ParseHistoryFilter builds a filter from user input. since is a duration
+// back from now ("24h", "7d") or a date ("2024-01-01" or RFC 3339).
+func ParseHistoryFilter(query, since, order string, now time.Time) (HistoryFilter, error) {
+	f := HistoryFilter{Query: query, Sort: order}
+	switch order {
+	case "":
+		f.Sort = SortDate
+	case SortDate, SortName, SortSize:
+	default:
+		return f, fmt.Errorf("invalid sort %q (use date, name or size)", order)
+	}
+	if since != "" {
+		t, err := parseSince(since, now)
+		if err != nil {
+			return f, err
+		}
+		f.Since = t
+	}
+	return f, nil
+}
+
+// parseSince turns a -since value into the earliest time it allows.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q (use a duration like 24h or 7d, or a date like 2024-01-01)", s)
+}
+
+// Apply returns the records matching f in f's order. records must be newest
+// first, as Store.All returns them; it is filtered in place.
+func (f HistoryFilter) Apply(records []DownloadRecord) []DownloadRecord {
+	q := strings.ToLower(f.Query)
+	matched := records[:0]
+	for _, r := range records {
+		if !f.Since.IsZero() && r.Downloaded.Before(f.Since) {
+			continue
+		}
+		if q != "" && !strings.Contains(strings.ToLower(r.Filename), q) && !strings.Contains(strings.ToLower(r.URL), q) {
+			continue
+		}
+		matched = append(matched, r)
+	}
+
+	switch f.Sort {
+	case SortName:
+		sort.SliceStable(matched, func(i, j int) bool {
+			return strings.ToLower(matched[i].Filename) < strings.ToLower(matched[j].Filename)
+		})
+	case SortSize:
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].Size > matched[j].Size
+		})
+	}
+	return matched
+}
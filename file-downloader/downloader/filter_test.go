@@ -0,0 +1,90 @@
+package downloader
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		since string
+		want  time.Time
+	}{
+		{"24h", now.Add(-24 * time.Hour)},
+		{"90m", now.Add(-90 * time.Minute)},
+		{"0s", now},
+		{"7d", time.Date(2024, 3, 3, 12, 0, 0, 0, time.Local)},
+		{"2024-01-01", time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-01-01T08:30:00Z", time.Date(2024, 1, 1, 8, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.since, now)
+		if err != nil {
+			t.Errorf("%s: %v", tt.since, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: %v, want %v", tt.since, got, tt.want)
+		}
+	}
+
+	for _, since := range []string{"yesterday", "-24h", "-1d", "2024-13-01", "24"} {
+		if _, err := parseSince(since, now); err == nil {
+			t.Errorf("%s: no error", since)
+		}
+	}
+}
+
+func TestParseHistoryFilterSort(t *testing.T) {
+	f, err := ParseHistoryFilter("", "", "", time.Now())
+	if err != nil || f.Sort != SortDate {
+		t.Errorf("default sort = %q, %v; want %q", f.Sort, err, SortDate)
+	}
+	if _, err := ParseHistoryFilter("", "", "colour", time.Now()); err == nil {
+		t.Error("invalid sort: no error")
+	}
+}
+
+func TestHistoryFilterApply(t *testing.T) {
+	now := time.Now()
+	// Newest first, as Store.All returns them
+	records := func() []DownloadRecord {
+		var out []DownloadRecord
+		for i, name := range []string{"b.iso", "c.txt", "a.iso", "d.iso"} {
+			r := testRecord(name)
+			r.Downloaded = now.Add(-time.Duration(i) * 24 * time.Hour)
+			r.Size = int64(10 * (i%2 + 1) * (i + 1))
+			out = append(out, r)
+		}
+		return out
+	}
+
+	tests := []struct {
+		query, since, sort string
+		want               []string
+	}{
+		{"", "", "", []string{"b.iso", "c.txt", "a.iso", "d.iso"}},
+		{"", "36h", "", []string{"b.iso", "c.txt"}},
+		{"", "2d", "", []string{"b.iso", "c.txt", "a.iso"}},
+		{"", now.Add(-36 * time.Hour).Format(time.RFC3339), "", []string{"b.iso", "c.txt"}},
+		{"", "60h", SortName, []string{"a.iso", "b.iso", "c.txt"}},
+		{"", "", SortSize, []string{"d.iso", "c.txt", "a.iso", "b.iso"}},
+		{"iso", "36h", SortSize, []string{"b.iso"}},
+	}
+	for _, tt := range tests {
+		f, err := ParseHistoryFilter(tt.query, tt.since, tt.sort, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range f.Apply(records()) {
+			names = append(names, filepath.Base(r.Filename))
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("q=%q since=%q sort=%q: %q, want %q", tt.query, tt.since, tt.sort, names, tt.want)
+		}
+	}
+}
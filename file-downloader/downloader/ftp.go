@@ -0,0 +1,279 @@
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpTransport is an http.RoundTripper for ftp:// and ftps:// URLs. It is
+// registered on the download client, so FTP files go through the same
+// pipeline as HTTP ones: a GET becomes a RETR whose data connection is the
+// response body, SIZE and MDTM fill in Content-Length and Last-Modified, and
+// a "bytes=N-" Range is sent as REST N so interrupted downloads resume.
+// ftps:// upgrades the control connection with AUTH TLS and protects the
+// data connection as well. The protocol is spoken by github.com/jlaffaye/ftp.
+//
+// Only passive mode is supported. Credentials come from the URL and default
+// to anonymous. FTP errors are reported as HTTP statuses, see ftpStatus.
+type ftpTransport struct {
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	tlsConfig *tls.Config // base config for ftps://; nil uses the defaults
+}
+
+func (t *ftpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil, fmt.Errorf("ftp: method %s not supported", req.Method)
+	}
+	c, err := t.connect(req.Context(), req.URL)
+	if err != nil {
+		return ftpError(req, err)
+	}
+	resp, err := t.retrieve(req, c)
+	if err != nil || resp.Body == http.NoBody {
+		c.Quit()
+	}
+	if err != nil {
+		return ftpError(req, err)
+	}
+	return resp, nil
+}
+
+// connect dials the server and logs in.
+func (t *ftpTransport) connect(ctx context.Context, u *url.URL) (*ftp.ServerConn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	var tlsConfig *tls.Config
+	if u.Scheme == "ftps" {
+		tlsConfig = &tls.Config{}
+		if t.tlsConfig != nil {
+			tlsConfig = t.tlsConfig.Clone()
+		}
+		tlsConfig.ServerName = u.Hostname()
+		// Servers commonly require data connections to resume the
+		// control connection's TLS session
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+
+	opts := []ftp.DialOption{ftp.DialWithContext(ctx), ftp.DialWithDialFunc(t.dialer(ctx, u.Hostname(), tlsConfig))}
+	if tlsConfig != nil {
+		opts = append(opts, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+	c, err := ftp.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	user, pass := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			pass = p
+		}
+	}
+	if err := c.Login(user, pass); err != nil {
+		c.Quit()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialer returns the dial function for one session with host. The first
+// call opens the control connection; the rest are passive data connections,
+// which go to host whatever address the server names (that also works
+// behind NAT) and are wrapped in TLS for ftps://. Every connection is closed
+// when ctx ends.
+func (t *ftpTransport) dialer(ctx context.Context, host string, tlsConfig *tls.Config) func(network, addr string) (net.Conn, error) {
+	control := true
+	return func(network, addr string) (net.Conn, error) {
+		data := !control
+		control = false
+		if data {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			addr = net.JoinHostPort(host, port)
+		}
+		conn, err := t.dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if data && tlsConfig != nil {
+			conn = tls.Client(conn, tlsConfig)
+		}
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		return &watchedConn{Conn: conn, stop: stop}, nil
+	}
+}
+
+// retrieve answers req on the logged-in connection c. For a GET the body
+// reads from the data connection and closes c when done.
+func (t *ftpTransport) retrieve(req *http.Request, c *ftp.ServerConn) (*http.Response, error) {
+	// Paths are relative to the login directory, as with curl; "%2F" at
+	// the start makes one absolute
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path == "" || strings.HasSuffix(path, "/") {
+		return nil, &textproto.Error{Code: 550, Msg: "not a file"}
+	}
+
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          http.NoBody,
+		ContentLength: -1,
+		Request:       req,
+	}
+	size, err := c.FileSize(path)
+	if err != nil {
+		size = -1
+	}
+	if mod, err := c.GetTime(path); err == nil {
+		resp.Header.Set("Last-Modified", mod.Format(http.TimeFormat))
+	}
+	resp.ContentLength = size
+	if size >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if req.Method == "HEAD" {
+		return resp, nil
+	}
+
+	// Only the start of a range is honored; the body runs to the end
+	var offset int64
+	if start, ok := rangeStart(req.Header.Get("Range")); ok && start > 0 {
+		if size >= 0 && start >= size {
+			resp.Status, resp.StatusCode = "416 Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = 0
+			return resp, nil
+		}
+		offset = start
+	}
+
+	data, err := c.RetrFrom(path, uint64(offset))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		resp.Status, resp.StatusCode = "206 Partial Content", http.StatusPartialContent
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		if size >= 0 {
+			resp.ContentLength = size - offset
+			resp.Header.Set("Content-Length", strconv.FormatInt(size-offset, 10))
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+		}
+	}
+	resp.Body = &ftpBody{data: data, c: c}
+	return resp, nil
+}
+
+// watchedConn is a connection that stops watching the request's context once
+// closed.
+type watchedConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (w *watchedConn) Close() error {
+	w.stop()
+	return w.Conn.Close()
+}
+
+// ftpBody is the body of a RETR. The server's final reply is read at the end
+// of the data, so a transfer it aborted is an error rather than a short file.
+type ftpBody struct {
+	data *ftp.Response
+	c    *ftp.ServerConn
+	done bool // the final reply has been read and the data connection closed
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	if b.done {
+		// The data connection is closed by now
+		return 0, io.EOF
+	}
+	n, err := b.data.Read(p)
+	if err == io.EOF {
+		b.done = true
+		if cerr := b.data.Close(); cerr != nil {
+			return n, fmt.Errorf("ftp: transfer failed: %w", cerr)
+		}
+	}
+	return n, err
+}
+
+func (b *ftpBody) Close() error {
+	// A transfer cut short is answered with 426; Close reads it so QUIT
+	// goes to a connection in step
+	b.done = true
+	b.data.Close()
+	b.c.Quit()
+	return nil
+}
+
+// ftpError turns an FTP error reply into a response with the closest HTTP
+// status, so the retry and mirror logic treat it like an HTTP failure.
+// Other errors are returned as they are.
+func ftpError(req *http.Request, err error) (*http.Response, error) {
+	var fe *textproto.Error
+	if !errors.As(err, &fe) {
+		return nil, err
+	}
+	code := ftpStatus(fe.Code)
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s (FTP %d %s)", code, http.StatusText(code), fe.Code, strings.TrimSpace(fe.Msg)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+// ftpStatus maps an FTP reply code to an HTTP status.
+func ftpStatus(code int) int {
+	switch code {
+	case 550, 553:
+		return http.StatusNotFound
+	case 530, 532:
+		return http.StatusForbidden
+	case 421, 425, 426, 450, 451, 452:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// rangeStart returns N from a "bytes=N-" or "bytes=N-M" Range header.
+func rangeStart(header string) (int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, false
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil && n >= 0
+}
@@ -0,0 +1,293 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ftpStub is a minimal FTP server for the commands ftpTransport sends. It
+// serves files from memory and records every command it receives.
+type ftpStub struct {
+	files    map[string]string // path, relative to the login directory, to content
+	user     string            // required user name; empty accepts anonymous
+	pass     string
+	noEPSV   bool // refuse EPSV so the client falls back to PASV
+	abortRET bool // send half of a file, then 426
+
+	addr string
+	mu   sync.Mutex
+	cmds []string
+}
+
+func newFTPStub(t *testing.T, files map[string]string) *ftpStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &ftpStub{files: files, addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// url returns the ftp:// URL of path on the stub.
+func (s *ftpStub) url(path string) string {
+	return "ftp://" + s.addr + "/" + path
+}
+
+func (s *ftpStub) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.cmds)
+}
+
+func (s *ftpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var user string
+	var offset int64
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+
+	reply("220 stub ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.cmds = append(s.cmds, line)
+		s.mu.Unlock()
+		cmd, arg, _ := strings.Cut(line, " ")
+
+		switch cmd {
+		case "USER":
+			user = arg
+			reply("331 password please")
+		case "PASS":
+			if s.user != "" && (user != s.user || arg != s.pass) || s.user == "" && user != "anonymous" {
+				reply("530 login incorrect")
+				continue
+			}
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n MDTM\r\n211 End")
+		case "TYPE":
+			reply("200 type set")
+		case "SIZE":
+			if content, ok := s.files[arg]; ok {
+				reply("213 %d", len(content))
+			} else {
+				reply("550 no such file")
+			}
+		case "MDTM":
+			if _, ok := s.files[arg]; ok {
+				reply("213 20240102030405")
+			} else {
+				reply("550 no such file")
+			}
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", offset)
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && s.noEPSV {
+				reply("500 EPSV not understood")
+				continue
+			}
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 can't open data connection")
+				continue
+			}
+			port := data.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				// The address is deliberately wrong: clients should use
+				// the control connection's host
+				reply("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "RETR":
+			content, ok := s.files[arg]
+			if !ok || data == nil {
+				reply("550 no such file")
+				continue
+			}
+			reply("150 opening data connection")
+			dc, err := data.Accept()
+			data.Close()
+			data = nil
+			if err != nil {
+				return
+			}
+			content = content[min(offset, int64(len(content))):]
+			offset = 0
+			if s.abortRET {
+				dc.Write([]byte(content[:len(content)/2]))
+				dc.Close()
+				reply("426 transfer aborted")
+				continue
+			}
+			dc.Write([]byte(content))
+			dc.Close()
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 %s not implemented", cmd)
+		}
+	}
+}
+
+func ftpTestOptions(t *testing.T) *DownloadOptions {
+	t.Helper()
+	client, err := NewHTTPClient(ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DownloadOptions{Client: client}
+}
+
+func TestFTPDownload(t *testing.T) {
+	content := strings.Repeat("ftp data ", 1000)
+	for _, noEPSV := range []bool{false, true} {
+		s := newFTPStub(t, map[string]string{"pub/app.iso": content})
+		s.noEPSV = noEPSV
+
+		result, err := ftpTestOptions(t).FetchMirrors(context.Background(), []string{s.url("pub/app.iso")}, t.TempDir(), "", noProgress)
+		if err != nil {
+			t.Fatalf("EPSV refused %t: %v", noEPSV, err)
+		}
+		if data, _ := os.ReadFile(result.Path); string(data) != content {
+			t.Errorf("EPSV refused %t: file has %d bytes, want %d", noEPSV, len(data), len(content))
+		}
+		if filepath.Base(result.Path) != "app.iso" || result.Size != int64(len(content)) {
+			t.Errorf("EPSV refused %t: result %s, %d bytes", noEPSV, result.Path, result.Size)
+		}
+		if result.LastModified != "Tue, 02 Jan 2024 03:04:05 GMT" {
+			t.Errorf("EPSV refused %t: Last-Modified %q from MDTM", noEPSV, result.LastModified)
+		}
+
+		cmds := s.commands()
+		for _, want := range []string{"USER anonymous", "PASS anonymous@", "TYPE I", "SIZE pub/app.iso", "RETR pub/app.iso"} {
+			if !slices.Contains(cmds, want) {
+				t.Errorf("EPSV refused %t: no %q in %q", noEPSV, want, cmds)
+			}
+		}
+		if noEPSV && !slices.Contains(cmds, "PASV") {
+			t.Errorf("no PASV fallback in %q", cmds)
+		}
+	}
+}
+
+func TestFTPLogin(t *testing.T) {
+	s := newFTPStub(t, map[string]string{"app.iso": "private"})
+	s.user, s.pass = "alice", "s3cret"
+	opts := ftpTestOptions(t)
+
+	good := "ftp://alice:s3cret@" + s.addr + "/app.iso"
+	result, err := opts.FetchMirrors(context.Background(), []string{good}, t.TempDir(), "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != "private" {
+		t.Errorf("file = %q", data)
+	}
+
+	// A refused login is a 403, which isn't retried
+	_, err = opts.FetchMirrors(context.Background(), []string{"ftp://alice:wrong@" + s.addr + "/app.iso"}, t.TempDir(), "", noProgress)
+	var se *statusError
+	if !errors.As(err, &se) || se.Code != http.StatusForbidden || !strings.Contains(se.Status, "FTP 530") {
+		t.Errorf("wrong password: %v, want a 403 from FTP 530", err)
+	}
+}
+
+func TestFTPErrors(t *testing.T) {
+	s := newFTPStub(t, map[string]string{})
+	opts := ftpTestOptions(t)
+
+	dir := t.TempDir()
+	_, err := opts.FetchMirrors(context.Background(), []string{s.url("missing.iso")}, dir, "", noProgress)
+	var se *statusError
+	if !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Errorf("missing file: %v, want a 404", err)
+	}
+
+	// A transfer the server aborts is an error, not a short file
+	aborting := newFTPStub(t, map[string]string{"half.iso": strings.Repeat("x", 1000)})
+	aborting.abortRET = true
+	_, err = opts.FetchMirrors(context.Background(), []string{aborting.url("half.iso")}, dir, "", noProgress)
+	if err == nil {
+		t.Error("aborted transfer succeeded")
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "half.iso")); !os.IsNotExist(statErr) {
+		t.Error("aborted transfer saved a file")
+	}
+}
+
+func TestFTPResume(t *testing.T) {
+	content := "0123456789abcdefghij"
+	s := newFTPStub(t, map[string]string{"app.iso": content})
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "app.iso")
+	writeTestFile(t, dir, "app.iso"+PartSuffix, []byte(content[:8]))
+
+	result, err := ftpTestOptions(t).Resume(context.Background(), s.url("app.iso"), outputPath, noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != content {
+		t.Errorf("resumed file = %q, want %q", data, content)
+	}
+	if cmds := s.commands(); !slices.Contains(cmds, "REST 8") {
+		t.Errorf("no REST 8 in %q", cmds)
+	}
+}
+
+func TestRangeStart(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int64
+		ok     bool
+	}{
+		{"bytes=100-", 100, true},
+		{"bytes=0-499", 0, true},
+		{"bytes=-500", 0, false},
+		{"items=1-", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := rangeStart(tt.header); got != tt.want || ok != tt.ok {
+			t.Errorf("rangeStart(%q) = %d, %t, want %d, %t", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FetchHead requests bytes 0 to n-1 of rawURL and writes at most n bytes of
+// the response to path. It describes how the server answered the range and
+// returns how many bytes were saved.
+func (o *DownloadOptions) FetchHead(ctx context.Context, rawURL, path string, n int64) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	o.setHeaders(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	// A compressed range would be a prefix of the encoded body, not the file
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	var result string
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		result = "honored (206"
+		cr := resp.Header.Get("Content-Range")
+		if !strings.HasPrefix(cr, "bytes 0-") {
+			return "", 0, fmt.Errorf("server returned the wrong range %q", cr)
+		}
+		if _, size, ok := strings.Cut(cr, "/"); ok {
+			if total, err := strconv.ParseInt(size, 10, 64); err == nil {
+				result += " of " + FormatBytes(total)
+			}
+		}
+		result += ")"
+	case http.StatusOK:
+		result = "ignored (200"
+		if resp.ContentLength >= 0 {
+			result += ", full body is " + FormatBytes(resp.ContentLength)
+		}
+		result += ")"
+	default:
+		return "", 0, &statusError{Code: resp.StatusCode, Status: resp.Status, URL: resp.Request.URL.String()}
+	}
+
+	out, err := o.createPart(path)
+	if err != nil {
+		return "", 0, err
+	}
+	saved, err := io.Copy(out, io.LimitReader(resp.Body, n))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", 0, err
+	}
+	// Content-Length is the range's length for a 206, the file's for a 200
+	want := n
+	if resp.ContentLength >= 0 {
+		want = min(n, resp.ContentLength)
+	}
+	if saved < want {
+		result += ", ended early"
+	}
+	return result, saved, nil
+}
@@ -0,0 +1,71 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchHead(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 100))
+	ranged, ranges := rangeServer(t, body, false, "")
+	unranged, _ := rangeServer(t, body, true, "")
+	opts := &DownloadOptions{Client: http.DefaultClient}
+
+	tests := []struct {
+		name   string
+		srv    *httptest.Server
+		n      int64
+		result string
+		saved  int64
+	}{
+		{"honored", ranged, 10, "honored (206 of 1000 B)", 10},
+		{"ignored", unranged, 10, "ignored (200, full body is 1000 B)", 10},
+		{"past the end", ranged, 5000, "honored (206 of 1000 B)", 1000},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "file.bin.partial")
+		result, saved, err := opts.FetchHead(context.Background(), tt.srv.URL+"/file.bin", path, tt.n)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if result != tt.result || saved != tt.saved {
+			t.Errorf("%s: %q, %d bytes; want %q, %d", tt.name, result, saved, tt.result, tt.saved)
+		}
+		if data, _ := os.ReadFile(path); string(data) != string(body[:tt.saved]) {
+			t.Errorf("%s: saved %q", tt.name, data)
+		}
+	}
+	if got := ranges(); len(got) == 0 || got[0] != "bytes=0-9" {
+		t.Errorf("Range headers = %q, want bytes=0-9 first", got)
+	}
+
+	// A range that doesn't start at 0 or an error status saves nothing
+	wrong := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 500-509/1000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body[500:510])
+	}))
+	defer wrong.Close()
+	dir := t.TempDir()
+	if _, _, err := opts.FetchHead(context.Background(), wrong.URL+"/file.bin", filepath.Join(dir, "a.partial"), 10); err == nil || !strings.Contains(err.Error(), "wrong range") {
+		t.Errorf("wrong range: err = %v", err)
+	}
+	_, _, err := opts.FetchHead(context.Background(), wrong.URL+"/missing.bin", filepath.Join(dir, "b.partial"), 10)
+	var se *statusError
+	if !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Errorf("missing file: err = %v, want a 404", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("failed probes saved %v", entries)
+	}
+}
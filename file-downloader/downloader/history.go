@@ -0,0 +1,167 @@
+package downloader
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+)
+
+type DownloadRecord struct {
+	URL        string    `json:"url"`
+	FinalURL   string    `json:"final_url,omitempty"` // after redirects
+	Mirror     string    `json:"mirror,omitempty"`    // fallback URL used instead of URL
+	Filename   string    `json:"filename"`
+	Downloaded time.Time `json:"downloaded"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"`
+
+	// Timing; missing in records from older versions
+	StartedAt time.Time     `json:"started_at,omitzero"`
+	Duration  time.Duration `json:"duration,omitempty"` // nanoseconds
+
+	OriginalURL string `json:"original_url,omitempty"` // URL as given, when -normalize rewrote URL
+
+	// Validators for -if-changed
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	AcceptRanges bool   `json:"accept_ranges,omitempty"` // server supports resuming via Range
+	ExtractedTo  string `json:"extracted_to,omitempty"`  // set by -extract
+
+	SignedBy string `json:"signed_by,omitempty"` // minisign key ID that verified the file (-verify-key)
+
+	Versions []string `json:"versions,omitempty"` // older copies kept by -keep-versions, newest first
+}
+
+// newDownloadRecord builds the history record for a completed download.
+// rawURL is the primary URL, which the history is keyed on even when a
+// mirror served the file. started is when the transfer began; the zero time
+// leaves the timing fields empty.
+func newDownloadRecord(rawURL string, result *DownloadResult, started time.Time) DownloadRecord {
+	now := time.Now()
+	record := DownloadRecord{
+		URL:        rawURL,
+		FinalURL:   result.FinalURL,
+		Filename:   result.Path,
+		Downloaded: now,
+		Size:       result.Size,
+		SHA256:     result.SHA256,
+
+		AcceptRanges: result.AcceptRanges,
+		ExtractedTo:  result.ExtractedTo,
+		ETag:         result.ETag,
+		LastModified: result.LastModified,
+
+		SignedBy: result.SignedBy,
+	}
+	if result.URL != rawURL {
+		record.Mirror = result.URL
+	}
+	if !started.IsZero() {
+		record.StartedAt, record.Duration = started, now.Sub(started)
+	}
+	return record
+}
+
+// AverageSpeed returns the download's average speed in bytes per second, or
+// 0 when the duration wasn't recorded.
+func (r DownloadRecord) AverageSpeed() int64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return int64(float64(r.Size) / r.Duration.Seconds())
+}
+
+type History struct {
+	Downloads       map[string]DownloadRecord `json:"downloads"`
+	DownloadedFiles map[string]string         `json:"downloaded_files"`
+
+	Failures map[string]FailureRecord `json:"failures,omitempty"` // last failure per URL (-track-failures)
+
+	LogSeq int64 `json:"log_seq,omitempty"` // last history log entry included, see JSONStore
+}
+
+// FailureRecord describes the last failed attempt to download a URL. It is
+// removed once the URL downloads successfully.
+type FailureRecord struct {
+	URL      string    `json:"url"`
+	Error    string    `json:"error"`
+	Status   int       `json:"status,omitempty"`    // HTTP status, when the server answered with an error
+	FinalURL string    `json:"final_url,omitempty"` // URL that answered, after redirects
+	Time     time.Time `json:"time"`
+}
+
+// HistoryFileMode is the permission set on the history file (-history-mode).
+var HistoryFileMode os.FileMode = 0644
+
+func loadHistory(historyFile string) (*History, bool, error) {
+	history := &History{
+		Downloads:       make(map[string]DownloadRecord),
+		DownloadedFiles: make(map[string]string),
+		Failures:        make(map[string]FailureRecord),
+	}
+
+	data, err := os.ReadFile(historyFile)
+	if os.IsNotExist(err) {
+		return history, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := json.Unmarshal(data, history); err != nil {
+		return nil, false, err
+	}
+
+	if history.Downloads == nil {
+		history.Downloads = make(map[string]DownloadRecord)
+	}
+	if history.DownloadedFiles == nil {
+		history.DownloadedFiles = make(map[string]string)
+	}
+	if history.Failures == nil {
+		history.Failures = make(map[string]FailureRecord)
+	}
+
+	// Migrate: populate DownloadedFiles from Downloads if empty
+	needsSave := false
+	if len(history.DownloadedFiles) == 0 && len(history.Downloads) > 0 {
+		for u := range history.Downloads {
+			filename := FilenameFromURL(u)
+			history.DownloadedFiles[filename] = u
+		}
+		needsSave = true
+	}
+
+	return history, needsSave, nil
+}
+
+func saveHistory(historyFile string, history *History) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file and rename so readers never see a partial file
+	tmp := historyFile + ".tmp"
+	if err := os.WriteFile(tmp, data, HistoryFileMode); err != nil {
+		return err
+	}
+	// WriteFile's mode is masked by the umask; set it exactly
+	if err := os.Chmod(tmp, HistoryFileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, historyFile)
+}
+
+// historyRecords returns all records sorted by download time (newest first).
+func historyRecords(history *History) []DownloadRecord {
+	records := make([]DownloadRecord, 0, len(history.Downloads))
+	for _, r := range history.Downloads {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Downloaded.After(records[j].Downloaded)
+	})
+	return records
+}
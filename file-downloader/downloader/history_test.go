@@ -0,0 +1,46 @@
+package downloader
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadRecordTiming(t *testing.T) {
+	result := &DownloadResult{URL: "https://example.com/a.iso", Path: "/downloads/a.iso", Size: 4000}
+	started := time.Now().Add(-2 * time.Second)
+
+	record := newDownloadRecord("https://example.com/a.iso", result, started)
+	if !record.StartedAt.Equal(started) {
+		t.Errorf("StartedAt = %v, want %v", record.StartedAt, started)
+	}
+	if record.Duration < 2*time.Second || record.Duration > 3*time.Second {
+		t.Errorf("Duration = %v, want about 2s", record.Duration)
+	}
+	if speed := record.AverageSpeed(); speed < 1300 || speed > 2000 {
+		t.Errorf("AverageSpeed = %d, want about 2000 B/s", speed)
+	}
+
+	// Without a start time, e.g. a file found on disk, there's no timing
+	record = newDownloadRecord("https://example.com/a.iso", result, time.Time{})
+	if !record.StartedAt.IsZero() || record.Duration != 0 || record.AverageSpeed() != 0 {
+		t.Errorf("record without a start: %v, %v, %d B/s", record.StartedAt, record.Duration, record.AverageSpeed())
+	}
+	data, _ := json.Marshal(record)
+	if strings.Contains(string(data), "started_at") || strings.Contains(string(data), "duration") {
+		t.Errorf("empty timing written: %s", data)
+	}
+}
+
+func TestDownloadRecordWithoutTiming(t *testing.T) {
+	// A record saved before the timing fields existed
+	old := `{"url":"https://example.com/a.iso","filename":"/downloads/a.iso","downloaded":"2024-03-01T10:00:00Z","size":1024}`
+	var record DownloadRecord
+	if err := json.Unmarshal([]byte(old), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Size != 1024 || !record.StartedAt.IsZero() || record.Duration != 0 || record.AverageSpeed() != 0 {
+		t.Errorf("old record loaded as %+v", record)
+	}
+}
@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHistoryLogRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history.json")
+	store, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(name string) DownloadRecord {
+		return DownloadRecord{URL: "https://example.com/files/" + name, Filename: name, Size: 100, Downloaded: time.Now()}
+	}
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		if err := store.Put(name, record(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete(record("a.bin").URL); err != nil {
+		t.Fatal(err)
+	}
+	// A crash cut the last log line short
+	f, err := os.OpenFile(historyLogPath(path), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2099-01-01T00:00:00Z","name":"d.bin","rec`)
+	f.Close()
+	names := func(s Store) []string {
+		var names []string
+		for _, r := range s.All() {
+			names = append(names, r.Filename)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	// A corrupt file is rebuilt from the whole log, deletions included
+	if err := os.WriteFile(path, []byte(`{"downloads": {"https://exa`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(recovered); !slices.Equal(got, []string{"b.bin", "c.bin"}) {
+		t.Errorf("recovered %v, want b.bin and c.bin", got)
+	}
+	if !recovered.HasFilename("b.bin") || recovered.HasFilename("a.bin") {
+		t.Error("file name index not rebuilt")
+	}
+	// The rebuilt history was saved
+	var h History
+	if data, _ := os.ReadFile(path); json.Unmarshal(data, &h) != nil || len(h.Downloads) != 2 {
+		t.Errorf("history file not rewritten after recovery")
+	}
+
+	// A file that doesn't hold the latest entries gets them replayed onto
+	// it, whatever its modification time
+	old, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recovered.Put("e.bin", record("e.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+	replayed, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(replayed); !slices.Equal(got, []string{"b.bin", "c.bin", "e.bin"}) {
+		t.Errorf("after replay %v, want b.bin, c.bin and e.bin", got)
+	}
+
+	// Deleting the file still starts a fresh history
+	os.Remove(path)
+	fresh, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fresh.All()); n != 0 {
+		t.Errorf("%d records without a history file, want none", n)
+	}
+}
+
+func TestHistoryLogCompaction(t *testing.T) {
+	defer func(limit int64) { historyLogLimit = limit }(historyLogLimit)
+	historyLogLimit = 4 << 10
+	path := filepath.Join(t.TempDir(), "history.json")
+	store, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second store stands in for another process
+	other, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first write starts the history file, later ones only append to
+	// the log
+	var before os.FileInfo
+	for i := range 5 {
+		name := fmt.Sprintf("%d.bin", i)
+		if err := store.Put(name, testRecord(name)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if before, err = os.Stat(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if after, err := os.Stat(path); err != nil || !os.SameFile(before, after) || !after.ModTime().Equal(before.ModTime()) {
+		t.Error("a write rewrote the history file")
+	}
+
+	// Past the limit the log is folded into the file and starts over as one
+	// entry per record
+	for i := 5; i < 100; i++ {
+		name := fmt.Sprintf("%d.bin", i)
+		if err := store.Put(name, testRecord(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(testRecord(name).URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logInfo, err := os.Stat(historyLogPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logInfo.Size() > historyLogLimit {
+		t.Errorf("log is %d bytes, want it compacted below %d", logInfo.Size(), historyLogLimit)
+	}
+	var h History
+	if data, _ := os.ReadFile(path); json.Unmarshal(data, &h) != nil || len(h.Downloads) < 5 {
+		t.Errorf("history file has %d records after compaction, want at least 5", len(h.Downloads))
+	}
+
+	// The other store catches up with the compacted files on its next write
+	if err := other.Put("last.bin", testRecord("last.bin")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*JSONStore{other, mustOpenJSONStore(t, path)} {
+		if n := len(s.All()); n != 6 {
+			t.Errorf("%d records, want 6", n)
+		}
+	}
+}
+
+func mustOpenJSONStore(t *testing.T, path string) *JSONStore {
+	t.Helper()
+	s, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
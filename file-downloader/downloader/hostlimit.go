@@ -0,0 +1,59 @@
+package downloader
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// HostOf returns the lowercased host name of rawURL, which per-host limits
+// are keyed on. Mirrors count against the primary URL's host.
+func HostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// HostLimiter lets at most n CLI downloads run against one host at a time
+// (-per-host), while downloads from other hosts proceed.
+type HostLimiter struct {
+	n int
+
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+// NewHostLimiter returns a limiter for n downloads per host, or nil (no
+// limit) when n is 0 or less.
+func NewHostLimiter(n int) *HostLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &HostLimiter{n: n, sems: make(map[string]chan struct{})}
+}
+
+// Acquire waits for a free slot on rawURL's host and returns the function
+// that gives it back. A nil limiter never waits.
+func (l *HostLimiter) Acquire(ctx context.Context, rawURL string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	host := HostOf(rawURL)
+	l.mu.Lock()
+	sem, ok := l.sems[host]
+	if !ok {
+		sem = make(chan struct{}, l.n)
+		l.sems[host] = sem
+	}
+	l.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHostOf(t *testing.T) {
+	tests := map[string]string{
+		"https://Example.COM/a.iso":      "example.com",
+		"https://example.com:8443/a.iso": "example.com",
+		"http://[::1]:8080/a.iso":        "::1",
+		"://bad":                         "",
+	}
+	for in, want := range tests {
+		if got := HostOf(in); got != want {
+			t.Errorf("HostOf(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	l := NewHostLimiter(2)
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	peak := make(map[string]int)
+	total, peakTotal := 0, 0
+	full := make(chan struct{}) // closed once both hosts are at their cap
+
+	var wg sync.WaitGroup
+	for i := range 12 {
+		rawURL := "https://a.example/file"
+		if i%2 == 1 {
+			rawURL = "https://B.example:8443/file"
+		}
+		wg.Go(func() {
+			release, err := l.Acquire(context.Background(), rawURL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			host := HostOf(rawURL)
+			mu.Lock()
+			running[host]++
+			total++
+			peak[host] = max(peak[host], running[host])
+			peakTotal = max(peakTotal, total)
+			if peakTotal == 4 && total == 4 {
+				select {
+				case <-full:
+				default:
+					close(full)
+				}
+			}
+			mu.Unlock()
+
+			select {
+			case <-full:
+			case <-time.After(time.Second):
+			}
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running[host]--
+			total--
+			mu.Unlock()
+			release()
+		})
+	}
+	wg.Wait()
+
+	for host, n := range peak {
+		if n > 2 {
+			t.Errorf("%d downloads at once from %s, limit is 2", n, host)
+		}
+	}
+	if peakTotal != 4 {
+		t.Errorf("at most %d downloads at once, want 4 (2 per host)", peakTotal)
+	}
+}
+
+func TestHostLimiterCancel(t *testing.T) {
+	l := NewHostLimiter(1)
+	release, err := l.Acquire(context.Background(), "https://example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, "https://example.com/b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting on a full host: %v, want the context's error", err)
+	}
+	release()
+	if _, err := l.Acquire(context.Background(), "https://example.com/b"); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+
+	// No limit
+	none := NewHostLimiter(0)
+	for range 3 {
+		if _, err := none.Acquire(context.Background(), "https://example.com/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
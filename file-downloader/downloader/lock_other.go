@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package downloader
+
+// lockFile is a no-op on platforms without a supported locking primitive.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
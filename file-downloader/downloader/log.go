@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// sensitiveHeaders are masked when headers are logged.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Amz-Security-Token"}
+
+// loggingTransport logs each outgoing request and its response headers at
+// debug level (-v), followed by how long the connection phases took.
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return t.next.RoundTrip(req)
+	}
+	slog.DebugContext(ctx, "request", "method", req.Method, "url", req.URL.Redacted(), "headers", logHeaders(req.Header))
+	timing := &requestTiming{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, timing.trace()))
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		slog.DebugContext(ctx, "request failed", "url", req.URL.Redacted(), "error", err)
+		return nil, err
+	}
+	slog.DebugContext(ctx, "response", "url", req.URL.Redacted(), "status", resp.Status, "headers", logHeaders(resp.Header))
+	slog.DebugContext(ctx, "timing", append([]any{"url", req.URL.Redacted()}, timing.attrs()...)...)
+	return resp, nil
+}
+
+// requestTiming collects the phases of one request from httptrace hooks.
+// They can run on the transport's dialing goroutines, hence the lock.
+type requestTiming struct {
+	mu    sync.Mutex
+	start time.Time
+
+	dnsStart, connectStart, tlsStart time.Time
+	dns, connect, tls, firstByte     time.Duration
+	reused                           bool
+}
+
+func (t *requestTiming) trace() *httptrace.ClientTrace {
+	// since is how long ago a phase started, or 0 if it never did
+	since := func(from time.Time) time.Duration {
+		if from.IsZero() {
+			return 0
+		}
+		return time.Since(from)
+	}
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.dns = since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		// With several addresses connects may race; the first start and
+		// the successful one count
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err != nil {
+				return
+			}
+			t.mu.Lock()
+			t.connect = since(t.connectStart)
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			t.mu.Lock()
+			t.tls = since(t.tlsStart)
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = since(t.start)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// attrs returns the phases that happened as log attributes. A reused
+// connection has no DNS, connect or TLS phase.
+func (t *requestTiming) attrs() []any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var attrs []any
+	for _, phase := range []struct {
+		key string
+		d   time.Duration
+	}{{"dns", t.dns}, {"connect", t.connect}, {"tls", t.tls}, {"first_byte", t.firstByte}} {
+		if phase.d > 0 {
+			attrs = append(attrs, phase.key, phase.d.Round(time.Microsecond))
+		}
+	}
+	return append(attrs, "reused", t.reused)
+}
+
+// logHeaders returns h for logging, with sensitiveHeaders masked.
+func logHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range sensitiveHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, "REDACTED")
+		}
+	}
+	return h
+}
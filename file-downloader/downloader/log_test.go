@@ -0,0 +1,83 @@
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoggingTransportTiming(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	client := &http.Client{Transport: &loggingTransport{next: srv.Client().Transport}}
+	get := func() string {
+		t.Helper()
+		logs.Reset()
+		resp, err := client.Get(srv.URL + "/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Drained so the connection goes back to the pool
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		for line := range strings.Lines(logs.String()) {
+			if strings.Contains(line, "msg=timing") {
+				return line
+			}
+		}
+		t.Fatalf("no timing logged: %s", logs.String())
+		return ""
+	}
+
+	// A fresh connection goes through connect and the TLS handshake; the
+	// test server's address is an IP, so there's no DNS lookup
+	first := get()
+	for _, key := range []string{"connect=", "tls=", "first_byte=", "reused=false"} {
+		if !strings.Contains(first, key) {
+			t.Errorf("first request timing lacks %s: %s", key, first)
+		}
+	}
+
+	second := get()
+	if !strings.Contains(second, "reused=true") || !strings.Contains(second, "first_byte=") {
+		t.Errorf("second request timing = %s, want a reused connection", second)
+	}
+	for _, key := range []string{"connect=", "tls="} {
+		if strings.Contains(second, key) {
+			t.Errorf("reused connection logged %s: %s", key, second)
+		}
+	}
+}
+
+func TestLoggingTransportQuiet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	client := &http.Client{Transport: &loggingTransport{next: http.DefaultTransport}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Without -v nothing is traced or logged
+	if logs.Len() != 0 {
+		t.Errorf("logged without debug level: %s", logs.String())
+	}
+}
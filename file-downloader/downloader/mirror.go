@@ -0,0 +1,227 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts.
+const maxRetryDelay = 30 * time.Second
+
+// maxRetryAfter caps how long a Retry-After header can make us wait, and
+// maxRateLimitWaits how many times per URL we wait for one.
+const (
+	maxRetryAfter     = 5 * time.Minute
+	maxRateLimitWaits = 3
+)
+
+// statusError is returned by fetch for a non-200 response.
+type statusError struct {
+	Code   int
+	Status string
+	URL    string // URL that returned the status, after redirects
+
+	RetryAfter time.Duration // from the Retry-After header of a 429 or 503, capped at maxRetryAfter
+}
+
+func (e *statusError) Error() string {
+	return "bad status: " + e.Status
+}
+
+// retryAfter returns the wait a 429 Too Many Requests or 503 Service
+// Unavailable response asks for in its Retry-After header, in either the
+// delay-seconds or the HTTP-date form. It is 0 for other responses and for
+// a missing, invalid or past value.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	var wait time.Duration
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		wait = time.Duration(min(secs, int64(maxRetryAfter/time.Second))) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		wait = t.Sub(now).Round(time.Second)
+	}
+	return max(min(wait, maxRetryAfter), 0)
+}
+
+// Mirror strategies for -mirror-strategy.
+const (
+	MirrorFirst      = "first"      // always start with the primary URL
+	MirrorRoundRobin = "roundrobin" // rotate the starting mirror across downloads
+	MirrorRandom     = "random"     // start with a random mirror
+)
+
+// MirrorSelector picks which mirror a download starts with. The remaining
+// mirrors are still tried in order after it, wrapping around, so failover
+// covers the whole set.
+type MirrorSelector struct {
+	strategy string
+	next     atomic.Uint64
+}
+
+func NewMirrorSelector(strategy string) (*MirrorSelector, error) {
+	switch strategy {
+	case MirrorFirst, MirrorRoundRobin, MirrorRandom:
+		return &MirrorSelector{strategy: strategy}, nil
+	}
+	return nil, fmt.Errorf("unknown mirror strategy %q (use first, roundrobin or random)", strategy)
+}
+
+// order returns urls rotated so the selected mirror comes first. A nil
+// selector uses the first strategy.
+func (s *MirrorSelector) order(urls []string) []string {
+	if s == nil || len(urls) < 2 {
+		return urls
+	}
+	var start int
+	switch s.strategy {
+	case MirrorRoundRobin:
+		start = int((s.next.Add(1) - 1) % uint64(len(urls)))
+	case MirrorRandom:
+		start = rand.IntN(len(urls))
+	}
+	return append(urls[start:len(urls):len(urls)], urls[:start]...)
+}
+
+// SplitMirrors splits the "URL|URL2|URL3" syntax into the primary URL and
+// its fallbacks.
+func SplitMirrors(line string) []string {
+	var urls []string
+	for _, u := range strings.Split(line, "|") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// mirrorURLs returns the URLs to try for a download: the given ones (primary
+// first) followed by the primary's path on each -mirror base URL. The result
+// is a new slice.
+func (o *DownloadOptions) mirrorURLs(urls []string) []string {
+	all := append([]string(nil), urls...)
+	primary, err := url.Parse(urls[0])
+	if err != nil {
+		return all
+	}
+	for _, base := range o.Mirrors {
+		b, err := url.Parse(base)
+		if err != nil {
+			continue
+		}
+		u := *primary
+		u.Scheme, u.Host, u.User = b.Scheme, b.Host, b.User
+		u.Path = strings.TrimSuffix(b.Path, "/") + primary.Path
+		u.RawPath = ""
+		all = append(all, u.String())
+	}
+	return all
+}
+
+// FetchMirrors downloads the first of urls that succeeds, trying each one
+// Retries+1 times before moving on. urls[0] is the primary URL; the file is
+// named after it unless name or ContentDisposition is set. The result's URL
+// field tells which one was used. A download that fails checkSHA256 moves
+// straight on to the next mirror. A retry, on the same mirror or the next
+// one, continues from where a PartialError left off, since mirrors serve the
+// same file.
+func (o *DownloadOptions) FetchMirrors(ctx context.Context, urls []string, outputDir, name string, newProgress ProgressFunc) (*DownloadResult, error) {
+	urls = o.mirrorURLs(urls)
+	if name == "" && len(urls) > 1 && !o.ContentDisposition {
+		name = FilenameFromURL(urls[0])
+	}
+	urls = o.MirrorSelector.order(urls)
+
+	var err error
+	// resumePath is the output path whose .part file an attempt left for
+	// the next one to continue, see PartialError
+	var resumePath string
+	defer func() {
+		// Partial data nothing will resume is dropped, unless the download
+		// was cancelled: save keeps that for a later resume
+		if resumePath != "" && ctx.Err() == nil {
+			os.Remove(PartPath(resumePath))
+		}
+	}()
+	for i, u := range urls {
+		if i > 0 {
+			slog.Warn("trying next mirror", "url", u, "previous_error", err)
+		}
+		rateLimited, waited := 0, false
+		for attempt := 0; attempt <= o.Retries; attempt++ {
+			if attempt > 0 && !waited {
+				delay := min(time.Second<<(attempt-1), maxRetryDelay)
+				slog.Warn("retrying download", "url", u, "attempt", attempt+1, "delay", delay, "error", err)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil, err
+				}
+			}
+			waited = false
+
+			var result *DownloadResult
+			switch {
+			case resumePath != "":
+				result, err = o.Resume(ctx, u, resumePath, newProgress)
+			default:
+				result, err = o.fetchWith(ctx, o.fetcher(), u, outputDir, name, newProgress)
+			}
+			var partial *PartialError
+			if errors.As(err, &partial) {
+				resumePath = partial.path
+			} else if _, statErr := os.Stat(PartPath(resumePath)); resumePath != "" && statErr != nil {
+				resumePath = "" // finished or removed
+			}
+			if err == nil {
+				result.URL = u
+				if err = o.checkSHA256(result); err == nil {
+					if o.ExpectSHA256 != "" {
+						slog.Info("checksum verified", "url", u, "sha256", result.SHA256)
+					}
+					return result, nil
+				}
+				slog.Warn("checksum mismatch", "url", u, "error", err)
+				break // a retry would likely get the same bytes; try the next mirror
+			}
+			err = OutputError(err)
+			if ctx.Err() != nil || errors.Is(err, ErrNotModified) ||
+				errors.Is(err, ErrTooLarge) || errors.Is(err, ErrInsufficientSpace) ||
+				errors.Is(err, ErrFileExists) || errors.Is(err, ErrDeclined) ||
+				errors.Is(err, ErrOutputUnwritable) {
+				// Another attempt or mirror won't help
+				return nil, err
+			}
+			var se *statusError
+			if errors.As(err, &se) && se.RetryAfter > 0 && rateLimited < maxRateLimitWaits {
+				// Waiting as asked doesn't use up a retry
+				rateLimited++
+				slog.Warn("rate limited, waiting as the server asked", "url", u, "status", se.Code, "wait", se.RetryAfter)
+				select {
+				case <-time.After(se.RetryAfter):
+				case <-ctx.Done():
+					return nil, err
+				}
+				attempt, waited = attempt-1, true
+				continue
+			}
+			if errors.As(err, &se) && se.Code < http.StatusInternalServerError && se.Code != http.StatusTooManyRequests ||
+				errors.Is(err, errUnexpectedType) {
+				break // won't change on retry; go to the next mirror
+			}
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,328 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchMirrorsFailover(t *testing.T) {
+	var primaryHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "from the mirror")
+	}))
+	defer mirror.Close()
+
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: http.DefaultClient, Retries: 1}
+	primaryURL := primary.URL + "/releases/app.tar.gz"
+	result, err := opts.FetchMirrors(context.Background(), []string{primaryURL, mirror.URL + "/releases/app.tar.gz"}, dir, "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := primaryHits.Load(); n != 2 {
+		t.Errorf("primary tried %d times, want 2 (Retries 1) before failing over", n)
+	}
+	if result.URL != mirror.URL+"/releases/app.tar.gz" {
+		t.Errorf("URL = %q, want the mirror", result.URL)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != "from the mirror" {
+		t.Errorf("file = %q, want the mirror's content", data)
+	}
+
+	// History is keyed on the primary URL and records the mirror
+	record := opts.HistoryRecord(primaryURL, result, time.Time{})
+	if record.URL != primaryURL || record.Mirror != result.URL {
+		t.Errorf("record URL %q, Mirror %q, want %q, %q", record.URL, record.Mirror, primaryURL, result.URL)
+	}
+}
+
+func TestFetchMirrorsChecksumFailover(t *testing.T) {
+	const content = "the real release"
+	sum := sha256.Sum256([]byte(content))
+	var corruptHits atomic.Int32
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		corruptHits.Add(1)
+		io.WriteString(w, "the real relea5e")
+	}))
+	defer corrupt.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content)
+	}))
+	defer good.Close()
+
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: http.DefaultClient, Retries: 2, ExpectSHA256: hex.EncodeToString(sum[:])}
+	primaryURL := corrupt.URL + "/app.iso"
+	result, err := opts.FetchMirrors(context.Background(), []string{primaryURL, good.URL + "/app.iso"}, dir, "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := corruptHits.Load(); n != 1 {
+		t.Errorf("corrupt mirror tried %d times, want 1: a mismatch skips the retries", n)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != content {
+		t.Errorf("file = %q, want the good mirror's content", data)
+	}
+	if result.SHA256 != opts.ExpectSHA256 {
+		t.Errorf("SHA256 = %s, want %s", result.SHA256, opts.ExpectSHA256)
+	}
+	if record := opts.HistoryRecord(primaryURL, result, time.Time{}); record.Mirror != good.URL+"/app.iso" {
+		t.Errorf("record Mirror %q, want the mirror that matched", record.Mirror)
+	}
+
+	// When every mirror is corrupt the download fails and nothing is kept
+	dir = t.TempDir()
+	_, err = opts.FetchMirrors(context.Background(), []string{primaryURL, corrupt.URL + "/other/app.iso"}, dir, "", noProgress)
+	if !errors.Is(err, errChecksum) {
+		t.Errorf("err = %v, want errChecksum", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("corrupt downloads left %v", entries)
+	}
+}
+
+func TestFetchMirrorsAllFail(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	opts := &DownloadOptions{Client: srv.Client()}
+	_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/a", srv.URL + "/b"}, t.TempDir(), "", noProgress)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("err = %v, want the last mirror's 404", err)
+	}
+}
+
+func TestFetchMirrorsContinuesPartial(t *testing.T) {
+	body := strings.Repeat("0123456789", 100)
+	// The primary stalls halfway through
+	primary, _ := stallingServer(t, body)
+	var mirrorRange string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorRange = r.Header.Get("Range")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer mirror.Close()
+
+	opts := &DownloadOptions{Client: http.DefaultClient, StallTimeout: 100 * time.Millisecond}
+	result, err := opts.FetchMirrors(context.Background(), []string{primary.URL + "/file.bin", mirror.URL + "/file.bin"}, t.TempDir(), "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("bytes=%d-", len(body)/2); mirrorRange != want {
+		t.Errorf("mirror got Range %q, want %q", mirrorRange, want)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != body {
+		t.Errorf("file has %d bytes, want the %d byte body", len(data), len(body))
+	}
+}
+
+func TestMirrorURLs(t *testing.T) {
+	opts := &DownloadOptions{Mirrors: []string{"https://mirror.example.org", "http://backup.example.net/pub/"}}
+	got := opts.mirrorURLs([]string{"https://example.com/releases/v1/app.iso?x=1", "https://alt.example.com/app.iso"})
+	want := []string{
+		"https://example.com/releases/v1/app.iso?x=1",
+		"https://alt.example.com/app.iso",
+		"https://mirror.example.org/releases/v1/app.iso?x=1",
+		"http://backup.example.net/pub/releases/v1/app.iso?x=1",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("mirrorURLs = %q, want %q", got, want)
+	}
+}
+
+func TestSplitMirrors(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"https://a/x", []string{"https://a/x"}},
+		{"https://a/x|https://b/x", []string{"https://a/x", "https://b/x"}},
+		{" https://a/x | https://b/x ||https://c/x ", []string{"https://a/x", "https://b/x", "https://c/x"}},
+		{"|", nil},
+	}
+	for _, tt := range tests {
+		if got := SplitMirrors(tt.line); !slices.Equal(got, tt.want) {
+			t.Errorf("SplitMirrors(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestMirrorSelectorDistribution(t *testing.T) {
+	urls := []string{"https://a/f", "https://b/f", "https://c/f"}
+	const n = 300
+	tests := []struct {
+		strategy string
+		check    func(t *testing.T, counts map[string]int)
+	}{
+		{MirrorFirst, func(t *testing.T, counts map[string]int) {
+			if counts["https://a/f"] != n {
+				t.Errorf("first: counts %v, want every download on the primary", counts)
+			}
+		}},
+		{MirrorRoundRobin, func(t *testing.T, counts map[string]int) {
+			for _, u := range urls {
+				if counts[u] != n/len(urls) {
+					t.Errorf("roundrobin: counts %v, want %d each", counts, n/len(urls))
+				}
+			}
+		}},
+		{MirrorRandom, func(t *testing.T, counts map[string]int) {
+			// Loose bounds that a fair pick practically never misses
+			for _, u := range urls {
+				if c := counts[u]; c < n/len(urls)/2 || c > 2*n/len(urls) {
+					t.Errorf("random: counts %v, want roughly %d each", counts, n/len(urls))
+				}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			s, err := NewMirrorSelector(tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts := map[string]int{}
+			for range n {
+				order := s.order(urls)
+				// Failover still covers every mirror
+				sorted := slices.Sorted(slices.Values(order))
+				if !slices.Equal(sorted, urls) {
+					t.Fatalf("order %q lost or repeated a mirror", order)
+				}
+				counts[order[0]]++
+			}
+			tt.check(t, counts)
+		})
+	}
+	if _, err := NewMirrorSelector("fastest"); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestMirrorSelectorRoundRobinFetch(t *testing.T) {
+	var hits [2]atomic.Int32
+	var urls []string
+	for i := range hits {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+			io.WriteString(w, "data")
+		}))
+		defer srv.Close()
+		urls = append(urls, srv.URL+"/file.bin")
+	}
+	selector, _ := NewMirrorSelector(MirrorRoundRobin)
+	opts := &DownloadOptions{Client: http.DefaultClient, MirrorSelector: selector}
+	for range 4 {
+		if _, err := opts.FetchMirrors(context.Background(), urls, t.TempDir(), "", noProgress); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits[0].Load() != 2 || hits[1].Load() != 2 {
+		t.Errorf("hits %d and %d, want 2 on each mirror", hits[0].Load(), hits[1].Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		status int
+		header string
+		want   time.Duration
+	}{
+		{http.StatusTooManyRequests, "2", 2 * time.Second},
+		{http.StatusTooManyRequests, " 30 ", 30 * time.Second},
+		{http.StatusServiceUnavailable, "5", 5 * time.Second},
+		{http.StatusTooManyRequests, now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{http.StatusTooManyRequests, "Wed, 01 May 2024 12:01:30 GMT", 90 * time.Second},
+		{http.StatusTooManyRequests, now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{http.StatusTooManyRequests, "86400", maxRetryAfter},
+		{http.StatusTooManyRequests, now.Add(time.Hour).Format(http.TimeFormat), maxRetryAfter},
+		{http.StatusTooManyRequests, "-5", 0},
+		{http.StatusTooManyRequests, "soon", 0},
+		{http.StatusTooManyRequests, "", 0},
+		{http.StatusNotFound, "2", 0},
+		{http.StatusOK, "2", 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(resp, now); got != tt.want {
+			t.Errorf("%d with Retry-After %q: %v, want %v", tt.status, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestFetchMirrorsRateLimited(t *testing.T) {
+	for name, header := range map[string]func() string{
+		"seconds":   func() string { return "1" },
+		"HTTP-date": func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if hits.Add(1) == 1 {
+					w.Header().Set("Retry-After", header())
+					http.Error(w, "slow down", http.StatusTooManyRequests)
+					return
+				}
+				io.WriteString(w, "data")
+			}))
+			defer srv.Close()
+
+			// No retries: waiting as the server asked doesn't use one up
+			opts := &DownloadOptions{Client: srv.Client()}
+			start := time.Now()
+			result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, t.TempDir(), "", noProgress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+				t.Errorf("retried after %v, before the Retry-After wait", elapsed)
+			}
+			if data, _ := os.ReadFile(result.Path); string(data) != "data" {
+				t.Errorf("file = %q", data)
+			}
+			if n := hits.Load(); n != 2 {
+				t.Errorf("%d requests, want 2", n)
+			}
+		})
+	}
+}
+
+func TestFetchMirrorsRateLimitCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	opts := &DownloadOptions{Client: srv.Client()}
+	start := time.Now()
+	_, err := opts.FetchMirrors(ctx, []string{srv.URL + "/file.bin"}, t.TempDir(), "", noProgress)
+	if err == nil {
+		t.Fatal("rate-limited download succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelling took %v; the wait should stop with the context", elapsed)
+	}
+}
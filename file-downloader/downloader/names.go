@@ -0,0 +1,235 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func FormatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// Truncate shortens s to at most n characters, ending it with "..." when
+// anything was cut. It counts runes, so multibyte characters stay intact.
+func Truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:max(0, n-3)]) + "..."
+}
+
+// ParseBytes parses a size such as "512", "500K", "1.5G" or "2GB". Units are
+// powers of 1024, matching FormatBytes.
+func ParseBytes(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	num = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(num), "B"), "I")
+	mult := int64(1)
+	if n := len(num); n > 0 {
+		if i := strings.IndexByte("KMGTPE", num[n-1]); i >= 0 {
+			num = num[:n-1]
+			for ; i >= 0; i-- {
+				mult *= 1024
+			}
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+func urlHash(u string) string {
+	h := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(h[:8])
+}
+
+func keys(m map[string]string) []string {
+	k := make([]string, 0, len(m))
+	for key := range m {
+		k = append(k, key)
+	}
+	return k
+}
+
+// SplitOutputName splits the inline "URL>filename" syntax. The returned name
+// is empty when no override was given.
+func SplitOutputName(line string) (string, string) {
+	i := strings.LastIndex(line, ">")
+	if i < 0 {
+		return line, ""
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// MaxNameLength is the longest file name in bytes the output filesystem
+// allows (-max-name-length). Most allow 255.
+var MaxNameLength = 255
+
+// nameHeadroom is kept free below MaxNameLength for what is appended to a
+// name later: the .part suffix, a -collision hash or a .sha256 sidecar.
+const nameHeadroom = 32
+
+// MinNameLength is the smallest -max-name-length, leaving room for the
+// headroom and the hash truncateFilename adds.
+const MinNameLength = 64
+
+// SanitizeFilename makes name safe to use as a single file name inside the
+// output directory, truncating it to fit MaxNameLength. It returns "" when
+// nothing usable is left.
+func SanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		return ""
+	}
+	return truncateFilename(name, MaxNameLength-nameHeadroom)
+}
+
+// truncateFilename shortens a name longer than max bytes, keeping its
+// extension and adding a hash of the full name so that long names sharing a
+// prefix stay distinct: "long…name_1a2b3c4d.zip". The cut never splits a
+// UTF-8 sequence.
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	suffix := "_" + urlHash(name)[:8]
+	ext := filepath.Ext(name)
+	if len(ext) > max/2 {
+		ext = "" // not a real extension, or too long to keep
+	}
+	base := name[:len(name)-len(ext)]
+	n := max - len(suffix) - len(ext)
+	for n > 0 && !utf8.RuneStart(base[n]) {
+		n--
+	}
+	return strings.TrimSpace(base[:n]) + suffix + ext
+}
+
+// expandOutTemplate expands an -out-template into a relative path for
+// filename. Supported placeholders are {host}, {date} / {date:LAYOUT} (Go
+// time layout, default 2006-01-02), {name} (the file name) and {ext} (its
+// extension without the dot). Every path element is sanitized and empty or
+// ".." elements are dropped, so the result always stays inside outputDir.
+func expandOutTemplate(tmpl, rawURL, filename string, now time.Time) string {
+	host := "unknown-host"
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.Hostname() != "" {
+		host = parsed.Hostname()
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(tmpl, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(tmpl[start:], "}")
+		if end < 0 {
+			break
+		}
+		end += start
+		b.WriteString(tmpl[:start])
+
+		key, arg, _ := strings.Cut(tmpl[start+1:end], ":")
+		switch key {
+		case "host":
+			b.WriteString(host)
+		case "date":
+			if arg == "" {
+				arg = "2006-01-02"
+			}
+			b.WriteString(now.Format(arg))
+		case "name":
+			b.WriteString(filename)
+		case "ext":
+			b.WriteString(strings.TrimPrefix(filepath.Ext(filename), "."))
+		default:
+			b.WriteString(tmpl[start : end+1])
+		}
+		tmpl = tmpl[end+1:]
+	}
+	b.WriteString(tmpl)
+
+	var parts []string
+	for _, part := range strings.FieldsFunc(b.String(), func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part = SanitizeFilename(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// ValidateURL rejects anything that isn't an http(s), ftp(s) or s3 URL before any network
+// call is made. Bare inputs like "example.com/x" are prefixed with https://
+// when assumeHTTPS is set. It returns the URL to download.
+func ValidateURL(rawURL string, assumeHTTPS bool) (string, error) {
+	if !strings.Contains(rawURL, "://") {
+		if scheme, _, ok := strings.Cut(rawURL, ":"); ok && scheme != "" && !strings.ContainsAny(scheme, "./") {
+			return "", fmt.Errorf("unsupported URL scheme %q in %s (only http, https, ftp, ftps and s3 are supported)", scheme, rawURL)
+		}
+		if !assumeHTTPS {
+			return "", fmt.Errorf("missing URL scheme in %s (use http:// or https://, or -assume-https)", rawURL)
+		}
+		rawURL = "https://" + rawURL
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %s: %w", rawURL, err)
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https", "ftp", "ftps", "s3":
+	default:
+		return "", fmt.Errorf("unsupported URL scheme %q in %s (only http, https, ftp, ftps and s3 are supported)", parsed.Scheme, rawURL)
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("invalid URL %s: missing host", rawURL)
+	}
+	return rawURL, nil
+}
+
+func FilenameFromURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return urlHash(rawURL)
+	}
+
+	filename := filepath.Base(parsed.Path)
+	if filename == "" || filename == "." || filename == "/" {
+		return urlHash(rawURL)
+	}
+
+	return filename
+}
+
+// CleanLine strips whitespace and stray carriage returns from a pasted line.
+func CleanLine(line string) string {
+	line = strings.TrimSpace(line)
+	return strings.ReplaceAll(line, "\r", "")
+}
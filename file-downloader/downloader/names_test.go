@@ -0,0 +1,197 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		assumeHTTPS bool
+		want        string
+		wantErr     bool
+	}{
+		{"http", "http://example.com/a.iso", false, "http://example.com/a.iso", false},
+		{"https", "https://example.com/a.iso", false, "https://example.com/a.iso", false},
+		{"upper-case scheme", "HTTPS://example.com/a.iso", false, "HTTPS://example.com/a.iso", false},
+		{"ftp", "ftp://example.com/a.iso", false, "ftp://example.com/a.iso", false},
+		{"s3", "s3://bucket/a.iso", false, "s3://bucket/a.iso", false},
+		{"bare domain", "example.com/a.iso", false, "", true},
+		{"bare domain with -assume-https", "example.com/a.iso", true, "https://example.com/a.iso", false},
+		{"bare host and port with -assume-https", "example.com:8080/a.iso", true, "https://example.com:8080/a.iso", false},
+		{"magnet", "magnet:?xt=urn:btih:abc", false, "", true},
+		{"magnet with -assume-https", "magnet:?xt=urn:btih:abc", true, "", true},
+		{"file", "file:///etc/passwd", false, "", true},
+		{"javascript", "javascript:alert(1)", true, "", true},
+		{"missing host", "https:///a.iso", false, "", true},
+		{"empty", "", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateURL(tt.raw, tt.assumeHTTPS)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateURL(%q, %v) err = %v, wantErr %v", tt.raw, tt.assumeHTTPS, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ValidateURL(%q, %v) = %q, want %q", tt.raw, tt.assumeHTTPS, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitOutputName(t *testing.T) {
+	tests := []struct {
+		line, wantURL, wantName string
+	}{
+		{"https://example.com/a?id=1", "https://example.com/a?id=1", ""},
+		{"https://example.com/a?id=1>a.bin", "https://example.com/a?id=1", "a.bin"},
+		{"https://example.com/a?id=1 > a b.bin ", "https://example.com/a?id=1", "a b.bin"},
+		{"https://example.com/a?q=>>x", "https://example.com/a?q=>", "x"},
+	}
+	for _, tt := range tests {
+		u, name := SplitOutputName(tt.line)
+		if u != tt.wantURL || name != tt.wantName {
+			t.Errorf("SplitOutputName(%q) = %q, %q, want %q, %q", tt.line, u, name, tt.wantURL, tt.wantName)
+		}
+	}
+}
+
+func TestExpandOutTemplate(t *testing.T) {
+	now := time.Date(2024, 3, 9, 15, 4, 5, 0, time.UTC)
+	rawURL := "https://cdn.example.com:8443/releases/app-1.2.tar.gz?sig=abc"
+	tests := []struct {
+		tmpl, want string
+	}{
+		{"{host}/{name}", filepath.Join("cdn.example.com", "app-1.2.tar.gz")},
+		{"{date}/{name}", filepath.Join("2024-03-09", "app-1.2.tar.gz")},
+		{"{date:2006/01}/{ext}/{name}", filepath.Join("2024", "03", "gz", "app-1.2.tar.gz")},
+		{"{host}/{unknown}/{name}", filepath.Join("cdn.example.com", "{unknown}", "app-1.2.tar.gz")},
+		{"../../{host}/./{name}", filepath.Join("cdn.example.com", "app-1.2.tar.gz")},
+		{"/etc/{name}", filepath.Join("etc", "app-1.2.tar.gz")},
+		{`..\..\{name}`, "app-1.2.tar.gz"},
+	}
+	for _, tt := range tests {
+		if got := expandOutTemplate(tt.tmpl, rawURL, "app-1.2.tar.gz", now); got != tt.want {
+			t.Errorf("expandOutTemplate(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestOutTemplateCreatesDirectory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), OutTemplate: "{host}/{ext}/{name}"}
+
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/files/report.pdf"}, dir, "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "127.0.0.1", "pdf", "report.pdf")
+	if result.Path != want {
+		t.Errorf("Path = %q, want %q", result.Path, want)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"500K", 500 << 10, false},
+		{"500M", 500 << 20, false},
+		{"500mb", 500 << 20, false},
+		{"500MiB", 500 << 20, false},
+		{"1.5G", 3 << 29, false},
+		{" 2GB ", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"-5M", 0, true},
+		{"5X", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBytes(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseBytes(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	long := "https://example.com/" + strings.Repeat("x", 100)
+	unicode := "https://example.com/" + strings.Repeat("ж", 100)
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"https://example.com/a.iso", 80, "https://example.com/a.iso"},
+		{long[:80], 80, long[:80]},
+		{long, 80, long[:77] + "..."},
+		{unicode, 30, "https://example.com/жжжжжжж..."},
+		{"жжжж", 4, "жжжж"},
+		{"abcdef", 2, "..."},
+	}
+	for _, tt := range tests {
+		got := Truncate(tt.in, tt.n)
+		if got != tt.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("Truncate(%q, %d) = %q, not valid UTF-8", tt.in, tt.n, got)
+		}
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	ascii := strings.Repeat("a", 296) + ".zip"
+	cyrillic := strings.Repeat("ж", 150) + ".zip" // 2 bytes a rune
+	limit := MaxNameLength - nameHeadroom
+
+	for _, name := range []string{ascii, cyrillic, strings.Repeat("b", 300), strings.Repeat("c", 200) + "." + strings.Repeat("d", 100)} {
+		got := SanitizeFilename(name)
+		if len(got) > limit {
+			t.Errorf("%d-byte name shortened to %d bytes, limit %d", len(name), len(got), limit)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%d-byte name shortened to invalid UTF-8 %q", len(name), got)
+		}
+		if got == name || got[:10] != name[:10] {
+			t.Errorf("%d-byte name shortened to %q", len(name), got)
+		}
+	}
+	if got := SanitizeFilename(ascii); filepath.Ext(got) != ".zip" || !strings.HasSuffix(got, "_"+urlHash(ascii)[:8]+".zip") {
+		t.Errorf("long name shortened to %q, want the hash before the kept extension", got)
+	}
+	// Names sharing a long prefix stay distinct
+	if a, b := SanitizeFilename(ascii), SanitizeFilename(strings.Repeat("a", 296)+"b.zip"); a == b {
+		t.Errorf("both names shortened to %q", a)
+	}
+	if name := strings.Repeat("a", limit); SanitizeFilename(name) != name {
+		t.Error("a name at the limit was shortened")
+	}
+
+	old := MaxNameLength
+	t.Cleanup(func() { MaxNameLength = old })
+	MaxNameLength = MinNameLength
+	if got := SanitizeFilename(ascii); len(got) > MinNameLength-nameHeadroom || filepath.Ext(got) != ".zip" {
+		t.Errorf("with MaxNameLength %d: %q", MinNameLength, got)
+	}
+}
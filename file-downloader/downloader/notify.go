@@ -0,0 +1,117 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// notifyTimeout bounds webhook calls and notify commands so a broken
+// endpoint can't hold up the next download.
+const notifyTimeout = 10 * time.Second
+
+// Notification is the payload sent when a download finishes or fails.
+type Notification struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Notifier posts a Notification to a webhook and/or runs a shell command
+// with the notification fields in DOWNLOAD_* environment variables.
+type Notifier struct {
+	URL     string
+	Command string
+	Client  *http.Client
+}
+
+// Notify delivers n. Failures are reported on stderr and otherwise ignored.
+func (nt *Notifier) Notify(n Notification) {
+	if nt == nil {
+		return
+	}
+	if nt.URL != "" {
+		if err := nt.post(n); err != nil {
+			slog.Warn("notification webhook failed", "url", nt.URL, "error", err)
+		}
+	}
+	if nt.Command != "" {
+		if err := nt.run(n); err != nil {
+			slog.Warn("notification command failed", "error", err)
+		}
+	}
+}
+
+func (nt *Notifier) post(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", nt.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := nt.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (nt *Notifier) run(n Notification) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", nt.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", nt.Command)
+	}
+	cmd.Env = append(os.Environ(),
+		"DOWNLOAD_URL="+n.URL,
+		"DOWNLOAD_FILENAME="+n.Filename,
+		"DOWNLOAD_SIZE="+strconv.FormatInt(n.Size, 10),
+		"DOWNLOAD_SUCCESS="+strconv.FormatBool(n.Success),
+		"DOWNLOAD_ERROR="+n.Error,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Notify reports the outcome of a download through o.Notifier, if set.
+func (o *DownloadOptions) Notify(rawURL, filename string, result *DownloadResult, err error) {
+	if o.Notifier == nil {
+		return
+	}
+	n := Notification{URL: rawURL, Filename: filename, Success: err == nil}
+	if err != nil {
+		n.Error = err.Error()
+	} else {
+		n.Filename = result.Path
+		n.Size = result.Size
+	}
+	o.Notifier.Notify(n)
+}
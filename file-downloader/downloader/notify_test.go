@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNotifierWebhook(t *testing.T) {
+	payloads := make(chan Notification, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		payloads <- n
+	}))
+	defer srv.Close()
+
+	opts := &DownloadOptions{Notifier: &Notifier{URL: srv.URL, Client: srv.Client()}}
+	tests := []struct {
+		name   string
+		result *DownloadResult
+		err    error
+		want   Notification
+	}{
+		{
+			name:   "success",
+			result: &DownloadResult{Path: "/downloads/a.iso", Size: 42},
+			want:   Notification{URL: "https://example.com/a.iso", Filename: "/downloads/a.iso", Size: 42, Success: true},
+		},
+		{
+			name: "failure",
+			err:  errors.New("404 Not Found"),
+			want: Notification{URL: "https://example.com/a.iso", Filename: "a.iso", Error: "404 Not Found"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts.Notify("https://example.com/a.iso", "a.iso", tt.result, tt.err)
+			if got := <-payloads; got != tt.want {
+				t.Errorf("payload = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifierCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	out := filepath.Join(t.TempDir(), "env.txt")
+	nt := &Notifier{Command: `printf '%s|%s|%s|%s' "$DOWNLOAD_URL" "$DOWNLOAD_FILENAME" "$DOWNLOAD_SIZE" "$DOWNLOAD_SUCCESS" > ` + out}
+	nt.Notify(Notification{URL: "https://example.com/a.iso", Filename: "/downloads/a.iso", Size: 42, Success: true})
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://example.com/a.iso|/downloads/a.iso|42|true"; strings.TrimSpace(string(data)) != want {
+		t.Errorf("command saw %q, want %q", data, want)
+	}
+}
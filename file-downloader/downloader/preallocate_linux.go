@@ -0,0 +1,31 @@
+//go:build linux
+
+package downloader
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves size bytes of disk space for f. FALLOC_FL_KEEP_SIZE
+// leaves the file's size alone, so an interrupted .part file still resumes
+// from the bytes actually written.
+func preallocate(f *os.File, size int64) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ctlErr := conn.Control(func(fd uintptr) {
+		for {
+			err = unix.Fallocate(int(fd), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+			if err != unix.EINTR {
+				return
+			}
+		}
+	})
+	if ctlErr != nil {
+		return ctlErr
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPreallocate(t *testing.T) {
+	dir := t.TempDir()
+	probe, err := os.Create(filepath.Join(dir, "probe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = preallocate(probe, 4096)
+	probe.Close()
+	os.Remove(probe.Name())
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("the temp directory's filesystem can't preallocate")
+	}
+
+	const size = 8 << 20
+	first := make([]byte, 1024)
+	sent, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Write(first)
+		w.(http.Flusher).Flush()
+		close(sent)
+		<-release
+		w.Write(make([]byte, size-len(first)))
+	}))
+	defer srv.Close()
+
+	opts := &DownloadOptions{Client: srv.Client(), Preallocate: true}
+	done := make(chan error, 1)
+	go func() {
+		_, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/big.bin"}, dir, "", noProgress)
+		done <- err
+	}()
+	<-sent
+
+	// While downloading, the whole size is reserved but the file only as
+	// long as what was written, so an interrupted .part resumes correctly
+	part := PartPath(filepath.Join(dir, "big.bin"))
+	var st syscall.Stat_t
+	deadline := time.Now().Add(5 * time.Second)
+	for syscall.Stat(part, &st) != nil || st.Size < int64(len(first)) {
+		if time.Now().After(deadline) {
+			t.Fatal("the first bytes never reached the .part file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.Blocks*512 < size {
+		t.Errorf("%d bytes allocated, want at least %d", st.Blocks*512, size)
+	}
+	if st.Size != int64(len(first)) {
+		t.Errorf(".part is %d bytes, want the %d written", st.Size, len(first))
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "big.bin")); err != nil || fi.Size() != size {
+		t.Errorf("big.bin: %v, %v; want %d bytes", fi, err, size)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package downloader
+
+import "os"
+
+// preallocate sizes f to size bytes. Without fallocate this only reserves
+// space on filesystems that don't create sparse files; save truncates the
+// file back to what was written if the download is interrupted.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
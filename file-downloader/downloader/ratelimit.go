@@ -0,0 +1,101 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting throughput to a number of bytes per
+// second. One limiter can be shared by several readers, which then split the
+// rate between them.
+type RateLimiter struct {
+	rate float64 // bytes per second
+
+	mu     sync.Mutex
+	tokens float64 // may go negative; readers wait until it's paid back
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter for bytesPerSec, or nil (no limit) when
+// it is 0 or less. The bucket holds at most one second's worth of bytes.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, sleeping until they are covered or ctx
+// is done.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from r no faster than every one of its limiters
+// allows, so the tightest limit wins.
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+	chunk    int // largest read, so a single read never exceeds a bucket
+}
+
+// limiters returns a fresh bucket for the per-download Limit plus the shared
+// TotalLimiter, leaving out the ones that aren't set. Everything reading for
+// one download should share the result.
+func (o *DownloadOptions) limiters() []*RateLimiter {
+	var limiters []*RateLimiter
+	if l := NewRateLimiter(o.Limit); l != nil {
+		limiters = append(limiters, l)
+	}
+	if o.TotalLimiter != nil {
+		limiters = append(limiters, o.TotalLimiter)
+	}
+	return limiters
+}
+
+// throttle wraps r so it reads no faster than limiters allow. r is returned
+// as is when there are none.
+func throttle(ctx context.Context, r io.Reader, limiters []*RateLimiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+	chunk := 32 * 1024
+	for _, l := range limiters {
+		chunk = max(1, min(chunk, int(l.rate)))
+	}
+	return &throttledReader{ctx: ctx, r: r, limiters: limiters, chunk: chunk}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n, err := t.r.Read(p)
+	for _, l := range t.limiters {
+		if werr := l.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
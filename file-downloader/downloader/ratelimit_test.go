@@ -0,0 +1,69 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttledFetch downloads size bytes from a local server once per options
+// in opts, all at the same time, and returns how long that took.
+func throttledFetch(t *testing.T, size int, opts ...*DownloadOptions) time.Duration {
+	t.Helper()
+	body := strings.Repeat("x", size)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, o := range opts {
+		o.Client = srv.Client()
+		wg.Go(func() {
+			result, err := o.FetchMirrors(context.Background(), []string{srv.URL + "/file.bin"}, t.TempDir(), "", noProgress)
+			if err != nil {
+				t.Errorf("download %d: %v", i, err)
+			} else if result.Size != int64(size) {
+				t.Errorf("download %d: %d bytes, want %d", i, result.Size, size)
+			}
+		})
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestTotalLimit(t *testing.T) {
+	const rate = 20_000
+	shared := NewRateLimiter(rate)
+	// Two streams of rate bytes each. The bucket starts with one second's
+	// worth, so the second second must be paid for at the capped rate.
+	elapsed := throttledFetch(t, rate, &DownloadOptions{TotalLimiter: shared}, &DownloadOptions{TotalLimiter: shared})
+	if elapsed < 900*time.Millisecond {
+		t.Errorf("2 x %d bytes took %v under a %d B/s total limit, want at least ~1s", rate, elapsed, rate)
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("took %v, want about 1s", elapsed)
+	}
+}
+
+func TestLimitsCompose(t *testing.T) {
+	// The per-download limit is tighter than the total, so it wins
+	const size = 20_000
+	elapsed := throttledFetch(t, size, &DownloadOptions{Limit: size / 2, TotalLimiter: NewRateLimiter(size * 100)})
+	if elapsed < 900*time.Millisecond {
+		t.Errorf("%d bytes at %d B/s took %v, want at least ~1s", size, size/2, elapsed)
+	}
+
+	// Unlimited readers aren't wrapped at all
+	if _, ok := throttle(context.Background(), strings.NewReader(""), (&DownloadOptions{}).limiters()).(*throttledReader); ok {
+		t.Error("reader throttled without any limit")
+	}
+	if NewRateLimiter(0) != nil {
+		t.Error("NewRateLimiter(0) is a limit")
+	}
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// redactedValue replaces the values of -redact-query parameters.
+const redactedValue = "REDACTED"
+
+// redactURL masks the RedactQuery parameters of rawURL ("*" masks all of
+// them) and returns the URL with its query in sorted order, so the same
+// download always maps to the same history key even when its signed
+// parameters change. Without RedactQuery rawURL is returned unchanged.
+func (o *DownloadOptions) redactURL(rawURL string) string {
+	if len(o.RedactQuery) == 0 || rawURL == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+	query := u.Query()
+	for key, values := range query {
+		if !o.redacts(key) {
+			continue
+		}
+		for i := range values {
+			values[i] = redactedValue
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redacts reports whether the query parameter key is masked.
+func (o *DownloadOptions) redacts(key string) bool {
+	for _, k := range o.RedactQuery {
+		if k == "*" || strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalizeURL returns a normal form of rawURL for -normalize, so
+// equivalent spellings of a URL share a history entry: scheme and host are
+// lowercased, default ports dropped, "." and ".." resolved in the path,
+// query parameters sorted and the fragment removed. URLs that don't parse
+// are returned unchanged.
+func canonicalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); port == "80" && u.Scheme == "http" || port == "443" && u.Scheme == "https" {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	clean := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && clean != "/" {
+		clean += "/"
+	}
+	u.Path, u.RawPath = clean, ""
+	if u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
+
+// HistoryKey returns the URL rawURL is stored and looked up under in
+// history: redacted, and canonicalized with -normalize.
+func (o *DownloadOptions) HistoryKey(rawURL string) string {
+	key := o.redactURL(rawURL)
+	if o.Normalize {
+		key = canonicalizeURL(key)
+	}
+	return key
+}
+
+// HistoryRecord is newDownloadRecord with every URL redacted and the
+// record keyed by HistoryKey. rawURL is the full URL that was requested.
+// When -normalize changed it, the URL as given (still redacted) is kept in
+// OriginalURL for display.
+func (o *DownloadOptions) HistoryRecord(rawURL string, result *DownloadResult, started time.Time) DownloadRecord {
+	r := newDownloadRecord(rawURL, result, started)
+	r.URL, r.FinalURL, r.Mirror = o.HistoryKey(rawURL), o.redactURL(r.FinalURL), o.redactURL(r.Mirror)
+	if given := o.redactURL(rawURL); given != r.URL {
+		r.OriginalURL = given
+	}
+	return r
+}
+
+// FailureRecord builds the -track-failures record for a failed download of
+// rawURL, with URLs redacted the same way as in HistoryRecord.
+func (o *DownloadOptions) FailureRecord(rawURL string, err error) FailureRecord {
+	f := FailureRecord{URL: o.HistoryKey(rawURL), Error: err.Error(), Time: time.Now()}
+	// Client errors quote the request URL
+	if given := o.redactURL(rawURL); given != rawURL {
+		f.Error = strings.ReplaceAll(f.Error, rawURL, given)
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		f.Status, f.FinalURL = se.Code, o.redactURL(se.URL)
+	}
+	return f
+}
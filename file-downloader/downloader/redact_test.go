@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		keys []string
+		in   string
+		want string
+	}{
+		{nil, "https://example.com/a.iso?token=abc", "https://example.com/a.iso?token=abc"},
+		{[]string{"token"}, "https://example.com/a.iso?token=abc&v=2", "https://example.com/a.iso?token=REDACTED&v=2"},
+		{[]string{"TOKEN"}, "https://example.com/a.iso?Token=abc", "https://example.com/a.iso?Token=REDACTED"},
+		{[]string{"X-Amz-Signature", "X-Amz-Credential"}, "https://bucket.s3.amazonaws.com/a.iso?X-Amz-Signature=f00&X-Amz-Credential=AKIA&X-Amz-Expires=60",
+			"https://bucket.s3.amazonaws.com/a.iso?X-Amz-Credential=REDACTED&X-Amz-Expires=60&X-Amz-Signature=REDACTED"},
+		{[]string{"*"}, "https://example.com/a.iso?b=1&a=2&a=3", "https://example.com/a.iso?a=REDACTED&a=REDACTED&b=REDACTED"},
+		{[]string{"token"}, "https://example.com/a.iso", "https://example.com/a.iso"},
+	}
+	for _, tt := range tests {
+		o := &DownloadOptions{RedactQuery: tt.keys}
+		if got := o.redactURL(tt.in); got != tt.want {
+			t.Errorf("redactURL(%q) with %q = %q, want %q", tt.in, tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestHistoryRecordRedacted(t *testing.T) {
+	o := &DownloadOptions{RedactQuery: []string{"token"}}
+	first := "https://example.com/a.iso?token=first&v=2"
+	// The same download with a fresh token and its parameters reordered
+	second := "https://example.com/a.iso?v=2&token=second"
+	if o.HistoryKey(first) != o.HistoryKey(second) {
+		t.Errorf("keys differ: %q and %q", o.HistoryKey(first), o.HistoryKey(second))
+	}
+
+	result := &DownloadResult{
+		URL:      "https://mirror.example.org/a.iso?token=first&v=2",
+		FinalURL: "https://cdn.example.net/a.iso?token=first",
+		Path:     "/downloads/a.iso",
+	}
+	r := o.HistoryRecord(first, result, time.Time{})
+	for _, u := range []string{r.URL, r.FinalURL, r.Mirror, r.OriginalURL} {
+		if strings.Contains(u, "first") {
+			t.Errorf("record keeps the token: %+v", r)
+		}
+	}
+	if r.URL != o.HistoryKey(first) || r.Mirror == "" || r.FinalURL == "" {
+		t.Errorf("record URL %q, Mirror %q, FinalURL %q", r.URL, r.Mirror, r.FinalURL)
+	}
+
+	err := &statusError{Code: 403, Status: "403 Forbidden", URL: result.FinalURL}
+	f := o.FailureRecord(first, fmt.Errorf("Get %q: %w", first, err))
+	if strings.Contains(f.URL+f.FinalURL+f.Error, "first") || f.Status != 403 {
+		t.Errorf("failure record keeps the token: %+v", f)
+	}
+}
+
+func TestCanonicalizeURL(t *testing.T) {
+	const canonical = "https://example.com/files/a.iso?b=1&c=2"
+	equivalent := []string{
+		"https://example.com/files/a.iso?b=1&c=2",
+		"https://example.com/files/a.iso?c=2&b=1",
+		"HTTPS://Example.COM/files/a.iso?b=1&c=2",
+		"https://example.com:443/files/a.iso?b=1&c=2",
+		"https://example.com/files/./a.iso?b=1&c=2",
+		"https://example.com/downloads/../files/a.iso?b=1&c=2",
+		"https://example.com//files/a.iso?b=1&c=2",
+		"https://example.com/files/a.iso?b=1&c=2#section",
+	}
+	for _, u := range equivalent {
+		if got := canonicalizeURL(u); got != canonical {
+			t.Errorf("canonicalizeURL(%q) = %q, want %q", u, got, canonical)
+		}
+	}
+
+	// Differences that matter are kept
+	distinct := map[string]string{
+		"http://example.com:80/a":   "http://example.com/a",
+		"http://example.com:8080/a": "http://example.com:8080/a",
+		"https://example.com/dir/":  "https://example.com/dir/",
+		"https://example.com":       "https://example.com/",
+		"https://example.com/A.iso": "https://example.com/A.iso",
+		"https://example.com/a?b=2": "https://example.com/a?b=2",
+		"https://example.com/a%20b": "https://example.com/a%20b",
+		"http://example.com:443/a":  "http://example.com:443/a",
+		"not a url with no host":    "not a url with no host",
+	}
+	for in, want := range distinct {
+		if got := canonicalizeURL(in); got != want {
+			t.Errorf("canonicalizeURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNormalizeHistoryKey(t *testing.T) {
+	a, b := "https://Example.com/a.iso?b=1&c=2", "https://example.com:443/./a.iso?c=2&b=1"
+	o := &DownloadOptions{}
+	if o.HistoryKey(a) == o.HistoryKey(b) {
+		t.Error("URLs share a key without -normalize")
+	}
+	o.Normalize = true
+	if o.HistoryKey(a) != o.HistoryKey(b) {
+		t.Errorf("keys %q and %q differ with -normalize", o.HistoryKey(a), o.HistoryKey(b))
+	}
+
+	// The record keeps the URL as given for display
+	r := o.HistoryRecord(a, &DownloadResult{URL: a, Path: "/downloads/a.iso"}, time.Time{})
+	if r.URL != "https://example.com/a.iso?b=1&c=2" || r.OriginalURL != a {
+		t.Errorf("record URL %q, OriginalURL %q", r.URL, r.OriginalURL)
+	}
+}
@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// reindexURL is the synthetic URL -reindex records a file under. The
+// original URL is unknown; a file URL of its absolute path is unique and
+// ends in the file name, so repairFileIndex derives the same name entry.
+func reindexURL(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// RunReindex implements -reindex: it adds a history record and a file name
+// entry for every file in outputDir that the history doesn't know, so later
+// downloads of the same name are skipped. It finds them the way -clean does,
+// minus .part and checksum files. Files whose name is already in the index
+// are counted but left alone, since duplicate detection covers them.
+func RunReindex(outputDir string, store Store, keep []string) error {
+	files, err := findOrphans(outputDir, store, keep)
+	if err != nil {
+		return err
+	}
+
+	var added, taken int
+	var total int64
+	for _, f := range files {
+		if strings.HasSuffix(f.Path, PartSuffix) || strings.HasSuffix(f.Path, checksumSuffix) {
+			continue
+		}
+		name := filepath.Base(f.Path)
+		if store.HasFilename(name) {
+			taken++
+			continue
+		}
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			return err
+		}
+		record := DownloadRecord{
+			URL:        reindexURL(f.Path),
+			Filename:   f.Path,
+			Downloaded: info.ModTime(),
+			Size:       info.Size(),
+		}
+		if err := store.Put(name, record); err != nil {
+			return err
+		}
+		added++
+		total += info.Size()
+		fmt.Printf("  + %s (%s)\n", f.Path, FormatBytes(info.Size()))
+	}
+
+	fmt.Printf("Indexed %d files, %s\n", added, FormatBytes(total))
+	if taken > 0 {
+		fmt.Printf("%d files were skipped because a file with the same name is already in history\n", taken)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRunReindex(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.MkdirAll(filepath.Join(dir, "copies"), 0755)
+	historyPath := filepath.Join(dir, "history.json")
+	store, err := OpenStore("", historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := testRecord("app.iso")
+	known.Filename = writeTestFile(t, dir, "app.iso", []byte("app"))
+	if err := store.Put("app.iso", known); err != nil {
+		t.Fatal(err)
+	}
+
+	newFile := writeTestFile(t, dir, "new.bin", []byte("twelve bytes"))
+	mtime := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(newFile, mtime, mtime)
+	nested := writeTestFile(t, dir, "sub/nested.txt", []byte("nested"))
+	writeTestFile(t, dir, "new.bin"+checksumSuffix, []byte("sum"))
+	writeTestFile(t, dir, "crashed.zip"+PartSuffix, []byte("partial"))
+	// Same name as a known download: left to duplicate detection
+	writeTestFile(t, dir, "copies/app.iso", []byte("copy"))
+
+	if err := RunReindex(dir, store, HistoryPaths(historyPath, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	var indexed []string
+	for _, r := range store.All() {
+		indexed = append(indexed, r.Filename)
+	}
+	slices.Sort(indexed)
+	if want := []string{known.Filename, newFile, nested}; !slices.Equal(indexed, want) {
+		t.Errorf("records for %q, want %q", indexed, want)
+	}
+	record, ok := store.Get(reindexURL(newFile))
+	if !ok {
+		t.Fatalf("no record under %s", reindexURL(newFile))
+	}
+	if record.Size != 12 || !record.Downloaded.Equal(mtime) {
+		t.Errorf("record has size %d, downloaded %v; want 12 and the file's mtime", record.Size, record.Downloaded)
+	}
+	// Later downloads of these names are found as duplicates
+	for _, name := range []string{"new.bin", "nested.txt"} {
+		if !store.HasFilename(name) {
+			t.Errorf("%s is not in the file name index", name)
+		}
+	}
+	if store.HasFilename("crashed.zip"+PartSuffix) || store.HasFilename("new.bin"+checksumSuffix) {
+		t.Error(".part or checksum file indexed")
+	}
+
+	// The index is saved, and running again adds nothing
+	reopened, err := OpenStore("", historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RunReindex(dir, reopened, HistoryPaths(historyPath, "")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(reopened.All()); n != 3 {
+		t.Errorf("%d records after a second -reindex, want 3", n)
+	}
+}
+
+func TestReindexURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "my file.iso")
+	u := reindexURL(path)
+	if FilenameFromURL(u) != "my file.iso" {
+		t.Errorf("FilenameFromURL(%q) = %q, want the file's name", u, FilenameFromURL(u))
+	}
+}
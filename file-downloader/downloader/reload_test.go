@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	store, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(name string, size int64) {
+		t.Helper()
+		record := DownloadRecord{URL: "https://example.com/files/" + name, Filename: name, Size: size, Downloaded: time.Now()}
+		if err := store.Put(name, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// edit changes the file behind the store's back, as a text editor
+	// would: what the log holds beyond it isn't there to edit
+	edit := func(fn func(h *History)) {
+		t.Helper()
+		h, _, err := loadHistory(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(h)
+		data, _ := json.Marshal(h)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setSize := func(name string, size int64) func(h *History) {
+		return func(h *History) {
+			r := h.Downloads["https://example.com/files/"+name]
+			r.Size = size
+			h.Downloads[r.URL] = r
+		}
+	}
+	reload := func(want int) {
+		t.Helper()
+		if n, err := store.Reload(); err != nil || n != want {
+			t.Errorf("Reload() = %d, %v, want %d records", n, err, want)
+		}
+	}
+	sizes := func() map[string]int64 {
+		sizes := make(map[string]int64)
+		for _, r := range store.All() {
+			sizes[r.Filename] = r.Size
+		}
+		return sizes
+	}
+	// A finished run leaves its downloads in the file
+	put("a.bin", 100)
+	put("b.bin", 200)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = openJSONStore(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop a.bin and change b.bin
+	edit(func(h *History) {
+		delete(h.Downloads, "https://example.com/files/a.bin")
+		delete(h.DownloadedFiles, "a.bin")
+		setSize("b.bin", 12345)(h)
+	})
+	reload(1)
+	if want := map[string]int64{"b.bin": 12345}; !maps.Equal(sizes(), want) {
+		t.Errorf("history after reload = %v, want %v", sizes(), want)
+	}
+	if store.HasFilename("a.bin") {
+		t.Error("the removed record's file name is still known")
+	}
+
+	// A download that completes between an edit and the reload is kept,
+	// and so is the edit
+	edit(setSize("b.bin", 7))
+	put("c.bin", 300)
+	reload(2)
+	if want := map[string]int64{"b.bin": 7, "c.bin": 300}; !maps.Equal(sizes(), want) {
+		t.Errorf("history after reload = %v, want %v", sizes(), want)
+	}
+
+	// So is one that is only in the log when the file is edited after it
+	put("d.bin", 400)
+	edit(setSize("b.bin", 8))
+	reload(3)
+	if want := map[string]int64{"b.bin": 8, "c.bin": 300, "d.bin": 400}; !maps.Equal(sizes(), want) {
+		t.Errorf("history after reload = %v, want %v", sizes(), want)
+	}
+	if !store.HasFilename("d.bin") {
+		t.Error("d.bin's file name was lost")
+	}
+}
@@ -0,0 +1,133 @@
+package downloader
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// emptySHA256 is the hex SHA-256 of an empty payload, sent as
+// x-amz-content-sha256 for GET and HEAD requests.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Transport is an http.RoundTripper for s3://bucket/key URLs, registered on
+// the download client like ftpTransport. Each request is rewritten to the
+// bucket's HTTPS endpoint, signed with the AWS SDK's Signature Version 4
+// signer and sent with next, so ranges, segments and resuming work as for
+// any HTTP server.
+//
+// Credentials and region are loaded by the AWS SDK the way the AWS tools
+// read them: the AWS_* environment variables, then the AWS_PROFILE profile
+// of ~/.aws/credentials and ~/.aws/config, including SSO and assumed roles.
+// EC2 instance metadata isn't queried. The configuration is loaded once per
+// transport, on its first request, and its credentials cache keeps temporary
+// credentials until they expire. Without credentials requests are sent
+// unsigned, which works for public buckets. AWS_ENDPOINT_URL_S3 or
+// AWS_ENDPOINT_URL points at another S3-compatible service, addressed
+// path-style. The credentials only ever go into request headers, never into
+// URLs, so they can't end up in history.
+type s3Transport struct {
+	next http.RoundTripper
+
+	once   sync.Once
+	cfg    aws.Config
+	cfgErr error
+}
+
+// s3Signer signs S3 requests. S3 paths are signed as sent rather than
+// escaped a second time.
+var s3Signer = v4.NewSigner(func(o *v4.SignerOptions) {
+	o.DisableURIPathEscaping = true
+})
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "" {
+		return nil, errors.New("s3: missing bucket name")
+	}
+	ctx := req.Context()
+	cfg, err := t.config()
+	if err != nil {
+		return nil, err
+	}
+	region := cmp.Or(cfg.Region, "us-east-1")
+	target, err := s3Endpoint(req.URL, region)
+	if err != nil {
+		return nil, err
+	}
+
+	out := req.Clone(ctx)
+	out.URL, out.Host = target, ""
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		slog.Debug("no AWS credentials, sending the request unsigned", "error", err)
+	} else if err := signS3Request(ctx, out, creds, region, time.Now()); err != nil {
+		return nil, fmt.Errorf("s3: signing request: %w", err)
+	}
+	return t.next.RoundTrip(out)
+}
+
+// config returns the AWS configuration, loading it on the first call. It
+// isn't loaded with the request's context, which may be canceled while
+// later requests still use the result.
+func (t *s3Transport) config() (aws.Config, error) {
+	t.once.Do(func() {
+		t.cfg, t.cfgErr = config.LoadDefaultConfig(context.Background(), config.WithEC2IMDSClientEnableState(imds.ClientDisabled))
+		if t.cfgErr != nil {
+			t.cfgErr = fmt.Errorf("s3: loading AWS configuration: %w", t.cfgErr)
+		}
+	})
+	return t.cfg, t.cfgErr
+}
+
+// s3Endpoint returns the HTTPS URL of the object an s3:// URL names.
+// Buckets are addressed virtual-hosted style on AWS unless their names have
+// dots, which don't match the wildcard certificate, and path-style on a
+// custom endpoint.
+func s3Endpoint(u *url.URL, region string) (*url.URL, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if key == "" {
+		return nil, fmt.Errorf("s3: missing object key in %s", u.Redacted())
+	}
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		base, err := url.Parse(endpoint)
+		if err != nil || base.Host == "" {
+			return nil, fmt.Errorf("s3: invalid endpoint %q", endpoint)
+		}
+		return &url.URL{Scheme: base.Scheme, Host: base.Host, Path: strings.TrimSuffix(base.Path, "/") + "/" + bucket + "/" + key, RawQuery: u.RawQuery}, nil
+	}
+	if strings.Contains(bucket, ".") {
+		return &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com", Path: "/" + bucket + "/" + key, RawQuery: u.RawQuery}, nil
+	}
+	return &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com", Path: "/" + key, RawQuery: u.RawQuery}, nil
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header to req,
+// a GET or HEAD without a body.
+func signS3Request(ctx context.Context, req *http.Request, creds aws.Credentials, region string, now time.Time) error {
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	return s3Signer.SignHTTP(ctx, creds, req, emptySHA256, "s3", region, now)
+}
+
+// firstEnv returns the value of the first of the named environment
+// variables that is set.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
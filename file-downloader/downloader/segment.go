@@ -0,0 +1,166 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minSegmentSize keeps -segments from splitting small files into ranges
+// that cost more in requests than they gain.
+const minSegmentSize = 256 * 1024
+
+// segmentCount returns how many ranges to download resp's body in, or 1
+// for a single stream. Segmenting needs range support and a known,
+// unencoded length.
+func (o *DownloadOptions) segmentCount(resp *http.Response, total int64, decoded bool) int {
+	if o.Segments < 2 || decoded || total <= 0 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return 1
+	}
+	return int(max(1, min(int64(o.Segments), total/minSegmentSize, 64)))
+}
+
+// syncWriter serializes writes from concurrent segments.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// saveSegments is save for a body split into n ranges fetched concurrently.
+// The file is allocated up front and each range written at its offset. The
+// first range is read from resp, which already carries the start of the
+// body; the others get their own Range requests against the final URL.
+//
+// A segmented .part file has holes until every range finishes, so unlike a
+// single stream it can't be resumed and is removed on any failure.
+func (o *DownloadOptions) saveSegments(ctx context.Context, resp *http.Response, out *os.File, outputPath string, total int64, n int, newProgress ProgressFunc, cancel context.CancelFunc) (*DownloadResult, error) {
+	part := PartPath(outputPath)
+	fail := func(err error) (*DownloadResult, error) {
+		out.Close()
+		os.Remove(part)
+		return nil, err
+	}
+	if err := out.Truncate(total); err != nil {
+		return fail(err)
+	}
+
+	progress := newProgress(outputPath, 0, total)
+	var watchdog *stallWatchdog
+	if o.StallTimeout > 0 {
+		watchdog = newStallWatchdog(o.StallTimeout, cancel)
+		defer watchdog.Stop()
+		progress = io.MultiWriter(progress, watchdog)
+	}
+	var speed *speedWatchdog
+	if o.MinSpeed > 0 {
+		speed = newSpeedWatchdog(o.MinSpeed, cancel)
+		defer speed.Stop()
+		progress = io.MultiWriter(progress, speed)
+	}
+	progress = &syncWriter{w: progress}
+	limiters := o.limiters()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	size := (total + int64(n) - 1) / int64(n)
+	for i := range n {
+		start := int64(i) * size
+		end := min(start+size, total) // exclusive
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := o.fetchSegment(ctx, resp, i == 0, out, start, end, limiters, progress)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("segment %d (bytes %d-%d): %w", i+1, start, end-1, err)
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		if watchdog != nil && watchdog.Stalled() {
+			return fail(fmt.Errorf("%w: no data received for %s", ErrStalled, o.StallTimeout))
+		}
+		if speed != nil && speed.Slow() {
+			return fail(o.slowError())
+		}
+		return fail(firstErr)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(part)
+		return nil, err
+	}
+	if err := o.finish(part, outputPath, resp.Header.Get("Last-Modified"), nil); err != nil {
+		return nil, err
+	}
+
+	sum, _ := fileSHA256(outputPath)
+	return &DownloadResult{
+		Path:     outputPath,
+		Size:     total,
+		FinalURL: resp.Request.URL.String(),
+		SHA256:   sum,
+
+		AcceptRanges: true,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// fetchSegment writes bytes [start, end) of the body into out. With first
+// set they are read from resp itself; otherwise a Range request is made.
+func (o *DownloadOptions) fetchSegment(ctx context.Context, resp *http.Response, first bool, out *os.File, start, end int64, limiters []*RateLimiter, progress io.Writer) error {
+	body := resp.Body
+	if !first {
+		req, err := http.NewRequestWithContext(ctx, "GET", resp.Request.URL.String(), nil)
+		if err != nil {
+			return err
+		}
+		o.setHeaders(req)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+		// Don't let the transport gzip a range; offsets must be raw bytes
+		req.Header.Set("Accept-Encoding", "identity")
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-Range", etag)
+		}
+
+		r, err := o.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		if r.StatusCode != http.StatusPartialContent {
+			return &statusError{Code: r.StatusCode, Status: r.Status, URL: r.Request.URL.String()}
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(start, 10)+"-") {
+			return errors.New("server returned the wrong range")
+		}
+		body = r.Body
+	}
+
+	want := end - start
+	w := io.NewOffsetWriter(out, start)
+	n, err := o.copyBody(w, io.TeeReader(throttle(ctx, io.LimitReader(body, want), limiters), progress))
+	if err == nil && n < want {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer serves body with range support unless noRanges is set, and
+// records the Range header of every GET. Range requests for failRange get a
+// 500 instead.
+func rangeServer(t *testing.T, body []byte, noRanges bool, failRange string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if noRanges {
+			w.Write(body)
+			return
+		}
+		if failRange != "" && r.Header.Get("Range") == failRange {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+// segmentBody returns size bytes that differ from one segment to the next,
+// so misplaced ranges show up.
+func segmentBody(size int) []byte {
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	return body
+}
+
+func TestSegmentedDownload(t *testing.T) {
+	body := segmentBody(4*minSegmentSize + 1000)
+	srv, requests := rangeServer(t, body, false, "")
+
+	opts := &DownloadOptions{Client: srv.Client(), Segments: 4}
+	var total int64
+	var progress countingWriter
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/disk.img"}, t.TempDir(), "", func(_ string, _, n int64) io.Writer {
+		total = n
+		return &progress
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(result.Path)
+	if !bytes.Equal(data, body) {
+		t.Errorf("reassembled file differs from the body (%d of %d bytes)", len(data), len(body))
+	}
+	if total != int64(len(body)) || progress.n != total {
+		t.Errorf("progress %d of %d, want %d of %d", progress.n, total, len(body), len(body))
+	}
+
+	// The first segment comes from the initial GET, the others from ranges
+	got := requests()
+	size := (len(body) + 3) / 4
+	want := map[string]bool{"": true}
+	for i := 1; i < 4; i++ {
+		want[fmt.Sprintf("bytes=%d-%d", i*size, min((i+1)*size, len(body))-1)] = true
+	}
+	if len(got) != 4 {
+		t.Errorf("requests with Range %q, want 4", got)
+	}
+	for _, r := range got {
+		if !want[r] {
+			t.Errorf("unexpected request with Range %q", r)
+		}
+	}
+}
+
+func TestSegmentedFallback(t *testing.T) {
+	body := segmentBody(4 * minSegmentSize)
+	srv, requests := rangeServer(t, body, true, "")
+
+	opts := &DownloadOptions{Client: srv.Client(), Segments: 4}
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/disk.img"}, t.TempDir(), "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(result.Path); !bytes.Equal(data, body) {
+		t.Error("file differs from the body")
+	}
+	if got := requests(); len(got) != 1 {
+		t.Errorf("requests with Range %q, want a single stream", got)
+	}
+}
+
+func TestSegmentedFailure(t *testing.T) {
+	body := segmentBody(2 * minSegmentSize)
+	srv, _ := rangeServer(t, body, false, fmt.Sprintf("bytes=%d-%d", minSegmentSize, 2*minSegmentSize-1))
+
+	dir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), Segments: 2}
+	if _, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/disk.img"}, dir, "", noProgress); err == nil {
+		t.Fatal("err = nil with a failing range")
+	}
+	// A segmented .part has holes, so nothing is kept to resume
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("failed download left %s", filepath.Join(dir, entries[0].Name()))
+	}
+}
+
+func TestSegmentCount(t *testing.T) {
+	ranges := &http.Response{Header: http.Header{"Accept-Ranges": {"bytes"}}}
+	tests := []struct {
+		name     string
+		segments int
+		resp     *http.Response
+		total    int64
+		decoded  bool
+		want     int
+	}{
+		{"not asked", 1, ranges, 100 * minSegmentSize, false, 1},
+		{"asked", 4, ranges, 100 * minSegmentSize, false, 4},
+		{"small file", 4, ranges, 2 * minSegmentSize, false, 2},
+		{"tiny file", 4, ranges, minSegmentSize / 2, false, 1},
+		{"capped", 1000, ranges, 1000 * minSegmentSize, false, 64},
+		{"unknown size", 4, ranges, -1, false, 1},
+		{"no ranges", 4, &http.Response{Header: http.Header{}}, 100 * minSegmentSize, false, 1},
+		{"decoded", 4, ranges, 100 * minSegmentSize, true, 1},
+	}
+	for _, tt := range tests {
+		o := &DownloadOptions{Segments: tt.segments}
+		if got := o.segmentCount(tt.resp, tt.total, tt.decoded); got != tt.want {
+			t.Errorf("%s: segmentCount = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package downloader
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+
+	_ "modernc.org/sqlite" // pure Go, so it builds with CGO_ENABLED=0
+)
+
+// sqliteSchema creates the tables of a SQLite store. Records and failures
+// are kept as JSON, like in the history file, so new DownloadRecord fields
+// need no schema change; the columns beside them are what lookups and
+// ordering use.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS downloads (
+	url        TEXT PRIMARY KEY,
+	downloaded INTEGER NOT NULL,
+	record     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS downloads_downloaded ON downloads (downloaded);
+CREATE TABLE IF NOT EXISTS files (
+	name TEXT PRIMARY KEY,
+	url  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_url ON files (url);
+CREATE TABLE IF NOT EXISTS failures (
+	url     TEXT PRIMARY KEY,
+	time    INTEGER NOT NULL,
+	failure TEXT NOT NULL
+);
+PRAGMA user_version = 1;
+`
+
+// SQLiteStore keeps the history in a SQLite database (-store sqlite:PATH).
+// Nothing is held in memory: each call is a query or a transaction, so a
+// write costs the same however long the history is and lookups use the
+// indexes. SQLite's own locking lets several processes share the database,
+// and the write-ahead log lets them read while one writes.
+//
+// The Store methods without an error result log a warning when their query
+// fails and return what they have.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*SQLiteStore, error) {
+	// Create the file first so it gets HistoryFileMode exactly; SQLite
+	// gives its -wal and -shm files the same mode
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, HistoryFileMode)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Chmod(HistoryFileMode)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() +
+		"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// update runs fn in a transaction, committing it if fn succeeds. The
+// transaction takes the write lock up front (_txlock=immediate), so two
+// processes waiting on each other time out in busy_timeout rather than
+// failing at once.
+func (s *SQLiteStore) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Get(url string) (DownloadRecord, bool) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT record FROM downloads WHERE url = ?`, url).Scan(&data)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Warn("could not read history", "error", err)
+		}
+		return DownloadRecord{}, false
+	}
+	var record DownloadRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		slog.Warn("could not read history record", "url", url, "error", err)
+		return DownloadRecord{}, false
+	}
+	return record, true
+}
+
+func (s *SQLiteStore) Put(name string, record DownloadRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO downloads (url, downloaded, record) VALUES (?, ?, ?)`,
+			record.URL, record.Downloaded.UnixNano(), data); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO files (name, url) VALUES (?, ?)`, name, record.URL); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM failures WHERE url = ?`, record.URL)
+		return err
+	})
+}
+
+func (s *SQLiteStore) HasFilename(name string) bool {
+	var one int
+	err := s.db.QueryRow(`SELECT 1 FROM files WHERE name = ?`, name).Scan(&one)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Warn("could not read history", "error", err)
+	}
+	return err == nil
+}
+
+func (s *SQLiteStore) Files() map[string]string {
+	files, err := sqliteFiles(s.db)
+	if err != nil {
+		slog.Warn("could not read history", "error", err)
+	}
+	return files
+}
+
+// sqliteQuerier is what *sql.DB and *sql.Tx have in common.
+type sqliteQuerier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// sqliteFiles returns the file name to URL index.
+func sqliteFiles(q sqliteQuerier) (map[string]string, error) {
+	files := make(map[string]string)
+	rows, err := q.Query(`SELECT name, url FROM files`)
+	if err != nil {
+		return files, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, u string
+		if err := rows.Scan(&name, &u); err != nil {
+			return files, err
+		}
+		files[name] = u
+	}
+	return files, rows.Err()
+}
+
+func (s *SQLiteStore) All() []DownloadRecord {
+	records := []DownloadRecord{}
+	rows, err := s.db.Query(`SELECT record FROM downloads ORDER BY downloaded DESC`)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var data []byte
+			if err = rows.Scan(&data); err != nil {
+				break
+			}
+			var record DownloadRecord
+			if err = json.Unmarshal(data, &record); err != nil {
+				break
+			}
+			records = append(records, record)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	if err != nil {
+		slog.Warn("could not read history", "error", err)
+	}
+	return records
+}
+
+func (s *SQLiteStore) Delete(url string) error {
+	return s.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM downloads WHERE url = ?`, url); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM files WHERE url = ?`, url)
+		return err
+	})
+}
+
+func (s *SQLiteStore) PutFailure(record FailureRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO failures (url, time, failure) VALUES (?, ?, ?)`,
+		record.URL, record.Time.UnixNano(), data)
+	return err
+}
+
+func (s *SQLiteStore) Failures() []FailureRecord {
+	failures := []FailureRecord{}
+	rows, err := s.db.Query(`SELECT failure FROM failures ORDER BY time DESC`)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var data []byte
+			if err = rows.Scan(&data); err != nil {
+				break
+			}
+			var failure FailureRecord
+			if err = json.Unmarshal(data, &failure); err != nil {
+				break
+			}
+			failures = append(failures, failure)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	if err != nil {
+		slog.Warn("could not read history failures", "error", err)
+	}
+	return failures
+}
+
+func (s *SQLiteStore) RepairFiles(apply bool) (FileIndexRepair, error) {
+	var r FileIndexRepair
+	err := s.update(func(tx *sql.Tx) error {
+		files, err := sqliteFiles(tx)
+		if err != nil {
+			return err
+		}
+		h := &History{Downloads: make(map[string]DownloadRecord), DownloadedFiles: files}
+		rows, err := tx.Query(`SELECT url FROM downloads`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var u string
+			if err := rows.Scan(&u); err != nil {
+				rows.Close()
+				return err
+			}
+			h.Downloads[u] = DownloadRecord{}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		r = repairFileIndex(h)
+		if !apply {
+			return nil
+		}
+		for name := range r.Removed {
+			if _, err := tx.Exec(`DELETE FROM files WHERE name = ?`, name); err != nil {
+				return err
+			}
+		}
+		for name, u := range r.Added {
+			if _, err := tx.Exec(`INSERT INTO files (name, url) VALUES (?, ?)`, name, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return r, err
+}
+
+// Reload only counts the records: every call reads the database, so there
+// is nothing in memory to refresh.
+func (s *SQLiteStore) Reload() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM downloads`).Scan(&n)
+	return n, err
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
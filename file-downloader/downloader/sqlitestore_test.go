@@ -0,0 +1,181 @@
+package downloader
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := OpenStore("sqlite:"+path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, recent := testRecord("old.iso"), testRecord("recent.iso")
+	old.Downloaded = recent.Downloaded.Add(-time.Hour)
+	old.Versions = []string{"/downloads/old.1.iso"}
+	if err := store.PutFailure(FailureRecord{URL: recent.URL, Error: "404 Not Found", Status: 404, Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutFailure(FailureRecord{URL: "https://example.com/gone.iso", Error: "timeout", Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	for name, record := range map[string]DownloadRecord{"old.iso": old, "recent-renamed.iso": recent} {
+		if err := store.Put(name, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// Everything is on disk, and a successful download cleared its failure
+	store, err = OpenStore("sqlite:"+path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if r, ok := store.Get(old.URL); !ok || r.Filename != old.Filename || !slices.Equal(r.Versions, old.Versions) || !r.Downloaded.Equal(old.Downloaded) {
+		t.Errorf("Get(%s) = %+v, %t", old.URL, r, ok)
+	}
+	if _, ok := store.Get("https://example.com/missing.iso"); ok {
+		t.Error("Get found a missing URL")
+	}
+	if !store.HasFilename("recent-renamed.iso") || store.HasFilename("recent.iso") {
+		t.Errorf("file names = %v, want recent.iso under its saved name", store.Files())
+	}
+	if want := map[string]string{"old.iso": old.URL, "recent-renamed.iso": recent.URL}; !maps.Equal(store.Files(), want) {
+		t.Errorf("Files() = %v, want %v", store.Files(), want)
+	}
+	if all := store.All(); len(all) != 2 || all[0].URL != recent.URL || all[1].URL != old.URL {
+		t.Errorf("All() = %+v, want recent.iso then old.iso", all)
+	}
+	if f := store.Failures(); len(f) != 1 || f[0].URL != "https://example.com/gone.iso" {
+		t.Errorf("Failures() = %+v, want only gone.iso", f)
+	}
+	if n, err := store.Reload(); n != 2 || err != nil {
+		t.Errorf("Reload() = %d, %v, want 2 records", n, err)
+	}
+
+	if err := store.Delete(old.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get(old.URL); ok || store.HasFilename("old.iso") {
+		t.Error("Delete left the record or its file name")
+	}
+}
+
+func TestSQLiteStoreRepairFiles(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Put("a.bin", testRecord("a.bin")); err != nil {
+		t.Fatal(err)
+	}
+	// A stale entry, ghost.bin for a URL without a record, and a record
+	// without one, b.bin
+	if _, err := store.db.Exec(`INSERT INTO files (name, url) VALUES ('ghost.bin', 'https://example.com/deleted.bin')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec(`INSERT INTO downloads (url, downloaded, record) VALUES ('https://example.com/b.bin', 0, '{}')`); err != nil {
+		t.Fatal(err)
+	}
+	wantRemoved := map[string]string{"ghost.bin": "https://example.com/deleted.bin"}
+	wantAdded := map[string]string{"b.bin": "https://example.com/b.bin"}
+
+	// A dry run reports the changes without making them
+	for _, apply := range []bool{false, true} {
+		r, err := store.RepairFiles(apply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(r.Removed, wantRemoved) || !maps.Equal(r.Added, wantAdded) {
+			t.Errorf("apply %t: removed %v, added %v; want %v, %v", apply, r.Removed, r.Added, wantRemoved, wantAdded)
+		}
+		if store.HasFilename("b.bin") != apply || store.HasFilename("ghost.bin") == apply {
+			t.Errorf("apply %t: index is now %v", apply, store.Files())
+		}
+	}
+	if r, _ := store.RepairFiles(true); len(r.Added)+len(r.Removed) != 0 {
+		t.Errorf("second repair changed %v, %v", r.Removed, r.Added)
+	}
+}
+
+func TestMigrateStoreToSQLite(t *testing.T) {
+	src, err := OpenStore("", filepath.Join(t.TempDir(), "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.iso", "b.iso", "c.iso"} {
+		if err := src.Put(name, testRecord(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.PutFailure(FailureRecord{URL: "https://example.com/d.iso", Error: "403 Forbidden", Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := OpenStore("sqlite:"+filepath.Join(t.TempDir(), "history.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	n, err := MigrateStore(src, dst)
+	if err != nil || n != 3 {
+		t.Fatalf("MigrateStore() = %d, %v, want 3 records", n, err)
+	}
+	if !maps.Equal(dst.Files(), src.Files()) {
+		t.Errorf("files %v, want %v", dst.Files(), src.Files())
+	}
+	for _, record := range src.All() {
+		if got, ok := dst.Get(record.URL); !ok || got.Filename != record.Filename || got.Size != record.Size {
+			t.Errorf("Get(%s) = %+v, %t, want %+v", record.URL, got, ok, record)
+		}
+	}
+	if f := dst.Failures(); len(f) != 1 || f[0].URL != "https://example.com/d.iso" {
+		t.Errorf("failures %+v, want d.iso's", f)
+	}
+}
+
+func TestSQLiteStoreConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+
+	// Two stores on one database stand in for two processes
+	const perWriter = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*perWriter)
+	for _, writer := range []string{"a", "b"} {
+		store, err := OpenStore("sqlite:"+path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		wg.Go(func() {
+			for i := range perWriter {
+				name := fmt.Sprintf("%s-%d.bin", writer, i)
+				if err := store.Put(name, testRecord(name)); err != nil {
+					errs <- err
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	store, err := OpenStore("sqlite:"+path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if n := len(store.All()); n != 2*perWriter {
+		t.Errorf("history has %d records, want %d", n, 2*perWriter)
+	}
+}
@@ -0,0 +1,678 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store persists the download history. The CLI and the web server only talk
+// to history through this interface.
+type Store interface {
+	// Get returns the record for a URL.
+	Get(url string) (DownloadRecord, bool)
+	// Put records a completed download. name is the file name used for
+	// duplicate detection (see HasFilename).
+	Put(name string, record DownloadRecord) error
+	// HasFilename reports whether a file with this name was downloaded before.
+	HasFilename(name string) bool
+	// Files returns the file name to URL index.
+	Files() map[string]string
+	// All returns every record, newest first.
+	All() []DownloadRecord
+	// Delete removes a URL and its file name entry.
+	Delete(url string) error
+	// PutFailure records a failed download, replacing any earlier failure
+	// of the same URL. Put clears it.
+	PutFailure(record FailureRecord) error
+	// Failures returns the recorded failures, newest first.
+	Failures() []FailureRecord
+	// RepairFiles makes the file name index agree with the records, see
+	// repairFileIndex. Without apply it only reports what would change.
+	RepairFiles(apply bool) (FileIndexRepair, error)
+	// Reload replaces what the store holds with what is on disk, picking up
+	// external edits, and returns the number of records.
+	Reload() (int, error)
+	Close() error
+}
+
+// OpenStore opens the store described by spec, "json:PATH" or
+// "sqlite:PATH". An empty spec means the JSON file at historyFile.
+func OpenStore(spec, historyFile string) (Store, error) {
+	if spec == "" {
+		return openJSONStore(historyFile)
+	}
+
+	kind, path, ok := strings.Cut(spec, ":")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("invalid store %q (use json:PATH or sqlite:PATH)", spec)
+	}
+	switch kind {
+	case "json":
+		return openJSONStore(path)
+	case "sqlite":
+		return openSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store type %q (use json or sqlite)", kind)
+	}
+}
+
+// MigrateStore copies every record and failure from src into dst and
+// returns how many records were copied.
+func MigrateStore(src, dst Store) (int, error) {
+	names := make(map[string]string)
+	for name, u := range src.Files() {
+		names[u] = name
+	}
+
+	n := 0
+	for _, record := range src.All() {
+		name, ok := names[record.URL]
+		if !ok {
+			name = FilenameFromURL(record.URL)
+		}
+		if err := dst.Put(name, record); err != nil {
+			return n, err
+		}
+		n++
+	}
+	// After the records, as Put clears a URL's failure
+	for _, failure := range src.Failures() {
+		if err := dst.PutFailure(failure); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ImportHistory merges the history file at path into dst. URLs dst already
+// has are skipped unless overwrite is set. Imported records keep their file
+// paths, which refer to the other machine; missing counts the ones that
+// don't exist here.
+func ImportHistory(dst Store, path string, overwrite bool) (added, missing int, err error) {
+	// loadHistory treats a missing file as empty history; here it's an error
+	if _, err := os.Stat(path); err != nil {
+		return 0, 0, err
+	}
+	src, _, err := loadHistory(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Records saved since the file was last compacted are in its log
+	if _, _, err := replayHistoryLog(historyLogPath(path), src, 0); err != nil {
+		return 0, 0, err
+	}
+
+	names := make(map[string]string)
+	for name, u := range src.DownloadedFiles {
+		names[u] = name
+	}
+	for _, record := range historyRecords(src) {
+		if _, ok := dst.Get(record.URL); ok && !overwrite {
+			continue
+		}
+		name, ok := names[record.URL]
+		if !ok {
+			name = FilenameFromURL(record.URL)
+		}
+		if err := dst.Put(name, record); err != nil {
+			return added, missing, err
+		}
+		added++
+		if _, err := os.Stat(record.Filename); err != nil {
+			missing++
+		}
+	}
+	return added, missing, nil
+}
+
+// JSONStore keeps the whole history in memory, in the JSON file at PATH and
+// an append log next to it (see historyLogPath). This is the original
+// history format. A change is appended to the log under an advisory lock on
+// PATH.lock; the file is only rewritten when compactLog folds a grown log
+// back into it, so a write costs the same however long the history is.
+//
+// Log entries are numbered, and the file records the number of the last one
+// it includes (log_seq), so opening the store loads the file and replays the
+// entries after that one, or the whole log when the file is corrupt. An
+// external edit keeps log_seq, so downloads logged since the file was saved
+// aren't lost to it. Before writing, a store applies the log entries other
+// processes appended since it last read or wrote it, so processes sharing a
+// history file don't lose each other's records. Close folds the log into the
+// file if the store wrote to it, so the file is current for other tools once
+// the process is done.
+type JSONStore struct {
+	path    string
+	mu      sync.RWMutex
+	history *History
+
+	file    os.FileInfo // the history file as last loaded or saved, nil if missing
+	logSize int64       // how much of the log history holds
+	dirty   bool        // written to the log since the file was saved
+}
+
+func openJSONStore(path string) (*JSONStore, error) {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	s := &JSONStore{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replaces the history in memory with the history file and the log
+// entries numbered after its LogSeq. It runs under the file lock. A migrated or
+// rebuilt file is saved. A missing file is a fresh history, as without a
+// log, so deleting it still resets the history; write saves it before
+// logging anything.
+func (s *JSONStore) load() error {
+	logPath := historyLogPath(s.path)
+	history, needsSave, err := loadHistory(s.path)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+			return err
+		}
+		if _, statErr := os.Stat(logPath); statErr != nil {
+			return err
+		}
+		slog.Warn("history file is corrupt, rebuilding it from the log", "file", s.path, "error", err)
+		history = &History{
+			Downloads:       make(map[string]DownloadRecord),
+			DownloadedFiles: make(map[string]string),
+			Failures:        make(map[string]FailureRecord),
+
+			// Replay every entry, including the unnumbered ones a save
+			// writes for what the file held
+			LogSeq: -1,
+		}
+		needsSave = true
+	} else if _, err := os.Stat(s.path); err != nil {
+		s.history, s.file, s.logSize = history, nil, 0
+		return nil
+	}
+
+	n, size, err := replayHistoryLog(logPath, history, 0)
+	if err != nil {
+		return err
+	}
+	history.LogSeq = max(history.LogSeq, 0)
+	if n > 0 {
+		slog.Debug("replayed history log", "file", logPath, "entries", n, "records", len(history.Downloads))
+	}
+	s.history, s.file, s.logSize = history, nil, size
+
+	if needsSave {
+		if err := s.save(); err != nil {
+			slog.Warn("could not save history", "error", err)
+		}
+	} else if s.file, err = os.Stat(s.path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// catchUp applies what other processes wrote since the store last read or
+// wrote the files. It runs under the file lock. Usually that is the end of
+// the log past logSize; when the history file was replaced, as by another
+// process compacting the log or an external edit, the store is loaded
+// again.
+func (s *JSONStore) catchUp() error {
+	info, err := os.Stat(s.path)
+	if err != nil || s.file == nil || !os.SameFile(info, s.file) ||
+		!info.ModTime().Equal(s.file.ModTime()) || info.Size() != s.file.Size() {
+		return s.load()
+	}
+	logPath := historyLogPath(s.path)
+	if logInfo, err := os.Stat(logPath); err == nil && logInfo.Size() < s.logSize {
+		return s.load()
+	}
+	_, size, err := replayHistoryLog(logPath, s.history, s.logSize)
+	if err != nil {
+		return err
+	}
+	s.logSize = size
+	return nil
+}
+
+// write numbers entry after the last one applied, appends it to the log and
+// applies it to the history in memory, under the file lock and after
+// catching up with other processes.
+func (s *JSONStore) write(entry historyLogEntry) error {
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.catchUp(); err != nil {
+		return err
+	}
+	if s.file == nil {
+		// Start the history, so replaying the log starts from it
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+	entry.Seq, entry.Time = s.history.LogSeq+1, time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	size, err := appendLine(historyLogPath(s.path), data)
+	if err != nil {
+		return err
+	}
+	s.logSize, s.dirty = size, true
+	applyLogEntry(s.history, entry)
+	s.history.LogSeq = entry.Seq
+	s.compactLog()
+	return nil
+}
+
+func (s *JSONStore) Get(url string) (DownloadRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.history.Downloads[url]
+	return record, ok
+}
+
+func (s *JSONStore) Put(name string, record DownloadRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(historyLogEntry{Name: name, Record: &record})
+}
+
+func putRecord(h *History, name string, record DownloadRecord) {
+	h.Downloads[record.URL] = record
+	h.DownloadedFiles[name] = record.URL
+	delete(h.Failures, record.URL)
+}
+
+func (s *JSONStore) PutFailure(record FailureRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(historyLogEntry{Failure: &record})
+}
+
+func (s *JSONStore) Failures() []FailureRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	failures := make([]FailureRecord, 0, len(s.history.Failures))
+	for _, f := range s.history.Failures {
+		failures = append(failures, f)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Time.After(failures[j].Time)
+	})
+	return failures
+}
+
+func (s *JSONStore) HasFilename(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.history.DownloadedFiles[name]
+	return ok
+}
+
+func (s *JSONStore) Files() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	files := make(map[string]string, len(s.history.DownloadedFiles))
+	for name, u := range s.history.DownloadedFiles {
+		files[name] = u
+	}
+	return files
+}
+
+func (s *JSONStore) All() []DownloadRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return historyRecords(s.history)
+}
+
+func (s *JSONStore) Delete(url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(historyLogEntry{Deleted: url})
+}
+
+func deleteRecord(h *History, url string) {
+	delete(h.Downloads, url)
+	for name, u := range h.DownloadedFiles {
+		if u == url {
+			delete(h.DownloadedFiles, name)
+		}
+	}
+}
+
+// RepairFiles with apply saves the repaired history straight to the file,
+// as the log has no entry for a file name on its own.
+func (s *JSONStore) RepairFiles(apply bool) (FileIndexRepair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !apply {
+		h := &History{Downloads: s.history.Downloads, DownloadedFiles: maps.Clone(s.history.DownloadedFiles)}
+		return repairFileIndex(h), nil
+	}
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return FileIndexRepair{}, err
+	}
+	defer unlock()
+
+	if err := s.catchUp(); err != nil {
+		return FileIndexRepair{}, err
+	}
+	r := repairFileIndex(s.history)
+	return r, s.save()
+}
+
+// Reload re-reads the file and replays the log entries numbered after its
+// log_seq. Records an external edit removed or changed are dropped from
+// memory unless an entry replayed on top of the file puts them back, so the
+// edit only sticks for records the file already held; downloads logged
+// since the file was saved are kept whether the edit came before or after
+// them. A write notices an edited file too and reloads first.
+func (s *JSONStore) Reload() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	return len(s.history.Downloads), nil
+}
+
+func (s *JSONStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.catchUp(); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// historyLogPath returns the append log kept next to the history file at
+// path: .download_history.json logs to .download_history.jsonl.
+func historyLogPath(path string) string {
+	return strings.TrimSuffix(path, ".json") + ".jsonl"
+}
+
+// historyLogEntry is one line of the history log: a record that was saved
+// under a file name, a failure, or the URL of a record that was deleted.
+// Entries a write appends are numbered from 1 up; the ones a save writes for
+// what the file holds have no number, so they are only replayed to rebuild
+// a corrupt file.
+type historyLogEntry struct {
+	Seq     int64           `json:"seq,omitempty"`
+	Time    time.Time       `json:"time"`
+	Name    string          `json:"name,omitempty"`
+	Record  *DownloadRecord `json:"record,omitempty"`
+	Failure *FailureRecord  `json:"failure,omitempty"`
+	Deleted string          `json:"deleted,omitempty"`
+}
+
+// applyLogEntry applies entry to h. It reports false for an entry with
+// nothing to apply.
+func applyLogEntry(h *History, entry historyLogEntry) bool {
+	switch {
+	case entry.Record != nil:
+		putRecord(h, entry.Name, *entry.Record)
+	case entry.Failure != nil:
+		h.Failures[entry.Failure.URL] = *entry.Failure
+	case entry.Deleted != "":
+		deleteRecord(h, entry.Deleted)
+	default:
+		return false
+	}
+	return true
+}
+
+// historyLogLimit is the size past which compactLog folds the history log
+// into the history file. It is a variable so tests can lower it.
+var historyLogLimit int64 = 4 << 20
+
+// compactLog saves the history once the log has grown past historyLogLimit,
+// or past twice the history file for a big history, so the log doesn't grow
+// without bound and the rewrite's cost is spread over the writes that grew
+// it. It runs under the file lock after the latest entry was applied. The
+// entry is already in the log, so a failure only logs a warning.
+func (s *JSONStore) compactLog() {
+	if s.logSize <= historyLogLimit || s.file != nil && s.logSize <= 2*s.file.Size() {
+		return
+	}
+	from := s.logSize
+	if err := s.save(); err != nil {
+		slog.Warn("could not compact history log", "error", err)
+		return
+	}
+	slog.Debug("compacted history log", "file", historyLogPath(s.path), "from", from, "to", s.logSize)
+}
+
+// save writes the history to the file, then rewrites the log as one
+// unnumbered entry per record and failure in it, so the log can still
+// rebuild a corrupt file. Each entry is dated when its record was downloaded
+// or its failure happened. It runs under the file lock.
+func (s *JSONStore) save() error {
+	if err := saveHistory(s.path, s.history); err != nil {
+		return err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.file = info
+
+	names := make(map[string]string, len(s.history.DownloadedFiles))
+	for name, u := range s.history.DownloadedFiles {
+		names[u] = name
+	}
+	var entries []historyLogEntry
+	// Oldest first, the order they were logged in. Failures go last, as
+	// replaying a record clears its URL's failure.
+	for _, record := range slices.Backward(historyRecords(s.history)) {
+		name, ok := names[record.URL]
+		if !ok {
+			name = FilenameFromURL(record.URL)
+		}
+		entries = append(entries, historyLogEntry{Time: record.Downloaded, Name: name, Record: &record})
+	}
+	for _, failure := range s.history.Failures {
+		entries = append(entries, historyLogEntry{Time: failure.Time, Failure: &failure})
+	}
+	var b []byte
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, data...), '\n')
+	}
+
+	logPath := historyLogPath(s.path)
+	tmp := logPath + ".tmp"
+	err = os.WriteFile(tmp, b, HistoryFileMode)
+	if err == nil {
+		err = os.Chmod(tmp, HistoryFileMode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, logPath)
+	}
+	if err != nil {
+		// The file's LogSeq covers all of the old log's entries
+		os.Remove(tmp)
+		return err
+	}
+	s.logSize, s.dirty = int64(len(b)), false
+	return nil
+}
+
+// appendLine appends data and a newline to the file at path and returns the
+// file's new size. A new file gets HistoryFileMode exactly, whatever the
+// umask. A last line cut short by a crash is ended first, so it doesn't
+// swallow the new one.
+func appendLine(path string, data []byte) (int64, error) {
+	info, statErr := os.Stat(path)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, HistoryFileMode)
+	if err != nil {
+		return 0, err
+	}
+	line := append(data, '\n')
+	var size int64
+	if errors.Is(statErr, fs.ErrNotExist) {
+		err = f.Chmod(HistoryFileMode)
+	} else if statErr == nil && info.Size() > 0 {
+		size = info.Size()
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, size-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if err == nil {
+		_, err = f.Write(line)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return size + int64(len(line)), err
+}
+
+// replayHistoryLog applies the entries of the log at path from byte offset
+// on that are numbered after h.LogSeq to h, in order, and advances h.LogSeq
+// past them. It returns how many it applied and the offset it read up to,
+// the log's size. A missing log has no entries. Lines that don't parse, such
+// as one cut short by a crash, are skipped.
+func replayHistoryLog(path string, h *History, offset int64) (int, int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, offset, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, offset, err
+	}
+
+	n := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		offset += int64(len(line))
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var entry historyLogEntry
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				slog.Warn("skipping unreadable history log line", "file", path, "error", jsonErr)
+			} else if entry.Seq > h.LogSeq {
+				if applyLogEntry(h, entry) {
+					n++
+				}
+				if entry.Seq > 0 {
+					h.LogSeq = entry.Seq
+				}
+			}
+		}
+		if err == io.EOF {
+			return n, offset, nil
+		}
+		if err != nil {
+			return n, offset, err
+		}
+	}
+}
+
+// FileIndexRepair lists the file name index entries repairFileIndex
+// changed, each as file name to URL.
+type FileIndexRepair struct {
+	Added   map[string]string
+	Removed map[string]string
+}
+
+// repairFileIndex makes h.DownloadedFiles agree with h.Downloads. Entries
+// whose URL has no record are removed, so they no longer cause phantom
+// skips, and records without an entry get one named after their URL, as in
+// the migration in loadHistory. A name already taken by another URL is left
+// alone.
+func repairFileIndex(h *History) FileIndexRepair {
+	r := FileIndexRepair{Added: make(map[string]string), Removed: make(map[string]string)}
+	indexed := make(map[string]bool)
+	for name, u := range h.DownloadedFiles {
+		if _, ok := h.Downloads[u]; !ok {
+			r.Removed[name] = u
+			delete(h.DownloadedFiles, name)
+			continue
+		}
+		indexed[u] = true
+	}
+	for u := range h.Downloads {
+		if indexed[u] {
+			continue
+		}
+		name := FilenameFromURL(u)
+		if _, taken := h.DownloadedFiles[name]; taken {
+			continue
+		}
+		h.DownloadedFiles[name] = u
+		r.Added[name] = u
+	}
+	return r
+}
+
+// RunRepairHistory implements -repair-history: it lists the file name index
+// entries that don't match the records, and fixes them when apply is set.
+func RunRepairHistory(store Store, apply bool) error {
+	r, err := store.RepairFiles(apply)
+	if err != nil {
+		return err
+	}
+	if len(r.Added) == 0 && len(r.Removed) == 0 {
+		fmt.Println("File name index matches the history")
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(r.Removed)) {
+		fmt.Printf("  - %s (%s has no record)\n", name, r.Removed[name])
+	}
+	for _, name := range slices.Sorted(maps.Keys(r.Added)) {
+		fmt.Printf("  + %s (%s)\n", name, r.Added[name])
+	}
+	if !apply {
+		fmt.Printf("%d stale and %d missing file name entries. Run with -repair-history -f to fix them.\n", len(r.Removed), len(r.Added))
+		return nil
+	}
+	fmt.Printf("Removed %d stale and added %d missing file name entries\n", len(r.Removed), len(r.Added))
+	return nil
+}
@@ -0,0 +1,268 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRecord returns a record for a download of name from example.com.
+func testRecord(name string) DownloadRecord {
+	return DownloadRecord{
+		URL:        "https://example.com/" + name,
+		Filename:   "/downloads/" + name,
+		Downloaded: time.Now(),
+		Size:       int64(len(name)),
+	}
+}
+
+func TestJSONStoreConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+
+	// Two stores on one file stand in for two processes: each holds its
+	// own copy of the history in memory
+	const perWriter = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*perWriter)
+	for _, writer := range []string{"a", "b"} {
+		store, err := OpenStore("", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Go(func() {
+			for i := range perWriter {
+				name := fmt.Sprintf("%s-%d.bin", writer, i)
+				if err := store.Put(name, testRecord(name)); err != nil {
+					errs <- err
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	store, err := OpenStore("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.All()); n != 2*perWriter {
+		t.Errorf("history has %d records, want %d", n, 2*perWriter)
+	}
+	for _, writer := range []string{"a", "b"} {
+		for i := range perWriter {
+			name := fmt.Sprintf("%s-%d.bin", writer, i)
+			if _, ok := store.Get("https://example.com/" + name); !ok {
+				t.Errorf("record for %s lost", name)
+			}
+			if !store.HasFilename(name) {
+				t.Errorf("file name %s lost", name)
+			}
+		}
+	}
+}
+
+func TestImportHistory(t *testing.T) {
+	dir := t.TempDir()
+	local := writeTestFile(t, dir, "local.iso", []byte("here"))
+	shared := testRecord("shared.iso")
+
+	// The other machine's history: one URL both have, one only it has
+	theirs := filepath.Join(dir, "theirs.json")
+	other := shared
+	other.Size = 999
+	remote := testRecord("remote.iso")
+	remote.Filename = "/mnt/other-machine/remote.iso"
+	h := &History{
+		Downloads:       map[string]DownloadRecord{other.URL: other, remote.URL: remote},
+		DownloadedFiles: map[string]string{"shared.iso": other.URL, "remote-renamed.iso": remote.URL},
+	}
+	if err := saveHistory(theirs, h); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, overwrite := range []bool{false, true} {
+		store, err := OpenStore("", filepath.Join(t.TempDir(), "history.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mine := testRecord("local.iso")
+		mine.Filename = local
+		store.Put("local.iso", mine)
+		store.Put("shared.iso", shared)
+
+		added, missing, err := ImportHistory(store, theirs, overwrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantAdded, wantSize := 1, shared.Size
+		if overwrite {
+			wantAdded, wantSize = 2, other.Size
+		}
+		if added != wantAdded || missing != added {
+			t.Errorf("overwrite %t: added %d, missing %d, want %d and %d", overwrite, added, missing, wantAdded, wantAdded)
+		}
+		if len(store.All()) != 3 {
+			t.Errorf("overwrite %t: %d records, want 3", overwrite, len(store.All()))
+		}
+		if r, _ := store.Get(shared.URL); r.Size != wantSize {
+			t.Errorf("overwrite %t: shared record has size %d, want %d", overwrite, r.Size, wantSize)
+		}
+		// The file name it was saved under on the other machine is kept
+		if store.Files()["remote-renamed.iso"] != remote.URL {
+			t.Errorf("overwrite %t: files %v, want remote-renamed.iso imported", overwrite, store.Files())
+		}
+		if r, _ := store.Get(mine.URL); r.Filename != local {
+			t.Errorf("overwrite %t: local record changed to %+v", overwrite, r)
+		}
+	}
+
+	store, _ := OpenStore("", filepath.Join(t.TempDir(), "history.json"))
+	if _, _, err := ImportHistory(store, filepath.Join(dir, "missing.json"), false); err == nil {
+		t.Error("importing a missing file succeeded")
+	}
+}
+
+func TestFailures(t *testing.T) {
+	var missing atomic.Bool
+	missing.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved.iso" {
+			http.Redirect(w, r, "/app.iso", http.StatusFound)
+			return
+		}
+		if missing.Load() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("app"))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "history.json")
+	store, err := OpenStore("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &DownloadOptions{Client: srv.Client()}
+	rawURL := srv.URL + "/moved.iso"
+	dir := t.TempDir()
+
+	// A 404 is recorded with its status and the URL that answered
+	_, err = opts.FetchMirrors(context.Background(), []string{rawURL}, dir, "", noProgress)
+	if err == nil {
+		t.Fatal("404 download succeeded")
+	}
+	if err := store.PutFailure(opts.FailureRecord(rawURL, err)); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenStore("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := reopened.Failures()
+	if len(failures) != 1 {
+		t.Fatalf("%d failures, want 1", len(failures))
+	}
+	f := failures[0]
+	if f.URL != rawURL || f.Status != http.StatusNotFound || f.FinalURL != srv.URL+"/app.iso" || f.Error == "" || f.Time.IsZero() {
+		t.Errorf("failure = %+v", f)
+	}
+
+	// A later 200 clears it
+	missing.Store(false)
+	result, err := opts.FetchMirrors(context.Background(), []string{rawURL}, dir, "", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("app.iso", opts.HistoryRecord(rawURL, result, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.Failures()); n != 0 {
+		t.Errorf("%d failures after a successful download, want 0", n)
+	}
+	if reopened, _ = OpenStore("", path); len(reopened.Failures()) != 0 {
+		t.Errorf("failure still on disk after a successful download")
+	}
+}
+
+// writeInconsistentHistory writes a history whose file name index has a
+// stale entry, ghost.bin for a URL without a record, and lacks one for
+// b.bin. c.bin's name is taken by another URL's entry.
+func writeInconsistentHistory(t *testing.T, dir string) string {
+	t.Helper()
+	h := History{
+		Downloads: map[string]DownloadRecord{
+			"https://example.com/a.bin":  testRecord("a.bin"),
+			"https://example.com/b.bin":  testRecord("b.bin"),
+			"https://example.com/c.bin":  testRecord("c.bin"),
+			"https://mirror.org/x/c.bin": testRecord("c.bin"),
+		},
+		DownloadedFiles: map[string]string{
+			"a.bin":     "https://example.com/a.bin",
+			"ghost.bin": "https://example.com/deleted.bin",
+			"c.bin":     "https://mirror.org/x/c.bin",
+		},
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, dir, "history.json", data)
+}
+
+func TestRepairFiles(t *testing.T) {
+	path := writeInconsistentHistory(t, t.TempDir())
+	store, err := OpenStore("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRemoved := map[string]string{"ghost.bin": "https://example.com/deleted.bin"}
+	wantAdded := map[string]string{"b.bin": "https://example.com/b.bin"}
+
+	// A dry run reports the changes without making them
+	r, err := store.RepairFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(r.Removed, wantRemoved) || !maps.Equal(r.Added, wantAdded) {
+		t.Errorf("dry run: removed %v, added %v; want %v, %v", r.Removed, r.Added, wantRemoved, wantAdded)
+	}
+	if !store.HasFilename("ghost.bin") || store.HasFilename("b.bin") {
+		t.Error("dry run changed the index")
+	}
+
+	if r, err = store.RepairFiles(true); err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(r.Removed, wantRemoved) || !maps.Equal(r.Added, wantAdded) {
+		t.Errorf("repair: removed %v, added %v; want %v, %v", r.Removed, r.Added, wantRemoved, wantAdded)
+	}
+
+	// The fix is saved, and a second repair finds nothing left to do
+	reopened, err := OpenStore("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a.bin": true, "b.bin": true, "c.bin": true, "ghost.bin": false} {
+		if got := reopened.HasFilename(name); got != want {
+			t.Errorf("after repair HasFilename(%s) = %t, want %t", name, got, want)
+		}
+	}
+	if r, _ = reopened.RepairFiles(true); len(r.Added)+len(r.Removed) != 0 {
+		t.Errorf("second repair changed %v, %v", r.Removed, r.Added)
+	}
+	if n := len(reopened.All()); n != 4 {
+		t.Errorf("repair left %d records, want all 4", n)
+	}
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// teeFile is the second copy of a download that -tee writes into another
+// directory under the same file name. It is best effort: the first error
+// removes it and the download carries on with only the primary file.
+type teeFile struct {
+	path string // final path; data goes to its .part file until commit
+	f    *os.File
+	done bool // committed or aborted
+}
+
+// openTee starts the -tee copy of outputPath, or returns nil if Tee isn't
+// set. A copy that can't be created comes back already aborted, so finish
+// doesn't try again.
+func (o *DownloadOptions) openTee(outputPath string) *teeFile {
+	if o.Tee == "" {
+		return nil
+	}
+	// Only the base name, already sanitized, so the copy stays inside Tee
+	path := filepath.Join(o.Tee, filepath.Base(outputPath))
+	f, err := o.createPart(PartPath(path))
+	if err != nil {
+		slog.Warn("could not create tee copy", "file", path, "error", err)
+		return &teeFile{path: path, done: true}
+	}
+	return &teeFile{path: path, f: f}
+}
+
+// copyTee writes the -tee copy of the finished file at outputPath. It is
+// used when the body wasn't streamed through a teeFile: a resumed or
+// segmented download, or a .part file that was already complete.
+func (o *DownloadOptions) copyTee(outputPath string) *teeFile {
+	t := o.openTee(outputPath)
+	if t == nil || t.done {
+		return t
+	}
+	src, err := os.Open(outputPath)
+	if err != nil {
+		t.fail(err)
+		return t
+	}
+	defer src.Close()
+	if _, err := io.Copy(t.f, src); err != nil {
+		t.fail(err)
+	}
+	return t
+}
+
+// Write never fails, so a full or missing tee directory can't stop the
+// download it sits next to in an io.MultiWriter.
+func (t *teeFile) Write(p []byte) (int, error) {
+	if !t.done {
+		if _, err := t.f.Write(p); err != nil {
+			t.fail(err)
+		}
+	}
+	return len(p), nil
+}
+
+func (t *teeFile) fail(err error) {
+	slog.Warn("tee copy failed, keeping only the primary file", "file", t.path, "error", err)
+	t.abort()
+}
+
+// abort removes the copy's .part file. It is safe on a nil teeFile.
+func (t *teeFile) abort() {
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	t.f.Close()
+	os.Remove(PartPath(t.path))
+}
+
+// commit moves the finished copy into place and reports whether it got
+// there.
+func (t *teeFile) commit() bool {
+	if t == nil || t.done {
+		return false
+	}
+	err := t.f.Close()
+	if err == nil {
+		err = os.Rename(PartPath(t.path), t.path)
+	}
+	if err != nil {
+		t.fail(err)
+		return false
+	}
+	t.done = true
+	return true
+}
+
+// SameDir reports whether a and b name the same directory.
+func SameDir(a, b string) (bool, error) {
+	a, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	b, err = filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return a == b, nil
+}
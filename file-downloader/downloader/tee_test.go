@@ -0,0 +1,123 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTee(t *testing.T) {
+	body := strings.Repeat("tee data ", 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		opts    DownloadOptions
+		partial string // already in the primary .part file
+	}{
+		{"streamed", DownloadOptions{}, ""},
+		{"resumed", DownloadOptions{}, body[:100]},
+		// The copy is named after the file, not the -out-template path
+		{"out-template", DownloadOptions{OutTemplate: "{host}/{name}"}, ""},
+	}
+	for _, tt := range tests {
+		dir, teeDir := t.TempDir(), t.TempDir()
+		if tt.partial != "" {
+			writeTestFile(t, dir, "app.bin"+PartSuffix, []byte(tt.partial))
+		}
+		opts := tt.opts
+		opts.Client, opts.Tee = srv.Client(), teeDir
+		result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/app.bin"}, dir, "", noProgress)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		primary, _ := os.ReadFile(result.Path)
+		copied, err := os.ReadFile(filepath.Join(teeDir, "app.bin"))
+		if err != nil || string(primary) != body || string(copied) != body {
+			t.Errorf("%s: primary has %d bytes, copy %d (err %v), want %d", tt.name, len(primary), len(copied), err, len(body))
+		}
+		if entries, _ := os.ReadDir(teeDir); len(entries) != 1 {
+			t.Errorf("%s: tee directory holds %v", tt.name, entries)
+		}
+	}
+
+	// A failed download leaves nothing in the tee directory
+	teeDir := t.TempDir()
+	opts := &DownloadOptions{Client: srv.Client(), Tee: teeDir}
+	if _, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/missing.bin"}, t.TempDir(), "", noProgress); err == nil {
+		t.Error("missing.bin downloaded")
+	}
+	if entries, _ := os.ReadDir(teeDir); len(entries) != 0 {
+		t.Errorf("failed download left %v in the tee directory", entries)
+	}
+}
+
+func TestTeeFailureKeepsPrimary(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "primary")
+	}))
+	defer srv.Close()
+
+	opts := &DownloadOptions{Client: srv.Client(), Tee: filepath.Join(t.TempDir(), "not", "there")}
+	result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/app.bin"}, t.TempDir(), "", noProgress)
+	if err != nil {
+		t.Fatalf("download failed with an unusable tee directory: %v", err)
+	}
+	if data, _ := os.ReadFile(result.Path); string(data) != "primary" {
+		t.Errorf("primary file = %q", data)
+	}
+
+	// A write error part way through drops only the copy
+	tee := &teeFile{path: filepath.Join(t.TempDir(), "copy.bin")}
+	f, err := os.Create(PartPath(tee.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close() // writes now fail
+	tee.f = f
+	if n, err := tee.Write([]byte("data")); n != 4 || err != nil {
+		t.Errorf("Write = %d, %v; want the write reported as done", n, err)
+	}
+	if tee.commit() {
+		t.Error("a failed copy was committed")
+	}
+	if _, err := os.Stat(PartPath(tee.path)); !os.IsNotExist(err) {
+		t.Error("failed copy's .part file is still there")
+	}
+}
+
+func TestSameDir(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{dir, dir + string(filepath.Separator), true},
+		{dir, rel, true},
+		{dir, filepath.Join(dir, "sub", ".."), true},
+		{dir, filepath.Join(dir, "sub"), false},
+	}
+	for _, tt := range tests {
+		if got, err := SameDir(tt.a, tt.b); err != nil || got != tt.want {
+			t.Errorf("SameDir(%q, %q) = %t, %v; want %t", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+}
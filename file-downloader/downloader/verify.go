@@ -0,0 +1,160 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// errSignature is reported when -verify-key is set and a download's
+// signature is missing or doesn't match. The file is deleted.
+var errSignature = errors.New("signature verification failed")
+
+// maxSignatureSize bounds how much of a signature file is read.
+const maxSignatureSize = 64 * 1024
+
+// MinisignKey is a minisign public key, as created by "minisign -G".
+type MinisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// ParseMinisignKey parses -verify-key: the path of a minisign.pub file, or
+// the base64 key itself as given to "minisign -P".
+func ParseMinisignKey(s string) (*MinisignKey, error) {
+	line := strings.TrimSpace(s)
+	if data, err := os.ReadFile(s); err == nil {
+		line = ""
+		for l := range strings.Lines(string(data)) {
+			if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "untrusted comment:") {
+				line = l
+				break
+			}
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(raw) != 42 || string(raw[:2]) != "Ed" {
+		return nil, errors.New("not a minisign public key")
+	}
+	k := &MinisignKey{key: ed25519.PublicKey(raw[10:])}
+	copy(k.id[:], raw[2:10])
+	return k, nil
+}
+
+// ID returns the key ID the way minisign prints it.
+func (k *MinisignKey) ID() string {
+	id := k.id
+	slices.Reverse(id[:])
+	return strings.ToUpper(hex.EncodeToString(id[:]))
+}
+
+// verify checks the minisign signature sig (the contents of a .minisig
+// file) for the file at path. Both the legacy and the prehashed signature
+// algorithms are accepted, and the trusted comment must be signed too.
+func (k *MinisignKey) verify(path string, sig []byte) error {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(sig))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("not a minisign signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 74 {
+		return errors.New("not a minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("not a minisign signature")
+	}
+	alg, id, signature := string(raw[:2]), raw[2:10], raw[10:]
+	if !bytes.Equal(id, k.id[:]) {
+		other := slices.Clone(id)
+		slices.Reverse(other)
+		return fmt.Errorf("signed with key %X, not %s", other, k.ID())
+	}
+
+	var message []byte
+	switch alg {
+	case "Ed":
+		if message, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	case "ED":
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		d, _ := blake2b.New512(nil) // only fails for an oversized key
+		_, err = io.Copy(d, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		message = d.Sum(nil)
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	if !ed25519.Verify(k.key, message, signature) {
+		return errors.New("signature does not match the file")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(k.key, append(slices.Clone(signature), trusted...), global) {
+		return errors.New("invalid trusted comment signature")
+	}
+	return nil
+}
+
+// verifySignature checks a finished download against VerifyKey. The
+// signature comes from VerifySig, a file or URL, or else from the download
+// URL with ".minisig" appended. On failure the file is deleted.
+func (o *DownloadOptions) verifySignature(ctx context.Context, result *DownloadResult) error {
+	src := o.VerifySig
+	if src == "" {
+		src = result.URL + ".minisig"
+	}
+	sig, err := o.readSignature(ctx, src)
+	if err == nil {
+		err = o.VerifyKey.verify(result.Path, sig)
+	}
+	if err != nil {
+		os.Remove(result.Path)
+		return fmt.Errorf("%w: %s: %v", errSignature, src, err)
+	}
+	result.SignedBy = o.VerifyKey.ID()
+	return nil
+}
+
+// readSignature reads a signature from a local file or an http(s) URL.
+func (o *DownloadOptions) readSignature(ctx context.Context, src string) ([]byte, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return os.ReadFile(src)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", src, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.setHeaders(req)
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{Code: resp.StatusCode, Status: resp.Status, URL: resp.Request.URL.String()}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+}
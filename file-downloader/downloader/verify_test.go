@@ -0,0 +1,146 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A minisign key pair and signatures for "hello minisign\n", made outside
+// this package with openssl's Ed25519 and Python's BLAKE2b. The key ID is
+// 0123456789abcdef.
+const (
+	testMinisignPub = "untrusted comment: minisign public key EFCDAB8967452301\n" +
+		"RWQBI0VniavN7ylhVurYaJKRHiKGp4N5pR1WG/ITj2gVTxnTfwp+AsMW\n"
+
+	testMinisigned = "hello minisign\n"
+
+	// Prehashed (BLAKE2b-512), what current minisign versions write
+	testMinisig = "untrusted comment: signature from minisign secret key\n" +
+		"RUQBI0VniavN7+DVojsjYYl5hwFwlxuiUup8Z45AFCNa/suMOsR9fbVKPdqmtdgF8L2QyBFEIWpoYOzcYVOp5H//N4EWnXPqvAY=\n" +
+		"trusted comment: timestamp:1700000000\tfile:hello.txt\n" +
+		"LKjJFwCjJlh0WKqk3QqX/9aYe2QhM0KbW7+F9+60mnTFFBmRi6Z29ettfVFYygThUv8CJ3hWSI63XVUnbhxaCw==\n"
+
+	// Legacy, signing the file itself
+	testMinisigLegacy = "untrusted comment: signature from minisign secret key\n" +
+		"RWQBI0VniavN75CCG17FOk4Jr91aSeLmp32k3i/irpTv2Br1oz1EShD39+XP6WnAqgeDaKE23w9Fy0XGPiKMBlaiwLdxEP8PHgQ=\n" +
+		"trusted comment: timestamp:1700000000\tfile:hello.txt\n" +
+		"eS3N29vzwO1le1JBObf+LXMQH2eGFyBW3kv5ROo9Ek2Rd0lnD8X051UKZCRfxQn9bVfKKlFYLBLS5x+TioY3Aw==\n"
+)
+
+func TestParseMinisignKey(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "minisign.pub", []byte(testMinisignPub))
+	for _, s := range []string{path, "RWQBI0VniavN7ylhVurYaJKRHiKGp4N5pR1WG/ITj2gVTxnTfwp+AsMW"} {
+		k, err := ParseMinisignKey(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if k.ID() != "EFCDAB8967452301" {
+			t.Errorf("%s: key ID %s, want EFCDAB8967452301", s, k.ID())
+		}
+	}
+	if _, err := ParseMinisignKey("not a key"); err == nil {
+		t.Error("invalid key: no error")
+	}
+}
+
+func TestMinisignVerify(t *testing.T) {
+	key, err := ParseMinisignKey(testMinisignPub[strings.Index(testMinisignPub, "\n")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	good := writeTestFile(t, dir, "hello.txt", []byte(testMinisigned))
+	bad := writeTestFile(t, dir, "tampered.txt", []byte("hello minisign!\n"))
+
+	for name, sig := range map[string]string{"prehashed": testMinisig, "legacy": testMinisigLegacy} {
+		if err := key.verify(good, []byte(sig)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := key.verify(bad, []byte(sig)); err == nil {
+			t.Errorf("%s: tampered file verified", name)
+		}
+		forged := strings.Replace(sig, "timestamp:1700000000", "timestamp:1800000000", 1)
+		if err := key.verify(good, []byte(forged)); err == nil {
+			t.Errorf("%s: altered trusted comment verified", name)
+		}
+	}
+
+	other := *key
+	other.id[0] ^= 0xff
+	if err := other.verify(good, []byte(testMinisig)); err == nil || !strings.Contains(err.Error(), "EFCDAB8967452301") {
+		t.Errorf("other key ID: %v, want an error naming EFCDAB8967452301", err)
+	}
+	if err := key.verify(good, []byte("untrusted comment: x\n")); err == nil {
+		t.Error("truncated signature verified")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hello.txt", "/forged.txt":
+			w.Write([]byte(testMinisigned))
+		case "/hello.txt.minisig":
+			w.Write([]byte(testMinisig))
+		case "/forged.txt.minisig":
+			w.Write([]byte(testMinisigLegacy[:len(testMinisigLegacy)-10] + "AAAAAAAAA\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	key, err := ParseMinisignKey(writeTestFile(t, t.TempDir(), "minisign.pub", []byte(testMinisignPub)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(name string, opts *DownloadOptions) (*DownloadResult, error) {
+		result, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/" + name}, t.TempDir(), "", noProgress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result, opts.PostProcess(context.Background(), result)
+	}
+
+	// The signature is fetched from the download URL plus .minisig
+	opts := &DownloadOptions{Client: srv.Client(), VerifyKey: key}
+	result, err := fetch("hello.txt", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SignedBy != "EFCDAB8967452301" {
+		t.Errorf("SignedBy = %q", result.SignedBy)
+	}
+	if r := opts.HistoryRecord(result.URL, result, time.Now()); r.SignedBy != "EFCDAB8967452301" {
+		t.Errorf("history record SignedBy = %q", r.SignedBy)
+	}
+
+	// A local -verify-sig file
+	sigPath := writeTestFile(t, t.TempDir(), "sig.minisig", []byte(testMinisigLegacy))
+	if _, err := fetch("hello.txt", &DownloadOptions{Client: srv.Client(), VerifyKey: key, VerifySig: sigPath}); err != nil {
+		t.Errorf("-verify-sig file: %v", err)
+	}
+
+	tests := []struct {
+		name, file, sig string
+	}{
+		{"bad signature", "forged.txt", ""},
+		{"missing signature", "hello.txt", srv.URL + "/missing.minisig"},
+	}
+	for _, tt := range tests {
+		result, err := fetch(tt.file, &DownloadOptions{Client: srv.Client(), VerifyKey: key, VerifySig: tt.sig})
+		if !errors.Is(err, errSignature) {
+			t.Errorf("%s: error %v, want errSignature", tt.name, err)
+		}
+		if _, statErr := os.Stat(result.Path); !os.IsNotExist(statErr) {
+			t.Errorf("%s: %s kept after a failed verification", tt.name, filepath.Base(result.Path))
+		}
+	}
+}
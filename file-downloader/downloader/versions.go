@@ -0,0 +1,104 @@
+package downloader
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// versionLayout is the timestamp -keep-versions adds to the older versions
+// of a file: file.20261016-013503.zip. It is the old file's modification
+// time, which is when it was downloaded, or with -preserve-mtime when the
+// server last changed it.
+const versionLayout = "20060102-150405"
+
+// keepVersion moves the file at path, about to be replaced by a new
+// download, aside as a timestamped version and then removes all but the
+// newest KeepVersions versions. A missing file is not an error.
+func (o *DownloadOptions) keepVersion(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext) + "." + info.ModTime().UTC().Format(versionLayout)
+	version := base + ext
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(version); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		version = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	if err := os.Rename(path, version); err != nil {
+		return err
+	}
+	slog.Info("kept previous version", "file", version)
+
+	versions := ListVersions(path)
+	for _, old := range versions[min(o.KeepVersions, len(versions)):] {
+		if err := os.Remove(old); err != nil {
+			slog.Warn("could not remove old version", "file", old, "error", err)
+			continue
+		}
+		slog.Info("removed old version", "file", old)
+	}
+	return nil
+}
+
+// ListVersions returns the versions of path kept by keepVersion, newest
+// first.
+func ListVersions(path string) []string {
+	dir, file := filepath.Split(path)
+	ext := filepath.Ext(file)
+	prefix := strings.TrimSuffix(file, ext) + "."
+	entries, err := os.ReadDir(cmp.Or(dir, "."))
+	if err != nil {
+		return nil
+	}
+
+	type version struct {
+		path string
+		mod  time.Time
+	}
+	var versions []version
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if stamp, ok = strings.CutSuffix(stamp, ext); !ok || len(stamp) < len(versionLayout) {
+			continue
+		}
+		if _, err := time.Parse(versionLayout, stamp[:len(versionLayout)]); err != nil {
+			continue
+		}
+		// "-N" tells apart versions from the same second
+		if n := stamp[len(versionLayout):]; n != "" && (len(n) < 2 || n[0] != '-' || strings.Trim(n[1:], "0123456789") != "") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version{filepath.Join(dir, e.Name()), info.ModTime()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].mod.After(versions[j].mod)
+	})
+
+	paths := make([]string, len(versions))
+	for i, v := range versions {
+		paths[i] = v.path
+	}
+	return paths
+}
@@ -0,0 +1,100 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepVersions(t *testing.T) {
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "v%d", n.Add(1))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "app.zip")
+	opts := &DownloadOptions{Client: srv.Client(), Overwrite: true, KeepVersions: 2}
+	contents := func(paths []string) []string {
+		var got []string
+		for _, p := range paths {
+			data, _ := os.ReadFile(p)
+			got = append(got, string(data))
+		}
+		return got
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 4 {
+		if _, err := opts.FetchMirrors(context.Background(), []string{srv.URL + "/app.zip"}, dir, "", noProgress); err != nil {
+			t.Fatal(err)
+		}
+		// A day apart, so each version gets its own timestamp
+		mtime := start.AddDate(0, 0, i)
+		if err := os.Chtimes(outputPath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 2 {
+			// Three downloads leave the current file and two versions
+			if got := contents(ListVersions(outputPath)); !slices.Equal(got, []string{"v2", "v1"}) {
+				t.Errorf("versions after 3 downloads = %q, want v2, v1", got)
+			}
+		}
+	}
+
+	// The fourth prunes the oldest
+	versions := ListVersions(outputPath)
+	if got := contents(versions); !slices.Equal(got, []string{"v3", "v2"}) {
+		t.Errorf("versions after 4 downloads = %q, want v3, v2", got)
+	}
+	if got := contents([]string{outputPath}); got[0] != "v4" {
+		t.Errorf("current file = %q, want v4", got[0])
+	}
+	if want := filepath.Join(dir, "app.20260103-000000.zip"); len(versions) == 0 || versions[0] != want {
+		t.Errorf("newest version is %v, want %s", versions, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Errorf("directory holds %d files, want the current one and 2 versions", len(entries))
+	}
+}
+
+func TestListVersions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"app.zip",
+		"app.20260101-000000.zip",
+		"app.20260101-000000-2.zip",
+		"app.20260102-000000.zip",
+		"app.notadate.zip",
+		"app.20260101-000000-x.zip",
+		"app.20260101-000000.tar",
+		"other.20260101-000000.zip",
+	} {
+		writeTestFile(t, dir, name, nil)
+	}
+	mtimes := map[string]time.Time{
+		"app.20260101-000000.zip":   time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		"app.20260101-000000-2.zip": time.Date(2026, 1, 1, 0, 0, 0, 1, time.UTC),
+		"app.20260102-000000.zip":   time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+	for name, mtime := range mtimes {
+		os.Chtimes(filepath.Join(dir, name), mtime, mtime)
+	}
+
+	var got []string
+	for _, p := range ListVersions(filepath.Join(dir, "app.zip")) {
+		got = append(got, filepath.Base(p))
+	}
+	if want := []string{"app.20260102-000000.zip", "app.20260101-000000-2.zip", "app.20260101-000000.zip"}; !slices.Equal(got, want) {
+		t.Errorf("ListVersions = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"umbrel-downloader/downloader"
+)
+
+// saveActive writes the current download list to the snapshot file. Once
+// shutdown has begun the snapshot is left as it was.
+func (wd *WebDownloader) saveActive() {
+	wd.downloadsMu.RLock()
+	if wd.stopping {
+		wd.downloadsMu.RUnlock()
+		return
+	}
+	entries := make([]downloader.ActiveEntry, 0, len(wd.downloads))
+	for _, d := range wd.getActiveDownloadsLocked() {
+		entries = append(entries, downloader.ActiveEntry{URLs: d.urls, OutputPath: d.OutputPath, Bytes: d.Progress})
+	}
+	wd.downloadsMu.RUnlock()
+
+	wd.activeMu.Lock()
+	defer wd.activeMu.Unlock()
+
+	if len(entries) == 0 {
+		if err := os.Remove(wd.activePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("could not remove active download snapshot", "error", err)
+		}
+		return
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := wd.activePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		slog.Warn("could not save active downloads", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, wd.activePath); err != nil {
+		slog.Warn("could not save active downloads", "error", err)
+	}
+}
+
+// snapshotActive refreshes the snapshot periodically so byte counts stay
+// roughly current. Starts and completions save it immediately.
+func (wd *WebDownloader) snapshotActive() {
+	for range time.Tick(downloader.ActiveSnapshotInterval) {
+		if len(wd.getActiveDownloads()) > 0 {
+			wd.saveActive()
+		}
+	}
+}
+
+// restoreActive re-adds the downloads from a previous run's snapshot.
+// Entries with a .part file on disk are resumed; the rest start over.
+func (wd *WebDownloader) restoreActive() {
+	data, err := os.ReadFile(wd.activePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Warn("could not read active download snapshot", "error", err)
+		return
+	}
+	var entries []downloader.ActiveEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		slog.Warn("could not parse active download snapshot", "error", err)
+		return
+	}
+
+	for _, e := range entries {
+		if len(e.URLs) == 0 {
+			continue
+		}
+		if _, done := wd.store.Get(wd.opts.HistoryKey(e.URLs[0])); done {
+			continue
+		}
+
+		d := &ActiveDownload{
+			URL:      e.URLs[0],
+			Filename: downloader.FilenameFromURL(e.URLs[0]),
+			urls:     e.URLs,
+		}
+		if e.OutputPath != "" {
+			if _, err := os.Stat(downloader.PartPath(e.OutputPath)); err == nil {
+				d.resumePath = e.OutputPath
+				d.Filename = filepath.Base(e.OutputPath)
+			}
+		}
+		if _, err := wd.add(d, wd.opts, false); err != nil {
+			slog.Warn("could not restore download", "url", d.URL, "error", err)
+			continue
+		}
+		slog.Info("restored download", "url", d.URL, "resume", d.resumePath != "")
+	}
+}
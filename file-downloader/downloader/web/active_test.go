@@ -0,0 +1,79 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"umbrel-downloader/downloader"
+)
+
+func TestRestoreActive(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	var mu sync.Mutex
+	var ranges []string
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer files.Close()
+
+	// What a killed process leaves behind: a snapshot and half a .part file
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "downloads")
+	if err := os.Mkdir(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(outputDir, "big.iso")
+	half := len(body) / 2
+	if err := os.WriteFile(downloader.PartPath(output), []byte(body[:half]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _ := json.Marshal([]downloader.ActiveEntry{{URLs: []string{files.URL + "/big.iso"}, OutputPath: output, Bytes: int64(half)}})
+	activePath := filepath.Join(outputDir, downloader.ActiveFileName)
+	if err := os.WriteFile(activePath, snapshot, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, srv := newTestServerIn(t, dir, Config{Metrics: true}, nil)
+	waitIdle(t, wd)
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Errorf("file has %d bytes, want the %d byte body", len(data), len(body))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "bytes=" + strconv.Itoa(half) + "-"; len(ranges) != 1 || ranges[0] != want {
+		t.Errorf("requests with Range %q, want one with %q", ranges, want)
+	}
+	if _, ok := wd.store.Get(wd.opts.HistoryKey(files.URL + "/big.iso")); !ok {
+		t.Error("resumed download not in history")
+	}
+	if _, err := os.Stat(activePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("snapshot left after the download finished (stat err = %v)", err)
+	}
+	// Restored downloads count like any other
+	samples := scrape(t, srv.URL)
+	for _, name := range []string{"downloader_downloads_started_total", "downloader_downloads_completed_total"} {
+		if samples[name] != 1 {
+			t.Errorf("%s = %v, want 1", name, samples[name])
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// requireBasicAuth rejects requests that don't carry the given HTTP Basic
+// credentials. Both fields are always compared so the response time doesn't
+// reveal which one was wrong.
+func requireBasicAuth(next http.Handler, user, pass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Downloader", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
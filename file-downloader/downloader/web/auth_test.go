@@ -0,0 +1,58 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	_, srv := newTestServer(t, Config{Auth: "admin:s3cret:with-colon"}, nil)
+
+	tests := []struct {
+		name       string
+		path       string
+		user, pass string
+		useAuth    bool
+		want       int
+	}{
+		{name: "page without credentials", path: "/", want: http.StatusUnauthorized},
+		{name: "API without credentials", path: "/api/history", want: http.StatusUnauthorized},
+		{name: "wrong password", path: "/api/history", user: "admin", pass: "s3cret", useAuth: true, want: http.StatusUnauthorized},
+		{name: "wrong user", path: "/api/history", user: "root", pass: "s3cret:with-colon", useAuth: true, want: http.StatusUnauthorized},
+		{name: "page", path: "/", user: "admin", pass: "s3cret:with-colon", useAuth: true, want: http.StatusOK},
+		{name: "API", path: "/api/history", user: "admin", pass: "s3cret:with-colon", useAuth: true, want: http.StatusOK},
+		{name: "health probe stays open", path: "/healthz", want: http.StatusOK},
+		{name: "readiness probe stays open", path: "/readyz", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", srv.URL+tt.path, nil)
+			if tt.useAuth {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestNoAuth(t *testing.T) {
+	_, srv := newTestServer(t, Config{}, nil)
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d without -web-auth, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,33 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Liveness and readiness probes for supervisors and container runtimes.
+// They are served outside -web-auth.
+
+// handleHealthz reports that the server is up, with the number of running
+// downloads and the uptime.
+func (wd *WebDownloader) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "ok",
+		"active": wd.running(),
+		"uptime": time.Since(wd.started).Round(time.Second).String(),
+	})
+}
+
+// handleReadyz returns 503 until the history is loaded and interrupted
+// downloads have been restored.
+func (wd *WebDownloader) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !wd.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -0,0 +1,108 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"umbrel-downloader/downloader"
+)
+
+func TestHealthz(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{}, nil)
+	wd.started = time.Now().Add(-90 * time.Second)
+
+	var health struct {
+		Status string
+		Active int
+		Uptime string
+	}
+	if code := getJSON(t, srv.URL+"/healthz", &health); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if health.Status != "ok" || health.Active != 0 {
+		t.Errorf("healthz = %+v, want ok with nothing active", health)
+	}
+	if d, err := time.ParseDuration(health.Uptime); err != nil || d < 90*time.Second {
+		t.Errorf("uptime %q, want at least 1m30s", health.Uptime)
+	}
+
+	startDownload(t, srv, files.URL+"/slow/a.iso")
+	waitFor(t, "the download to start", func() bool { return wd.running() == 1 })
+	getJSON(t, srv.URL+"/healthz", &health)
+	if health.Active != 1 {
+		t.Errorf("active = %d during a download, want 1", health.Active)
+	}
+	release()
+	waitIdle(t, wd)
+}
+
+// blockingStore holds up lookups until release is closed, as a slow store
+// would hold up restoring downloads.
+type blockingStore struct {
+	downloader.Store
+	release chan struct{}
+}
+
+func (s blockingStore) Get(url string) (downloader.DownloadRecord, bool) {
+	<-s.release
+	return s.Store.Get(url)
+}
+
+func TestReadyz(t *testing.T) {
+	files, releaseFiles := fileServer(t)
+	dir := t.TempDir()
+	store, err := downloader.OpenStore("", filepath.Join(dir, "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// A snapshot to restore, so startup looks the URL up in history
+	snapshot, _ := json.Marshal([]downloader.ActiveEntry{{URLs: []string{files.URL + "/slow/a.iso"}}})
+	if err := os.WriteFile(filepath.Join(dir, downloader.ActiveFileName), snapshot, 0644); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	wd := newWebDownloader(dir, blockingStore{store, release}, &downloader.DownloadOptions{Client: http.DefaultClient}, Config{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + ln.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, ln, wd, Config{}) }()
+	defer func() {
+		releaseFiles()
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+		waitIdle(t, wd)
+	}()
+
+	// Listening, but still restoring downloads
+	var ready struct{ Status string }
+	if code := getJSON(t, base+"/healthz", nil); code != http.StatusOK {
+		t.Errorf("healthz during startup: %d, want 200", code)
+	}
+	if code := getJSON(t, base+"/readyz", &ready); code != http.StatusServiceUnavailable || ready.Status != "starting" {
+		t.Errorf("starting server: %d %q, want 503 starting", code, ready.Status)
+	}
+
+	close(release)
+	waitFor(t, "the server to be ready", func() bool { return getJSON(t, base+"/readyz", &ready) == http.StatusOK })
+	if ready.Status != "ok" {
+		t.Errorf("ready server: %q, want ok", ready.Status)
+	}
+	if n := len(wd.getActiveDownloads()); n != 1 {
+		t.Errorf("%d downloads restored, want 1", n)
+	}
+}
@@ -0,0 +1,20 @@
+package web
+
+import (
+	"umbrel-downloader/downloader"
+)
+
+// hostFreeLocked reports whether another download of rawURL may start
+// without going over -per-host. The caller must hold downloadsMu.
+func (wd *WebDownloader) hostFreeLocked(rawURL string) bool {
+	if wd.perHost <= 0 {
+		return true
+	}
+	host, n := downloader.HostOf(rawURL), 0
+	for _, d := range wd.downloads {
+		if d.Status == DownloadRunning && downloader.HostOf(d.URL) == host {
+			n++
+		}
+	}
+	return n < wd.perHost
+}
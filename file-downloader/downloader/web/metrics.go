@@ -0,0 +1,113 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics counts web server downloads and serves them for Prometheus. Each
+// server has its own registry, holding these and the Go runtime and process
+// collectors.
+//
+// A nil *Metrics is valid and records nothing, so callers don't need to check
+// whether -metrics is enabled.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	started   prometheus.Counter
+	completed prometheus.Counter
+	failed    prometheus.Counter
+	cancelled prometheus.Counter
+
+	sizes     prometheus.Histogram
+	durations prometheus.Histogram
+}
+
+// Bucket bounds for the download histograms.
+var (
+	sizeBuckets     = []float64{1 << 20, 10 << 20, 100 << 20, 1 << 30, 10 << 30}
+	durationBuckets = []float64{1, 5, 15, 60, 300, 900, 3600}
+)
+
+// newMetrics registers the download metrics. active reports the current
+// number of running downloads at scrape time.
+func newMetrics(active func() int) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		started: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "downloader_downloads_started_total",
+			Help: "Downloads started.",
+		}),
+		completed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "downloader_downloads_completed_total",
+			Help: "Downloads that finished successfully.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "downloader_downloads_failed_total",
+			Help: "Downloads that failed.",
+		}),
+		cancelled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "downloader_downloads_cancelled_total",
+			Help: "Downloads cancelled by the user.",
+		}),
+		sizes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "downloader_download_size_bytes",
+			Help:    "Size of completed downloads.",
+			Buckets: sizeBuckets,
+		}),
+		durations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "downloader_download_duration_seconds",
+			Help:    "Time taken by completed downloads.",
+			Buckets: durationBuckets,
+		}),
+	}
+	m.registry.MustRegister(
+		m.started, m.completed, m.failed, m.cancelled, m.sizes, m.durations,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "downloader_active_downloads",
+			Help: "Downloads currently running.",
+		}, func() float64 { return float64(active()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) downloadStarted() {
+	if m == nil {
+		return
+	}
+	m.started.Inc()
+}
+
+func (m *Metrics) downloadCompleted(size int64, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.completed.Inc()
+	m.sizes.Observe(float64(size))
+	m.durations.Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) downloadFailed() {
+	if m == nil {
+		return
+	}
+	m.failed.Inc()
+}
+
+func (m *Metrics) downloadCancelled() {
+	if m == nil {
+		return
+	}
+	m.cancelled.Inc()
+}
+
+// handler serves /metrics.
+func (m *Metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,148 @@
+package web
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape fetches /metrics and returns the samples by name and labels, e.g.
+// `downloader_download_size_bytes_bucket{le="+Inf"}`. It fails the test if
+// the body isn't valid Prometheus text exposition format.
+func scrape(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the text exposition format", ct)
+	}
+	return parseExposition(t, resp.Body)
+}
+
+var (
+	helpLine   = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*) .+$`)
+	typeLine   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|histogram|summary|untyped)$`)
+	sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+)
+
+// parseExposition checks the text exposition format: every metric family
+// has HELP and TYPE lines before its samples, sample names belong to the
+// family (with _bucket, _sum and _count for histograms and summaries), and
+// values parse.
+func parseExposition(t *testing.T, r io.Reader) map[string]float64 {
+	t.Helper()
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+	var family string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case helpLine.MatchString(line):
+			family = helpLine.FindStringSubmatch(line)[1]
+			if _, dup := types[family]; dup {
+				t.Errorf("metric family %s repeated", family)
+			}
+		case typeLine.MatchString(line):
+			m := typeLine.FindStringSubmatch(line)
+			if m[1] != family {
+				t.Errorf("TYPE for %s follows HELP for %s", m[1], family)
+			}
+			types[m[1]] = m[2]
+		case sampleLine.MatchString(line):
+			m := sampleLine.FindStringSubmatch(line)
+			name := m[1]
+			if types[family] == "histogram" || types[family] == "summary" {
+				name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+			}
+			if name != family {
+				t.Errorf("sample %s outside its family (current family %s)", m[1], family)
+			}
+			v, err := strconv.ParseFloat(m[3], 64)
+			if err != nil {
+				t.Errorf("sample %s: bad value %q", m[1], m[3])
+			}
+			samples[m[1]+m[2]] = v
+		default:
+			t.Errorf("invalid exposition line %q", line)
+		}
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{Metrics: true}, nil)
+
+	before := scrape(t, srv.URL)
+	if before["downloader_downloads_started_total"] != 0 || before["downloader_active_downloads"] != 0 {
+		t.Fatalf("fresh server has non-zero counters: %v", before)
+	}
+	for _, name := range []string{"go_goroutines", "go_memstats_alloc_bytes", "go_gc_duration_seconds_count"} {
+		if _, ok := before[name]; !ok {
+			t.Errorf("default collector metric %s missing", name)
+		}
+	}
+
+	// One download completes; one is cancelled while running
+	startDownload(t, srv, files.URL+"/file.bin")
+	id := startDownload(t, srv, files.URL+"/slow/other.bin")
+	waitFor(t, "one download to finish", func() bool { return len(wd.getActiveDownloads()) == 1 })
+	if active := scrape(t, srv.URL)["downloader_active_downloads"]; active != 1 {
+		t.Errorf("downloader_active_downloads = %v during a download, want 1", active)
+	}
+	postJSON(t, srv.URL+"/api/cancel", map[string]string{"id": id})
+	release()
+	waitIdle(t, wd)
+
+	after := scrape(t, srv.URL)
+	want := map[string]float64{
+		"downloader_downloads_started_total":                       2,
+		"downloader_downloads_completed_total":                     1,
+		"downloader_downloads_failed_total":                        0,
+		"downloader_downloads_cancelled_total":                     1,
+		"downloader_active_downloads":                              0,
+		"downloader_download_size_bytes_count":                     1,
+		"downloader_download_size_bytes_sum":                       float64(len("file.bin")),
+		`downloader_download_size_bytes_bucket{le="+Inf"}`:         1,
+		`downloader_download_size_bytes_bucket{le="1.048576e+06"}`: 1,
+		"downloader_download_duration_seconds_count":               1,
+	}
+	for name, v := range want {
+		if after[name] != v {
+			t.Errorf("%s = %v, want %v", name, after[name], v)
+		}
+	}
+}
+
+func TestMetricsFailed(t *testing.T) {
+	files := httptest.NewServer(http.NotFoundHandler())
+	defer files.Close()
+	wd, srv := newTestServer(t, Config{Metrics: true}, nil)
+
+	startDownload(t, srv, files.URL+"/missing.bin")
+	waitIdle(t, wd)
+	if failed := scrape(t, srv.URL)["downloader_downloads_failed_total"]; failed != 1 {
+		t.Errorf("downloader_downloads_failed_total = %v, want 1", failed)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	_, srv := newTestServer(t, Config{}, nil)
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Error("/metrics served without -metrics")
+	}
+}
@@ -0,0 +1,69 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfSignedTLS(t *testing.T) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, _ := newTestServer(t, Config{}, nil)
+	srv := httptest.NewUnstartedServer(wd.handler(Config{}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// A client trusting the certificate verifies it for the loopback address
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz over TLS: %s", resp.Status)
+	}
+	if resp.TLS == nil || !resp.TLS.HandshakeComplete {
+		t.Error("response not served over TLS")
+	}
+
+	// Without trusting it the handshake fails
+	if resp, err := http.Get(srv.URL + "/healthz"); err == nil {
+		resp.Body.Close()
+		t.Error("self-signed certificate accepted by a default client")
+	}
+}
+
+func TestStartConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"cert without key", Config{TLSCert: "cert.pem"}, "-tls-cert and -tls-key"},
+		{"key without cert", Config{TLSKey: "key.pem"}, "-tls-cert and -tls-key"},
+		{"self-signed and cert", Config{TLSSelfSigned: true, TLSCert: "cert.pem", TLSKey: "key.pem"}, "-tls-self-signed"},
+		{"auth without password", Config{Auth: "admin"}, "-web-auth"},
+		{"auth without user", Config{Auth: ":secret"}, "-web-auth"},
+	}
+	for _, tt := range tests {
+		err := Start("127.0.0.1:0", t.TempDir(), nil, nil, tt.cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want one mentioning %s", tt.name, err, tt.want)
+		}
+	}
+}
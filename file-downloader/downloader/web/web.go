@@ -0,0 +1,1539 @@
+package web
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"umbrel-downloader/downloader"
+)
+
+// Active download tracking
+type ActiveDownload struct {
+	ID         string             `json:"id"`
+	URL        string             `json:"url"`
+	Filename   string             `json:"filename"`
+	Progress   int64              `json:"progress"`
+	Total      int64              `json:"total"`
+	Speed      int64              `json:"speed"`  // bytes per second
+	Status     string             `json:"status"` // DownloadQueued or DownloadRunning
+	StartedAt  time.Time          `json:"started_at"`
+	OutputPath string             `json:"-"`
+	CancelFunc context.CancelFunc `json:"-"`
+
+	urls       []string // primary URL and mirrors
+	resumePath string   // output path of a .part file to resume, see restoreActive
+	run        func()   // performs the download; set by add
+}
+
+// Statuses of an ActiveDownload.
+const (
+	DownloadQueued  = "queued"
+	DownloadRunning = "downloading"
+)
+
+// Web server state
+type WebDownloader struct {
+	outputDir string
+	opts      *downloader.DownloadOptions
+	store     downloader.Store
+	metrics   *Metrics // nil unless -metrics is set
+
+	maxConcurrent int  // running downloads allowed at once; 0 means no limit
+	queue         bool // queue downloads over the limit instead of rejecting them
+	perHost       int  // running downloads allowed per host; 0 means no limit
+	trackFailures bool // record failed downloads in history
+
+	downloads   map[string]*ActiveDownload
+	queued      []string // IDs waiting for a free slot, oldest first
+	downloadsMu sync.RWMutex
+	nextID      int
+	stopping    bool // set by shutdown; no new downloads start after this
+
+	// Finished downloads by ID, for /api/download/{id}: the history URL of
+	// each, and the IDs oldest first so only the last maxCompleted are kept
+	completed    map[string]string
+	completedIDs []string
+
+	limiter *downloader.RateLimiter // -limit-total, shared by all downloads; nil means unlimited
+
+	started time.Time   // for /healthz
+	ready   atomic.Bool // set once history is loaded and downloads are restored
+
+	activePath string     // snapshot of active downloads, see active.go
+	activeMu   sync.Mutex // serializes snapshot writes
+
+	// WebSocket clients receiving progress updates
+	subscribers   map[*wsConn]struct{}
+	subscribersMu sync.Mutex
+	changed       chan struct{} // signalled when the active list changes
+}
+
+func (wd *WebDownloader) getActiveDownloads() []ActiveDownload {
+	wd.downloadsMu.RLock()
+	defer wd.downloadsMu.RUnlock()
+	return wd.getActiveDownloadsLocked()
+}
+
+// getActiveDownloadsLocked is getActiveDownloads for callers already holding
+// downloadsMu. Running downloads come first, then the queued ones in queue
+// order.
+func (wd *WebDownloader) getActiveDownloadsLocked() []ActiveDownload {
+	result := make([]ActiveDownload, 0, len(wd.downloads))
+	for _, d := range wd.downloads {
+		if d.Status != DownloadQueued {
+			result = append(result, *d)
+		}
+	}
+	// Sort by start time (oldest first - keeps stable order)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return append(result, wd.getQueueLocked()...)
+}
+
+// getQueue returns the queued downloads, next to start first.
+func (wd *WebDownloader) getQueue() []ActiveDownload {
+	wd.downloadsMu.RLock()
+	defer wd.downloadsMu.RUnlock()
+	return wd.getQueueLocked()
+}
+
+// getQueueLocked is getQueue for callers already holding downloadsMu.
+func (wd *WebDownloader) getQueueLocked() []ActiveDownload {
+	result := make([]ActiveDownload, 0, len(wd.queued))
+	for _, id := range wd.queued {
+		if d, ok := wd.downloads[id]; ok && d.Status == DownloadQueued {
+			result = append(result, *d)
+		}
+	}
+	return result
+}
+
+func (wd *WebDownloader) updateProgress(id string, progress, total, speed int64) {
+	wd.downloadsMu.Lock()
+	if d, ok := wd.downloads[id]; ok {
+		d.Progress = progress
+		d.Total = total
+		d.Speed = speed
+	}
+	wd.downloadsMu.Unlock()
+	wd.progressChanged()
+}
+
+// progressBroadcastInterval caps how often WebSocket clients are sent the
+// active download list.
+const progressBroadcastInterval = 100 * time.Millisecond
+
+// progressChanged tells broadcastProgress that there is something new to
+// send. It never blocks; changes made before the next broadcast are merged.
+func (wd *WebDownloader) progressChanged() {
+	select {
+	case wd.changed <- struct{}{}:
+	default:
+	}
+}
+
+// broadcastProgress pushes the active download list to every WebSocket
+// client whenever it changes, at most once per progressBroadcastInterval.
+func (wd *WebDownloader) broadcastProgress() {
+	for range wd.changed {
+		data, err := json.Marshal(wd.getActiveDownloads())
+		if err != nil {
+			continue
+		}
+
+		// A slow client can take up to wsWriteTimeout; writing outside the
+		// lock keeps it from holding up subscribe and shutdown meanwhile
+		wd.subscribersMu.Lock()
+		conns := slices.Collect(maps.Keys(wd.subscribers))
+		wd.subscribersMu.Unlock()
+		for _, conn := range conns {
+			if err := conn.WriteText(data); err != nil {
+				wd.unsubscribe(conn)
+			}
+		}
+
+		time.Sleep(progressBroadcastInterval)
+	}
+}
+
+func (wd *WebDownloader) subscribe(conn *wsConn) {
+	wd.subscribersMu.Lock()
+	wd.subscribers[conn] = struct{}{}
+	wd.subscribersMu.Unlock()
+}
+
+func (wd *WebDownloader) unsubscribe(conn *wsConn) {
+	wd.subscribersMu.Lock()
+	delete(wd.subscribers, conn)
+	wd.subscribersMu.Unlock()
+	conn.Close()
+}
+
+type WebProgressWriter struct {
+	wd           *WebDownloader
+	downloadID   string
+	Total        int64
+	Downloaded   int64
+	LastUpdate   time.Time
+	LastBytes    int64
+	CurrentSpeed int64
+}
+
+func (wpw *WebProgressWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	wpw.Downloaded += int64(n)
+
+	now := time.Now()
+	elapsed := now.Sub(wpw.LastUpdate)
+	if elapsed >= 500*time.Millisecond {
+		bytesDelta := wpw.Downloaded - wpw.LastBytes
+		wpw.CurrentSpeed = int64(float64(bytesDelta) / elapsed.Seconds())
+		wpw.LastUpdate = now
+		wpw.LastBytes = wpw.Downloaded
+	}
+
+	wpw.wd.updateProgress(wpw.downloadID, wpw.Downloaded, wpw.Total, wpw.CurrentSpeed)
+	return n, nil
+}
+
+// downloadFile downloads urls (the primary URL and its mirrors) for the web
+// UI. When resumePath is set, the .part file for that path is continued from
+// the primary URL instead.
+func (wd *WebDownloader) downloadFile(ctx context.Context, opts *downloader.DownloadOptions, downloadID string, urls []string, resumePath string) (*downloader.DownloadResult, error) {
+	newProgress := func(outputPath string, offset, total int64) io.Writer {
+		// Track output path for cleanup
+		wd.downloadsMu.Lock()
+		if d, ok := wd.downloads[downloadID]; ok {
+			d.OutputPath = outputPath
+			d.Filename = filepath.Base(outputPath)
+		}
+		wd.downloadsMu.Unlock()
+		wd.saveActive()
+
+		wd.updateProgress(downloadID, offset, total, 0)
+		return io.MultiWriter(&WebProgressWriter{
+			wd:         wd,
+			downloadID: downloadID,
+			Total:      total,
+			Downloaded: offset,
+			LastBytes:  offset,
+			LastUpdate: time.Now(),
+		}, downloader.NewMilestoneWriter(downloadID, urls[0], outputPath, offset, total))
+	}
+
+	if wd.limiter != nil {
+		o := *opts
+		o.TotalLimiter = wd.limiter
+		opts = &o
+	}
+
+	var result *downloader.DownloadResult
+	var err error
+	if resumePath != "" {
+		result, err = opts.Resume(ctx, urls[0], resumePath, newProgress)
+		var partial *downloader.PartialError
+		if errors.As(err, &partial) && ctx.Err() == nil {
+			os.Remove(downloader.PartPath(resumePath)) // no retry follows to continue it
+		}
+		err = downloader.OutputError(err)
+		if result != nil {
+			result.URL = urls[0]
+		}
+	} else {
+		result, err = opts.FetchMirrors(ctx, urls, wd.outputDir, "", newProgress)
+	}
+	if err == nil {
+		err = opts.PostProcess(ctx, result)
+	}
+	return result, err
+}
+
+// spaceCheckTimeout bounds the HEAD request prepare uses to learn the size
+// before accepting a download.
+const spaceCheckTimeout = 10 * time.Second
+
+// errTooManyDownloads is returned by startDownload when -max-concurrent
+// downloads are already running and queuing is disabled.
+var errTooManyDownloads = errors.New("too many concurrent downloads, try again later")
+
+// startDownload starts rawURL in the background using opts, which is either
+// wd.opts or a per-request copy of it. When the concurrency limit is reached
+// the download is queued (with -queue) or rejected with errTooManyDownloads.
+// ctx bounds the up-front checks, not the download itself.
+func (wd *WebDownloader) startDownload(ctx context.Context, rawURL string, opts *downloader.DownloadOptions) (string, error) {
+	d, err := wd.prepare(ctx, rawURL, opts)
+	if err != nil {
+		return "", err
+	}
+	return wd.add(d, opts, !wd.queue)
+}
+
+// startDownloads is startDownload for a batch. The checks run concurrently;
+// the downloads are then added in order so IDs and queue positions follow
+// the request.
+func (wd *WebDownloader) startDownloads(ctx context.Context, rawURLs []string, opts *downloader.DownloadOptions) []BatchResult {
+	prepared := make([]*ActiveDownload, len(rawURLs))
+	errs := make([]error, len(rawURLs))
+	var wg sync.WaitGroup
+	for i, u := range rawURLs {
+		wg.Go(func() { prepared[i], errs[i] = wd.prepare(ctx, u, opts) })
+	}
+	wg.Wait()
+
+	results := make([]BatchResult, len(rawURLs))
+	for i, u := range rawURLs {
+		results[i].URL = u
+		err := errs[i]
+		if err == nil {
+			results[i].ID, err = wd.add(prepared[i], opts, !wd.queue)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	return results
+}
+
+// prepare validates rawURL and checks history, size and disk space, so the
+// UI gets those errors right away instead of seeing the download disappear.
+func (wd *WebDownloader) prepare(ctx context.Context, rawURL string, opts *downloader.DownloadOptions) (*ActiveDownload, error) {
+	urls := downloader.SplitMirrors(rawURL)
+	if len(urls) == 0 {
+		return nil, errors.New("missing URL")
+	}
+	for i, u := range urls {
+		valid, err := downloader.ValidateURL(u, opts.AssumeHTTPS)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = valid
+	}
+	rawURL = urls[0]
+	filename := downloader.FilenameFromURL(rawURL)
+
+	// Check history
+	_, urlExists := wd.store.Get(opts.HistoryKey(rawURL))
+	fileExists := wd.store.HasFilename(filename)
+
+	if urlExists || fileExists {
+		return nil, fmt.Errorf("already downloaded: %s", filename)
+	}
+
+	// The HEAD ends with the request, so a client that gives up doesn't
+	// leave it running
+	headCtx, headCancel := context.WithTimeout(ctx, spaceCheckTimeout)
+	size, _, ok := opts.Head(headCtx, rawURL)
+	headCancel()
+	if ok && size >= 0 {
+		if err := opts.CheckSize(size); err != nil {
+			return nil, err
+		}
+		if err := downloader.CheckDiskSpace(wd.outputDir, size, opts.MinFree); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ActiveDownload{
+		URL:      rawURL,
+		Filename: filename,
+		urls:     urls,
+	}, nil
+}
+
+// add registers d and starts it, or queues it when the concurrency limit is
+// reached. With rejectWhenFull a full server returns errTooManyDownloads
+// instead of queuing.
+func (wd *WebDownloader) add(d *ActiveDownload, opts *downloader.DownloadOptions, rejectWhenFull bool) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	wd.downloadsMu.Lock()
+	full := wd.maxConcurrent > 0 && wd.runningLocked() >= wd.maxConcurrent || !wd.hostFreeLocked(d.URL)
+	if full && rejectWhenFull {
+		wd.downloadsMu.Unlock()
+		cancel()
+		return "", errTooManyDownloads
+	}
+	wd.nextID++
+	id := fmt.Sprintf("dl-%d", wd.nextID)
+	d.ID = id
+	d.Status = DownloadRunning
+	d.StartedAt = time.Now()
+	d.CancelFunc = cancel
+	d.run = func() { wd.run(ctx, opts, d) }
+	wd.downloads[id] = d
+	if full {
+		d.Status = DownloadQueued
+		wd.queued = append(wd.queued, id)
+	}
+	wd.downloadsMu.Unlock()
+
+	wd.progressChanged()
+	wd.saveActive()
+
+	if full {
+		slog.Info("download queued", "id", id, "url", d.URL)
+		downloader.LogEvent(downloader.Event{Event: downloader.EventQueued, ID: id, URL: d.URL})
+		return id, nil
+	}
+	go d.run()
+	return id, nil
+}
+
+// run performs a download started by add and then starts the next queued
+// one, if any.
+func (wd *WebDownloader) run(ctx context.Context, opts *downloader.DownloadOptions, d *ActiveDownload) {
+	id, rawURL, filename := d.ID, d.URL, d.Filename
+	started := time.Now()
+	wd.metrics.downloadStarted()
+	slog.Info("download started", "id", id, "url", rawURL)
+	downloader.LogEvent(downloader.Event{Event: downloader.EventStarted, ID: id, URL: rawURL})
+
+	defer func() {
+		wd.downloadsMu.Lock()
+		delete(wd.downloads, id)
+		wd.downloadsMu.Unlock()
+		wd.progressChanged()
+		wd.saveActive()
+		wd.startQueued()
+	}()
+
+	result, err := wd.downloadFile(ctx, opts, id, d.urls, d.resumePath)
+	opts.Notify(rawURL, filename, result, err)
+	if err != nil {
+		if ctx.Err() == nil || errors.Is(err, downloader.ErrStalled) || errors.Is(err, downloader.ErrTooSlow) {
+			wd.metrics.downloadFailed()
+			slog.Error("download failed", "id", id, "url", rawURL, "error", err)
+			downloader.LogEvent(downloader.Event{Event: downloader.EventFailed, ID: id, URL: rawURL, Error: err.Error()})
+			if wd.trackFailures {
+				if err := wd.store.PutFailure(opts.FailureRecord(rawURL, err)); err != nil {
+					slog.Warn("could not save history", "error", err)
+				}
+			}
+		}
+		return
+	}
+	wd.metrics.downloadCompleted(result.Size, time.Since(started))
+	slog.Info("download complete", "id", id, "file", result.Path, "size", result.Size)
+	downloader.LogEvent(downloader.Event{Event: downloader.EventCompleted, ID: id, URL: rawURL, File: result.Path, Bytes: result.Size})
+
+	record := opts.HistoryRecord(rawURL, result, d.StartedAt)
+	if err := wd.store.Put(filepath.Base(result.Path), record); err != nil {
+		slog.Warn("could not save history", "error", err)
+	}
+	wd.addCompleted(id, record.URL)
+}
+
+// maxCompleted is how many finished download IDs /api/download/{id} can
+// still look up in history.
+const maxCompleted = 1000
+
+// addCompleted remembers that download id finished and was recorded in
+// history under url.
+func (wd *WebDownloader) addCompleted(id, url string) {
+	wd.downloadsMu.Lock()
+	defer wd.downloadsMu.Unlock()
+	wd.completed[id] = url
+	wd.completedIDs = append(wd.completedIDs, id)
+	if len(wd.completedIDs) > maxCompleted {
+		delete(wd.completed, wd.completedIDs[0])
+		wd.completedIDs = wd.completedIDs[1:]
+	}
+}
+
+// getDownload returns the active download id, or else the history record
+// of a finished one.
+func (wd *WebDownloader) getDownload(id string) (*ActiveDownload, *downloader.DownloadRecord) {
+	wd.downloadsMu.RLock()
+	d, active := wd.downloads[id]
+	url, done := wd.completed[id]
+	var copied ActiveDownload
+	if active {
+		copied = *d
+	}
+	wd.downloadsMu.RUnlock()
+
+	if active {
+		return &copied, nil
+	}
+	if done {
+		if record, ok := wd.store.Get(url); ok {
+			return nil, &record
+		}
+	}
+	return nil, nil
+}
+
+// startQueued starts queued downloads, oldest first, while there are free
+// slots. Downloads whose host is at its -per-host limit stay queued without
+// holding up other hosts. Cancelled entries are skipped.
+func (wd *WebDownloader) startQueued() {
+	var next []*ActiveDownload
+
+	wd.downloadsMu.Lock()
+	var waiting []string
+	for _, id := range wd.queued {
+		d, ok := wd.downloads[id]
+		if !ok {
+			continue
+		}
+		if wd.stopping || wd.maxConcurrent > 0 && wd.runningLocked() >= wd.maxConcurrent || !wd.hostFreeLocked(d.URL) {
+			waiting = append(waiting, id)
+			continue
+		}
+		d.Status = DownloadRunning
+		d.StartedAt = time.Now()
+		next = append(next, d)
+	}
+	wd.queued = waiting
+	wd.downloadsMu.Unlock()
+
+	for _, d := range next {
+		go d.run()
+	}
+	if len(next) > 0 {
+		wd.progressChanged()
+	}
+}
+
+// runningLocked counts downloads that aren't queued. The caller must hold
+// downloadsMu.
+func (wd *WebDownloader) runningLocked() int {
+	n := 0
+	for _, d := range wd.downloads {
+		if d.Status == DownloadRunning {
+			n++
+		}
+	}
+	return n
+}
+
+func (wd *WebDownloader) running() int {
+	wd.downloadsMu.RLock()
+	defer wd.downloadsMu.RUnlock()
+	return wd.runningLocked()
+}
+
+func (wd *WebDownloader) cancelDownload(id string) {
+	wd.downloadsMu.Lock()
+	d, ok := wd.downloads[id]
+	if ok {
+		wd.cancelLocked(d)
+	}
+	wd.downloadsMu.Unlock()
+
+	if ok {
+		wd.progressChanged()
+		wd.saveActive()
+		wd.cancelled(d)
+		wd.startQueued()
+	}
+}
+
+// cancelLocked stops d, removes its partial file and forgets it. The caller
+// must hold downloadsMu and call cancelled once it is released.
+func (wd *WebDownloader) cancelLocked(d *ActiveDownload) {
+	d.CancelFunc()
+	// Cleanup partial file; a restored download that is still queued only
+	// has its resume path
+	if path := cmp.Or(d.OutputPath, d.resumePath); path != "" {
+		os.Remove(downloader.PartPath(path))
+	}
+	delete(wd.downloads, d.ID)
+}
+
+// cancelled records that d was cancelled.
+func (wd *WebDownloader) cancelled(d *ActiveDownload) {
+	wd.metrics.downloadCancelled()
+	slog.Info("download cancelled", "id", d.ID, "url", d.URL)
+	downloader.LogEvent(downloader.Event{Event: downloader.EventCancelled, ID: d.ID, URL: d.URL, File: d.OutputPath, Bytes: d.Progress})
+}
+
+// cancelAll cancels every running and queued download and returns how many
+// there were.
+func (wd *WebDownloader) cancelAll() int {
+	wd.downloadsMu.Lock()
+	cancelled := make([]*ActiveDownload, 0, len(wd.downloads))
+	for _, d := range wd.downloads {
+		wd.cancelLocked(d)
+		cancelled = append(cancelled, d)
+	}
+	wd.queued = nil
+	wd.downloadsMu.Unlock()
+
+	// saveActive takes downloadsMu itself, so it must come after Unlock
+	if len(cancelled) > 0 {
+		wd.progressChanged()
+		wd.saveActive()
+	}
+	for _, d := range cancelled {
+		wd.cancelled(d)
+	}
+	return len(cancelled)
+}
+
+// cancelURL cancels every running and queued download of rawURL and
+// returns their IDs. rawURL is matched after the same validation
+// startDownload applies, so "example.com/f.zip" finds what it started.
+func (wd *WebDownloader) cancelURL(rawURL string) []string {
+	if valid, err := downloader.ValidateURL(rawURL, wd.opts.AssumeHTTPS); err == nil {
+		rawURL = valid
+	}
+
+	wd.downloadsMu.Lock()
+	var cancelled []*ActiveDownload
+	for _, d := range wd.downloads {
+		if d.URL == rawURL {
+			wd.cancelLocked(d)
+			cancelled = append(cancelled, d)
+		}
+	}
+	wd.downloadsMu.Unlock()
+
+	if len(cancelled) == 0 {
+		return nil
+	}
+	wd.progressChanged()
+	wd.saveActive()
+	sort.Slice(cancelled, func(i, j int) bool {
+		return cancelled[i].StartedAt.Before(cancelled[j].StartedAt)
+	})
+	ids := make([]string, len(cancelled))
+	for i, d := range cancelled {
+		wd.cancelled(d)
+		ids[i] = d.ID
+	}
+	wd.startQueued()
+	return ids
+}
+
+// errNotQueued is returned by reorderQueue for an ID that isn't waiting in
+// the queue, usually because it has started or been cancelled meanwhile.
+var errNotQueued = errors.New("download is not queued")
+
+// reorderQueue moves the queued downloads ids to the front of the queue, in
+// that order. Queued downloads not listed keep their order behind them.
+func (wd *WebDownloader) reorderQueue(ids []string) error {
+	wd.downloadsMu.Lock()
+	queued := make(map[string]bool, len(wd.queued))
+	for _, d := range wd.getQueueLocked() {
+		queued[d.ID] = true
+	}
+	order := make([]string, 0, len(queued))
+	for _, id := range ids {
+		if _, ok := queued[id]; !ok {
+			wd.downloadsMu.Unlock()
+			return fmt.Errorf("%w: %s", errNotQueued, id)
+		}
+		if queued[id] {
+			order = append(order, id)
+			queued[id] = false // ignore repeats
+		}
+	}
+	for _, id := range wd.queued {
+		if queued[id] {
+			order = append(order, id)
+			queued[id] = false
+		}
+	}
+	wd.queued = order
+	wd.downloadsMu.Unlock()
+
+	wd.progressChanged()
+	wd.saveActive()
+	return nil
+}
+
+// clearQueue cancels every queued download, leaving running ones alone, and
+// returns how many there were.
+func (wd *WebDownloader) clearQueue() int {
+	wd.downloadsMu.Lock()
+	var cleared []*ActiveDownload
+	for _, id := range wd.queued {
+		if d, ok := wd.downloads[id]; ok && d.Status == DownloadQueued {
+			wd.cancelLocked(d)
+			cleared = append(cleared, d)
+		}
+	}
+	wd.queued = nil
+	wd.downloadsMu.Unlock()
+
+	if len(cleared) > 0 {
+		wd.progressChanged()
+		wd.saveActive()
+	}
+	for _, d := range cleared {
+		wd.cancelled(d)
+	}
+	return len(cleared)
+}
+
+// HistoryPage is one page of /api/history results. Total counts every record
+// matching the query, not just the ones in Items.
+type HistoryPage struct {
+	Total int                         `json:"total"`
+	Items []downloader.DownloadRecord `json:"items"`
+}
+
+// getHistory returns the records matching f, skipping offset records and
+// returning at most limit. A limit of 0 means no limit.
+func (wd *WebDownloader) getHistory(f downloader.HistoryFilter, limit, offset int) HistoryPage {
+	records := f.Apply(wd.store.All())
+
+	page := HistoryPage{Total: len(records)}
+	if offset > len(records) {
+		offset = len(records)
+	}
+	records = records[offset:]
+	if limit > 0 && limit < len(records) {
+		records = records[:limit]
+	}
+	page.Items = records
+	return page
+}
+
+// HistoryStats summarizes the history for /api/stats.
+type HistoryStats struct {
+	Downloads int                        `json:"downloads"`
+	Bytes     int64                      `json:"bytes"` // sum of the records' sizes
+	Last24h   int                        `json:"last_24h"`
+	Last7d    int                        `json:"last_7d"`
+	Largest   *downloader.DownloadRecord `json:"largest,omitempty"`
+}
+
+// historyStats computes the HistoryStats of records as of now.
+func historyStats(records []downloader.DownloadRecord, now time.Time) HistoryStats {
+	stats := HistoryStats{Downloads: len(records)}
+	for i, r := range records {
+		stats.Bytes += r.Size
+		if age := now.Sub(r.Downloaded); age <= 24*time.Hour {
+			stats.Last24h++
+			stats.Last7d++
+		} else if age <= 7*24*time.Hour {
+			stats.Last7d++
+		}
+		if stats.Largest == nil || r.Size > stats.Largest.Size {
+			stats.Largest = &records[i]
+		}
+	}
+	return stats
+}
+
+const htmlTemplate = `<!DOCTYPE html>
+<html>
+<head>
+    <title>Downloader</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>
+        * { box-sizing: border-box; }
+        body { font-family: system-ui, sans-serif; max-width: 800px; margin: 0 auto; padding: 20px; background: #1a1a2e; color: #eee; }
+        h1 { color: #00d4ff; margin-bottom: 5px; }
+        .stats { color: #aaa; font-size: 14px; margin-bottom: 20px; }
+        .input-group { display: flex; gap: 10px; margin-bottom: 20px; }
+        input[type="text"], textarea { flex: 1; padding: 12px; border: 1px solid #333; border-radius: 6px; background: #16213e; color: #eee; font-size: 16px; }
+        button { padding: 12px 24px; border: none; border-radius: 6px; cursor: pointer; font-size: 16px; font-weight: bold; }
+        .btn-primary { background: #00d4ff; color: #000; }
+        .btn-danger { background: #ff4757; color: #fff; padding: 8px 16px; font-size: 14px; }
+        .btn-primary:hover { background: #00b8e6; }
+        .btn-danger:hover { background: #ff3344; }
+        .downloads-section { margin-bottom: 20px; }
+        .downloads-section h2 { color: #00d4ff; border-bottom: 1px solid #333; padding-bottom: 10px; margin-bottom: 15px; }
+        .download-item { background: #16213e; border-radius: 8px; padding: 15px; margin-bottom: 10px; }
+        .download-header { display: flex; justify-content: space-between; align-items: center; margin-bottom: 8px; }
+        .download-filename { font-weight: bold; color: #00d4ff; word-break: break-all; }
+        .progress-bar { height: 20px; background: #333; border-radius: 10px; overflow: hidden; margin: 8px 0; }
+        .progress-fill { height: 100%; background: linear-gradient(90deg, #00d4ff, #00ff88); transition: width 0.3s; }
+        .progress-fill.indeterminate { width: 30%; animation: indeterminate 1.2s ease-in-out infinite alternate; }
+        @keyframes indeterminate { from { margin-left: 0; } to { margin-left: 70%; } }
+        .progress-text { font-size: 13px; color: #aaa; }
+        .history { margin-top: 30px; }
+        .history h2 { color: #00d4ff; border-bottom: 1px solid #333; padding-bottom: 10px; }
+        .history-item { background: #16213e; padding: 15px; border-radius: 6px; margin-bottom: 10px; }
+        .history-item .name { font-weight: bold; color: #00ff88; }
+        .history-item .size { color: #aaa; font-size: 14px; }
+        .history-item .date { color: #666; font-size: 12px; }
+        .empty { color: #666; font-style: italic; }
+        #history-search { width: 100%; margin-bottom: 15px; }
+        .pager { display: flex; gap: 10px; align-items: center; justify-content: center; color: #aaa; }
+        .btn-page { background: #16213e; color: #eee; padding: 8px 16px; font-size: 14px; }
+        .section-header { display: flex; justify-content: space-between; align-items: center; }
+        .queue-item { display: flex; gap: 10px; align-items: center; background: #16213e; border-radius: 8px; padding: 10px 15px; margin-bottom: 8px; }
+        .queue-item.dragging { opacity: 0.5; }
+        .queue-item .download-filename { flex: 1; }
+        .drag-handle { cursor: grab; color: #666; user-select: none; }
+    </style>
+</head>
+<body>
+    <h1>Downloader</h1>
+    <div class="stats" id="stats"></div>
+
+    <div class="input-group">
+        <textarea id="url" rows="1" placeholder="Enter URL to download (paste several, one per line)..." onkeydown="if(event.key==='Enter'&&!event.shiftKey){event.preventDefault();startDownload()}"></textarea>
+        <button class="btn-primary" onclick="startDownload()">Download</button>
+    </div>
+
+    <div class="downloads-section" id="downloads-section" style="display:none;">
+        <div class="section-header">
+            <h2>Active Downloads</h2>
+            <button class="btn-danger" id="cancel-all" onclick="cancelAll()">Cancel All</button>
+        </div>
+        <div id="downloads-list"></div>
+    </div>
+
+    <div class="downloads-section" id="queue-section" style="display:none;">
+        <div class="section-header">
+            <h2>Queue</h2>
+            <button class="btn-danger" onclick="clearQueue()">Clear</button>
+        </div>
+        <div id="queue-list"></div>
+    </div>
+
+    <div class="history">
+        <h2>Download History</h2>
+        <input type="text" id="history-search" placeholder="Search history..." oninput="historyOffset = 0; loadHistory()">
+        <div id="history-list"><p class="empty">No downloads yet</p></div>
+        <div class="pager" id="history-pager" style="display:none;">
+            <button class="btn-page" onclick="historyPage(-1)">Previous</button>
+            <span id="history-page-text"></span>
+            <button class="btn-page" onclick="historyPage(1)">Next</button>
+        </div>
+    </div>
+
+    <script>
+        let polling = false;
+        let socket = null;
+        let hadDownloads = false;
+
+        function formatBytes(bytes) {
+            if (bytes === 0) return '0 B';
+            const k = 1024;
+            const sizes = ['B', 'KB', 'MB', 'GB'];
+            const i = Math.floor(Math.log(bytes) / Math.log(k));
+            return parseFloat((bytes / Math.pow(k, i)).toFixed(1)) + ' ' + sizes[i];
+        }
+
+        async function startDownload() {
+            const urls = document.getElementById('url').value.split('\n').map(u => u.trim()).filter(u => u);
+            if (urls.length === 0) return;
+
+            const resp = await fetch('/api/download', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify(urls.length === 1 ? {url: urls[0]} : {urls: urls})
+            });
+
+            if (resp.ok) {
+                document.getElementById('url').value = '';
+                if (!socket && !polling) pollProgress();
+                if (urls.length > 1) {
+                    const failed = (await resp.json()).filter(r => r.error);
+                    if (failed.length > 0) {
+                        alert('Failed:\n' + failed.map(r => r.url + ': ' + r.error).join('\n'));
+                    }
+                }
+            } else {
+                const text = await resp.text();
+                alert('Failed: ' + text);
+            }
+        }
+
+        async function cancelDownload(id) {
+            await fetch('/api/cancel', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({id: id})
+            });
+        }
+
+        async function cancelAll() {
+            if (!confirm('Cancel all downloads?')) return;
+            await fetch('/api/cancel-all', {method: 'POST'});
+        }
+
+        async function clearQueue() {
+            await fetch('/api/queue/clear', {method: 'POST'});
+        }
+
+        // Queued downloads are reordered by dragging them by their handle;
+        // dropping one on another moves it to that position.
+        let queueIDs = [];
+        let dragID = null;
+
+        function dragStart(e, id) {
+            dragID = id;
+            e.dataTransfer.effectAllowed = 'move';
+            e.target.classList.add('dragging');
+        }
+
+        function dragEnd(e) {
+            dragID = null;
+            e.target.classList.remove('dragging');
+        }
+
+        async function dropOn(e, id) {
+            e.preventDefault();
+            if (!dragID || dragID === id) return;
+            const ids = queueIDs.filter(x => x !== dragID);
+            ids.splice(queueIDs.indexOf(id), 0, dragID);
+            dragID = null;
+            const resp = await fetch('/api/queue/reorder', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({ids: ids})
+            });
+            if (resp.ok) renderQueue(await resp.json());
+        }
+
+        function renderQueue(queued) {
+            const section = document.getElementById('queue-section');
+            const list = document.getElementById('queue-list');
+            queueIDs = queued.map(d => d.id);
+            section.style.display = queued.length > 0 ? 'block' : 'none';
+            // Filenames come from the URL, so the rows are built from nodes
+            // rather than markup
+            list.replaceChildren(...queued.map(d => {
+                const item = document.createElement('div');
+                item.className = 'queue-item';
+                item.draggable = true;
+                item.addEventListener('dragstart', e => dragStart(e, d.id));
+                item.addEventListener('dragend', dragEnd);
+                item.addEventListener('dragover', e => e.preventDefault());
+                item.addEventListener('drop', e => dropOn(e, d.id));
+
+                const handle = document.createElement('span');
+                handle.className = 'drag-handle';
+                handle.textContent = '\u2630';
+                const name = document.createElement('span');
+                name.className = 'download-filename';
+                name.textContent = d.filename;
+                const cancel = document.createElement('button');
+                cancel.className = 'btn-danger';
+                cancel.textContent = 'Cancel';
+                cancel.addEventListener('click', () => cancelDownload(d.id));
+
+                item.append(handle, name, cancel);
+                return item;
+            }));
+        }
+
+        function renderDownloads(downloads) {
+            const section = document.getElementById('downloads-section');
+            const list = document.getElementById('downloads-list');
+            const running = downloads.filter(d => d.status !== 'queued');
+            // Don't redraw the queue under a drag in progress
+            if (!dragID) renderQueue(downloads.filter(d => d.status === 'queued'));
+
+            if (downloads.length > 0) {
+                hadDownloads = true;
+                section.style.display = running.length > 0 ? 'block' : 'none';
+                document.getElementById('cancel-all').style.display = downloads.length > 1 ? 'block' : 'none';
+                // As in renderQueue, filenames come from the URL
+                list.replaceChildren(...running.map(d => {
+                    // Without a Content-Length there is no percentage, only bytes
+                    const known = d.total > 0;
+                    const pct = known ? (d.progress / d.total * 100) : 0;
+
+                    const item = document.createElement('div');
+                    item.className = 'download-item';
+                    item.id = 'dl-' + d.id;
+
+                    const header = document.createElement('div');
+                    header.className = 'download-header';
+                    const name = document.createElement('span');
+                    name.className = 'download-filename';
+                    name.textContent = d.filename;
+                    const cancel = document.createElement('button');
+                    cancel.className = 'btn-danger';
+                    cancel.textContent = 'Cancel';
+                    cancel.addEventListener('click', () => cancelDownload(d.id));
+                    header.append(name, cancel);
+
+                    const bar = document.createElement('div');
+                    bar.className = 'progress-bar';
+                    const fill = document.createElement('div');
+                    fill.className = 'progress-fill';
+                    if (known) {
+                        fill.style.width = pct + '%';
+                    } else {
+                        fill.classList.add('indeterminate');
+                    }
+                    bar.append(fill);
+                    const text = document.createElement('div');
+                    text.className = 'progress-text';
+                    text.textContent = known
+                        ? pct.toFixed(1) + '% - ' + formatBytes(d.progress) + ' / ' + formatBytes(d.total) + ' - ' + formatBytes(d.speed) + '/s'
+                        : formatBytes(d.progress) + ' downloaded - ' + formatBytes(d.speed) + '/s';
+
+                    item.append(header, bar, text);
+                    return item;
+                }));
+            } else {
+                section.style.display = 'none';
+                list.replaceChildren();
+                if (hadDownloads) {
+                    hadDownloads = false;
+                    loadHistory();
+                    loadStats();
+                }
+            }
+        }
+
+        // Progress is pushed over a WebSocket; if that isn't available,
+        // fall back to polling /api/progress.
+        function connectSocket() {
+            const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+            const ws = new WebSocket(proto + '//' + location.host + '/ws');
+            ws.onopen = () => { socket = ws; };
+            ws.onmessage = e => renderDownloads(JSON.parse(e.data));
+            ws.onclose = () => {
+                socket = null;
+                if (!polling) pollProgress();
+            };
+        }
+
+        async function pollProgress() {
+            polling = true;
+            const poll = async () => {
+                const resp = await fetch('/api/progress');
+                const downloads = await resp.json();
+                renderDownloads(downloads);
+                if (downloads.length > 0) {
+                    setTimeout(poll, 500);
+                } else {
+                    polling = false;
+                }
+            };
+            poll();
+        }
+
+        const historyLimit = 20;
+        let historyOffset = 0;
+        let historyTotal = 0;
+
+        function historyPage(dir) {
+            const offset = historyOffset + dir * historyLimit;
+            if (offset < 0 || offset >= historyTotal) return;
+            historyOffset = offset;
+            loadHistory();
+        }
+
+        async function loadHistory() {
+            const q = document.getElementById('history-search').value.trim();
+            const params = new URLSearchParams({limit: historyLimit, offset: historyOffset, q: q});
+            const resp = await fetch('/api/history?' + params);
+            const data = await resp.json();
+            historyTotal = data.total;
+
+            const list = document.getElementById('history-list');
+            const pager = document.getElementById('history-pager');
+            if (data.items.length === 0) {
+                const empty = document.createElement('p');
+                empty.className = 'empty';
+                empty.textContent = q ? 'No matches' : 'No downloads yet';
+                list.replaceChildren(empty);
+                pager.style.display = 'none';
+                return;
+            }
+
+            pager.style.display = data.total > historyLimit ? 'flex' : 'none';
+            document.getElementById('history-page-text').textContent =
+                (historyOffset + 1) + '-' + (historyOffset + data.items.length) + ' of ' + data.total;
+
+            // File names come from the URL or the server, so they are set as
+            // text
+            list.replaceChildren(...data.items.map(item => {
+                // duration is in nanoseconds and missing from older records
+                const speed = item.duration > 0 ? ' at ' + formatBytes(item.size / (item.duration / 1e9)) + '/s' : '';
+                const row = document.createElement('div');
+                row.className = 'history-item';
+                for (const [cls, text] of [
+                    ['name', item.filename.split('/').pop()],
+                    ['size', formatBytes(item.size) + speed],
+                    ['date', new Date(item.downloaded).toLocaleString()],
+                ]) {
+                    const cell = document.createElement('div');
+                    cell.className = cls;
+                    cell.textContent = text;
+                    row.append(cell);
+                }
+                return row;
+            }));
+        }
+
+        async function loadStats() {
+            const resp = await fetch('/api/stats');
+            const s = await resp.json();
+            let text = s.downloads + ' downloads, ' + formatBytes(s.bytes) + ' total - ' +
+                s.last_24h + ' in the last 24h, ' + s.last_7d + ' in the last 7 days';
+            if (s.largest) {
+                text += ' - largest: ' + s.largest.filename.split('/').pop() + ' (' + formatBytes(s.largest.size) + ')';
+            }
+            document.getElementById('stats').textContent = text;
+        }
+
+        // Initial load
+        loadHistory();
+        loadStats();
+        connectSocket();
+    </script>
+</body>
+</html>`
+
+// BatchResult is the per-URL reply to a batch /api/download request.
+type BatchResult struct {
+	URL   string `json:"url"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Config holds the settings that only apply to the web server.
+type Config struct {
+	Metrics       bool // serve Prometheus metrics at /metrics
+	MaxConcurrent int  // running downloads allowed at once; 0 means no limit
+	Queue         bool // queue downloads over MaxConcurrent instead of returning 429
+	PerHost       int  // running downloads allowed per host; 0 means no limit
+	TrackFailures bool // record failed downloads in history
+
+	LimitTotal int64 // bytes per second shared by all downloads; 0 means unlimited
+
+	// HTTPS: either a certificate and key file, or a generated certificate
+	TLSCert       string
+	TLSKey        string
+	TLSSelfSigned bool
+
+	Auth string // "user:pass" required via HTTP Basic auth; empty leaves the server open
+}
+
+// shutdownTimeout bounds how long the web server waits for in-flight
+// requests when stopping.
+const shutdownTimeout = 10 * time.Second
+
+// shutdown stops every active and queued download and disconnects WebSocket
+// clients. The .part files and the active download snapshot are kept so the
+// downloads resume on the next start.
+func (wd *WebDownloader) shutdown() {
+	wd.saveActive()
+
+	wd.downloadsMu.Lock()
+	wd.stopping = true
+	for _, d := range wd.downloads {
+		d.CancelFunc()
+	}
+	wd.downloadsMu.Unlock()
+
+	wd.subscribersMu.Lock()
+	for conn := range wd.subscribers {
+		conn.Close()
+		delete(wd.subscribers, conn)
+	}
+	wd.subscribersMu.Unlock()
+}
+
+// queryInt parses a non-negative integer query parameter. A missing parameter
+// is 0.
+func queryInt(query url.Values, name string) (int, error) {
+	v := query.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// maxRequestBody caps the JSON bodies the API accepts. A batch of a few
+// thousand URLs fits comfortably.
+const maxRequestBody = 1 << 20
+
+// decodeJSONBody decodes r's JSON body into v, rejecting oversized bodies,
+// unknown fields and anything after the JSON value. On failure it has already
+// replied with 413 or 400 and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		if _, extra := dec.Token(); extra != io.EOF {
+			err = errors.New("unexpected data after the JSON object")
+		}
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Request body larger than %s", downloader.FormatBytes(tooLarge.Limit)), http.StatusRequestEntityTooLarge)
+		return false
+	case errors.Is(err, io.EOF):
+		http.Error(w, "Invalid request: empty body", 400)
+		return false
+	case err != nil:
+		http.Error(w, "Invalid request: "+err.Error(), 400)
+		return false
+	}
+	return true
+}
+
+// newWebDownloader creates the web server state for cfg. It isn't ready to
+// serve downloads until startup has run.
+func newWebDownloader(outputDir string, store downloader.Store, opts *downloader.DownloadOptions, cfg Config) *WebDownloader {
+	wd := &WebDownloader{
+		outputDir:     outputDir,
+		opts:          opts,
+		store:         store,
+		maxConcurrent: cfg.MaxConcurrent,
+		queue:         cfg.Queue,
+		perHost:       cfg.PerHost,
+		trackFailures: cfg.TrackFailures,
+		downloads:     make(map[string]*ActiveDownload),
+		completed:     make(map[string]string),
+		subscribers:   make(map[*wsConn]struct{}),
+		changed:       make(chan struct{}, 1),
+		activePath:    filepath.Join(outputDir, downloader.ActiveFileName),
+		limiter:       downloader.NewRateLimiter(cfg.LimitTotal),
+		started:       time.Now(),
+	}
+	if cfg.Metrics {
+		wd.metrics = newMetrics(wd.running)
+	}
+	return wd
+}
+
+// startup restores the downloads a previous run left active and starts the
+// background work, then marks the server ready. It runs once the server is
+// listening, so /healthz answers and /readyz reports "starting" meanwhile.
+func (wd *WebDownloader) startup() {
+	go wd.broadcastProgress()
+	wd.restoreActive()
+	go wd.snapshotActive()
+	wd.ready.Store(true)
+	slog.Info("web server ready")
+}
+
+// handler returns the web UI and API handler. With cfg.Auth every route
+// but the health probes requires HTTP Basic auth.
+func (wd *WebDownloader) handler(cfg Config) http.Handler {
+	mux := http.NewServeMux()
+	if wd.metrics != nil {
+		mux.Handle("/metrics", wd.metrics.handler())
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(htmlTemplate))
+	})
+
+	mux.HandleFunc("/api/download", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		var req struct {
+			URL       string   `json:"url"`
+			URLs      []string `json:"urls"` // batch form; the reply is one result per URL
+			UserAgent string   `json:"user_agent"`
+			Referer   string   `json:"referer"`
+			SHA256    string   `json:"sha256"` // expected hash; single URL only
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if req.SHA256 != "" && (len(req.URLs) > 0 || !downloader.ValidSHA256(req.SHA256)) {
+			http.Error(w, "sha256 must be 64 hex digits and needs a single url", 400)
+			return
+		}
+		opts := wd.opts
+		if req.UserAgent != "" || req.Referer != "" || req.SHA256 != "" {
+			o := *wd.opts
+			if req.UserAgent != "" {
+				o.UserAgent = req.UserAgent
+			}
+			if req.Referer != "" {
+				o.Referer = req.Referer
+			}
+			o.ExpectSHA256 = req.SHA256
+			opts = &o
+		}
+		if len(req.URLs) > 0 {
+			results := wd.startDownloads(r.Context(), req.URLs, opts)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(results)
+			return
+		}
+		id, err := wd.startDownload(r.Context(), req.URL, opts)
+		if errors.Is(err, errTooManyDownloads) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, downloader.ErrTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, downloader.ErrInsufficientSpace) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+	})
+
+	// A single download: the ActiveDownload while queued or running, then a
+	// 404 saying whether it finished and made it into history
+	mux.HandleFunc("GET /api/download/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		d, record := wd.getDownload(r.PathValue("id"))
+		if d != nil {
+			json.NewEncoder(w).Encode(d)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct {
+			Error     string                     `json:"error"`
+			InHistory bool                       `json:"in_history"`
+			Record    *downloader.DownloadRecord `json:"record,omitempty"`
+		}{"download not active", record != nil, record})
+	})
+
+	mux.HandleFunc("/api/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		var req struct {
+			ID  string `json:"id"`
+			URL string `json:"url"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if req.URL == "" {
+			wd.cancelDownload(req.ID)
+			w.WriteHeader(200)
+			return
+		}
+		if req.ID != "" {
+			http.Error(w, "give either id or url, not both", http.StatusBadRequest)
+			return
+		}
+		// All downloads of the URL are cancelled; the reply lists their IDs
+		ids := wd.cancelURL(req.URL)
+		if len(ids) == 0 {
+			http.Error(w, "no active download for this URL", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"cancelled": ids})
+	})
+
+	mux.HandleFunc("POST /api/cancel-all", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"cancelled": wd.cancelAll()})
+	})
+
+	mux.HandleFunc("GET /api/queue", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wd.getQueue())
+	})
+
+	// Moves the listed queued IDs to the front; replies with the new queue
+	mux.HandleFunc("POST /api/queue/reorder", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IDs []string `json:"ids"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if err := wd.reorderQueue(req.IDs); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wd.getQueue())
+	})
+
+	mux.HandleFunc("POST /api/queue/clear", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"cleared": wd.clearQueue()})
+	})
+
+	mux.HandleFunc("/api/progress", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wd.getActiveDownloads())
+	})
+
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		wd.subscribe(conn)
+		defer wd.unsubscribe(conn)
+
+		// Send the current state right away; later updates come from
+		// broadcastProgress.
+		data, _ := json.Marshal(wd.getActiveDownloads())
+		if err := conn.WriteText(data); err != nil {
+			return
+		}
+		conn.ReadLoop()
+	})
+
+	mux.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		query := r.URL.Query()
+		limit, err := queryInt(query, "limit")
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		offset, err := queryInt(query, "offset")
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		filter, err := downloader.ParseHistoryFilter(query.Get("q"), query.Get("since"), query.Get("sort"), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		json.NewEncoder(w).Encode(wd.getHistory(filter, limit, offset))
+	})
+
+	mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(historyStats(wd.store.All(), time.Now()))
+	})
+
+	// Picks up external edits to the history file; replies with the record
+	// count
+	mux.HandleFunc("POST /api/reload", func(w http.ResponseWriter, r *http.Request) {
+		n, err := wd.store.Reload()
+		if err != nil {
+			slog.Error("could not reload history", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("history reloaded", "records", n)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"records": n})
+	})
+
+	mux.HandleFunc("/api/history.csv", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := downloader.ParseHistoryFilter(query.Get("q"), query.Get("since"), query.Get("sort"), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.csv"`)
+		downloader.WriteHistoryCSV(w, wd.getHistory(filter, 0, 0).Items)
+	})
+
+	var handler http.Handler = mux
+	if cfg.Auth != "" {
+		user, pass, _ := strings.Cut(cfg.Auth, ":")
+		handler = requireBasicAuth(handler, user, pass)
+	}
+	// Probes stay reachable without credentials
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", wd.handleHealthz)
+	root.HandleFunc("/readyz", wd.handleReadyz)
+	root.Handle("/", handler)
+	return logRequests(root)
+}
+
+// Start serves the web UI and API on addr until SIGINT or SIGTERM, then
+// shuts down gracefully. store has been loaded already; the server listens
+// before restoring interrupted downloads, and /readyz turns ready after.
+func Start(addr, outputDir string, store downloader.Store, opts *downloader.DownloadOptions, cfg Config) error {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("-tls-cert and -tls-key must be used together")
+	}
+	if cfg.TLSSelfSigned && cfg.TLSCert != "" {
+		return errors.New("-tls-self-signed cannot be combined with -tls-cert")
+	}
+	authUser, _, hasAuth := strings.Cut(cfg.Auth, ":")
+	if cfg.Auth != "" && (!hasAuth || authUser == "") {
+		return errors.New("-web-auth must be in the form user:pass")
+	}
+
+	wd := newWebDownloader(outputDir, store, opts, cfg)
+	ln, err := net.Listen("tcp", cmp.Or(addr, ":http"))
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, ln, wd, cfg)
+}
+
+// serve runs the startup sequence on ln and serves until ctx is done, then
+// shuts down gracefully.
+func serve(ctx context.Context, ln net.Listener, wd *WebDownloader, cfg Config) error {
+	srv := &http.Server{Handler: wd.handler(cfg)}
+	useTLS := cfg.TLSCert != "" || cfg.TLSSelfSigned
+	if cfg.TLSSelfSigned {
+		cert, err := selfSignedCert()
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("generating self-signed certificate: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if useTLS {
+			// With -tls-self-signed the certificate is already in TLSConfig
+			errc <- srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+		} else {
+			errc <- srv.Serve(ln)
+		}
+	}()
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	slog.Info("starting web server", "url", scheme+"://"+ln.Addr().String(), "tls", useTLS)
+	wd.startup()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down web server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	wd.shutdown()
+	return err
+}
@@ -0,0 +1,840 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"umbrel-downloader/downloader"
+)
+
+// newTestServer starts the web UI and API for cfg on a test server, saving
+// downloads to a temporary directory. opts may be nil.
+func newTestServer(t *testing.T, cfg Config, opts *downloader.DownloadOptions) (*WebDownloader, *httptest.Server) {
+	t.Helper()
+	return newTestServerIn(t, t.TempDir(), cfg, opts)
+}
+
+// newTestServerIn is newTestServer with the downloads directory and history
+// under dir, which may hold files from an earlier run.
+func newTestServerIn(t *testing.T, dir string, cfg Config, opts *downloader.DownloadOptions) (*WebDownloader, *httptest.Server) {
+	t.Helper()
+	outputDir := filepath.Join(dir, "downloads")
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	store, err := downloader.OpenStore("", filepath.Join(dir, "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts == nil {
+		opts = &downloader.DownloadOptions{}
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	wd := newWebDownloader(outputDir, store, opts, cfg)
+	srv := httptest.NewServer(wd.handler(cfg))
+	wd.startup()
+	t.Cleanup(func() {
+		srv.Close()
+		wd.shutdown()
+		waitIdle(t, wd)
+	})
+	return wd, srv
+}
+
+// fileServer serves each path's base name as its content. Requests for
+// paths under /slow/ wait until release is closed.
+func fileServer(t *testing.T) (srv *httptest.Server, release func()) {
+	t.Helper()
+	ch := make(chan struct{})
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if filepath.Base(filepath.Dir(r.URL.Path)) == "slow" && r.Method == http.MethodGet {
+			w.(http.Flusher).Flush()
+			select {
+			case <-ch:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		io.WriteString(w, filepath.Base(r.URL.Path))
+	}))
+	var released bool
+	release = func() {
+		if !released {
+			released = true
+			close(ch)
+		}
+	}
+	t.Cleanup(func() {
+		release()
+		srv.Close()
+	})
+	return srv, release
+}
+
+// postJSON posts v as JSON to url and returns the response with its body
+// read.
+func postJSON(t *testing.T, url string, v any) (*http.Response, []byte) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+// getJSON gets url and decodes its JSON body into v, returning the status.
+func getJSON(t *testing.T, url string, v any) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// startDownload starts a download of rawURL through the API and returns its
+// ID.
+func startDownload(t *testing.T, srv *httptest.Server, rawURL string) string {
+	t.Helper()
+	resp, body := postJSON(t, srv.URL+"/api/download", map[string]string{"url": rawURL})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /api/download %s: %s: %s", rawURL, resp.Status, body)
+	}
+	var reply struct{ ID string }
+	if err := json.Unmarshal(body, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply.ID
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitIdle waits until no download is running or queued.
+func waitIdle(t *testing.T, wd *WebDownloader) {
+	t.Helper()
+	waitFor(t, "downloads to finish", func() bool { return len(wd.getActiveDownloads()) == 0 })
+}
+
+func TestMaxConcurrentRejects(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{MaxConcurrent: 1}, nil)
+
+	startDownload(t, srv, files.URL+"/slow/a.bin")
+	resp, _ := postJSON(t, srv.URL+"/api/download", map[string]string{"url": files.URL + "/b.bin"})
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second download: %s, want 429", resp.Status)
+	}
+	release()
+	waitIdle(t, wd)
+	if n := len(wd.store.All()); n != 1 {
+		t.Errorf("history has %d records, want 1", n)
+	}
+}
+
+func TestMaxConcurrentQueues(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{MaxConcurrent: 2, Queue: true}, nil)
+
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		startDownload(t, srv, files.URL+"/slow/"+name)
+	}
+	var active []ActiveDownload
+	getJSON(t, srv.URL+"/api/progress", &active)
+	statuses := make(map[string]int)
+	for _, d := range active {
+		statuses[d.Status]++
+	}
+	if statuses[DownloadRunning] != 2 || statuses[DownloadQueued] != 2 {
+		t.Errorf("statuses = %v, want 2 %s and 2 %s", statuses, DownloadRunning, DownloadQueued)
+	}
+	if n := wd.running(); n != 2 {
+		t.Errorf("%d downloads running, want 2", n)
+	}
+
+	// Queued downloads start as slots free up, never exceeding the limit
+	release()
+	waitFor(t, "queued downloads to run", func() bool {
+		if n := wd.running(); n > 2 {
+			t.Fatalf("%d downloads running, limit is 2", n)
+		}
+		return len(wd.getActiveDownloads()) == 0
+	})
+	if n := len(wd.store.All()); n != 4 {
+		t.Errorf("history has %d records, want 4", n)
+	}
+}
+
+// putRecords adds a history record for each name, the first one newest.
+func putRecords(t *testing.T, wd *WebDownloader, names ...string) {
+	t.Helper()
+	now := time.Now()
+	for i, name := range names {
+		record := downloader.DownloadRecord{
+			URL:        "https://example.com/files/" + name,
+			Filename:   filepath.Join(wd.outputDir, name),
+			Downloaded: now.Add(-time.Duration(i) * time.Hour),
+			Size:       int64(100 * (i + 1)),
+		}
+		if err := wd.store.Put(name, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHistoryPagination(t *testing.T) {
+	wd, srv := newTestServer(t, Config{}, nil)
+	putRecords(t, wd, "a.iso", "b.iso", "c.iso", "d.iso", "e.iso")
+
+	tests := []struct {
+		query     string
+		wantTotal int
+		wantNames []string
+	}{
+		{"", 5, []string{"a.iso", "b.iso", "c.iso", "d.iso", "e.iso"}},
+		{"limit=2", 5, []string{"a.iso", "b.iso"}},
+		{"limit=2&offset=2", 5, []string{"c.iso", "d.iso"}},
+		{"limit=2&offset=4", 5, []string{"e.iso"}},
+		{"offset=5", 5, nil},
+		{"offset=100", 5, nil},
+		{"limit=0&offset=3", 5, []string{"d.iso", "e.iso"}},
+		{"limit=100", 5, []string{"a.iso", "b.iso", "c.iso", "d.iso", "e.iso"}},
+	}
+	for _, tt := range tests {
+		var page HistoryPage
+		if status := getJSON(t, srv.URL+"/api/history?"+tt.query, &page); status != http.StatusOK {
+			t.Errorf("%s: status %d", tt.query, status)
+			continue
+		}
+		var names []string
+		for _, r := range page.Items {
+			names = append(names, filepath.Base(r.Filename))
+		}
+		if page.Total != tt.wantTotal || !slices.Equal(names, tt.wantNames) {
+			t.Errorf("%s: total %d, items %q, want %d, %q", tt.query, page.Total, names, tt.wantTotal, tt.wantNames)
+		}
+	}
+
+	for _, query := range []string{"limit=-1", "offset=x", "sort=colour", "since=yesterday"} {
+		resp, err := http.Get(srv.URL + "/api/history?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %s, want 400", query, resp.Status)
+		}
+	}
+}
+
+func TestHistorySearch(t *testing.T) {
+	wd, srv := newTestServer(t, Config{}, nil)
+	putRecords(t, wd, "Ubuntu-24.04.iso", "debian-12.iso", "ubuntu-22.04.iso", "notes.txt")
+
+	tests := []struct {
+		query     string
+		wantTotal int
+		wantNames []string
+	}{
+		{"q=ubuntu", 2, []string{"Ubuntu-24.04.iso", "ubuntu-22.04.iso"}},
+		{"q=UBUNTU&limit=1", 2, []string{"Ubuntu-24.04.iso"}},
+		{"q=ubuntu&limit=1&offset=1", 2, []string{"ubuntu-22.04.iso"}},
+		{"q=example.com/files/notes", 1, []string{"notes.txt"}}, // matches the URL
+		{"q=fedora", 0, nil},
+		{"since=90m", 2, []string{"Ubuntu-24.04.iso", "debian-12.iso"}},
+		{"sort=size", 4, []string{"notes.txt", "ubuntu-22.04.iso", "debian-12.iso", "Ubuntu-24.04.iso"}},
+		{"sort=name&since=150m", 3, []string{"debian-12.iso", "ubuntu-22.04.iso", "Ubuntu-24.04.iso"}},
+	}
+	for _, tt := range tests {
+		var page HistoryPage
+		getJSON(t, srv.URL+"/api/history?"+tt.query, &page)
+		var names []string
+		for _, r := range page.Items {
+			names = append(names, filepath.Base(r.Filename))
+		}
+		if page.Total != tt.wantTotal || !slices.Equal(names, tt.wantNames) {
+			t.Errorf("%s: total %d, items %q, want %d, %q", tt.query, page.Total, names, tt.wantTotal, tt.wantNames)
+		}
+	}
+}
+
+func TestInsufficientSpace(t *testing.T) {
+	files, _ := fileServer(t)
+	// No disk has an exabyte to spare
+	wd, srv := newTestServer(t, Config{}, &downloader.DownloadOptions{MinFree: 1 << 60})
+
+	resp, body := postJSON(t, srv.URL+"/api/download", map[string]string{"url": files.URL + "/file.bin"})
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("status %s, want 507: %s", resp.Status, body)
+	}
+	if n := len(wd.getActiveDownloads()); n != 0 {
+		t.Errorf("%d downloads started, want 0", n)
+	}
+}
+
+func TestBatchDownload(t *testing.T) {
+	files, _ := fileServer(t)
+	wd, srv := newTestServer(t, Config{}, nil)
+	putRecords(t, wd, "old.iso")
+
+	urls := []string{files.URL + "/new.iso", "https://example.com/files/old.iso", "mailto:someone@example.com"}
+	resp, body := postJSON(t, srv.URL+"/api/download", map[string][]string{"urls": urls})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s", resp.Status, body)
+	}
+	var results []BatchResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d results, want 3: %s", len(results), body)
+	}
+	for i, r := range results {
+		if r.URL != urls[i] {
+			t.Errorf("result %d is for %q, want %q", i, r.URL, urls[i])
+		}
+	}
+	if results[0].ID == "" || results[0].Error != "" {
+		t.Errorf("new URL: %+v, want an ID", results[0])
+	}
+	if results[1].ID != "" || !strings.Contains(results[1].Error, "already downloaded") {
+		t.Errorf("URL in history: %+v, want an already downloaded error", results[1])
+	}
+	if results[2].ID != "" || results[2].Error == "" {
+		t.Errorf("invalid URL: %+v, want an error", results[2])
+	}
+
+	waitIdle(t, wd)
+	if data, _ := os.ReadFile(filepath.Join(wd.outputDir, "new.iso")); string(data) != "new.iso" {
+		t.Errorf("new.iso = %q", data)
+	}
+}
+
+func TestBatchDownloadMaxConcurrent(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{MaxConcurrent: 1}, nil)
+
+	_, body := postJSON(t, srv.URL+"/api/download", map[string][]string{"urls": {files.URL + "/slow/a.iso", files.URL + "/slow/b.iso"}})
+	var results []BatchResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].ID == "" || results[1].Error != errTooManyDownloads.Error() {
+		t.Errorf("results %+v, want the second refused by -max-concurrent", results)
+	}
+	release()
+	waitIdle(t, wd)
+}
+
+func TestBatchDownloadChecksConcurrently(t *testing.T) {
+	// Each HEAD waits for the other, so checking one URL at a time would
+	// hold the first until the server gives up on it
+	var heads sync.WaitGroup
+	heads.Add(2)
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Done()
+			done := make(chan struct{})
+			go func() { heads.Wait(); close(done) }()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				http.Error(w, "HEADs ran one at a time", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		io.WriteString(w, filepath.Base(r.URL.Path))
+	}))
+	defer files.Close()
+	wd, srv := newTestServer(t, Config{}, nil)
+
+	start := time.Now()
+	_, body := postJSON(t, srv.URL+"/api/download", map[string][]string{"urls": {files.URL + "/a.iso", files.URL + "/b.iso"}})
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("batch took %v, want the HEADs to overlap", elapsed)
+	}
+	var results []BatchResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].ID != "dl-1" || results[1].ID != "dl-2" {
+		t.Errorf("results %+v, want dl-1 and dl-2 in request order", results)
+	}
+	waitIdle(t, wd)
+}
+
+func TestHistoryTiming(t *testing.T) {
+	files, _ := fileServer(t)
+	wd, srv := newTestServer(t, Config{}, nil)
+	before := time.Now()
+	startDownload(t, srv, files.URL+"/a.iso")
+	waitIdle(t, wd)
+
+	var page HistoryPage
+	getJSON(t, srv.URL+"/api/history", &page)
+	if len(page.Items) != 1 {
+		t.Fatalf("%d history records, want 1", len(page.Items))
+	}
+	r := page.Items[0]
+	if r.StartedAt.Before(before) || r.StartedAt.After(r.Downloaded) {
+		t.Errorf("StartedAt %v, want between the request at %v and completion at %v", r.StartedAt, before, r.Downloaded)
+	}
+	if r.Duration <= 0 || r.Duration > r.Downloaded.Sub(before) {
+		t.Errorf("Duration = %v, want a positive duration under %v", r.Duration, r.Downloaded.Sub(before))
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := downloader.OpenEventLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloader.DefaultEventLog = l
+	t.Cleanup(func() { downloader.DefaultEventLog = nil })
+
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{MaxConcurrent: 1, Queue: true}, nil)
+	first := startDownload(t, srv, files.URL+"/slow/a.iso")
+	second := startDownload(t, srv, files.URL+"/slow/b.iso")
+	waitFor(t, "the first download to start", func() bool { return wd.running() == 1 })
+	postJSON(t, srv.URL+"/api/cancel", map[string]string{"id": second})
+	release()
+	waitIdle(t, wd)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string) // download ID -> its events
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e downloader.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad event line %q: %v", line, err)
+		}
+		got[e.ID] = append(got[e.ID], e.Event)
+	}
+	want := map[string][]string{
+		first:  {downloader.EventStarted, downloader.EventCompleted},
+		second: {downloader.EventQueued, downloader.EventCancelled},
+	}
+	for id, events := range want {
+		if !slices.Equal(got[id], events) {
+			t.Errorf("download %s events %q, want %q", id, got[id], events)
+		}
+	}
+}
+
+func TestHistoryCSV(t *testing.T) {
+	wd, srv := newTestServer(t, Config{}, nil)
+	putRecords(t, wd, "a.iso", "b, the sequel.iso")
+
+	resp, err := http.Get(srv.URL + "/api/history.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Content-Type %q, want text/csv", ct)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment") {
+		t.Errorf("Content-Disposition %q, want an attachment", cd)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "url" {
+		t.Fatalf("rows %q, want a header and 2 records", rows)
+	}
+	for i, name := range []string{"a.iso", "b, the sequel.iso"} {
+		if rows[i+1][0] != "https://example.com/files/"+name || filepath.Base(rows[i+1][1]) != name {
+			t.Errorf("row %d = %q, want %s", i+1, rows[i+1], name)
+		}
+	}
+
+	// The history search applies
+	resp, err = http.Get(srv.URL + "/api/history.csv?q=sequel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if rows, _ := csv.NewReader(resp.Body).ReadAll(); len(rows) != 2 {
+		t.Errorf("%d rows for q=sequel, want the header and 1 record", len(rows))
+	}
+}
+
+func TestWriteChecksum(t *testing.T) {
+	files, _ := fileServer(t)
+	wd, srv := newTestServer(t, Config{}, &downloader.DownloadOptions{WriteChecksum: true})
+
+	startDownload(t, srv, files.URL+"/file.bin")
+	waitIdle(t, wd)
+
+	data, err := os.ReadFile(filepath.Join(wd.outputDir, "file.bin.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("file.bin"))
+	if want := hex.EncodeToString(sum[:]) + "  file.bin\n"; string(data) != want {
+		t.Errorf("sidecar = %q, want %q", data, want)
+	}
+}
+
+func TestPerHost(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{MaxConcurrent: 4, Queue: true, PerHost: 1}, nil)
+
+	// Two host names for the same server
+	other := strings.Replace(files.URL, "127.0.0.1", "localhost", 1)
+	for _, u := range []string{files.URL + "/slow/a.bin", files.URL + "/slow/b.bin", other + "/slow/c.bin", other + "/slow/d.bin"} {
+		startDownload(t, srv, u)
+	}
+	running := make(map[string]int)
+	for _, d := range wd.getActiveDownloads() {
+		if d.Status == DownloadRunning {
+			running[downloader.HostOf(d.URL)]++
+		}
+	}
+	if running["127.0.0.1"] != 1 || running["localhost"] != 1 {
+		t.Errorf("running per host = %v, want 1 each", running)
+	}
+
+	release()
+	waitFor(t, "queued downloads to run", func() bool {
+		running := make(map[string]int)
+		for _, d := range wd.getActiveDownloads() {
+			if d.Status == DownloadRunning {
+				if running[downloader.HostOf(d.URL)]++; running[downloader.HostOf(d.URL)] > 1 {
+					t.Fatalf("running per host = %v, limit is 1", running)
+				}
+			}
+		}
+		return len(running) == 0 && len(wd.getActiveDownloads()) == 0
+	})
+	if n := len(wd.store.All()); n != 4 {
+		t.Errorf("history has %d records, want 4", n)
+	}
+}
+
+func TestDownloadStatus(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{}, nil)
+
+	id := startDownload(t, srv, files.URL+"/slow/a.bin")
+	var d ActiveDownload
+	if status := getJSON(t, srv.URL+"/api/download/"+id, &d); status != http.StatusOK {
+		t.Fatalf("active download: status %d", status)
+	}
+	if d.ID != id || d.URL != files.URL+"/slow/a.bin" || d.Status != DownloadRunning {
+		t.Errorf("active download = %+v", d)
+	}
+
+	type notActive struct {
+		Error     string                     `json:"error"`
+		InHistory bool                       `json:"in_history"`
+		Record    *downloader.DownloadRecord `json:"record"`
+	}
+	release()
+	waitIdle(t, wd)
+	var done notActive
+	if status := getJSON(t, srv.URL+"/api/download/"+id, &done); status != http.StatusNotFound {
+		t.Errorf("completed download: status %d, want 404", status)
+	}
+	if !done.InHistory || done.Record == nil || filepath.Base(done.Record.Filename) != "a.bin" {
+		t.Errorf("completed download = %+v, want its history record", done)
+	}
+
+	var unknown notActive
+	if status := getJSON(t, srv.URL+"/api/download/dl-999", &unknown); status != http.StatusNotFound {
+		t.Errorf("unknown download: status %d, want 404", status)
+	}
+	if unknown.InHistory || unknown.Record != nil {
+		t.Errorf("unknown download = %+v", unknown)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	files, _ := fileServer(t)
+	wd, srv := newTestServer(t, Config{}, nil)
+
+	tests := []struct {
+		name, body string
+		wantStatus int
+		wantError  string
+	}{
+		{"oversized", `{"url": "` + strings.Repeat("x", maxRequestBody) + `"}`, http.StatusRequestEntityTooLarge, "larger than 1.0 MB"},
+		{"unknown field", `{"url": "https://example.com/a.iso", "ur1": "x"}`, http.StatusBadRequest, `unknown field "ur1"`},
+		{"trailing data", `{"url": "https://example.com/a.iso"} {"url": "https://example.com/b.iso"}`, http.StatusBadRequest, "after the JSON object"},
+		{"empty", ``, http.StatusBadRequest, "empty body"},
+		{"malformed", `{"url": `, http.StatusBadRequest, "Invalid request"},
+		{"wrong type", `{"url": 42}`, http.StatusBadRequest, "Invalid request"},
+	}
+	for _, path := range []string{"/api/download", "/api/cancel"} {
+		for _, tt := range tests {
+			resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus || !strings.Contains(string(body), tt.wantError) {
+				t.Errorf("%s %s: %s %q, want %d with %q", path, tt.name, resp.Status, body, tt.wantStatus, tt.wantError)
+			}
+		}
+	}
+	if n := len(wd.getActiveDownloads()); n != 0 {
+		t.Errorf("%d downloads started by invalid requests", n)
+	}
+
+	// Valid requests are unaffected, trailing whitespace included
+	resp, err := http.Post(srv.URL+"/api/download", "application/json", strings.NewReader(`{"url": "`+files.URL+`/a.bin"}`+"\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("valid request: %s", resp.Status)
+	}
+	waitIdle(t, wd)
+}
+
+// queueIDs lists the IDs of the queued downloads from GET /api/queue.
+func queueIDs(t *testing.T, srv *httptest.Server) []string {
+	t.Helper()
+	var queue []ActiveDownload
+	getJSON(t, srv.URL+"/api/queue", &queue)
+	ids := make([]string, len(queue))
+	for i, d := range queue {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+func TestQueueReorder(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{MaxConcurrent: 1, Queue: true}, nil)
+
+	running := startDownload(t, srv, files.URL+"/slow/a.bin")
+	b := startDownload(t, srv, files.URL+"/b.bin")
+	c := startDownload(t, srv, files.URL+"/c.bin")
+	d := startDownload(t, srv, files.URL+"/d.bin")
+	if ids := queueIDs(t, srv); !slices.Equal(ids, []string{b, c, d}) {
+		t.Fatalf("queue = %v, want %v", ids, []string{b, c, d})
+	}
+
+	// The listed IDs move to the front; the rest keep their order
+	resp, body := postJSON(t, srv.URL+"/api/queue/reorder", map[string][]string{"ids": {d, c, d}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reorder: %s: %s", resp.Status, body)
+	}
+	if ids := queueIDs(t, srv); !slices.Equal(ids, []string{d, c, b}) {
+		t.Errorf("queue after reorder = %v, want %v", ids, []string{d, c, b})
+	}
+	for _, id := range []string{running, "no-such-id"} {
+		if resp, _ := postJSON(t, srv.URL+"/api/queue/reorder", map[string][]string{"ids": {id}}); resp.StatusCode != http.StatusConflict {
+			t.Errorf("reorder with unqueued ID %s: %s, want 409", id, resp.Status)
+		}
+	}
+	if ids := queueIDs(t, srv); !slices.Equal(ids, []string{d, c, b}) {
+		t.Errorf("a failed reorder changed the queue to %v", ids)
+	}
+
+	// The queue drains in the new order
+	release()
+	waitIdle(t, wd)
+	records := wd.store.All()
+	slices.SortFunc(records, func(x, y downloader.DownloadRecord) int { return x.Downloaded.Compare(y.Downloaded) })
+	var order []string
+	for _, r := range records {
+		order = append(order, filepath.Base(r.Filename))
+	}
+	if want := []string{"a.bin", "d.bin", "c.bin", "b.bin"}; !slices.Equal(order, want) {
+		t.Errorf("downloaded %v, want %v", order, want)
+	}
+}
+
+func TestQueueClear(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{MaxConcurrent: 1, Queue: true}, nil)
+
+	running := startDownload(t, srv, files.URL+"/slow/a.bin")
+	startDownload(t, srv, files.URL+"/b.bin")
+	startDownload(t, srv, files.URL+"/c.bin")
+
+	resp, body := postJSON(t, srv.URL+"/api/queue/clear", nil)
+	var reply struct{ Cleared int }
+	if err := json.Unmarshal(body, &reply); resp.StatusCode != http.StatusOK || err != nil || reply.Cleared != 2 {
+		t.Errorf("clear: %s: %s, want 2 cleared", resp.Status, body)
+	}
+	if ids := queueIDs(t, srv); len(ids) != 0 {
+		t.Errorf("queue after clear = %v", ids)
+	}
+	// The running download isn't touched
+	active := wd.getActiveDownloads()
+	if len(active) != 1 || active[0].ID != running || active[0].Status != DownloadRunning {
+		t.Errorf("active after clear = %+v, want only the running download", active)
+	}
+
+	release()
+	waitIdle(t, wd)
+	if records := wd.store.All(); len(records) != 1 || filepath.Base(records[0].Filename) != "a.bin" {
+		t.Errorf("history = %+v, want only a.bin", records)
+	}
+}
+
+func TestCancelAll(t *testing.T) {
+	// Each download gets its first bytes, then stalls until cancelled
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer files.Close()
+	wd, srv := newTestServer(t, Config{MaxConcurrent: 2, Queue: true}, nil)
+
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		startDownload(t, srv, files.URL+"/"+name)
+	}
+	waitFor(t, "partial files", func() bool {
+		parts, _ := filepath.Glob(filepath.Join(wd.outputDir, "*"+downloader.PartSuffix))
+		return len(parts) == 2
+	})
+
+	resp, body := postJSON(t, srv.URL+"/api/cancel-all", nil)
+	var reply struct{ Cancelled int }
+	if err := json.Unmarshal(body, &reply); resp.StatusCode != http.StatusOK || err != nil || reply.Cancelled != 3 {
+		t.Errorf("cancel-all: %s: %s, want 3 cancelled", resp.Status, body)
+	}
+	waitIdle(t, wd)
+	if ids := queueIDs(t, srv); len(ids) != 0 {
+		t.Errorf("queue after cancel-all = %v", ids)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(wd.outputDir, "*.bin*")); len(parts) != 0 {
+		t.Errorf("cancel-all left %v", parts)
+	}
+	if n := len(wd.store.All()); n != 0 {
+		t.Errorf("history has %d records after cancelling everything", n)
+	}
+
+	// With nothing active there is nothing to cancel
+	if _, body := postJSON(t, srv.URL+"/api/cancel-all", nil); !strings.Contains(string(body), `"cancelled":0`) {
+		t.Errorf("second cancel-all: %s", body)
+	}
+}
+
+func TestHistoryStats(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	record := func(name string, size int64, age time.Duration) downloader.DownloadRecord {
+		return downloader.DownloadRecord{URL: "https://example.com/" + name, Filename: name, Size: size, Downloaded: now.Add(-age)}
+	}
+	records := []downloader.DownloadRecord{
+		record("recent.bin", 100, time.Hour),
+		record("day.bin", 200, 24*time.Hour),
+		record("week.bin", 5000, 3*24*time.Hour),
+		record("old.bin", 400, 30*24*time.Hour),
+	}
+	stats := historyStats(records, now)
+	if stats.Downloads != 4 || stats.Bytes != 5700 || stats.Last24h != 2 || stats.Last7d != 3 {
+		t.Errorf("stats = %+v, want 4 downloads, 5700 bytes, 2 in 24h, 3 in 7d", stats)
+	}
+	if stats.Largest == nil || stats.Largest.Filename != "week.bin" {
+		t.Errorf("largest = %+v, want week.bin", stats.Largest)
+	}
+	if empty := historyStats(nil, now); empty != (HistoryStats{}) {
+		t.Errorf("stats of no records = %+v", empty)
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	wd, srv := newTestServer(t, Config{}, nil)
+
+	var stats HistoryStats
+	if code := getJSON(t, srv.URL+"/api/stats", &stats); code != http.StatusOK || stats.Downloads != 0 || stats.Largest != nil {
+		t.Errorf("empty history: %d, %+v", code, stats)
+	}
+
+	putRecords(t, wd, "a.bin", "b.bin", "c.bin")
+	getJSON(t, srv.URL+"/api/stats", &stats)
+	if stats.Downloads != 3 || stats.Bytes != 600 || stats.Last24h != 3 || stats.Last7d != 3 {
+		t.Errorf("stats = %+v, want 3 downloads of 600 bytes, all recent", stats)
+	}
+	if stats.Largest == nil || filepath.Base(stats.Largest.Filename) != "c.bin" || stats.Largest.Size != 300 {
+		t.Errorf("largest = %+v, want c.bin", stats.Largest)
+	}
+}
+
+func TestCancelByURL(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{}, nil)
+
+	first := startDownload(t, srv, files.URL+"/slow/a.bin")
+	second := startDownload(t, srv, files.URL+"/slow/a.bin")
+	other := startDownload(t, srv, files.URL+"/slow/b.bin")
+
+	// Every download of the URL is cancelled, oldest first
+	resp, body := postJSON(t, srv.URL+"/api/cancel", map[string]string{"url": files.URL + "/slow/a.bin"})
+	var reply struct{ Cancelled []string }
+	if err := json.Unmarshal(body, &reply); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("cancel by URL: %s: %s", resp.Status, body)
+	}
+	if !slices.Equal(reply.Cancelled, []string{first, second}) {
+		t.Errorf("cancelled %v, want %v", reply.Cancelled, []string{first, second})
+	}
+	if active := wd.getActiveDownloads(); len(active) != 1 || active[0].ID != other {
+		t.Errorf("active after cancel = %+v, want only %s", active, other)
+	}
+
+	if resp, _ := postJSON(t, srv.URL+"/api/cancel", map[string]string{"url": files.URL + "/slow/a.bin"}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("cancelling a URL with nothing active: %s, want 404", resp.Status)
+	}
+	if resp, _ := postJSON(t, srv.URL+"/api/cancel", map[string]string{"id": other, "url": files.URL + "/slow/b.bin"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("both id and url: %s, want 400", resp.Status)
+	}
+
+	release()
+	waitIdle(t, wd)
+	if records := wd.store.All(); len(records) != 1 || filepath.Base(records[0].Filename) != "b.bin" {
+		t.Errorf("history = %+v, want only b.bin", records)
+	}
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The server only pushes JSON text messages to the browser. Incoming data
+// messages are read and discarded; the read side exists only to answer pings
+// and notice when the client goes away.
+
+const wsWriteTimeout = 5 * time.Second
+
+// wsUpgrader keeps the default origin check, so other sites can't open a
+// socket with the browser's credentials for this one.
+var wsUpgrader = websocket.Upgrader{}
+
+type wsConn struct {
+	conn *websocket.Conn
+
+	mu sync.Mutex // serializes writes; the library allows one writer at a time
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the
+// connection. On failure an HTTP error has already been written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{conn: conn}, nil
+}
+
+// WriteText sends data as a single text message.
+func (c *wsConn) WriteText(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// ReadLoop reads messages until the client closes the connection or an error
+// occurs. The library answers pings and close frames; messages are skipped
+// without buffering them.
+func (c *wsConn) ReadLoop() error {
+	for {
+		if _, _, err := c.conn.NextReader(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
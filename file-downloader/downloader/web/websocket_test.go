@@ -0,0 +1,123 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebSocket connects to path on srv.
+func dialWebSocket(t *testing.T, srv *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestWebSocketProgress(t *testing.T) {
+	files, release := fileServer(t)
+	wd, srv := newTestServer(t, Config{}, nil)
+	client := dialWebSocket(t, srv, "/ws")
+
+	// The current state comes first
+	kind, payload, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != websocket.TextMessage || strings.TrimSpace(string(payload)) != "[]" {
+		t.Fatalf("first message: type %d %q, want an empty list", kind, payload)
+	}
+
+	id := startDownload(t, srv, files.URL+"/slow/big.iso")
+	for {
+		kind, payload, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != websocket.TextMessage {
+			t.Fatalf("message type %d, want text", kind)
+		}
+		var active []ActiveDownload
+		if err := json.Unmarshal(payload, &active); err != nil {
+			t.Fatal(err)
+		}
+		if len(active) == 1 && active[0].ID == id && active[0].Filename == "big.iso" {
+			break
+		}
+	}
+	release()
+	waitIdle(t, wd)
+
+	// Pings are answered with the same payload, and a close is echoed
+	pong := make(chan string, 1)
+	client.SetPongHandler(func(data string) error {
+		pong <- data
+		return nil
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	client.WriteControl(websocket.PingMessage, []byte("are you there"), deadline)
+	client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+	for err == nil {
+		_, _, err = client.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("read ended with %v, want the close echoed", err)
+	}
+	select {
+	case data := <-pong:
+		if data != "are you there" {
+			t.Errorf("pong payload %q, want the ping's", data)
+		}
+	default:
+		t.Error("ping not answered")
+	}
+
+	waitFor(t, "the connection to be unsubscribed", func() bool {
+		wd.subscribersMu.Lock()
+		defer wd.subscribersMu.Unlock()
+		return len(wd.subscribers) == 0
+	})
+}
+
+func TestWebSocketHandshakeErrors(t *testing.T) {
+	_, srv := newTestServer(t, Config{}, nil)
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"plain GET", http.Header{}},
+		{"wrong version", http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Version": {"8"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}}},
+		{"missing key", http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Version": {"13"}}},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", srv.URL+"/ws", nil)
+		req.Header = tt.header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %s, want 400", tt.name, resp.Status)
+		}
+	}
+}
+
+func TestWebSocketCrossOrigin(t *testing.T) {
+	_, srv := newTestServer(t, Config{}, nil)
+	header := http.Header{"Origin": {"https://evil.example"}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+	if !errors.Is(err, websocket.ErrBadHandshake) || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-origin dial: err %v, want a 403 handshake failure", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"umbrel-downloader/downloader"
+)
+
+// runDryRun prints what a download run over urls would do: the resolved
+// file names and sizes, and which URLs would be skipped. Only response
+// headers are fetched; no files or history are written.
+func runDryRun(ctx context.Context, opts *downloader.DownloadOptions, store downloader.Store, urls []string, outputDir, outputName string, force bool) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tSIZE\tFILE\tURL")
+
+	var count, unknown int
+	var total int64
+	for _, line := range urls {
+		rawURL, name := downloader.SplitOutputName(downloader.CleanLine(line))
+		if rawURL == "" {
+			continue
+		}
+		if name == "" {
+			name = outputName
+		}
+		rawURL, err := downloader.ValidateURL(downloader.SplitMirrors(rawURL)[0], opts.AssumeHTTPS)
+		if err != nil {
+			fmt.Fprintf(tw, "error\t-\t-\t%s (%v)\n", line, err)
+			continue
+		}
+
+		if record, ok := store.Get(opts.HistoryKey(rawURL)); ok && !force {
+			fmt.Fprintf(tw, "skip (in history)\t%s\t%s\t%s\n", downloader.FormatBytes(record.Size), record.Filename, rawURL)
+			continue
+		}
+		filename := downloader.FilenameFromURL(rawURL)
+		if name != "" {
+			filename = downloader.SanitizeFilename(name)
+		}
+		if store.HasFilename(filename) && !force {
+			fmt.Fprintf(tw, "skip (file in history)\t-\t%s\t%s\n", filename, rawURL)
+			continue
+		}
+
+		resp, err := opts.Probe(ctx, rawURL)
+		if err != nil {
+			fmt.Fprintf(tw, "error\t-\t%s\t%s (%v)\n", filename, rawURL, err)
+			continue
+		}
+		if name != "" || !opts.ContentDisposition && !opts.InferExt {
+			name = filename
+		}
+		outputPath := opts.OutputPath(rawURL, outputDir, opts.Filename(rawURL, name, resp))
+		if opts.SkipExisting && !force {
+			if existing := opts.ExistingFile(outputPath, resp, false); existing != nil {
+				fmt.Fprintf(tw, "skip (on disk)\t%s\t%s\t%s\n", downloader.FormatBytes(existing.Size), outputPath, rawURL)
+				continue
+			}
+		}
+		path, err := opts.CollisionPath(rawURL, outputPath)
+		if err != nil {
+			fmt.Fprintf(tw, "skip (exists)\t-\t%s\t%s\n", outputPath, rawURL)
+			continue
+		}
+
+		size := "unknown"
+		if resp.ContentLength >= 0 {
+			size = downloader.FormatBytes(resp.ContentLength)
+			total += resp.ContentLength
+		} else {
+			unknown++
+		}
+		count++
+		target := rawURL
+		if final := resp.Request.URL.String(); final != rawURL {
+			target += " -> " + final
+		}
+		fmt.Fprintf(tw, "download\t%s\t%s\t%s\n", size, filepath.Clean(path), target)
+	}
+	tw.Flush()
+
+	fmt.Printf("%d files to download, %s", count, downloader.FormatBytes(total))
+	if unknown > 0 {
+		fmt.Printf(" plus %d of unknown size", unknown)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newLogger builds the logger used for all non-progress output. format is
+// "text" or "json"; level is debug, info, warn or error.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q (use debug, info, warn or error)", level)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q (use text or json)", format)
+	}
+}
+
+// Output styles for -style.
+const (
+	StylePlain = "plain"
+	StyleFancy = "fancy"
+)
+
+// statusPrinter prints the outcome of each URL in a CLI run. Plain prints
+// it as an ordinary log line; fancy as a line led by a colored symbol, which
+// main only enables for text logs on a color terminal.
+type statusPrinter struct {
+	fancy bool
+	w     io.Writer // the progress renderer, which keeps lines off its bars
+}
+
+func (p *statusPrinter) print(status, msg string, args ...any) {
+	level := slog.LevelInfo
+	if status == StatusError {
+		level = slog.LevelError
+	}
+	if !p.fancy {
+		slog.Log(context.Background(), level, msg, args...)
+		return
+	}
+	// -quiet and -log-level still apply
+	if slog.Default().Enabled(context.Background(), level) {
+		fmt.Fprintln(p.w, formatStatus(status, msg, args...))
+	}
+}
+
+// statusSymbols are the fancy style's symbols and their ANSI colors.
+var statusSymbols = map[string]struct{ symbol, color string }{
+	StatusDownloaded: {"✓", "32"},
+	StatusSkipped:    {"↷", "33"},
+	StatusError:      {"✗", "31"},
+}
+
+// formatStatus renders a fancy status line: the status's symbol, msg and
+// args as key=value pairs, quoted like slog's text handler when needed.
+func formatStatus(status, msg string, args ...any) string {
+	s := statusSymbols[status]
+	var b strings.Builder
+	fmt.Fprintf(&b, "\x1b[%sm%s\x1b[0m %s", s.color, s.symbol, msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		v := fmt.Sprint(args[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " \x1b[2m%v=\x1b[0m%s", args[i], v)
+	}
+	return b.String()
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
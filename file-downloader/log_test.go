@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestFormatStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		msg    string
+		args   []any
+		want   string
+	}{
+		{StatusDownloaded, "downloaded", []any{"file", "out/a.bin", "size", "5 B"},
+			"\x1b[32m✓\x1b[0m downloaded \x1b[2mfile=\x1b[0mout/a.bin \x1b[2msize=\x1b[0m\"5 B\""},
+		{StatusSkipped, "skipped: same URL already downloaded", []any{"file", "out/a.bin"},
+			"\x1b[33m↷\x1b[0m skipped: same URL already downloaded \x1b[2mfile=\x1b[0mout/a.bin"},
+		{StatusError, "download failed", []any{"url", "https://example.com/a.bin", "error", `got "x"`},
+			"\x1b[31m✗\x1b[0m download failed \x1b[2murl=\x1b[0mhttps://example.com/a.bin \x1b[2merror=\x1b[0m\"got \\\"x\\\"\""},
+		// Empty values are quoted, and a key without a value is dropped
+		{StatusError, "failed", []any{"error", "", "dangling"},
+			"\x1b[31m✗\x1b[0m failed \x1b[2merror=\x1b[0m\"\""},
+	}
+	for _, tt := range tests {
+		if got := formatStatus(tt.status, tt.msg, tt.args...); got != tt.want {
+			t.Errorf("formatStatus(%s, %q) =\n%q\nwant\n%q", tt.status, tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestStatusPrinter(t *testing.T) {
+	var logs, fancyOut bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	setLevel := func(level slog.Level) {
+		slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: level})))
+	}
+
+	// Plain prints log lines, errors at error level
+	setLevel(slog.LevelInfo)
+	plain := &statusPrinter{w: &fancyOut}
+	plain.print(StatusDownloaded, "downloaded", "file", "a.bin")
+	plain.print(StatusError, "download failed", "url", "b.bin")
+	if got := logs.String(); !strings.Contains(got, "level=INFO msg=downloaded file=a.bin") || !strings.Contains(got, `level=ERROR msg="download failed" url=b.bin`) {
+		t.Errorf("plain output:\n%s", got)
+	}
+	if fancyOut.Len() != 0 {
+		t.Errorf("plain wrote to the progress writer: %q", fancyOut.String())
+	}
+
+	// Fancy writes symbol lines instead, still filtered by the log level
+	logs.Reset()
+	setLevel(slog.LevelError)
+	fancy := &statusPrinter{fancy: true, w: &fancyOut}
+	fancy.print(StatusSkipped, "skipped", "file", "a.bin")
+	fancy.print(StatusError, "download failed", "url", "b.bin")
+	if want := formatStatus(StatusError, "download failed", "url", "b.bin") + "\n"; fancyOut.String() != want {
+		t.Errorf("fancy output at error level = %q, want %q", fancyOut.String(), want)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("fancy also logged:\n%s", logs.String())
+	}
+}
@@ -2,739 +2,851 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"umbrel-downloader/downloader"
+	"umbrel-downloader/downloader/web"
 )
 
-type DownloadRecord struct {
-	URL        string    `json:"url"`
-	Filename   string    `json:"filename"`
-	Downloaded time.Time `json:"downloaded"`
-	Size       int64     `json:"size"`
+// Version is set at build time via -ldflags "-X main.Version=...".
+var Version = "dev"
+
+// Statuses reported per URL in -json output.
+const (
+	StatusDownloaded = "downloaded"
+	StatusSkipped    = "skipped"
+	StatusError      = "error"
+)
+
+// URLResult is the per-URL outcome printed as one NDJSON line with -json.
+type URLResult struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
 }
 
-type History struct {
-	Downloads       map[string]DownloadRecord `json:"downloads"`
-	DownloadedFiles map[string]string         `json:"downloaded_files"`
+// BatchSummary totals the outcomes of a CLI run. With -json it is printed as
+// a final {"summary": ...} line after the per-URL results.
+type BatchSummary struct {
+	Total      int   `json:"total"`
+	Downloaded int   `json:"downloaded"`
+	Skipped    int   `json:"skipped"`
+	Failed     int   `json:"failed"`
+	Bytes      int64 `json:"bytes"` // downloaded bytes; skipped files don't count
 }
 
-type ProgressWriter struct {
-	Total      int64
-	Downloaded int64
-	Filename   string
-	LastPrint  time.Time
+func (s *BatchSummary) add(r URLResult) {
+	s.Total++
+	switch r.Status {
+	case StatusDownloaded:
+		s.Downloaded++
+		s.Bytes += r.Size
+	case StatusSkipped:
+		s.Skipped++
+	case StatusError:
+		s.Failed++
+	}
 }
 
-// Global state for tracking current download (for cleanup on cancel)
+// Global state for tracking the CLI's running downloads (for cleanup on
+// cancel). The keys are .part file paths.
 var (
-	currentDownloadPath string
-	currentDownloadMu   sync.Mutex
+	currentDownloads  = make(map[string]bool)
+	currentDownloadMu sync.Mutex
 )
 
-func setCurrentDownload(path string) {
-	currentDownloadMu.Lock()
-	currentDownloadPath = path
-	currentDownloadMu.Unlock()
-}
+// totalLimiter is the CLI's -limit-total bucket, shared by its downloads.
+var totalLimiter *downloader.RateLimiter
 
-func cleanupCurrentDownload() {
-	currentDownloadMu.Lock()
-	path := currentDownloadPath
-	currentDownloadPath = ""
-	currentDownloadMu.Unlock()
+// interruptWindow is how soon a second Ctrl+C must follow the first to stop
+// the whole CLI run rather than skip the current download again.
+const interruptWindow = 2 * time.Second
 
-	if path != "" {
-		os.Remove(path)
-		fmt.Printf("\nCleaned up partial download: %s\n", filepath.Base(path))
-	}
+// skipSignal lets the first Ctrl+C cancel the CLI's running downloads while
+// the batch goes on with the next URL. Downloads watch the current
+// generation's context; skip cancels it and starts a new one.
+type skipSignal struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func (pw *ProgressWriter) Write(p []byte) (int, error) {
-	n := len(p)
-	pw.Downloaded += int64(n)
+func newSkipSignal() *skipSignal {
+	s := &skipSignal{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
 
-	if time.Since(pw.LastPrint) > 100*time.Millisecond {
-		pw.printProgress()
-		pw.LastPrint = time.Now()
+// watch returns a context for one download that is cancelled by ctx or by
+// the next skip. Call stop once the download is over.
+func (s *skipSignal) watch(ctx context.Context) (_ context.Context, stop func()) {
+	s.mu.Lock()
+	skip := s.ctx
+	s.mu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	unwatch := context.AfterFunc(skip, cancel)
+	return ctx, func() {
+		unwatch()
+		cancel()
 	}
-	return n, nil
 }
 
-func (pw *ProgressWriter) printProgress() {
-	if pw.Total > 0 {
-		pct := float64(pw.Downloaded) / float64(pw.Total) * 100
-		bar := int(pct / 2)
-		fmt.Printf("\r[%-50s] %6.2f%% %s / %s  %s",
-			strings.Repeat("=", bar)+">",
-			pct,
-			formatBytes(pw.Downloaded),
-			formatBytes(pw.Total),
-			pw.Filename)
-	} else {
-		fmt.Printf("\r%s downloaded  %s", formatBytes(pw.Downloaded), pw.Filename)
-	}
+// skip cancels the downloads currently being watched.
+func (s *skipSignal) skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancel()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 }
 
-func formatBytes(b int64) string {
-	const unit = 1024
-	if b < unit {
-		return fmt.Sprintf("%d B", b)
-	}
-	div, exp := int64(unit), 0
-	for n := b / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
-	}
-	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+func trackDownload(part string) {
+	currentDownloadMu.Lock()
+	currentDownloads[part] = true
+	currentDownloadMu.Unlock()
 }
 
-func loadHistory(historyFile string) (*History, bool, error) {
-	history := &History{
-		Downloads:       make(map[string]DownloadRecord),
-		DownloadedFiles: make(map[string]string),
-	}
+func untrackDownload(part string) {
+	currentDownloadMu.Lock()
+	delete(currentDownloads, part)
+	currentDownloadMu.Unlock()
+}
 
-	data, err := os.ReadFile(historyFile)
-	if os.IsNotExist(err) {
-		return history, false, nil
-	}
-	if err != nil {
-		return nil, false, err
+// cleanupDownload removes the .part file of a cancelled download.
+func cleanupDownload(part string) {
+	untrackDownload(part)
+	if err := os.Remove(part); err != nil {
+		return
 	}
+	downloader.LogEvent(downloader.Event{Event: downloader.EventCancelled, File: strings.TrimSuffix(part, downloader.PartSuffix)})
+	slog.Info("cleaned up partial download", "file", filepath.Base(part))
+}
 
-	if err := json.Unmarshal(data, history); err != nil {
-		return nil, false, err
+// cleanupCurrentDownloads removes the .part files of every running download.
+func cleanupCurrentDownloads() {
+	currentDownloadMu.Lock()
+	var parts []string
+	for part := range currentDownloads {
+		parts = append(parts, part)
 	}
+	currentDownloadMu.Unlock()
 
-	if history.Downloads == nil {
-		history.Downloads = make(map[string]DownloadRecord)
+	if len(parts) > 0 {
+		fmt.Fprintln(os.Stderr)
 	}
-	if history.DownloadedFiles == nil {
-		history.DownloadedFiles = make(map[string]string)
+	for _, part := range parts {
+		cleanupDownload(part)
 	}
+}
 
-	// Migrate: populate DownloadedFiles from Downloads if empty
-	needsSave := false
-	if len(history.DownloadedFiles) == 0 && len(history.Downloads) > 0 {
-		for u := range history.Downloads {
-			filename := filenameFromURL(u)
-			history.DownloadedFiles[filename] = u
-		}
-		needsSave = true
-	}
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
 
-	return history, needsSave, nil
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
 }
 
-func saveHistory(historyFile string, history *History) error {
-	data, err := json.MarshalIndent(history, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(historyFile, data, 0644)
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
-func urlHash(u string) string {
-	h := sha256.Sum256([]byte(u))
-	return hex.EncodeToString(h[:8])
-}
+// byteSize is a flag.Value accepting sizes in ParseBytes format.
+type byteSize int64
 
-func keys(m map[string]string) []string {
-	k := make([]string, 0, len(m))
-	for key := range m {
-		k = append(k, key)
-	}
-	return k
+func (b *byteSize) String() string {
+	return downloader.FormatBytes(int64(*b))
 }
 
-func filenameFromURL(rawURL string) string {
-	parsed, err := url.Parse(rawURL)
+func (b *byteSize) Set(s string) error {
+	v, err := downloader.ParseBytes(s)
 	if err != nil {
-		return urlHash(rawURL)
+		return err
 	}
+	*b = byteSize(v)
+	return nil
+}
 
-	filename := filepath.Base(parsed.Path)
-	if filename == "" || filename == "." || filename == "/" {
-		return urlHash(rawURL)
-	}
+// fileMode is a flag.Value accepting octal permission bits such as 0640.
+type fileMode os.FileMode
 
-	return filename
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
 }
 
-func downloadFile(ctx context.Context, rawURL, outputDir string) (string, int64, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
-	if err != nil {
-		return "", 0, err
+func (m *fileMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		return fmt.Errorf("invalid file mode %q (use octal permissions such as 0644)", s)
 	}
+	*m = fileMode(v)
+	return nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", 0, err
+// newConfirmPrompt returns the DownloadOptions.Confirm hook for
+// -interactive. It asks on out and reads the answer from in; only "y" or
+// "yes" accepts. With yes set every prompt is accepted, and when in isn't a
+// terminal every prompt is declined, since nobody is there to answer.
+func newConfirmPrompt(in io.Reader, out io.Writer, tty, yes bool) func(string, int64, bool) bool {
+	answers := bufio.NewReader(in)
+	var mu sync.Mutex // one prompt at a time with -j
+	return func(outputPath string, size int64, overwrite bool) bool {
+		if yes {
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !tty {
+			slog.Warn("declined: stdin is not a terminal (use -yes to accept)", "file", outputPath)
+			return false
+		}
+		verb := "Download"
+		if overwrite {
+			verb = "Overwrite"
+		}
+		sizeText := "unknown size"
+		if size >= 0 {
+			sizeText = downloader.FormatBytes(size)
+		}
+		fmt.Fprintf(out, "%s %s (%s)? [y/N] ", verb, filepath.Base(outputPath), sizeText)
+		line, _ := answers.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true
+		}
+		return false
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", 0, fmt.Errorf("bad status: %s", resp.Status)
+// readURLs reads one URL per line from r, skipping blank lines and # comments.
+func readURLs(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	// Increase buffer for very long URLs
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := downloader.CleanLine(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
 	}
+	return urls, scanner.Err()
+}
 
-	filename := filenameFromURL(rawURL)
-	outputPath := filepath.Join(outputDir, filename)
-
-	// Handle duplicate filenames on disk
-	if _, err := os.Stat(outputPath); err == nil {
-		ext := filepath.Ext(filename)
-		base := strings.TrimSuffix(filename, ext)
-		outputPath = filepath.Join(outputDir, fmt.Sprintf("%s_%s%s", base, urlHash(rawURL), ext))
+// readURLFile reads a URL list from path, where "-" means stdin.
+func readURLFile(path string) ([]string, error) {
+	if path == "-" {
+		return readURLs(os.Stdin)
 	}
-
-	out, err := os.Create(outputPath)
+	f, err := os.Open(path)
 	if err != nil {
-		return "", 0, err
+		return nil, err
 	}
+	defer f.Close()
+	return readURLs(f)
+}
 
-	// Track current download for cleanup on cancel
-	setCurrentDownload(outputPath)
-	defer setCurrentDownload("")
-
-	pw := &ProgressWriter{
-		Total:    resp.ContentLength,
-		Filename: filepath.Base(outputPath),
+// downloadFile downloads a single URL for the CLI, falling back to its
+// mirrors (urls[1:]) on failure. Progress is drawn by progress.
+func downloadFile(ctx context.Context, opts *downloader.DownloadOptions, urls []string, outputDir, name string, progress *progressRenderer) (*downloader.DownloadResult, error) {
+	if totalLimiter != nil {
+		o := *opts
+		o.TotalLimiter = totalLimiter
+		opts = &o
 	}
 
-	size, err := io.Copy(out, io.TeeReader(resp.Body, pw))
-	out.Close()
-	fmt.Println() // newline after progress bar
+	var part string
+	var bar *ProgressWriter
+	result, err := opts.FetchMirrors(ctx, urls, outputDir, name, func(outputPath string, offset, total int64) io.Writer {
+		// Track current download for cleanup on cancel. A retry or
+		// another mirror may pick a different path.
+		if part != "" {
+			untrackDownload(part)
+		}
+		part = downloader.PartPath(outputPath)
+		trackDownload(part)
 
-	if err != nil {
-		os.Remove(outputPath)
-		return "", 0, err
+		progress.finish(bar)
+		bar = progress.start(filepath.Base(outputPath), offset, total)
+		return io.MultiWriter(bar, downloader.NewMilestoneWriter("", urls[0], outputPath, offset, total))
+	})
+	progress.finish(bar)
+	if part != "" {
+		if ctx.Err() != nil {
+			// The .part file is kept for resuming only within a run
+			cleanupDownload(part)
+		}
+		untrackDownload(part)
+	}
+	if err == nil {
+		err = opts.PostProcess(ctx, result)
 	}
 
-	return outputPath, size, nil
-}
-
-// Active download tracking
-type ActiveDownload struct {
-	ID         string             `json:"id"`
-	URL        string             `json:"url"`
-	Filename   string             `json:"filename"`
-	Progress   int64              `json:"progress"`
-	Total      int64              `json:"total"`
-	Speed      int64              `json:"speed"` // bytes per second
-	StartedAt  time.Time          `json:"started_at"`
-	OutputPath string             `json:"-"`
-	CancelFunc context.CancelFunc `json:"-"`
+	return result, err
 }
 
-// Web server state
-type WebDownloader struct {
-	outputDir   string
-	historyFile string
-	history     *History
-	historyMu   sync.RWMutex
+// exitDeadline is the exit code when -deadline cuts a run short, the same
+// one timeout(1) uses.
+const exitDeadline = 124
 
-	downloads   map[string]*ActiveDownload
-	downloadsMu sync.RWMutex
-	nextID      int
-}
-
-func (wd *WebDownloader) getActiveDownloads() []ActiveDownload {
-	wd.downloadsMu.RLock()
-	defer wd.downloadsMu.RUnlock()
+func main() {
+	outputDir := flag.String("o", ".", "Output directory for downloads")
+	historyFile := flag.String("history", ".download_history.json", "History file path")
+	profile := flag.String("profile", "", "Keep a separate history (.download_history_NAME.json) and output subdirectory (NAME) for this profile, unless -history/-store or -o are given")
+	storeSpec := flag.String("store", "", "History store: json:PATH or sqlite:PATH (default: JSON file from -history)")
+	migrateTo := flag.String("migrate-store", "", "Copy all history records into this store (json:PATH or sqlite:PATH) and exit")
+	importPath := flag.String("import", "", "Merge the history JSON file at this path into the current history and exit")
+	importOverwrite := flag.Bool("import-overwrite", false, "With -import, replace records for URLs already in the history")
+	force := flag.Bool("f", false, "Force re-download even if already downloaded")
+	listHistory := flag.Bool("list", false, "List download history")
+	since := flag.String("since", "", "With -list, only show downloads within this duration (24h, 7d) or since this date (2024-01-01)")
+	listFailures := flag.Bool("failures", false, "With -list, show the failed downloads recorded by -track-failures")
+	trackFailures := flag.Bool("track-failures", false, "Record the error, HTTP status and time of failed downloads in history")
+	long := flag.Bool("long", false, "With -list, show full URLs instead of shortening them")
+	sortBy := flag.String("sort", downloader.SortDate, "With -list, order by date (newest first), name or size (largest first)")
+	clean := flag.Bool("clean", false, "List .part files and files not in history in the output directory (with -f, remove them)")
+	reindex := flag.Bool("reindex", false, "Add history records for files in the output directory that aren't in history yet, so they aren't downloaded again")
+	repairHistory := flag.Bool("repair-history", false, "List file name entries in history that don't match its records (with -f, fix them)")
+	exportCSVPath := flag.String("export-csv", "", "Write the download history as CSV to this file (- for stdout)")
+	webAddr := flag.String("web", "", "Start web UI on this address (e.g., :8080)")
+	metricsEnabled := flag.Bool("metrics", false, "Serve Prometheus metrics at /metrics in web mode")
+	maxConcurrent := flag.Int("max-concurrent", 3, "Maximum simultaneous downloads in web mode (0 = no limit)")
+	queue := flag.Bool("queue", false, "Queue web downloads over -max-concurrent instead of rejecting them with 429")
+	perHost := flag.Int("per-host", 0, "Maximum simultaneous downloads from one host, with -j or in web mode (0 = no limit)")
+	tlsCert := flag.String("tls-cert", "", "Serve the web UI over HTTPS with this certificate file (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "Private key file for -tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Serve the web UI over HTTPS with a generated self-signed certificate")
+	webAuth := flag.String("web-auth", "", "Require HTTP Basic auth (user:pass) for the web UI and API")
+	proxy := flag.String("proxy", "", "Proxy URL (http://, https:// or socks5://); defaults to HTTP_PROXY/HTTPS_PROXY")
+	connectTimeout := flag.Duration("connect-timeout", 30*time.Second, "Timeout for establishing a connection (0 = none)")
+	ipv4Only := flag.Bool("ipv4-only", false, "Connect over IPv4 only")
+	ipv6Only := flag.Bool("ipv6-only", false, "Connect over IPv6 only")
+	http1 := flag.Bool("http1", false, "Use HTTP/1.1 only, never HTTP/2")
+	maxIdleConns := flag.Int("max-idle-conns", 0, "Idle connections kept open for reuse across downloads (0 = default of 100)")
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", 0, "Idle connections kept open per host (0 = default of 2; raise it with -j against one host)")
+	dnsServer := flag.String("dns", "", "Resolve host names with this DNS server (host or host:port) instead of the system resolver")
+	timeout := flag.Duration("timeout", 60*time.Second, "Timeout waiting for response headers (0 = none)")
+	notifyURL := flag.String("notify-url", "", "POST a JSON notification to this URL after each download")
+	notifyCommand := flag.String("notify-command", "", "Run this shell command after each download (DOWNLOAD_* env vars)")
+	extract := flag.Bool("extract", false, "Extract .zip, .tar and .tar.gz downloads into a directory named after the archive")
+	verifyKey := flag.String("verify-key", "", "Verify each download's minisign signature with this public key (a minisign.pub file or the key itself); failures are deleted")
+	verifySig := flag.String("verify-sig", "", "With -verify-key, the signature file or URL (default: the download URL + .minisig)")
+	writeChecksum := flag.Bool("write-checksum", false, "Write FILE.sha256 next to each download, in sha256sum format")
+	extractRemove := flag.Bool("extract-remove", false, "Delete the archive after a successful -extract")
+	preflight := flag.Bool("preflight", false, "Send a HEAD request first to report size and resume support")
+	outTemplate := flag.String("out-template", "", "Relative output path template, e.g. {host}/{date:2006-01-02}/{name}")
+	flat := flag.Bool("flat", false, "Keep every file directly in the output directory: path separators in file names and -out-template paths become -flat-char")
+	flatChar := flag.String("flat-char", "_", "What -flat replaces path separators with")
+	outputName := flag.String("O", "", "Output filename (single URL only; use URL>filename for batches)")
+	expectSHA256 := flag.String("sha256", "", "Expected SHA-256 of the file (single URL only); on a mismatch the next mirror is tried")
+	inputFile := flag.String("i", "", "Read URLs from file, one per line (- for stdin)")
+	retries := flag.Int("retries", 0, "Retry a failed download this many times (per mirror) before giving up")
+	var mirrorBases, denyTypes listFlag
+	flag.Var(&mirrorBases, "mirror", "Base URL of a mirror serving the same paths, tried after the primary (repeatable)")
+	ifChanged := flag.Bool("if-changed", false, "Re-download URLs already in history when the server reports a change (ETag/Last-Modified)")
+	onlyLarger := flag.Bool("only-larger", false, "Re-download URLs already in history only when the server reports a larger size (sends a HEAD request)")
+	keepVersions := flag.Int("keep-versions", 0, "When -f, -if-changed or -only-larger replaces a file, keep this many older versions with a timestamp in their name")
+	collision := flag.String("collision", downloader.CollisionHash, "When the output file exists: hash (add a URL hash), number (add \" (1)\"), overwrite, skip, or replace (overwrite unless the SHA-256 is the same)")
+	replaceExisting := flag.Bool("replace-existing-file", false, "Shorthand for -collision replace: keep an existing file with the same content, replace it otherwise")
+	interactive := flag.Bool("interactive", false, "Ask before overwriting a file or downloading more than -confirm-over")
+	assumeYes := flag.Bool("yes", false, "Answer yes to every -interactive prompt")
+	var confirmOver byteSize
+	flag.Var(&confirmOver, "confirm-over", "With -interactive, also ask before downloads larger than this, e.g. 1G (0 = never)")
+	deadline := flag.Duration("deadline", 0, "Abort the whole run after this long, removing partial files (exit code 124)")
+	failFast := flag.Bool("fail-fast", false, "Stop the batch at the first failed download")
+	normalize := flag.Bool("normalize", false, "Treat equivalent URLs (host case, default port, ./.. in the path, query order) as the same download")
+	redactQuery := flag.String("redact-query", "", "Comma-separated query parameters to mask in history, e.g. token,sig (* for all)")
+	segments := flag.Int("segments", 1, "Download large files in this many parallel ranges when the server supports it")
+	eventLogPath := flag.String("event-log", "", "Append download lifecycle events to this file as JSON lines")
+	var headBytes byteSize
+	flag.Var(&headBytes, "head-bytes", "Only fetch the first this many bytes of each URL with a Range request, save them to NAME.partial and report whether the server honored the range (no history)")
+	var eventLogMax byteSize = 10 << 20
+	flag.Var(&eventLogMax, "event-log-max-size", "Rotate the -event-log file to PATH.1 when it grows past this size (0 = never)")
+	noGlob := flag.Bool("no-glob", false, "Don't expand [01-20] ranges and {a,b} alternations in URLs")
+	dryRun := flag.Bool("dry-run", false, "Show the file names and sizes that would be downloaded, and what would be skipped, without downloading")
+	contentDisposition := flag.Bool("content-disposition", false, "Name files after the server's Content-Disposition header when it has one")
+	inferExt := flag.Bool("infer-ext", false, "Add an extension from the Content-Type to file names that have none, e.g. .zip for application/zip")
+	skipExisting := flag.Bool("skip-existing", false, "Skip URLs whose file is already in the output directory with the right size (or stored SHA-256), adding them to history")
+	flag.Var(&denyTypes, "deny-type", "Refuse downloads whose Content-Type starts with this, e.g. text/html (repeatable)")
+	expectType := flag.String("expect-type", "", "Expected Content-Type, e.g. application/octet-stream; abort if an HTML page arrives instead")
+	noDecompress := flag.Bool("no-decompress", false, "Keep gzip/deflate Content-Encoding as received instead of decompressing")
+	mirrorStrategy := flag.String("mirror-strategy", downloader.MirrorFirst, "Which mirror to start with: first, roundrobin or random")
+	var minFree, maxSize, limit, limitTotal, bufferSize, minSpeed byteSize
+	fileModeFlag, historyModeFlag := fileMode(0644), fileMode(0644)
+	flag.Var(&fileModeFlag, "file-mode", "Permissions for downloaded files, in octal (not affected by the umask)")
+	flag.IntVar(&downloader.MaxNameLength, "max-name-length", downloader.MaxNameLength, "Longest file name in bytes the output filesystem allows; longer names are shortened, keeping the extension and adding a hash")
+	flag.Var(&historyModeFlag, "history-mode", "Permissions for the history file, in octal (not affected by the umask)")
+	flag.Var(&limit, "limit", "Limit each download to this many bytes per second, e.g. 500K")
+	flag.Var(&limitTotal, "limit-total", "Limit all downloads together to this many bytes per second, e.g. 2M")
+	flag.Var(&maxSize, "max-size", "Abort downloads larger than this, e.g. 500M (0 = no limit)")
+	preallocateFlag := flag.Bool("preallocate", false, "Reserve disk space for the whole file before downloading when its size is known")
+	preserveMtime := flag.Bool("preserve-mtime", false, "Set each downloaded file's modification time to the server's Last-Modified")
+	teeDir := flag.String("tee", "", "Also write each download into this directory under the same file name (failures there only log a warning)")
+	flag.Var(&bufferSize, "buffer-size", "Copy buffer size for writing downloads, e.g. 1M (default 32K)")
+	flag.Var(&minFree, "min-free", "Free disk space to keep after a download, e.g. 1G (checked when the size is known)")
+	stallTimeout := flag.Duration("stall-timeout", 60*time.Second, "Abort a download when no data arrives for this long (0 = never)")
+	flag.Var(&minSpeed, "min-speed", "Abort and retry a download that stays slower than this many bytes per second for 30s, e.g. 10K (0 = never)")
+	maxRedirects := flag.Int("max-redirects", 10, "Maximum number of redirects to follow")
+	redirectSameHost := flag.Bool("redirect-same-host", false, "Refuse redirects that leave the original host")
+	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification (UNSAFE: allows man-in-the-middle attacks)")
+	caCert := flag.String("cacert", "", "PEM file with extra CA certificates to trust")
+	userAgent := flag.String("user-agent", "umbrel-downloader/"+Version, "User-Agent header to send")
+	referer := flag.String("referer", "", "Referer header to send")
+	var headers downloader.HeaderFlags
+	flag.Var(&headers, "H", "Extra request header \"Name: value\" (repeatable, overrides -user-agent/-referer)")
+	var cookies downloader.CookieFlags
+	flag.Var(&cookies, "cookie", "Cookie \"name=value\" to send with every download request (repeatable)")
+	cookieFile := flag.String("cookie-file", "", "Load cookies from a Netscape-format cookies.txt file")
+	assumeHTTPS := flag.Bool("assume-https", false, "Prefix URLs that have no scheme with https://")
+	jsonOutput := flag.Bool("json", false, "Print one JSON object per URL (NDJSON) on stdout and disable the progress bar")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	jobs := flag.Int("j", 1, "Number of URLs to download at the same time")
+	progressMode := flag.String("progress", "", "Progress display: none, single or multi (default: multi with -j, single on a terminal, otherwise none)")
+	barWidth := flag.Int("bar-width", 0, "Progress bar width in characters (0 = 50, or 20 with -progress multi)")
+	barStyleName := flag.String("bar-style", BarASCII, "Progress bar style: ascii or unicode")
+	barChar := flag.String("bar-char", "", "Character for the completed part of the progress bar (default: the style's)")
+	noColor := flag.Bool("no-color", false, "Don't color the progress bar (also when NO_COLOR is set or stderr isn't a terminal)")
+	outputStyle := flag.String("style", StylePlain, "Per-URL status output: plain (log lines) or fancy (colored ✓ ↷ ✗ lines; plain without color or a terminal)")
+	quiet := flag.Bool("quiet", false, "Only log errors (same as -log-level error)")
+	flag.BoolVar(quiet, "q", false, "Shorthand for -quiet")
+	verbose := flag.Bool("v", false, "Verbose: log request and response headers, connection timings, redirects and filename choices (same as -log-level debug)")
+	configPath := flag.String("config", "", "Read flag defaults from this file (default: "+cmp.Or(defaultConfigPath(), "none")+" if it exists); command-line flags take precedence")
+	flag.Parse()
 
-	result := make([]ActiveDownload, 0, len(wd.downloads))
-	for _, d := range wd.downloads {
-		result = append(result, *d)
+	// Flags not given on the command line may come from the config file
+	configFile, required := *configPath, true
+	if configFile == "" {
+		configFile, required = defaultConfigPath(), false
 	}
-	// Sort by start time (oldest first - keeps stable order)
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].StartedAt.Before(result[j].StartedAt)
-	})
-	return result
-}
-
-func (wd *WebDownloader) updateProgress(id string, progress, total, speed int64) {
-	wd.downloadsMu.Lock()
-	if d, ok := wd.downloads[id]; ok {
-		d.Progress = progress
-		d.Total = total
-		d.Speed = speed
+	if configFile != "" {
+		if err := applyConfig(flag.CommandLine, configFile, required); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
-	wd.downloadsMu.Unlock()
-}
 
-type WebProgressWriter struct {
-	wd          *WebDownloader
-	downloadID  string
-	Total       int64
-	Downloaded  int64
-	LastUpdate  time.Time
-	LastBytes   int64
-	CurrentSpeed int64
-}
-
-func (wpw *WebProgressWriter) Write(p []byte) (int, error) {
-	n := len(p)
-	wpw.Downloaded += int64(n)
-
-	now := time.Now()
-	elapsed := now.Sub(wpw.LastUpdate)
-	if elapsed >= 500*time.Millisecond {
-		bytesDelta := wpw.Downloaded - wpw.LastBytes
-		wpw.CurrentSpeed = int64(float64(bytesDelta) / elapsed.Seconds())
-		wpw.LastUpdate = now
-		wpw.LastBytes = wpw.Downloaded
+	if *profile != "" {
+		if downloader.SanitizeFilename(*profile) != *profile {
+			fmt.Fprintf(os.Stderr, "Error: invalid -profile %q (it must be usable as a file name)\n", *profile)
+			os.Exit(1)
+		}
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		if !given["history"] && !given["store"] {
+			*historyFile = ".download_history_" + *profile + ".json"
+		}
+		if !given["o"] {
+			*outputDir = filepath.Join(*outputDir, *profile)
+		}
 	}
 
-	wpw.wd.updateProgress(wpw.downloadID, wpw.Downloaded, wpw.Total, wpw.CurrentSpeed)
-	return n, nil
-}
-
-func (wd *WebDownloader) downloadFile(ctx context.Context, downloadID, rawURL string) (string, int64, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	switch {
+	case *quiet:
+		*logLevel = "error"
+	case *verbose:
+		*logLevel = "debug"
+	}
+	// Progress bars only make sense on a terminal, and not mixed with -json
+	switch *progressMode {
+	case "":
+		*progressMode = ProgressSingle
+		if *jsonOutput || !isTerminal(os.Stderr) {
+			*progressMode = ProgressNone
+		} else if *jobs > 1 {
+			*progressMode = ProgressMulti
+		}
+	case ProgressNone, ProgressSingle, ProgressMulti:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -progress %q (use none, single or multi)\n", *progressMode)
+		os.Exit(1)
+	}
+	color := !*noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stderr)
+	style, err := newBarStyle(*barStyleName, *barChar, *barWidth, color)
 	if err != nil {
-		return "", 0, err
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
+	progress := newProgressRenderer(os.Stderr, *progressMode, style)
 
-	resp, err := http.DefaultClient.Do(req)
+	logger, err := newLogger(progress, *logFormat, *logLevel)
 	if err != nil {
-		return "", 0, err
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", 0, fmt.Errorf("bad status: %s", resp.Status)
+	slog.SetDefault(logger)
+	if *outputStyle != StylePlain && *outputStyle != StyleFancy {
+		slog.Error("invalid -style (use plain or fancy)", "style", *outputStyle)
+		os.Exit(1)
 	}
-
-	filename := filenameFromURL(rawURL)
-	outputPath := filepath.Join(wd.outputDir, filename)
-
-	if _, err := os.Stat(outputPath); err == nil {
-		ext := filepath.Ext(filename)
-		base := strings.TrimSuffix(filename, ext)
-		outputPath = filepath.Join(wd.outputDir, fmt.Sprintf("%s_%s%s", base, urlHash(rawURL), ext))
+	printer := &statusPrinter{
+		fancy: *outputStyle == StyleFancy && color && strings.EqualFold(*logFormat, "text"),
+		w:     progress,
 	}
 
-	out, err := os.Create(outputPath)
+	var network string
+	switch {
+	case *ipv4Only && *ipv6Only:
+		slog.Error("-ipv4-only and -ipv6-only can't be combined")
+		os.Exit(1)
+	case *ipv4Only:
+		network = "tcp4"
+	case *ipv6Only:
+		network = "tcp6"
+	}
+	client, err := downloader.NewHTTPClient(downloader.ClientConfig{
+		Proxy:                 *proxy,
+		ConnectTimeout:        *connectTimeout,
+		ResponseHeaderTimeout: *timeout,
+		MaxRedirects:          *maxRedirects,
+		RedirectSameHost:      *redirectSameHost,
+		InsecureSkipVerify:    *insecure,
+		CACertFile:            *caCert,
+		CookieFile:            *cookieFile,
+
+		Network:   network,
+		DNSServer: *dnsServer,
+
+		HTTP1:               *http1,
+		MaxIdleConns:        *maxIdleConns,
+		MaxIdleConnsPerHost: *maxIdleConnsPerHost,
+	})
 	if err != nil {
-		return "", 0, err
+		slog.Error("invalid client settings", "error", err)
+		os.Exit(1)
 	}
-
-	// Track output path for cleanup
-	wd.downloadsMu.Lock()
-	if d, ok := wd.downloads[downloadID]; ok {
-		d.OutputPath = outputPath
-		d.Filename = filepath.Base(outputPath)
+	var sigKey *downloader.MinisignKey
+	if *verifyKey != "" {
+		if sigKey, err = downloader.ParseMinisignKey(*verifyKey); err != nil {
+			slog.Error("invalid -verify-key", "error", err)
+			os.Exit(1)
+		}
+	} else if *verifySig != "" {
+		slog.Error("-verify-sig requires -verify-key")
+		os.Exit(1)
 	}
-	wd.downloadsMu.Unlock()
-
-	wpw := &WebProgressWriter{
-		wd:         wd,
-		downloadID: downloadID,
-		Total:      resp.ContentLength,
-		LastUpdate: time.Now(),
+	if limit > 0 && minSpeed > limit {
+		slog.Error("-min-speed must not exceed -limit", "min_speed", int64(minSpeed), "limit", int64(limit))
+		os.Exit(1)
 	}
-	wd.updateProgress(downloadID, 0, resp.ContentLength, 0)
-
-	size, err := io.Copy(out, io.TeeReader(resp.Body, wpw))
-	out.Close()
-
+	if *keepVersions < 0 {
+		slog.Error("-keep-versions must not be negative")
+		os.Exit(1)
+	}
+	if downloader.MaxNameLength < downloader.MinNameLength {
+		slog.Error("-max-name-length is too small", "min", downloader.MinNameLength)
+		os.Exit(1)
+	}
+	var flatSep string
+	if *flat {
+		if *flatChar == "" || strings.ContainsAny(*flatChar, "/\\") || downloader.SanitizeFilename(*flatChar) != *flatChar {
+			slog.Error("invalid -flat-char", "char", *flatChar)
+			os.Exit(1)
+		}
+		flatSep = *flatChar
+	}
+	if bufferSize != 0 && (bufferSize < downloader.MinBufferSize || bufferSize > downloader.MaxBufferSize) {
+		slog.Error("-buffer-size must be between 4K and 64M", "size", int64(bufferSize))
+		os.Exit(1)
+	}
+	mirrorSelector, err := downloader.NewMirrorSelector(*mirrorStrategy)
 	if err != nil {
-		os.Remove(outputPath)
-		return "", 0, err
+		slog.Error("invalid -mirror-strategy", "error", err)
+		os.Exit(1)
 	}
-
-	return outputPath, size, nil
-}
-
-func (wd *WebDownloader) startDownload(rawURL string) (string, error) {
-	filename := filenameFromURL(rawURL)
-
-	// Check history
-	wd.historyMu.RLock()
-	_, urlExists := wd.history.Downloads[rawURL]
-	_, fileExists := wd.history.DownloadedFiles[filename]
-	wd.historyMu.RUnlock()
-
-	if urlExists || fileExists {
-		return "", fmt.Errorf("already downloaded: %s", filename)
+	if *replaceExisting {
+		if *collision != downloader.CollisionHash && *collision != downloader.CollisionReplace {
+			slog.Error("-replace-existing-file can't be combined with -collision", "collision", *collision)
+			os.Exit(1)
+		}
+		*collision = downloader.CollisionReplace
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-
-	wd.downloadsMu.Lock()
-	wd.nextID++
-	id := fmt.Sprintf("dl-%d", wd.nextID)
-	wd.downloads[id] = &ActiveDownload{
-		ID:         id,
-		URL:        rawURL,
-		Filename:   filename,
-		StartedAt:  time.Now(),
-		CancelFunc: cancel,
+	if !downloader.ValidCollision(*collision) {
+		slog.Error("invalid -collision (use hash, number, overwrite, skip or replace)", "collision", *collision)
+		os.Exit(1)
 	}
-	wd.downloadsMu.Unlock()
-
-	go func() {
-		defer func() {
-			wd.downloadsMu.Lock()
-			delete(wd.downloads, id)
-			wd.downloadsMu.Unlock()
-		}()
-
-		outputPath, size, err := wd.downloadFile(ctx, id, rawURL)
-		if err != nil {
-			return
+	for _, m := range mirrorBases {
+		if _, err := downloader.ValidateURL(m, false); err != nil {
+			slog.Error("invalid -mirror", "error", err)
+			os.Exit(1)
 		}
-
-		wd.historyMu.Lock()
-		wd.history.Downloads[rawURL] = DownloadRecord{
-			URL:        rawURL,
-			Filename:   outputPath,
-			Downloaded: time.Now(),
-			Size:       size,
+	}
+	if *insecure {
+		slog.Warn("TLS certificate verification is disabled (-insecure)")
+	}
+	opts := &downloader.DownloadOptions{
+		Client:        client,
+		StallTimeout:  *stallTimeout,
+		MinSpeed:      int64(minSpeed),
+		AssumeHTTPS:   *assumeHTTPS,
+		UserAgent:     *userAgent,
+		Referer:       *referer,
+		Header:        http.Header(headers),
+		Cookies:       cookies,
+		OutTemplate:   *outTemplate,
+		Preflight:     *preflight,
+		MinFree:       int64(minFree),
+		MaxSize:       int64(maxSize),
+		Retries:       *retries,
+		Mirrors:       mirrorBases,
+		Extract:       *extract,
+		ExtractRemove: *extractRemove,
+		WriteChecksum: *writeChecksum,
+		VerifyKey:     sigKey,
+		VerifySig:     *verifySig,
+
+		MirrorSelector: mirrorSelector,
+		NoDecompress:   *noDecompress,
+		ExpectType:     *expectType,
+		DenyTypes:      denyTypes,
+		SkipExisting:   *skipExisting,
+
+		ContentDisposition: *contentDisposition,
+		InferExt:           *inferExt,
+
+		Flat: flatSep,
+
+		Limit:     int64(limit),
+		Segments:  *segments,
+		Collision: *collision,
+		Normalize: *normalize,
+		FileMode:  os.FileMode(fileModeFlag),
+
+		BufferSize:  int(bufferSize),
+		Preallocate: *preallocateFlag,
+
+		PreserveMtime: *preserveMtime,
+
+		Tee: *teeDir,
+	}
+	for _, key := range strings.Split(*redactQuery, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			opts.RedactQuery = append(opts.RedactQuery, key)
 		}
-		wd.history.DownloadedFiles[filename] = rawURL
-		saveHistory(wd.historyFile, wd.history)
-		wd.historyMu.Unlock()
-	}()
-
-	return id, nil
-}
-
-func (wd *WebDownloader) cancelDownload(id string) {
-	wd.downloadsMu.Lock()
-	d, ok := wd.downloads[id]
-	if ok {
-		d.CancelFunc()
-		// Cleanup partial file
-		if d.OutputPath != "" {
-			os.Remove(d.OutputPath)
+	}
+	totalLimiter = downloader.NewRateLimiter(int64(limitTotal))
+	if *interactive && *webAddr == "" {
+		opts.Confirm = newConfirmPrompt(os.Stdin, os.Stderr, isTerminal(os.Stdin), *assumeYes)
+		opts.ConfirmOver = int64(confirmOver)
+	}
+	if *eventLogPath != "" {
+		if downloader.DefaultEventLog, err = downloader.OpenEventLog(*eventLogPath, int64(eventLogMax)); err != nil {
+			slog.Error("could not open event log", "error", err)
+			os.Exit(1)
 		}
-		delete(wd.downloads, id)
 	}
-	wd.downloadsMu.Unlock()
-}
-
-func (wd *WebDownloader) getHistory() []DownloadRecord {
-	wd.historyMu.RLock()
-	defer wd.historyMu.RUnlock()
-
-	records := make([]DownloadRecord, 0, len(wd.history.Downloads))
-	for _, r := range wd.history.Downloads {
-		records = append(records, r)
+	if *notifyURL != "" || *notifyCommand != "" {
+		opts.Notifier = &downloader.Notifier{URL: *notifyURL, Command: *notifyCommand, Client: client}
 	}
-	// Sort by download time (newest first)
-	sort.Slice(records, func(i, j int) bool {
-		return records[i].Downloaded.After(records[j].Downloaded)
-	})
-	return records
-}
 
-const htmlTemplate = `<!DOCTYPE html>
-<html>
-<head>
-    <title>Downloader</title>
-    <meta name="viewport" content="width=device-width, initial-scale=1">
-    <style>
-        * { box-sizing: border-box; }
-        body { font-family: system-ui, sans-serif; max-width: 800px; margin: 0 auto; padding: 20px; background: #1a1a2e; color: #eee; }
-        h1 { color: #00d4ff; }
-        .input-group { display: flex; gap: 10px; margin-bottom: 20px; }
-        input[type="text"] { flex: 1; padding: 12px; border: 1px solid #333; border-radius: 6px; background: #16213e; color: #eee; font-size: 16px; }
-        button { padding: 12px 24px; border: none; border-radius: 6px; cursor: pointer; font-size: 16px; font-weight: bold; }
-        .btn-primary { background: #00d4ff; color: #000; }
-        .btn-danger { background: #ff4757; color: #fff; padding: 8px 16px; font-size: 14px; }
-        .btn-primary:hover { background: #00b8e6; }
-        .btn-danger:hover { background: #ff3344; }
-        .downloads-section { margin-bottom: 20px; }
-        .downloads-section h2 { color: #00d4ff; border-bottom: 1px solid #333; padding-bottom: 10px; margin-bottom: 15px; }
-        .download-item { background: #16213e; border-radius: 8px; padding: 15px; margin-bottom: 10px; }
-        .download-header { display: flex; justify-content: space-between; align-items: center; margin-bottom: 8px; }
-        .download-filename { font-weight: bold; color: #00d4ff; word-break: break-all; }
-        .progress-bar { height: 20px; background: #333; border-radius: 10px; overflow: hidden; margin: 8px 0; }
-        .progress-fill { height: 100%; background: linear-gradient(90deg, #00d4ff, #00ff88); transition: width 0.3s; }
-        .progress-text { font-size: 13px; color: #aaa; }
-        .history { margin-top: 30px; }
-        .history h2 { color: #00d4ff; border-bottom: 1px solid #333; padding-bottom: 10px; }
-        .history-item { background: #16213e; padding: 15px; border-radius: 6px; margin-bottom: 10px; }
-        .history-item .name { font-weight: bold; color: #00ff88; }
-        .history-item .size { color: #aaa; font-size: 14px; }
-        .history-item .date { color: #666; font-size: 12px; }
-        .empty { color: #666; font-style: italic; }
-    </style>
-</head>
-<body>
-    <h1>Downloader</h1>
-
-    <div class="input-group">
-        <input type="text" id="url" placeholder="Enter URL to download..." onkeypress="if(event.key==='Enter')startDownload()">
-        <button class="btn-primary" onclick="startDownload()">Download</button>
-    </div>
-
-    <div class="downloads-section" id="downloads-section" style="display:none;">
-        <h2>Active Downloads</h2>
-        <div id="downloads-list"></div>
-    </div>
-
-    <div class="history">
-        <h2>Download History</h2>
-        <div id="history-list"><p class="empty">No downloads yet</p></div>
-    </div>
-
-    <script>
-        let polling = false;
-
-        function formatBytes(bytes) {
-            if (bytes === 0) return '0 B';
-            const k = 1024;
-            const sizes = ['B', 'KB', 'MB', 'GB'];
-            const i = Math.floor(Math.log(bytes) / Math.log(k));
-            return parseFloat((bytes / Math.pow(k, i)).toFixed(1)) + ' ' + sizes[i];
-        }
-
-        async function startDownload() {
-            const url = document.getElementById('url').value.trim();
-            if (!url) return;
-
-            const resp = await fetch('/api/download', {
-                method: 'POST',
-                headers: {'Content-Type': 'application/json'},
-                body: JSON.stringify({url: url})
-            });
-
-            if (resp.ok) {
-                document.getElementById('url').value = '';
-                if (!polling) pollProgress();
-            } else {
-                const text = await resp.text();
-                alert('Failed: ' + text);
-            }
-        }
-
-        async function cancelDownload(id) {
-            await fetch('/api/cancel', {
-                method: 'POST',
-                headers: {'Content-Type': 'application/json'},
-                body: JSON.stringify({id: id})
-            });
-        }
-
-        async function pollProgress() {
-            polling = true;
-            const section = document.getElementById('downloads-section');
-            const list = document.getElementById('downloads-list');
-
-            const poll = async () => {
-                const resp = await fetch('/api/progress');
-                const downloads = await resp.json();
-
-                if (downloads.length > 0) {
-                    section.style.display = 'block';
-                    list.innerHTML = downloads.map(d => {
-                        const pct = d.total > 0 ? (d.progress / d.total * 100) : 0;
-                        return '<div class="download-item" id="dl-' + d.id + '">' +
-                            '<div class="download-header">' +
-                                '<span class="download-filename">' + d.filename + '</span>' +
-                                '<button class="btn-danger" onclick="cancelDownload(\'' + d.id + '\')">Cancel</button>' +
-                            '</div>' +
-                            '<div class="progress-bar"><div class="progress-fill" style="width:' + pct + '%"></div></div>' +
-                            '<div class="progress-text">' + pct.toFixed(1) + '% - ' + formatBytes(d.progress) + ' / ' + formatBytes(d.total) + ' - ' + formatBytes(d.speed) + '/s</div>' +
-                        '</div>';
-                    }).join('');
-                    setTimeout(poll, 500);
-                } else {
-                    section.style.display = 'none';
-                    list.innerHTML = '';
-                    polling = false;
-                    loadHistory();
-                }
-            };
-            poll();
-        }
-
-        async function loadHistory() {
-            const resp = await fetch('/api/history');
-            const data = await resp.json();
-
-            const list = document.getElementById('history-list');
-            if (data.length === 0) {
-                list.innerHTML = '<p class="empty">No downloads yet</p>';
-                return;
-            }
-
-            list.innerHTML = data.map(item => {
-                const date = new Date(item.downloaded).toLocaleString();
-                const name = item.filename.split('/').pop();
-                return '<div class="history-item">' +
-                    '<div class="name">' + name + '</div>' +
-                    '<div class="size">' + formatBytes(item.size) + '</div>' +
-                    '<div class="date">' + date + '</div>' +
-                '</div>';
-            }).join('');
-        }
-
-        // Initial load
-        loadHistory();
-
-        // Check if downloads in progress
-        fetch('/api/progress').then(r => r.json()).then(data => {
-            if (data.length > 0) pollProgress();
-        });
-    </script>
-</body>
-</html>`
-
-func startWebServer(addr, outputDir, historyFile string) {
-	history, _, err := loadHistory(historyFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading history: %v\n", err)
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		slog.Error("could not create output directory", "error", err)
 		os.Exit(1)
 	}
-
-	wd := &WebDownloader{
-		outputDir:   outputDir,
-		historyFile: historyFile,
-		history:     history,
-		downloads:   make(map[string]*ActiveDownload),
+	if *teeDir != "" {
+		same, err := downloader.SameDir(*teeDir, *outputDir)
+		if err == nil && same {
+			err = errors.New("it is the output directory")
+		}
+		if err == nil {
+			err = os.MkdirAll(*teeDir, 0755)
+		}
+		if err != nil {
+			slog.Error("invalid -tee directory", "dir", *teeDir, "error", err)
+			os.Exit(1)
+		}
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(htmlTemplate))
-	})
+	downloader.HistoryFileMode = os.FileMode(historyModeFlag)
+	store, err := downloader.OpenStore(*storeSpec, *historyFile)
+	if err != nil {
+		slog.Error("could not load history", "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
 
-	http.HandleFunc("/api/download", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", 405)
-			return
-		}
-		var req struct{ URL string `json:"url"` }
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", 400)
-			return
+	if *migrateTo != "" {
+		dst, err := downloader.OpenStore(*migrateTo, "")
+		if err != nil {
+			slog.Error("could not open destination store", "error", err)
+			os.Exit(1)
 		}
-		id, err := wd.startDownload(req.URL)
+		n, err := downloader.MigrateStore(store, dst)
+		dst.Close()
 		if err != nil {
-			http.Error(w, err.Error(), 400)
-			return
+			slog.Error("could not migrate history", "error", err)
+			os.Exit(1)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"id": id})
-	})
+		fmt.Printf("Migrated %d records to %s\n", n, *migrateTo)
+		return
+	}
 
-	http.HandleFunc("/api/cancel", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", 405)
-			return
+	if *importPath != "" {
+		added, missing, err := downloader.ImportHistory(store, *importPath, *importOverwrite)
+		if err != nil {
+			slog.Error("could not import history", "error", err)
+			os.Exit(1)
 		}
-		var req struct{ ID string `json:"id"` }
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", 400)
-			return
+		fmt.Printf("Imported %d records from %s\n", added, *importPath)
+		if missing > 0 {
+			fmt.Printf("%d imported files are not present on this machine\n", missing)
 		}
-		wd.cancelDownload(req.ID)
-		w.WriteHeader(200)
-	})
-
-	http.HandleFunc("/api/progress", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(wd.getActiveDownloads())
-	})
-
-	http.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(wd.getHistory())
-	})
-
-	fmt.Printf("Starting web server at http://%s\n", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
-		os.Exit(1)
+		return
 	}
-}
 
-func main() {
-	outputDir := flag.String("o", ".", "Output directory for downloads")
-	historyFile := flag.String("history", ".download_history.json", "History file path")
-	force := flag.Bool("f", false, "Force re-download even if already downloaded")
-	listHistory := flag.Bool("list", false, "List download history")
-	webAddr := flag.String("web", "", "Start web UI on this address (e.g., :8080)")
-	flag.Parse()
-
-	// Set up signal handling for cleanup
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		cleanupCurrentDownload()
-		os.Exit(1)
-	}()
-
-	if err := os.MkdirAll(*outputDir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating output directory: %v\n", err)
-		os.Exit(1)
+	if *repairHistory {
+		if err := downloader.RunRepairHistory(store, *force); err != nil {
+			slog.Error("could not repair history", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	// Web server mode
 	if *webAddr != "" {
-		startWebServer(*webAddr, *outputDir, *historyFile)
+		err := web.Start(*webAddr, *outputDir, store, opts, web.Config{
+			Metrics:       *metricsEnabled,
+			MaxConcurrent: *maxConcurrent,
+			Queue:         *queue,
+			PerHost:       *perHost,
+			TrackFailures: *trackFailures,
+			LimitTotal:    int64(limitTotal),
+			TLSCert:       *tlsCert,
+			TLSKey:        *tlsKey,
+			TLSSelfSigned: *tlsSelfSigned,
+			Auth:          *webAuth,
+		})
+		if err != nil {
+			slog.Error("server error", "error", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	history, needsSave, err := loadHistory(*historyFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading history: %v\n", err)
-		os.Exit(1)
+	if *clean {
+		if err := downloader.RunClean(*outputDir, store, downloader.HistoryPaths(*historyFile, *storeSpec), *force); err != nil {
+			slog.Error("clean failed", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	// Save migrated history
-	if needsSave {
-		if err := saveHistory(*historyFile, history); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: could not save migrated history: %v\n", err)
+	if *reindex {
+		if err := downloader.RunReindex(*outputDir, store, downloader.HistoryPaths(*historyFile, *storeSpec)); err != nil {
+			slog.Error("reindex failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *exportCSVPath != "" {
+		if err := downloader.ExportCSV(store, *exportCSVPath); err != nil {
+			slog.Error("export failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *listHistory && *listFailures {
+		failures := store.Failures()
+		if *jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(failures)
+			return
+		}
+		if len(failures) == 0 {
+			fmt.Println("No failed downloads recorded")
+			return
 		}
+		fmt.Printf("Failed downloads (%d):\n", len(failures))
+		for _, f := range failures {
+			u := f.URL
+			if !*long {
+				u = downloader.Truncate(u, 80)
+			}
+			fmt.Printf("  %s\n    Failed: %s\n    Error: %s\n", u, f.Time.Local().Format(time.DateTime), f.Error)
+			if f.Status != 0 {
+				fmt.Printf("    Status: %d from %s\n", f.Status, f.FinalURL)
+			}
+		}
+		return
 	}
 
 	if *listHistory {
-		if len(history.Downloads) == 0 {
+		filter, err := downloader.ParseHistoryFilter("", *since, *sortBy, time.Now())
+		if err != nil {
+			slog.Error("invalid -list filter", "error", err)
+			os.Exit(1)
+		}
+		records := filter.Apply(store.All())
+		if *jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(records)
+			return
+		}
+		if len(records) == 0 {
 			fmt.Println("No downloads in history")
 			return
 		}
-		fmt.Printf("Downloaded files (%d):\n", len(history.DownloadedFiles))
-		for filename, u := range history.DownloadedFiles {
-			fmt.Printf("  %s\n    URL: %s\n", filename, u[:min(80, len(u))]+"...")
+		fmt.Printf("Downloaded files (%d):\n", len(records))
+		for _, r := range records {
+			u := r.URL
+			if !*long {
+				u = downloader.Truncate(u, 80)
+			}
+			fmt.Printf("  %s\n    URL: %s\n", r.Filename, u)
+			if r.Duration > 0 {
+				fmt.Printf("    Speed: %s/s (%s)\n", downloader.FormatBytes(r.AverageSpeed()), r.Duration.Round(time.Millisecond))
+			}
 		}
 		return
 	}
 
 	var urls []string
 
-	if flag.NArg() > 0 {
-		urls = flag.Args()
-	} else {
+	urls = append(urls, flag.Args()...)
+
+	if *inputFile != "" {
+		fileURLs, err := readURLFile(*inputFile)
+		if err != nil {
+			slog.Error("could not read URL list", "error", err)
+			os.Exit(1)
+		}
+		urls = append(urls, fileURLs...)
+	}
+
+	if len(urls) == 0 && *inputFile == "" {
 		scanner := bufio.NewScanner(os.Stdin)
 		// Increase buffer for very long URLs
 		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
-		fmt.Println("Paste URLs (one per line, empty line or Ctrl+D to finish):")
+		prompt := os.Stdout
+		if *jsonOutput {
+			prompt = os.Stderr
+		}
+		fmt.Fprintln(prompt, "Paste URLs (one per line, empty line or Ctrl+D to finish):")
 		for scanner.Scan() {
-			line := scanner.Text()
-			// Clean up - handle \r\n, extra whitespace
-			line = strings.TrimSpace(line)
-			line = strings.ReplaceAll(line, "\r", "")
+			line := downloader.CleanLine(scanner.Text())
 			if line == "" {
 				break
 			}
@@ -742,55 +854,307 @@ func main() {
 		}
 	}
 
+	if !*noGlob {
+		expanded, err := downloader.ExpandURLs(urls)
+		if err != nil {
+			slog.Error("invalid URL pattern", "error", err)
+			os.Exit(1)
+		}
+		urls = expanded
+	}
+
 	if len(urls) == 0 {
 		fmt.Println("No URLs provided")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if *outputName != "" && len(urls) != 1 {
+		slog.Error("-O requires exactly one URL (use URL>filename for batches)", "urls", len(urls))
+		os.Exit(1)
+	}
+	if *expectSHA256 != "" {
+		if len(urls) != 1 || !downloader.ValidSHA256(*expectSHA256) {
+			slog.Error("-sha256 needs exactly one URL and a hash of 64 hex digits", "urls", len(urls))
+			os.Exit(1)
+		}
+		opts.ExpectSHA256 = *expectSHA256
+	}
+
+	if *dryRun {
+		runDryRun(context.Background(), opts, store, urls, *outputDir, *outputName, *force)
+		return
+	}
+	if headBytes > 0 {
+		if runHeadBytes(context.Background(), opts, urls, *outputDir, *outputName, int64(headBytes)) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The first Ctrl+C skips the running downloads; a second one within
+	// interruptWindow, or SIGTERM, cleans up and exits.
+	skip := newSkipSignal()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		var last time.Time
+		for sig := range sigChan {
+			if sig == os.Interrupt && time.Since(last) > interruptWindow {
+				last = time.Now()
+				skip.skip()
+				slog.Warn("interrupted: skipping the current download; press Ctrl+C again within 2s to stop")
+				continue
+			}
+			cleanupCurrentDownloads()
+			os.Exit(1)
+		}
+	}()
+
 	ctx := context.Background()
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+	// abort stops the batch for -fail-fast; downloads still running are
+	// cancelled and their .part files removed, like on Ctrl+C
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	var aborted atomic.Bool
+	hostLimit := downloader.NewHostLimiter(*perHost)
+	results := json.NewEncoder(os.Stdout)
+	var summary BatchSummary
+	var reportMu sync.Mutex
+	report := func(r URLResult) {
+		reportMu.Lock()
+		defer reportMu.Unlock()
+		summary.add(r)
+		if *jsonOutput {
+			results.Encode(r)
+		}
+	}
 
-	for _, rawURL := range urls {
+	process := func(rawURL string) {
 		// Clean up URL - remove all whitespace, carriage returns, newlines
 		rawURL = strings.TrimSpace(rawURL)
 		rawURL = strings.ReplaceAll(rawURL, "\r", "")
 		rawURL = strings.ReplaceAll(rawURL, "\n", "")
 		if rawURL == "" {
-			continue
+			return
+		}
+		if ctx.Err() != nil {
+			reason := "not started: -deadline exceeded"
+			if aborted.Load() {
+				reason = "not started: -fail-fast after an earlier failure"
+			}
+			report(URLResult{URL: rawURL, Status: StatusError, Error: reason})
+			return
 		}
 
-		// Check if already downloaded (by URL)
-		if record, exists := history.Downloads[rawURL]; exists && !*force {
-			fmt.Printf("SKIP (same URL): %s\n", record.Filename)
-			continue
+		rawURL, name := downloader.SplitOutputName(rawURL)
+		if name == "" {
+			name = *outputName
+		}
+
+		mirrors := downloader.SplitMirrors(rawURL)
+		for i, u := range mirrors {
+			validURL, err := downloader.ValidateURL(u, *assumeHTTPS)
+			if err != nil {
+				mirrors = nil
+				printer.print(StatusError, "invalid URL", "url", u, "error", err)
+				report(URLResult{URL: rawURL, Status: StatusError, Error: err.Error()})
+				break
+			}
+			mirrors[i] = validURL
+		}
+		if len(mirrors) == 0 {
+			return
+		}
+		rawURL = mirrors[0]
+
+		// Check if already downloaded (by URL). With -if-changed the server
+		// is asked whether the file changed instead, and with -only-larger
+		// whether it grew.
+		dlOpts := opts
+		record, exists := store.Get(opts.HistoryKey(rawURL))
+		larger := false
+		if exists && *onlyLarger && !*force {
+			size, _, ok := opts.Head(ctx, rawURL)
+			if !ok || size <= record.Size {
+				printer.print(StatusSkipped, "skipped: up to date", "file", record.Filename, "size", record.Size)
+				report(URLResult{URL: rawURL, Filename: record.Filename, Size: record.Size, Status: StatusSkipped})
+				return
+			}
+			slog.Info("server has a larger file", "file", record.Filename, "size", size, "previous_size", record.Size)
+			larger = true
+		}
+		revalidate := exists && *ifChanged && !*force && !larger && (record.ETag != "" || record.LastModified != "")
+		if exists && !*force && !revalidate && !larger {
+			printer.print(StatusSkipped, "skipped: same URL already downloaded", "file", record.Filename)
+			report(URLResult{URL: rawURL, Filename: record.Filename, Size: record.Size, Status: StatusSkipped})
+			return
+		}
+		if revalidate {
+			o := *opts
+			o.IfNoneMatch, o.IfModifiedSince, o.Overwrite = record.ETag, record.LastModified, true
+			dlOpts = &o
+		}
+		if larger {
+			o := *dlOpts
+			o.Overwrite = true
+			dlOpts = &o
+		}
+		if exists && *keepVersions > 0 && (*force || revalidate || larger) {
+			// Replace the file in place, moving the old one aside
+			o := *dlOpts
+			o.Overwrite, o.KeepVersions = true, *keepVersions
+			dlOpts = &o
+		}
+		if *force && opts.SkipExisting {
+			o := *dlOpts
+			o.SkipExisting = false
+			dlOpts = &o
+		} else if exists && opts.SkipExisting {
+			o := *dlOpts
+			o.ExistingSHA256 = record.SHA256
+			dlOpts = &o
 		}
 
 		// Check if already downloaded (by filename)
-		filename := filenameFromURL(rawURL)
-		if _, exists := history.DownloadedFiles[filename]; exists && !*force {
-			fmt.Printf("SKIP (already have): %s\n", filename)
-			continue
+		filename := downloader.FilenameFromURL(rawURL)
+		if name != "" {
+			filename = downloader.SanitizeFilename(name)
+			if filename == "" {
+				err := fmt.Errorf("invalid output filename %q", name)
+				printer.print(StatusError, "invalid output filename", "url", rawURL, "error", err)
+				report(URLResult{URL: rawURL, Status: StatusError, Error: err.Error()})
+				return
+			}
+		}
+		if store.HasFilename(filename) && !*force && !revalidate && !larger {
+			printer.print(StatusSkipped, "skipped: file already downloaded", "file", filename)
+			report(URLResult{URL: rawURL, Filename: filename, Status: StatusSkipped})
+			return
 		}
 
-		fmt.Printf("Downloading: %s\n", filename)
-		outputPath, size, err := downloadFile(ctx, rawURL, *outputDir)
+		// With -content-disposition or -infer-ext the response may change
+		// the name
+		fixedName := filename
+		if name == "" && (opts.ContentDisposition || opts.InferExt) {
+			fixedName = ""
+		}
+
+		release, err := hostLimit.Acquire(ctx, rawURL)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-			continue
+			report(URLResult{URL: rawURL, Filename: filename, Status: StatusError, Error: "not started: " + err.Error()})
+			return
+		}
+		defer release()
+
+		slog.Info("downloading", "url", rawURL, "file", filename)
+		downloader.LogEvent(downloader.Event{Event: downloader.EventStarted, URL: rawURL})
+		started := time.Now()
+		dlCtx, stop := skip.watch(ctx)
+		result, err := downloadFile(dlCtx, dlOpts, mirrors, *outputDir, fixedName, progress)
+		interrupted := dlCtx.Err() != nil && ctx.Err() == nil
+		stop()
+		if err != nil && interrupted {
+			printer.print(StatusSkipped, "skipped: interrupted", "url", rawURL)
+			report(URLResult{URL: rawURL, Filename: filename, Status: StatusSkipped})
+			return
+		}
+		if errors.Is(err, downloader.ErrNotModified) {
+			printer.print(StatusSkipped, "skipped: not modified since last download", "file", record.Filename)
+			report(URLResult{URL: rawURL, Filename: record.Filename, Size: record.Size, Status: StatusSkipped})
+			return
+		}
+		if errors.Is(err, downloader.ErrFileExists) || errors.Is(err, downloader.ErrDeclined) {
+			printer.print(StatusSkipped, "skipped", "url", rawURL, "reason", err)
+			report(URLResult{URL: rawURL, Filename: filename, Status: StatusSkipped})
+			return
+		}
+		if err == nil && result.Existing {
+			printer.print(StatusSkipped, "skipped: file already on disk", "file", result.Path)
+			if err := store.Put(filepath.Base(result.Path), opts.HistoryRecord(rawURL, result, time.Time{})); err != nil {
+				slog.Warn("could not save history", "error", err)
+			}
+			report(URLResult{URL: rawURL, Filename: result.Path, Size: result.Size, Status: StatusSkipped})
+			return
+		}
+		opts.Notify(rawURL, filename, result, err)
+		if err != nil {
+			if errors.Is(err, downloader.ErrOutputUnwritable) {
+				printer.print(StatusError, "cannot write to the output directory; check that it exists, is writable and has free space",
+					"dir", *outputDir, "url", rawURL, "error", err)
+			} else if !aborted.Load() {
+				printer.print(StatusError, "download failed", "url", rawURL, "error", err)
+			}
+			downloader.LogEvent(downloader.Event{Event: downloader.EventFailed, URL: rawURL, Error: err.Error()})
+			if *trackFailures {
+				if err := store.PutFailure(opts.FailureRecord(rawURL, err)); err != nil {
+					slog.Warn("could not save history", "error", err)
+				}
+			}
+			report(URLResult{URL: rawURL, Filename: filename, Status: StatusError, Error: err.Error()})
+			if *failFast && !aborted.Swap(true) {
+				slog.Error("stopping the batch (-fail-fast)")
+				abort()
+			}
+			return
 		}
 
-		history.Downloads[rawURL] = DownloadRecord{
-			URL:        rawURL,
-			Filename:   outputPath,
-			Downloaded: time.Now(),
-			Size:       size,
+		done := opts.HistoryRecord(rawURL, result, started)
+		if dlOpts.KeepVersions > 0 {
+			done.Versions = downloader.ListVersions(result.Path)
+		}
+		// Index the file under the name it was saved as, which
+		// -content-disposition, -infer-ext or -collision may have changed
+		if err := store.Put(filepath.Base(result.Path), done); err != nil {
+			slog.Warn("could not save history", "error", err)
 		}
-		history.DownloadedFiles[filename] = rawURL
 
-		if err := saveHistory(*historyFile, history); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: could not save history: %v\n", err)
+		printer.print(StatusDownloaded, "downloaded", "file", result.Path, "size", downloader.FormatBytes(result.Size))
+		downloader.LogEvent(downloader.Event{Event: downloader.EventCompleted, URL: rawURL, File: result.Path, Bytes: result.Size})
+		report(URLResult{URL: rawURL, Filename: result.Path, Size: result.Size, Status: StatusDownloaded})
+	}
+
+	if *jobs <= 1 {
+		for _, rawURL := range urls {
+			process(rawURL)
+		}
+	} else {
+		work := make(chan string)
+		var wg sync.WaitGroup
+		for range *jobs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for rawURL := range work {
+					process(rawURL)
+				}
+			}()
+		}
+		for _, rawURL := range urls {
+			work <- rawURL
 		}
+		close(work)
+		wg.Wait()
+	}
 
-		fmt.Printf("OK: %s (%s)\n", outputPath, formatBytes(size))
+	if *jsonOutput {
+		results.Encode(struct {
+			Summary BatchSummary `json:"summary"`
+		}{summary})
+	} else if summary.Total > 1 {
+		slog.Info("done", "files", summary.Total, "downloaded", summary.Downloaded,
+			"skipped", summary.Skipped, "failed", summary.Failed, "size", downloader.FormatBytes(summary.Bytes))
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Error("-deadline exceeded", "deadline", *deadline)
+		os.Exit(exitDeadline)
+	}
+	if summary.Failed > 0 {
+		os.Exit(1)
 	}
 }
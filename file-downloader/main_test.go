@@ -0,0 +1,1278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"umbrel-downloader/downloader"
+)
+
+// TestMain runs the CLI instead of the tests when runCLI starts the test
+// binary as a subprocess.
+func TestMain(m *testing.M) {
+	if os.Getenv("UMBREL_DOWNLOADER_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCLI runs the CLI with args in dir, with stdin as its input, and returns
+// its output and exit code. The config directory is empty so no user config
+// is picked up.
+func runCLI(t *testing.T, dir, stdin string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := cliCommand(t, dir, args...)
+	cmd.Stdin = bytes.NewBufferString(stdin)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+// cliCommand returns the command runCLI runs, for tests that need to
+// interact with the process while it runs.
+func cliCommand(t *testing.T, dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "UMBREL_DOWNLOADER_RUN_MAIN=1", "XDG_CONFIG_HOME="+t.TempDir(), "HOME="+t.TempDir(), "NO_COLOR=1")
+	return cmd
+}
+
+// fileServer serves each path's base name as its content.
+func fileServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, filepath.Base(r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReadURLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.txt")
+	content := "# nightly images\n" +
+		"https://example.com/a.iso\r\n" +
+		"\n" +
+		"   https://example.com/b.iso   \n" +
+		"\t# disabled: https://example.com/c.iso\n" +
+		"https://example.com/d.iso"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	urls, err := readURLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://example.com/a.iso", "https://example.com/b.iso", "https://example.com/d.iso"}
+	if !slices.Equal(urls, want) {
+		t.Errorf("readURLFile = %q, want %q", urls, want)
+	}
+}
+
+func TestReadURLFileMissing(t *testing.T) {
+	if _, err := readURLFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("err = nil for a missing file")
+	}
+}
+
+func TestOutputName(t *testing.T) {
+	srv := fileServer(t)
+	tests := []struct {
+		name      string
+		args      []string
+		stdin     string
+		wantFiles []string
+		wantCode  int
+	}{
+		{
+			name:      "-O",
+			args:      []string{"-O", "report.csv", srv.URL + "/export?id=7"},
+			wantFiles: []string{"report.csv"},
+		},
+		{
+			name:      "-O stays in the output directory",
+			args:      []string{"-O", "../report.csv", srv.URL + "/export?id=7"},
+			wantFiles: []string{".._report.csv"},
+		},
+		{
+			name:     "-O with two URLs",
+			args:     []string{"-O", "report.csv", srv.URL + "/a", srv.URL + "/b"},
+			wantCode: 1,
+		},
+		{
+			name:      "inline",
+			stdin:     srv.URL + "/export?id=1>one.csv\n" + srv.URL + "/export?id=2 > two.csv\n",
+			wantFiles: []string{"one.csv", "two.csv"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			args := append([]string{"-o", "out", "-progress", "none"}, tt.args...)
+			_, stderr, code := runCLI(t, dir, tt.stdin, args...)
+			if code != tt.wantCode {
+				t.Fatalf("exit code %d, want %d; stderr:\n%s", code, tt.wantCode, stderr)
+			}
+			var files []string
+			entries, _ := os.ReadDir(filepath.Join(dir, "out"))
+			for _, e := range entries {
+				files = append(files, e.Name())
+			}
+			if !slices.Equal(files, tt.wantFiles) {
+				t.Errorf("files = %q, want %q", files, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestIfChanged(t *testing.T) {
+	lastModified := map[string]string{
+		"v1": "Mon, 02 Jan 2006 15:04:05 GMT",
+		"v2": "Tue, 03 Jan 2006 09:30:00 GMT",
+	}
+	tests := []struct {
+		name    string
+		set     func(h http.Header, version string)
+		matches func(r *http.Request, version string) bool
+	}{
+		{
+			name: "ETag",
+			set:  func(h http.Header, version string) { h.Set("ETag", `"`+version+`"`) },
+			matches: func(r *http.Request, version string) bool {
+				return r.Header.Get("If-None-Match") == `"`+version+`"`
+			},
+		},
+		{
+			name: "Last-Modified",
+			set:  func(h http.Header, version string) { h.Set("Last-Modified", lastModified[version]) },
+			matches: func(r *http.Request, version string) bool {
+				return r.Header.Get("If-Modified-Since") == lastModified[version]
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			version := "v1"
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests.Add(1)
+				tt.set(w.Header(), version)
+				if tt.matches(r, version) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				io.WriteString(w, "content "+version)
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			run := func(args ...string) string {
+				t.Helper()
+				args = append([]string{"-o", "out", "-progress", "none"}, append(args, srv.URL+"/feed.xml")...)
+				stdout, stderr, code := runCLI(t, dir, "", args...)
+				if code != 0 {
+					t.Fatalf("exit %d: %s", code, stderr)
+				}
+				return stdout + stderr
+			}
+			content := func() string {
+				data, _ := os.ReadFile(filepath.Join(dir, "out", "feed.xml"))
+				return string(data)
+			}
+
+			run()
+			// Without -if-changed the history skip doesn't ask the server
+			run()
+			if n := requests.Load(); n != 1 {
+				t.Fatalf("%d requests, want 1 before -if-changed", n)
+			}
+
+			// Unchanged: 304, skipped, file left alone
+			if out := run("-if-changed"); !strings.Contains(out, "not modified") {
+				t.Errorf("unchanged run output %q, want a not modified skip", out)
+			}
+			if n := requests.Load(); n != 2 || content() != "content v1" {
+				t.Errorf("after 304: %d requests, file %q", n, content())
+			}
+
+			// Changed: 200 replaces the file and stores the new validator
+			mu.Lock()
+			version = "v2"
+			mu.Unlock()
+			run("-if-changed")
+			if content() != "content v2" {
+				t.Errorf("after a change the file is %q, want content v2", content())
+			}
+			if out := run("-if-changed"); !strings.Contains(out, "not modified") {
+				t.Errorf("run after the change output %q, want a not modified skip", out)
+			}
+		})
+	}
+}
+
+func TestBatchSummary(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, filepath.Base(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	for _, jobs := range []string{"1", "3"} {
+		t.Run("-j "+jobs, func(t *testing.T) {
+			dir := t.TempDir()
+			if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", srv.URL+"/a.bin"); code != 0 {
+				t.Fatalf("first run: exit %d: %s", code, stderr)
+			}
+
+			// a.bin is in history, b.bin is new and missing.bin fails
+			args := []string{"-o", "out", "-progress", "none", "-j", jobs, srv.URL + "/a.bin", srv.URL + "/b.bin", srv.URL + "/missing.bin"}
+			_, stderr, code := runCLI(t, dir, "", args...)
+			if code != 1 {
+				t.Errorf("exit %d with a failed download, want 1", code)
+			}
+			for _, want := range []string{"files=3", "downloaded=1", "skipped=1", "failed=1", `size="5 B"`} {
+				if !strings.Contains(stderr, want) {
+					t.Errorf("summary missing %s in:\n%s", want, stderr)
+				}
+			}
+
+			stdout, _, _ := runCLI(t, dir, "", append([]string{"-json"}, args...)...)
+			lines := strings.Split(strings.TrimSpace(stdout), "\n")
+			var last struct{ Summary *BatchSummary }
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || last.Summary == nil {
+				t.Fatalf("last -json line %q is not a summary (err %v)", lines[len(lines)-1], err)
+			}
+			// b.bin is in history by now too
+			if want := (BatchSummary{Total: 3, Skipped: 2, Failed: 1}); *last.Summary != want {
+				t.Errorf("summary = %+v, want %+v", *last.Summary, want)
+			}
+			if len(lines) != 4 {
+				t.Errorf("%d -json lines, want one per URL and the summary", len(lines))
+			}
+		})
+	}
+}
+
+func TestFileModeFlag(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{"0640", 0640, false},
+		{"600", 0600, false},
+		{"0777", 0777, false},
+		{"0999", 0, true},
+		{"1777", 0, true},
+		{"rw-r--r--", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		var m fileMode
+		err := m.Set(tt.in)
+		if (err != nil) != tt.wantErr || os.FileMode(m) != tt.want {
+			t.Errorf("Set(%q) = %#o, %v, want %#o (error %t)", tt.in, uint32(m), err, uint32(tt.want), tt.wantErr)
+		}
+	}
+}
+
+func TestSkipExisting(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	// Copied from another machine: the file ("a.bin" is what the server
+	// sends) without any history
+	os.Mkdir(filepath.Join(dir, "out"), 0755)
+	if err := os.WriteFile(filepath.Join(dir, "out", "a.bin"), []byte("a.bin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-json", "-skip-existing", srv.URL+"/a.bin")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	var result URLResult
+	if err := json.Unmarshal([]byte(strings.Split(stdout, "\n")[0]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != StatusSkipped {
+		t.Errorf("status %q, want skipped", result.Status)
+	}
+
+	// The history was back-filled, so a plain run skips it too
+	_, stderr, _ = runCLI(t, dir, "", "-o", "out", "-progress", "none", srv.URL+"/a.bin")
+	if !strings.Contains(stderr, "same URL already downloaded") {
+		t.Errorf("second run didn't find the URL in history:\n%s", stderr)
+	}
+}
+
+func TestListSpeed(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", srv.URL+"/a.bin"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, ".download_history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h struct {
+		Downloads map[string]struct{ Duration time.Duration } `json:"downloads"`
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Downloads) != 1 {
+		t.Fatalf("%d history records, want 1", len(h.Downloads))
+	}
+	for key, r := range h.Downloads {
+		if r.Duration <= 0 {
+			t.Errorf("history record %s has duration %v, want a positive one", key, r.Duration)
+		}
+	}
+
+	stdout, _, _ := runCLI(t, dir, "", "-list")
+	if !strings.Contains(stdout, "Speed: ") || !strings.Contains(stdout, "B/s (") {
+		t.Errorf("-list output has no speed:\n%s", stdout)
+	}
+}
+
+func TestHistorySavedName(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="report.pdf"`)
+		io.WriteString(w, "pdf")
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-content-disposition", srv.URL+"/export?id=7"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, ".download_history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h struct {
+		DownloadedFiles map[string]string `json:"downloaded_files"`
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.DownloadedFiles["report.pdf"]; !ok || len(h.DownloadedFiles) != 1 {
+		t.Errorf("file names %v, want only report.pdf", h.DownloadedFiles)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			w.Header().Set("Content-Disposition", `attachment; filename="report.pdf"`)
+			io.WriteString(w, "pdf")
+		case "/latest":
+			http.Redirect(w, r, "/releases/app-2.0.iso", http.StatusFound)
+		case "/gone.bin":
+			http.NotFound(w, r)
+		default:
+			io.WriteString(w, strings.Repeat("x", 1000))
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", srv.URL+"/old.bin"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	snapshot := func() map[string]string {
+		files := make(map[string]string)
+		filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				data, _ := os.ReadFile(path)
+				files[path] = string(data)
+			}
+			return nil
+		})
+		return files
+	}
+	before := snapshot()
+
+	stdout, stderr, code := runCLI(t, dir, "", "-o", "out", "-dry-run", "-content-disposition",
+		srv.URL+"/old.bin", srv.URL+"/export?id=7", srv.URL+"/latest", srv.URL+"/gone.bin")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	rows := make(map[string]string) // URL path -> its row
+	for _, line := range lines[1 : len(lines)-1] {
+		for _, p := range []string{"/old.bin", "/export", "/latest", "/gone.bin"} {
+			if strings.Contains(line, srv.URL+p) {
+				rows[p] = line
+			}
+		}
+	}
+	checks := []struct {
+		path string
+		want []string
+	}{
+		{"/old.bin", []string{"skip (in history)", "1000 B"}},
+		{"/export", []string{"download", "3 B", filepath.Join("out", "report.pdf")}},
+		{"/latest", []string{"download", "1000 B", filepath.Join("out", "latest"), "-> " + srv.URL + "/releases/app-2.0.iso"}},
+		{"/gone.bin", []string{"error", "404"}},
+	}
+	for _, c := range checks {
+		for _, want := range c.want {
+			if !strings.Contains(rows[c.path], want) {
+				t.Errorf("row for %s = %q, want it to contain %q", c.path, rows[c.path], want)
+			}
+		}
+	}
+	if total := lines[len(lines)-1]; total != "2 files to download, 1003 B" {
+		t.Errorf("total line %q", total)
+	}
+
+	after := snapshot()
+	if len(after) != len(before) {
+		t.Errorf("dry run created files: %d before, %d after", len(before), len(after))
+	}
+	for path, data := range before {
+		if after[path] != data {
+			t.Errorf("dry run changed %s", path)
+		}
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	runCLI(t, dir, "", "-o", "out", "-progress", "none", "-event-log", "events.jsonl", srv.URL+"/a.bin", srv.URL+"/missing.bin")
+
+	data, err := os.ReadFile(filepath.Join(dir, "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string) // URL path -> its events
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e downloader.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad event line %q: %v", line, err)
+		}
+		path := strings.TrimPrefix(e.URL, srv.URL)
+		got[path] = append(got[path], e.Event)
+	}
+	want := map[string][]string{
+		"/a.bin":       {"started", "progress", "progress", "progress", "completed"},
+		"/missing.bin": {"started", "failed"},
+	}
+	for path, events := range want {
+		if !slices.Equal(got[path], events) {
+			t.Errorf("%s events %q, want %q", path, got[path], events)
+		}
+	}
+}
+
+func TestCollisionFlag(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "out"), 0755)
+	os.WriteFile(filepath.Join(dir, "out", "a.bin"), []byte("someone else's"), 0644)
+
+	stdout, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-json", "-collision", "number", srv.URL+"/a.bin")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	var result URLResult
+	json.Unmarshal([]byte(strings.Split(stdout, "\n")[0]), &result)
+	if filepath.Base(result.Filename) != "a (1).bin" {
+		t.Errorf("saved to %q, want a (1).bin", result.Filename)
+	}
+
+	// History has the name it was saved under
+	stdout, _, _ = runCLI(t, dir, "", "-list")
+	if !strings.Contains(stdout, "a (1).bin") {
+		t.Errorf("-list doesn't show a (1).bin:\n%s", stdout)
+	}
+
+	if _, _, code := runCLI(t, dir, "", "-collision", "rename", srv.URL+"/b.bin"); code == 0 {
+		t.Error("invalid -collision accepted")
+	}
+}
+
+func TestConfirmPrompt(t *testing.T) {
+	var out bytes.Buffer
+	confirm := newConfirmPrompt(strings.NewReader("y\nno\n\n YES \nmaybe\n"), &out, true, false)
+	tests := []struct {
+		path      string
+		size      int64
+		overwrite bool
+		want      bool
+		prompt    string
+	}{
+		{"/out/a.zip", 1536, true, true, "Overwrite a.zip (1.5 KB)? [y/N] "},
+		{"/out/b.iso", 3 << 30, false, false, "Download b.iso (3.0 GB)? [y/N] "},
+		{"/out/c.iso", -1, false, false, "Download c.iso (unknown size)? [y/N] "},
+		{"/out/d.zip", 10, true, true, "Overwrite d.zip (10 B)? [y/N] "},
+		{"/out/e.zip", 10, true, false, "Overwrite e.zip (10 B)? [y/N] "},
+		// Out of answers
+		{"/out/f.zip", 10, true, false, "Overwrite f.zip (10 B)? [y/N] "},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		if got := confirm(tt.path, tt.size, tt.overwrite); got != tt.want {
+			t.Errorf("%s: answer taken as %t, want %t", tt.path, got, tt.want)
+		}
+		if out.String() != tt.prompt {
+			t.Errorf("prompt %q, want %q", out.String(), tt.prompt)
+		}
+	}
+
+	// Without a terminal nothing is asked and the answer is no, unless -yes
+	out.Reset()
+	if newConfirmPrompt(strings.NewReader("y\n"), &out, false, false)("/out/a.zip", 10, true) || out.Len() != 0 {
+		t.Errorf("non-terminal stdin: accepted or prompted %q", out.String())
+	}
+	if !newConfirmPrompt(strings.NewReader(""), &out, false, true)("/out/a.zip", 10, true) || out.Len() != 0 {
+		t.Errorf("-yes: declined or prompted %q", out.String())
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "out"), 0755)
+	existing := filepath.Join(dir, "out", "a.bin")
+	os.WriteFile(existing, []byte("mine"), 0644)
+
+	// A pipe isn't a terminal, so the overwrite is declined
+	args := []string{"-o", "out", "-progress", "none", "-interactive", "-collision", "overwrite", srv.URL + "/a.bin"}
+	if _, stderr, code := runCLI(t, dir, "y\n", args...); code != 0 || !strings.Contains(stderr, "not a terminal") {
+		t.Errorf("exit %d, stderr:\n%s", code, stderr)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "mine" {
+		t.Errorf("declined overwrite replaced the file with %q", data)
+	}
+
+	if _, stderr, code := runCLI(t, dir, "", append([]string{"-yes"}, args...)...); code != 0 {
+		t.Fatalf("-yes: exit %d: %s", code, stderr)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "a.bin" {
+		t.Errorf("with -yes the file is %q, want it overwritten", data)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Half the body, then nothing until the client gives up
+		w.Header().Set("Content-Length", "1000")
+		io.WriteString(w, strings.Repeat("x", 500))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	start := time.Now()
+	_, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-j", "2", "-deadline", "300ms",
+		srv.URL+"/a.iso", srv.URL+"/b.iso", srv.URL+"/c.iso")
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("run took %v with a 300ms deadline", elapsed)
+	}
+	if code != exitDeadline {
+		t.Errorf("exit %d, want %d; stderr:\n%s", code, exitDeadline, stderr)
+	}
+	if !strings.Contains(stderr, "-deadline exceeded") {
+		t.Errorf("stderr doesn't report the deadline:\n%s", stderr)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "out"))
+	for _, e := range entries {
+		t.Errorf("left %s in the output directory", e.Name())
+	}
+}
+
+func TestRedactQuery(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.URL.Query().Get("token"))
+		mu.Unlock()
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	args := []string{"-o", "out", "-progress", "none", "-redact-query", "token, sig"}
+	if _, stderr, code := runCLI(t, dir, "", append(args, srv.URL+"/a.iso?token=s3cret&v=1")...); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	mu.Lock()
+	if len(tokens) != 1 || tokens[0] != "s3cret" {
+		t.Errorf("server got tokens %q, want the full URL's", tokens)
+	}
+	mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(dir, ".download_history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Errorf("history holds the token:\n%s", data)
+	}
+	if !strings.Contains(string(data), "token=REDACTED") {
+		t.Errorf("history has no redacted URL:\n%s", data)
+	}
+
+	// A fresh token for the same file is still a repeat
+	_, stderr, _ := runCLI(t, dir, "", append(args, srv.URL+"/a.iso?v=1&token=0ther")...)
+	if !strings.Contains(stderr, "same URL already downloaded") {
+		t.Errorf("re-run with a new token wasn't skipped:\n%s", stderr)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	args := []string{"-o", "out", "-progress", "none", "-normalize"}
+	if _, stderr, code := runCLI(t, dir, "", append(args, srv.URL+"/a.iso?b=1&c=2")...); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	_, stderr, _ := runCLI(t, dir, "", append(args, srv.URL+"/x/../a.iso?c=2&b=1#top")...)
+	if !strings.Contains(stderr, "same URL already downloaded") {
+		t.Errorf("equivalent URL wasn't skipped:\n%s", stderr)
+	}
+}
+
+func TestExportCSVStdout(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", srv.URL+"/a.bin"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	stdout, stderr, code := runCLI(t, dir, "", "-export-csv", "-")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	rows, err := csv.NewReader(strings.NewReader(stdout)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1][0] != srv.URL+"/a.bin" || rows[1][2] != "5" {
+		t.Errorf("CSV rows %q, want a header and a.bin", rows)
+	}
+}
+
+func TestReadOnlyOutputDir(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs a user that directory permissions apply to")
+	}
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	for _, failFast := range []bool{false, true} {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out")
+		os.Mkdir(out, 0555)
+		t.Cleanup(func() { os.Chmod(out, 0755) })
+		requests.Store(0)
+
+		args := []string{"-o", "out", "-progress", "none", "-retries", "2", srv.URL + "/a.iso", srv.URL + "/b.iso"}
+		if failFast {
+			args = append([]string{"-fail-fast"}, args...)
+		}
+		_, stderr, code := runCLI(t, dir, "", args...)
+		if code != 1 {
+			t.Errorf("-fail-fast %t: exit %d, want 1", failFast, code)
+		}
+		if !strings.Contains(stderr, "cannot write to the output directory") {
+			t.Errorf("-fail-fast %t: no actionable message in:\n%s", failFast, stderr)
+		}
+		// No retries; with -fail-fast the batch stops at the first URL
+		want := int32(2)
+		if failFast {
+			want = 1
+		}
+		if n := requests.Load(); n != want {
+			t.Errorf("-fail-fast %t: %d requests, want %d", failFast, n, want)
+		}
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	// Count the TCP connections opened over a sequential batch: the shared
+	// client should keep one alive and reuse it for every file
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, filepath.Base(r.URL.Path))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	args := []string{"-o", "out", "-progress", "none", "-j", "1"}
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		args = append(args, srv.URL+"/"+name)
+	}
+	if _, stderr, code := runCLI(t, t.TempDir(), "", args...); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections for 4 sequential downloads, want 1", n)
+	}
+}
+
+func TestListURLs(t *testing.T) {
+	short := "https://example.com/a.iso"
+	long := "https://example.com/" + strings.Repeat("x", 100) + ".iso"
+	unicode := "https://example.com/" + strings.Repeat("ж", 100) + ".iso"
+
+	dir := t.TempDir()
+	downloads := map[string]downloader.DownloadRecord{}
+	for i, u := range []string{short, long, unicode} {
+		downloads[u] = downloader.DownloadRecord{URL: u, Filename: fmt.Sprintf("file%d.iso", i), Downloaded: time.Now()}
+	}
+	data, _ := json.Marshal(map[string]any{"downloads": downloads})
+	if err := os.WriteFile(filepath.Join(dir, ".download_history.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, code := runCLI(t, dir, "", "-list")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	if !utf8.ValidString(stdout) {
+		t.Errorf("-list output is not valid UTF-8:\n%q", stdout)
+	}
+	for _, want := range []string{
+		"URL: " + short + "\n",
+		"URL: " + long[:77] + "...\n",
+		"URL: " + string([]rune(unicode)[:77]) + "...\n",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("-list output missing %q:\n%s", want, stdout)
+		}
+	}
+
+	stdout, _, _ = runCLI(t, dir, "", "-list", "-long")
+	for _, u := range []string{short, long, unicode} {
+		if !strings.Contains(stdout, "URL: "+u+"\n") {
+			t.Errorf("-list -long output missing %s:\n%s", u, stdout)
+		}
+	}
+}
+
+func TestExpandPatterns(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	// file-02.bin also comes out of the range and is only downloaded once
+	args := []string{"-o", "out", "-progress", "none", srv.URL + "/file-[01-03].bin", srv.URL + "/file-02.bin", srv.URL + "/{x86,arm64}.tar"}
+	if _, stderr, code := runCLI(t, dir, "", args...); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "out"))
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"arm64.tar", "file-01.bin", "file-02.bin", "file-03.bin", "x86.tar"}
+	if !slices.Equal(names, want) {
+		t.Errorf("downloaded %q, want %q", names, want)
+	}
+}
+
+func TestPerHost(t *testing.T) {
+	var mu sync.Mutex
+	running := make(map[string]int)
+	peak := make(map[string]int)
+	total, peakTotal := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		mu.Lock()
+		running[host]++
+		total++
+		peak[host] = max(peak[host], running[host])
+		peakTotal = max(peakTotal, total)
+		mu.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, filepath.Base(r.URL.Path))
+
+		mu.Lock()
+		running[host]--
+		total--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	// Two host names for the same server
+	other := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	args := []string{"-o", "out", "-progress", "none", "-j", "6", "-per-host", "2"}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		args = append(args, srv.URL+"/"+name+"1.bin", other+"/"+name+"2.bin")
+	}
+	if _, stderr, code := runCLI(t, t.TempDir(), "", args...); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for host, n := range peak {
+		if n > 2 {
+			t.Errorf("%d downloads at once from %s, -per-host is 2", n, host)
+		}
+	}
+	if peakTotal <= 2 {
+		t.Errorf("at most %d downloads at once across two hosts, want more than 2", peakTotal)
+	}
+}
+
+func TestSkipSignal(t *testing.T) {
+	s := newSkipSignal()
+	first, stopFirst := s.watch(context.Background())
+	defer stopFirst()
+
+	s.skip()
+	select {
+	case <-first.Done():
+	case <-time.After(time.Second):
+		t.Error("skip didn't cancel the running download")
+	}
+	// Downloads started after the skip aren't affected by it
+	next, stopNext := s.watch(context.Background())
+	if next.Err() != nil {
+		t.Error("download after a skip starts cancelled")
+	}
+	stopNext()
+	if next.Err() == nil {
+		t.Error("stop didn't release the download's context")
+	}
+
+	// The batch's own context still reaches the download
+	ctx, cancel := context.WithCancel(context.Background())
+	dl, stop := s.watch(ctx)
+	defer stop()
+	cancel()
+	if dl.Err() == nil {
+		t.Error("cancelling the batch didn't cancel the download")
+	}
+}
+
+func TestTrackFailures(t *testing.T) {
+	var missing atomic.Bool
+	missing.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if missing.Load() {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "app")
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	args := []string{"-o", "out", "-progress", "none", "-track-failures", srv.URL + "/app.iso"}
+
+	if _, _, code := runCLI(t, dir, "", args...); code != 1 {
+		t.Fatalf("exit %d for a 404, want 1", code)
+	}
+	stdout, _, _ := runCLI(t, dir, "", "-list", "-failures")
+	for _, want := range []string{"Failed downloads (1):", srv.URL + "/app.iso", "Status: 404 from " + srv.URL + "/app.iso"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("-list -failures missing %q:\n%s", want, stdout)
+		}
+	}
+
+	missing.Store(false)
+	if _, stderr, code := runCLI(t, dir, "", args...); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	stdout, _, _ = runCLI(t, dir, "", "-list", "-failures")
+	if !strings.Contains(stdout, "No failed downloads recorded") {
+		t.Errorf("failure not cleared by a successful download:\n%s", stdout)
+	}
+
+	// Without -track-failures nothing is recorded
+	missing.Store(true)
+	runCLI(t, dir, "", "-o", "out", "-progress", "none", srv.URL+"/other.iso")
+	stdout, _, _ = runCLI(t, dir, "", "-list", "-failures")
+	if !strings.Contains(stdout, "No failed downloads recorded") {
+		t.Errorf("failure recorded without -track-failures:\n%s", stdout)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	download := func(args ...string) string {
+		t.Helper()
+		_, stderr, code := runCLI(t, dir, "", append([]string{"-progress", "none"}, args...)...)
+		if code != 0 {
+			t.Fatalf("%q: exit %d: %s", args, code, stderr)
+		}
+		return stderr
+	}
+
+	download("-profile", "work", srv.URL+"/a.bin")
+	// The same URL in another profile isn't a duplicate
+	if stderr := download("-profile", "personal", srv.URL+"/a.bin"); strings.Contains(stderr, "already downloaded") {
+		t.Errorf("personal profile saw work's history:\n%s", stderr)
+	}
+	if stderr := download("-profile", "work", srv.URL+"/a.bin"); !strings.Contains(stderr, "same URL already downloaded") {
+		t.Errorf("work profile forgot its own download:\n%s", stderr)
+	}
+	download("-profile", "personal", srv.URL+"/b.bin")
+
+	for _, path := range []string{"work/a.bin", "personal/a.bin", "personal/b.bin", ".download_history_work.json", ".download_history_personal.json"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".download_history.json")); err == nil {
+		t.Error("profiles wrote to the default history")
+	}
+
+	stdout, _, _ := runCLI(t, dir, "", "-list", "-profile", "work")
+	if !strings.Contains(stdout, "Downloaded files (1):") || strings.Contains(stdout, "b.bin") {
+		t.Errorf("-list -profile work:\n%s", stdout)
+	}
+	stdout, _, _ = runCLI(t, dir, "", "-list", "-profile", "personal")
+	if !strings.Contains(stdout, "Downloaded files (2):") {
+		t.Errorf("-list -profile personal:\n%s", stdout)
+	}
+
+	// An explicit -o isn't changed
+	download("-profile", "work", "-o", "elsewhere", srv.URL+"/c.bin")
+	if _, err := os.Stat(filepath.Join(dir, "elsewhere", "c.bin")); err != nil {
+		t.Errorf("-o with -profile: %v", err)
+	}
+
+	if _, stderr, code := runCLI(t, dir, "", "-profile", "../work", srv.URL+"/d.bin"); code == 0 || !strings.Contains(stderr, "invalid -profile") {
+		t.Errorf("-profile ../work: exit %d: %s", code, stderr)
+	}
+}
+
+func TestBufferSizeFlag(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	for _, size := range []string{"1", "100G", "lots"} {
+		if _, _, code := runCLI(t, dir, "", "-buffer-size", size, srv.URL+"/a.bin"); code == 0 {
+			t.Errorf("-buffer-size %s accepted", size)
+		}
+	}
+	if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-buffer-size", "1M", srv.URL+"/a.bin"); code != 0 {
+		t.Fatalf("-buffer-size 1M: exit %d: %s", code, stderr)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "out", "a.bin")); string(data) != "a.bin" {
+		t.Errorf("a.bin = %q", data)
+	}
+}
+
+func TestDenyTypeFlag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page.bin":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case "/error.bin":
+			w.Header().Set("Content-Type", "application/json")
+		default:
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		io.WriteString(w, filepath.Base(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	_, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-deny-type", "text/html", "-deny-type", "application/json",
+		srv.URL+"/page.bin", srv.URL+"/error.bin", srv.URL+"/file.bin")
+	if code != 1 {
+		t.Errorf("exit %d, want 1 for the refused downloads", code)
+	}
+	if !strings.Contains(stderr, "refused by -deny-type") {
+		t.Errorf("no refusal logged:\n%s", stderr)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "out"))
+	if len(entries) != 1 || entries[0].Name() != "file.bin" {
+		t.Errorf("out holds %v, want only file.bin", entries)
+	}
+}
+
+func TestCleanupCurrentDownloads(t *testing.T) {
+	dir := t.TempDir()
+	var parts []string
+	for _, name := range []string{"a.iso", "b.iso", "c.iso", "done.iso"} {
+		part := filepath.Join(dir, name+downloader.PartSuffix)
+		if err := os.WriteFile(part, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		trackDownload(part)
+		parts = append(parts, part)
+	}
+	// A finished download is no longer tracked and keeps its file
+	untrackDownload(parts[3])
+
+	cleanupCurrentDownloads()
+	for _, part := range parts[:3] {
+		if _, err := os.Stat(part); !os.IsNotExist(err) {
+			t.Errorf("%s not removed (stat err = %v)", filepath.Base(part), err)
+		}
+	}
+	if _, err := os.Stat(parts[3]); err != nil {
+		t.Errorf("untracked %s removed: %v", filepath.Base(parts[3]), err)
+	}
+	currentDownloadMu.Lock()
+	defer currentDownloadMu.Unlock()
+	if len(currentDownloads) != 0 {
+		t.Errorf("%d downloads still tracked after cleanup", len(currentDownloads))
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, filepath.Base(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	for _, style := range []string{"plain", "fancy"} {
+		dir := t.TempDir()
+		stdout, stderr, code := runCLI(t, dir, "", "-q", "-style", style, "-o", "out", "-progress", "none", srv.URL+"/a.bin", srv.URL+"/missing.bin")
+		if code != 1 {
+			t.Errorf("-style %s: exit %d, want 1 for the failed download", style, code)
+		}
+		out := stdout + stderr
+		if strings.Contains(out, "downloaded") || strings.Contains(out, "msg=done") {
+			t.Errorf("-q -style %s printed more than errors:\n%s", style, out)
+		}
+		if !strings.Contains(out, "download failed") {
+			t.Errorf("-q -style %s hid the error:\n%s", style, out)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "out", "a.bin")); string(data) != "a.bin" {
+			t.Errorf("-q -style %s: a.bin = %q", style, data)
+		}
+	}
+
+	dir := t.TempDir()
+	_, stderr, code := runCLI(t, dir, "", "-v", "-o", "out", "-progress", "none", srv.URL+"/a.bin")
+	if code != 0 {
+		t.Fatalf("-v: exit %d: %s", code, stderr)
+	}
+	for _, want := range []string{"msg=\"chose filename\"", "msg=\"chose output path\"", "msg=response", "msg=downloaded"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("-v output missing %s:\n%s", want, stderr)
+		}
+	}
+}
+
+func TestKeepVersionsFlag(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	for range 3 {
+		if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-f", "-keep-versions", "2", srv.URL+"/a.bin"); code != 0 {
+			t.Fatalf("exit %d: %s", code, stderr)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "out"))
+	if len(entries) != 3 {
+		t.Errorf("out holds %v, want a.bin and 2 versions", entries)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, ".download_history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h struct {
+		Downloads map[string]struct{ Versions []string } `json:"downloads"`
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		t.Fatal(err)
+	}
+	for key, r := range h.Downloads {
+		if len(r.Versions) != 2 {
+			t.Errorf("history record %s has versions %q, want 2", key, r.Versions)
+		}
+	}
+
+	// Without -f the file isn't replaced, so no version is added
+	if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-keep-versions", "2", srv.URL+"/a.bin"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "out")); len(entries) != 3 {
+		t.Errorf("a skipped download changed out to %v", entries)
+	}
+}
+
+func TestRepairHistoryFlag(t *testing.T) {
+	dir := t.TempDir()
+	history := `{"downloads": {"https://example.com/a.bin": {"url": "https://example.com/a.bin", "filename": "out/a.bin"}},
+		"downloaded_files": {"a.bin": "https://example.com/a.bin", "ghost.bin": "https://example.com/deleted.bin"}}`
+	if err := os.WriteFile(filepath.Join(dir, ".download_history.json"), []byte(history), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, code := runCLI(t, dir, "", "-repair-history")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "- ghost.bin (https://example.com/deleted.bin has no record)") || !strings.Contains(stdout, "-repair-history -f") {
+		t.Errorf("dry run output:\n%s", stdout)
+	}
+
+	if stdout, stderr, code = runCLI(t, dir, "", "-repair-history", "-f"); code != 0 {
+		t.Fatalf("-f: exit %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Removed 1 stale and added 0 missing") {
+		t.Errorf("-f output:\n%s", stdout)
+	}
+	if stdout, _, _ = runCLI(t, dir, "", "-repair-history"); !strings.Contains(stdout, "matches the history") {
+		t.Errorf("after -f:\n%s", stdout)
+	}
+}
+
+func TestOnlyLarger(t *testing.T) {
+	var mu sync.Mutex
+	content := "v1"
+	var gets atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		mu.Lock()
+		body := content
+		mu.Unlock()
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	setContent := func(s string) {
+		mu.Lock()
+		content = s
+		mu.Unlock()
+	}
+
+	dir := t.TempDir()
+	args := []string{"-o", "out", "-progress", "none", "-only-larger", "-keep-versions", "1", srv.URL + "/log.txt"}
+	if _, stderr, code := runCLI(t, dir, "", args...); code != 0 {
+		t.Fatalf("first run: exit %d: %s", code, stderr)
+	}
+
+	// Same size: only a HEAD request, and the file is up to date
+	_, stderr, code := runCLI(t, dir, "", args...)
+	if code != 0 || !strings.Contains(stderr, "up to date") {
+		t.Errorf("same size: exit %d:\n%s", code, stderr)
+	}
+	if n := gets.Load(); n != 1 {
+		t.Errorf("%d GET requests after a same-size check, want 1", n)
+	}
+
+	// The server's file grew, so it is downloaded again and the old one kept
+	setContent("v2, longer")
+	if _, stderr, code = runCLI(t, dir, "", args...); code != 0 || !strings.Contains(stderr, "server has a larger file") {
+		t.Fatalf("larger: exit %d:\n%s", code, stderr)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "out", "log.txt")); string(data) != "v2, longer" {
+		t.Errorf("log.txt = %q after the server's file grew", data)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "out")); len(entries) != 2 {
+		t.Errorf("out holds %v, want log.txt and one version", entries)
+	}
+
+	// A smaller file on the server isn't downloaded
+	setContent("v3")
+	if _, stderr, code = runCLI(t, dir, "", args...); code != 0 || !strings.Contains(stderr, "up to date") {
+		t.Errorf("smaller: exit %d:\n%s", code, stderr)
+	}
+	if n := gets.Load(); n != 2 {
+		t.Errorf("%d GET requests in all, want 2", n)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "out", "log.txt")); string(data) != "v2, longer" {
+		t.Errorf("log.txt = %q, want the larger download kept", data)
+	}
+}
+
+func TestTeeFlag(t *testing.T) {
+	srv := fileServer(t)
+	dir := t.TempDir()
+	if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-tee", "./out/", srv.URL+"/a.bin"); code == 0 || !strings.Contains(stderr, "it is the output directory") {
+		t.Errorf("-tee into the output directory: exit %d:\n%s", code, stderr)
+	}
+	if _, stderr, code := runCLI(t, dir, "", "-o", "out", "-progress", "none", "-tee", "nas/copies", srv.URL+"/a.bin"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	for _, path := range []string{"out/a.bin", "nas/copies/a.bin"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, path)); string(data) != "a.bin" {
+			t.Errorf("%s = %q", path, data)
+		}
+	}
+}
+
+func TestHeadBytes(t *testing.T) {
+	body := strings.Repeat("0123456789", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	stdout, stderr, code := runCLI(t, dir, "", "-o", "out", "-head-bytes", "16", srv.URL+"/a.bin", srv.URL+"/b.bin>probe.bin")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "honored (206 of 1000 B)") {
+		t.Errorf("output doesn't report the 206:\n%s", stdout)
+	}
+	for _, name := range []string{"a.bin.partial", "probe.bin.partial"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, "out", name)); string(data) != body[:16] {
+			t.Errorf("%s = %q, want the first 16 bytes", name, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".download_history.json")); err == nil {
+		t.Error("-head-bytes wrote history")
+	}
+}
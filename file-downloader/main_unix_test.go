@@ -0,0 +1,134 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterruptSkipsCurrent(t *testing.T) {
+	stalled := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall.bin" {
+			w.Header().Set("Content-Length", "1000")
+			io.WriteString(w, "first bytes")
+			w.(http.Flusher).Flush()
+			stalled <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, filepath.Base(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cmd := cliCommand(t, dir, "-o", "out", "-progress", "none", "-retries", "0", srv.URL+"/stall.bin", srv.URL+"/next.bin")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("first download never started")
+	}
+	// The first Ctrl+C skips stall.bin; the batch goes on with next.bin
+	cmd.Process.Signal(os.Interrupt)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("exit: %v: %s", err, stderr.String())
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("still running after the first interrupt: %s", stderr.String())
+	}
+
+	if !strings.Contains(stderr.String(), "press Ctrl+C again") {
+		t.Errorf("no hint after the first interrupt:\n%s", stderr.String())
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "out", "next.bin")); err != nil || string(data) != "next.bin" {
+		t.Errorf("next.bin = %q, %v after skipping stall.bin", data, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "out"))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "stall.bin") {
+			t.Errorf("%s left behind by the skipped download", e.Name())
+		}
+	}
+}
+
+func TestTerminateCleansUp(t *testing.T) {
+	stalled := make(chan string, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		io.WriteString(w, "first bytes")
+		w.(http.Flusher).Flush()
+		stalled <- r.URL.Path
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cmd := cliCommand(t, dir, "-o", "out", "-progress", "none", "-j", "3", srv.URL+"/a.bin", srv.URL+"/b.bin", srv.URL+"/c.bin")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	for range 3 {
+		select {
+		case <-stalled:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			t.Fatalf("downloads never all started: %s", stderr.String())
+		}
+	}
+	// Wait for the first bytes to reach each .part file
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		parts, _ := filepath.Glob(filepath.Join(dir, "out", "*.part"))
+		if len(parts) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatalf("found .part files %q, want 3", parts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// SIGTERM, like a second Ctrl+C, stops the batch and removes every
+	// running download's .part file
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("exit 0 after SIGTERM, want 1")
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("still running after SIGTERM: %s", stderr.String())
+	}
+
+	if parts, _ := filepath.Glob(filepath.Join(dir, "out", "*.part")); len(parts) != 0 {
+		t.Errorf("left behind %q:\n%s", parts, stderr.String())
+	}
+}
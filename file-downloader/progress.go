@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"umbrel-downloader/downloader"
+)
+
+// Progress display modes for -progress.
+const (
+	ProgressNone   = "none"   // no progress output
+	ProgressSingle = "single" // one bar, redrawn in place on the current line
+	ProgressMulti  = "multi"  // one line per running download (for -j)
+)
+
+// progressInterval limits how often the progress display is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+// Bar styles for -bar-style.
+const (
+	BarASCII   = "ascii"   // [=====>    ]
+	BarUnicode = "unicode" // [█████░░░░░]
+)
+
+// barStyle is how progress bars are drawn.
+type barStyle struct {
+	Width int    // characters between the brackets; 0 means 50, or 20 in multi mode
+	Fill  string // completed part
+	Head  string // drawn after the completed part, if any
+	Empty string // remaining part
+	Color bool   // draw the completed part in green
+
+	Spinner []string // frames shown instead of a bar when the size is unknown
+}
+
+// newBarStyle returns the named style. A non-empty fill replaces its fill
+// character.
+func newBarStyle(name, fill string, width int, color bool) (barStyle, error) {
+	var s barStyle
+	switch name {
+	case BarASCII:
+		s = barStyle{Fill: "=", Head: ">", Empty: " ", Spinner: []string{"|", "/", "-", "\\"}}
+	case BarUnicode:
+		s = barStyle{Fill: "█", Empty: "░", Spinner: []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}}
+	default:
+		return s, fmt.Errorf("invalid bar style %q (use ascii or unicode)", name)
+	}
+	if fill != "" {
+		if utf8.RuneCountInString(fill) != 1 {
+			return s, fmt.Errorf("bar character must be a single character, got %q", fill)
+		}
+		s.Fill = fill
+	}
+	if width < 0 {
+		return s, fmt.Errorf("invalid bar width %d", width)
+	}
+	s.Width, s.Color = width, color
+	return s, nil
+}
+
+// bar draws a bar width characters wide (plus brackets) filled to pct
+// percent.
+func (s barStyle) bar(width int, pct float64) string {
+	filled := max(0, min(width, int(pct*float64(width)/100)))
+	done := strings.Repeat(s.Fill, filled)
+	rest := width - filled
+	if s.Head != "" && rest > 0 {
+		done += s.Head
+		rest--
+	}
+	if s.Color && done != "" {
+		done = "\x1b[32m" + done + "\x1b[0m"
+	}
+	return "[" + done + strings.Repeat(s.Empty, rest) + "]"
+}
+
+// spinner returns the spinner frame for t. It advances once per
+// progressInterval, so every line of a multi display turns together.
+func (s barStyle) spinner(t time.Time) string {
+	return s.Spinner[t.UnixMilli()/progressInterval.Milliseconds()%int64(len(s.Spinner))]
+}
+
+// progressRenderer draws the CLI's progress bars on a terminal. In multi
+// mode it keeps a block of lines at the bottom, one per running download,
+// and redraws it with ANSI cursor movement. It is also the log writer in that
+// mode, so log lines are printed above the block instead of through it.
+type progressRenderer struct {
+	out   io.Writer
+	mode  string
+	style barStyle
+
+	mu       sync.Mutex
+	bars     []*ProgressWriter // running downloads, oldest first
+	drawn    int               // lines of the block currently on screen
+	lastDraw time.Time
+}
+
+func newProgressRenderer(out io.Writer, mode string, style barStyle) *progressRenderer {
+	return &progressRenderer{out: out, mode: mode, style: style}
+}
+
+// width returns the bar width for the renderer's mode.
+func (r *progressRenderer) width() int {
+	switch {
+	case r.style.Width > 0:
+		return r.style.Width
+	case r.mode == ProgressMulti:
+		return 20
+	}
+	return 50
+}
+
+// start adds a bar for a download and returns the writer that advances it.
+func (r *progressRenderer) start(filename string, offset, total int64) *ProgressWriter {
+	pw := &ProgressWriter{Total: total, Downloaded: offset, Filename: filename, r: r}
+	if r.mode == ProgressNone {
+		return pw
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bars = append(r.bars, pw)
+	r.drawLocked(pw, true)
+	return pw
+}
+
+// finish removes pw's bar. In single mode its final state is left on the
+// line above the next output.
+func (r *progressRenderer) finish(pw *ProgressWriter) {
+	if pw == nil || r.mode == ProgressNone {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, b := range r.bars {
+		if b == pw {
+			r.bars = append(r.bars[:i], r.bars[i+1:]...)
+			break
+		}
+	}
+	if r.mode == ProgressMulti {
+		io.WriteString(r.out, r.clear()+r.frame())
+		return
+	}
+	io.WriteString(r.out, "\r"+pw.line()+"\n")
+}
+
+// Write prints log output. In multi mode the block of bars is cleared first
+// and redrawn below it.
+func (r *progressRenderer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mode != ProgressMulti || r.drawn == 0 {
+		return r.out.Write(p)
+	}
+	io.WriteString(r.out, r.clear())
+	n, err := r.out.Write(p)
+	io.WriteString(r.out, r.frame())
+	return n, err
+}
+
+// drawLocked redraws after pw changed, at most every progressInterval
+// unless force is set.
+func (r *progressRenderer) drawLocked(pw *ProgressWriter, force bool) {
+	if !force && time.Since(r.lastDraw) < progressInterval {
+		return
+	}
+	r.lastDraw = time.Now()
+	if r.mode == ProgressMulti {
+		io.WriteString(r.out, r.clear()+r.frame())
+	} else {
+		io.WriteString(r.out, "\r"+pw.line())
+	}
+}
+
+// clear returns the escape sequence that moves the cursor back to the top
+// of the block and erases it.
+func (r *progressRenderer) clear() string {
+	if r.drawn == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("\x1b[%dA\x1b[J", r.drawn)
+	r.drawn = 0
+	return s
+}
+
+// frame returns the block: one line per bar, each ending in a newline so
+// the cursor rests below it.
+func (r *progressRenderer) frame() string {
+	var b strings.Builder
+	for _, pw := range r.bars {
+		b.WriteString(pw.line())
+		b.WriteString("\x1b[K\n")
+	}
+	r.drawn = len(r.bars)
+	return b.String()
+}
+
+// ProgressWriter counts the bytes of one download for its progress bar.
+type ProgressWriter struct {
+	Total      int64
+	Downloaded int64
+	Filename   string
+
+	r *progressRenderer
+}
+
+func (pw *ProgressWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if pw.r.mode == ProgressNone {
+		return n, nil
+	}
+	pw.r.mu.Lock()
+	pw.Downloaded += int64(n)
+	pw.r.drawLocked(pw, false)
+	pw.r.mu.Unlock()
+	return n, nil
+}
+
+// line renders the bar. In multi mode long file names are shortened so
+// the line fits a terminal row.
+func (pw *ProgressWriter) line() string {
+	name := pw.Filename
+	if pw.r.mode == ProgressMulti {
+		name = downloader.Truncate(name, 30)
+	}
+	if pw.Total <= 0 {
+		// A chunked response has no length to show a percentage of
+		return fmt.Sprintf("%s %s downloaded  %s", pw.r.style.spinner(time.Now()), downloader.FormatBytes(pw.Downloaded), name)
+	}
+	pct := float64(pw.Downloaded) / float64(pw.Total) * 100
+	return fmt.Sprintf("%s %6.2f%% %s / %s  %s",
+		pw.r.style.bar(pw.r.width(), pct),
+		pct,
+		downloader.FormatBytes(pw.Downloaded),
+		downloader.FormatBytes(pw.Total),
+		name)
+}
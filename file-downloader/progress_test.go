@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRenderer returns a renderer drawing ASCII bars into a buffer.
+func testRenderer(t *testing.T, mode string) (*progressRenderer, *bytes.Buffer) {
+	t.Helper()
+	style, err := newBarStyle(BarASCII, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	return newProgressRenderer(&out, mode, style), &out
+}
+
+func TestSpinner(t *testing.T) {
+	r, _ := testRenderer(t, ProgressSingle)
+	frames := r.style.Spinner
+	start := time.UnixMilli(0)
+	for i := range 2 * len(frames) {
+		at := start.Add(time.Duration(i) * progressInterval)
+		if got, want := r.style.spinner(at), frames[i%len(frames)]; got != want {
+			t.Errorf("frame %d = %q, want %q", i, got, want)
+		}
+	}
+
+	// A response without Content-Length shows a spinner and the bytes so far
+	pw := r.start("stream.bin", 0, -1)
+	pw.Write(make([]byte, 2048))
+	line := pw.line()
+	if !slices.ContainsFunc(frames, func(f string) bool { return strings.HasPrefix(line, f+" ") }) || !strings.HasSuffix(line, " 2.0 KB downloaded  stream.bin") {
+		t.Errorf("line = %q, want a spinner frame and the downloaded size", line)
+	}
+	if strings.Contains(line, "%") {
+		t.Errorf("line %q shows a percentage of an unknown size", line)
+	}
+}
+
+func TestMultiProgressBlock(t *testing.T) {
+	r, out := testRenderer(t, ProgressMulti)
+
+	a := r.start("a.iso", 0, 100)
+	b := r.start("b.iso", 0, 200)
+	c := r.start("c.iso", 0, 0)
+	if r.drawn != 3 {
+		t.Fatalf("%d lines drawn for 3 downloads", r.drawn)
+	}
+	// Each redraw moves up over the whole previous block first
+	if !strings.Contains(out.String(), "\x1b[1A\x1b[J") || !strings.Contains(out.String(), "\x1b[2A\x1b[J") {
+		t.Errorf("blocks not cleared before growing: %q", out.String())
+	}
+
+	out.Reset()
+	r.lastDraw = r.lastDraw.Add(-progressInterval)
+	b.Write(make([]byte, 100))
+	lines := strings.Split(strings.TrimPrefix(out.String(), "\x1b[3A\x1b[J"), "\x1b[K\n")
+	if len(lines) != 4 || lines[3] != "" {
+		t.Fatalf("redraw %q, want a cleared block of 3 lines", out.String())
+	}
+	for i, want := range []string{" 0.00% 0 B / 100 B  a.iso", "50.00% 100 B / 200 B  b.iso", "0 B downloaded  c.iso"} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("line %d = %q, want it to end with %q", i, lines[i], want)
+		}
+	}
+
+	// Log output goes above the block, which is redrawn below it
+	out.Reset()
+	r.Write([]byte("level=INFO msg=hello\n"))
+	if !strings.HasPrefix(out.String(), "\x1b[3A\x1b[Jlevel=INFO msg=hello\n") || strings.Count(out.String(), "\x1b[K\n") != 3 {
+		t.Errorf("log line written as %q", out.String())
+	}
+
+	// A finished download leaves the block
+	out.Reset()
+	r.finish(a)
+	if r.drawn != 2 || len(r.bars) != 2 || strings.Contains(out.String(), "a.iso") {
+		t.Errorf("after finishing a.iso: %d lines drawn, %d bars, output %q", r.drawn, len(r.bars), out.String())
+	}
+	r.finish(b)
+	r.finish(c)
+	if r.drawn != 0 || len(r.bars) != 0 {
+		t.Errorf("after finishing all: %d lines drawn, %d bars", r.drawn, len(r.bars))
+	}
+
+	// With nothing drawn, logs pass straight through
+	out.Reset()
+	r.Write([]byte("done\n"))
+	if out.String() != "done\n" {
+		t.Errorf("log line written as %q", out.String())
+	}
+}
+
+func TestSingleProgressLine(t *testing.T) {
+	r, out := testRenderer(t, ProgressSingle)
+	pw := r.start("a.iso", 50, 100)
+	if got := out.String(); got != "\r[=====>    ]  50.00% 50 B / 100 B  a.iso" {
+		t.Errorf("start drew %q", got)
+	}
+
+	// Redraws are throttled to progressInterval
+	out.Reset()
+	pw.Write(make([]byte, 10))
+	if out.Len() != 0 {
+		t.Errorf("redrawn straight after the last draw: %q", out.String())
+	}
+	r.finish(pw)
+	if got := out.String(); got != "\r[======>   ]  60.00% 60 B / 100 B  a.iso\n" {
+		t.Errorf("finish drew %q", got)
+	}
+}
+
+func TestNoProgress(t *testing.T) {
+	r, out := testRenderer(t, ProgressNone)
+	pw := r.start("a.iso", 0, 100)
+	pw.Write(make([]byte, 100))
+	r.finish(pw)
+	if out.Len() != 0 || len(r.bars) != 0 {
+		t.Errorf("-progress none drew %q", out.String())
+	}
+}
+
+func TestBar(t *testing.T) {
+	ascii, _ := newBarStyle(BarASCII, "", 0, false)
+	unicode, _ := newBarStyle(BarUnicode, "", 0, false)
+	hash, _ := newBarStyle(BarASCII, "#", 0, false)
+	tests := []struct {
+		style barStyle
+		width int
+		pct   float64
+		want  string
+	}{
+		{ascii, 10, 0, "[>         ]"},
+		{ascii, 10, 50, "[=====>    ]"},
+		{ascii, 10, 99, "[=========>]"},
+		{ascii, 10, 100, "[==========]"},
+		{ascii, 10, 250, "[==========]"},
+		{ascii, 10, -5, "[>         ]"},
+		{ascii, 4, 50, "[==> ]"},
+		{ascii, 50, 50, "[" + strings.Repeat("=", 25) + ">" + strings.Repeat(" ", 24) + "]"},
+		{ascii, 1, 50, "[>]"},
+		{ascii, 0, 50, "[]"},
+		{unicode, 10, 0, "[░░░░░░░░░░]"},
+		{unicode, 10, 35, "[███░░░░░░░]"},
+		{unicode, 10, 100, "[██████████]"},
+		{unicode, 20, 50, "[" + strings.Repeat("█", 10) + strings.Repeat("░", 10) + "]"},
+		{hash, 10, 30, "[###>      ]"},
+	}
+	for _, tt := range tests {
+		if got := tt.style.bar(tt.width, tt.pct); got != tt.want {
+			t.Errorf("%q bar(%d, %v) = %q, want %q", tt.style.Fill, tt.width, tt.pct, got, tt.want)
+		}
+	}
+
+	color, _ := newBarStyle(BarASCII, "", 0, true)
+	if got, want := color.bar(10, 50), "[\x1b[32m=====>\x1b[0m    ]"; got != want {
+		t.Errorf("colored bar = %q, want %q", got, want)
+	}
+	colorUnicode, _ := newBarStyle(BarUnicode, "", 0, true)
+	if got, want := colorUnicode.bar(4, 0), "[░░░░]"; got != want {
+		t.Errorf("colored empty bar = %q, want %q", got, want)
+	}
+}
+
+func TestNewBarStyle(t *testing.T) {
+	for _, tt := range []struct {
+		name, fill string
+		width      int
+	}{
+		{"blocks", "", 0},
+		{BarASCII, "==", 0},
+		{BarASCII, "", -1},
+	} {
+		if _, err := newBarStyle(tt.name, tt.fill, tt.width, false); err == nil {
+			t.Errorf("newBarStyle(%q, %q, %d): no error", tt.name, tt.fill, tt.width)
+		}
+	}
+	if s, err := newBarStyle(BarUnicode, "▓", 30, false); err != nil || s.Fill != "▓" || s.Width != 30 {
+		t.Errorf("newBarStyle(unicode, ▓, 30) = %+v, %v", s, err)
+	}
+
+	// The width defaults by mode
+	for mode, want := range map[string]int{ProgressSingle: 50, ProgressMulti: 20} {
+		if w := newProgressRenderer(nil, mode, barStyle{}).width(); w != want {
+			t.Errorf("%s default width = %d, want %d", mode, w, want)
+		}
+	}
+	if w := newProgressRenderer(nil, ProgressMulti, barStyle{Width: 30}).width(); w != 30 {
+		t.Errorf("-bar-width 30 gives width %d", w)
+	}
+}